@@ -2,35 +2,129 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
+/*
+ArtistId is the primary artist, Credits lists the other artists on the album, see credits.go.
+ReleaseType is one of the RELEASE_ types and LabelId the label that released it, see releases.go.
+ImageId is the cover art, see images.go.
+*/
 type Album struct {
-	Id       string `json:"id"`
-	Name     string `json:"name"`
-	Price    string `json:"price"`
-	ArtistId string `json:"albumId"`
+	Id          string      `json:"id"`
+	Name        string      `json:"name"`
+	Price       Price       `json:"price"`
+	ArtistId    string      `json:"albumId"`
+	Credits     []Credit    `json:"credits,omitempty"`
+	ReleaseDate PartialDate `json:"releaseDate"`
+	ReleaseType string      `json:"releaseType"`
+	LabelId     string      `json:"labelId"`
+	ImageId     string      `json:"imageId"`
+	Version     int64       `json:"version"`
 }
 
 func (album *Album) clone() *Album {
 	return &Album{
-		Id:       album.Id,
-		Name:     album.Name,
-		Price:    album.Price,
-		ArtistId: album.ArtistId,
+		Id:          album.Id,
+		Name:        album.Name,
+		Price:       album.Price,
+		ArtistId:    album.ArtistId,
+		Credits:     copyCredits(album.Credits),
+		ReleaseDate: album.ReleaseDate,
+		ReleaseType: album.ReleaseType,
+		LabelId:     album.LabelId,
+		ImageId:     album.ImageId,
+		Version:     album.Version,
 	}
 }
 
+/*
+Checks the fields of an album that is added or updated.
+*/
+func (album *Album) validate() error {
+	err := album.Price.validate()
+	if err != nil {
+		return err
+	}
+
+	err = album.ReleaseDate.validate("releaseDate")
+	if err != nil {
+		return err
+	}
+
+	if album.ReleaseType != "" && !validReleaseType(album.ReleaseType) {
+		return &ValidationError{"releaseType", fmt.Sprintf("'%s' is not a release type", album.ReleaseType)}
+	}
+
+	err = validateMediaId("imageId", album.ImageId)
+	if err != nil {
+		return err
+	}
+
+	return validateCredits(album.Credits)
+}
+
+/*
+An album with the totals of its songs, as returned by /getAlbum.
+*/
+type AlbumDetails struct {
+	Album
+	Runtime    Duration `json:"runtime"`
+	TrackCount int      `json:"trackCount"`
+}
+
+/*
+An album in the trash.
+*/
+type TrashedAlbum struct {
+	Album
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+/*
+AlbumStore is the storage backend behind the album end points.
+Albums is the in memory implementation.
+*/
+type AlbumStore interface {
+	Add(album *Album) error
+	// Moves the album to the trash.
+	Delete(id string, deletedAt time.Time) error
+	// Moves the album out of the trash.
+	Restore(id string) error
+	// Removes the album for good, bypassing the trash.
+	Remove(id string) error
+	// Removes the album from the trash for good.
+	Purge(id string) error
+	GetTrash() ([]*TrashedAlbum, error)
+	Update(album *Album) error
+	Revert(album *Album) error
+	Get(id string) (*Album, error)
+	GetAll() ([]string, error)
+	GetArtistAlbums(artistId string) ([]string, error)
+	// Lists the albums released from one date to another, newest first.
+	GetReleases(from, to PartialDate) ([]string, error)
+	GetLabelAlbums(labelId string) ([]string, error)
+}
+
+var _ AlbumStore = (*Albums)(nil)
+
 type Albums struct {
 	sync.RWMutex
 	albums       map[string]*Album
 	artistAlbums map[string][]string
+	trash        map[string]*TrashedAlbum
+	log          *Log
 }
 
 func NewAlbums() *Albums {
 	albums := &Albums{
 		albums:       make(map[string]*Album),
 		artistAlbums: make(map[string][]string),
+		trash:        make(map[string]*TrashedAlbum),
+		log:          NewLogger("albums", GetConfig().GetLogLevel()),
 	}
 
 	return albums
@@ -44,6 +138,9 @@ func (state *Albums) Add(album *Album) error {
 	if _, ok := state.albums[album.Id]; ok {
 		return errors.New("Artist by 'id' already exists")
 	}
+	if _, ok := state.trash[album.Id]; ok {
+		return errors.New("Album by 'id' is in the trash")
+	}
 
 	// Add this album to the artist.
 	err := state.addArtistAlbum(album.ArtistId, album.Id)
@@ -52,7 +149,9 @@ func (state *Albums) Add(album *Album) error {
 	}
 
 	// Copy the struct.
-	state.albums[album.Id] = album.clone()
+	stored := album.clone()
+	stored.Version = 1
+	state.albums[album.Id] = stored
 
 	return nil
 }
@@ -80,7 +179,7 @@ func (state *Albums) addArtistAlbum(artistId, albumId string) error {
 	return nil
 }
 
-func (state *Albums) Delete(id string) error {
+func (state *Albums) Delete(id string, deletedAt time.Time) error {
 	state.Lock()
 	defer state.Unlock()
 
@@ -90,16 +189,93 @@ func (state *Albums) Delete(id string) error {
 	}
 
 	// Get the artist of this album, and make sure it's removed from the list.
-	err := state.deleteArtistAlbum(album.ArtistId, id)
+	state.unindexAlbum(album)
+
+	delete(state.albums, id)
+	state.trash[id] = &TrashedAlbum{*album, deletedAt}
+
+	return nil
+}
+
+func (state *Albums) Restore(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	trashed, ok := state.trash[id]
+	if !ok {
+		return errors.New("Album is not in the trash")
+	}
+
+	err := state.addArtistAlbum(trashed.ArtistId, id)
 	if err != nil {
 		return err
 	}
 
+	delete(state.trash, id)
+	state.albums[id] = trashed.Album.clone()
+
+	return nil
+}
+
+func (state *Albums) Remove(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	album, ok := state.albums[id]
+	if !ok {
+		return errors.New("Album does not exist")
+	}
+
+	state.unindexAlbum(album)
+
 	delete(state.albums, id)
 
 	return nil
 }
 
+/*
+Removes the album from its artist, see Songs.unindexSong.
+*/
+func (state *Albums) unindexAlbum(album *Album) {
+	err := state.deleteArtistAlbum(album.ArtistId, album.Id)
+	if err != nil {
+		state.log.Warn("Album %s was not indexed under artist %s: %s", album.Id, album.ArtistId, err)
+	}
+}
+
+func (state *Albums) Purge(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.trash[id]; !ok {
+		return errors.New("Album is not in the trash")
+	}
+
+	delete(state.trash, id)
+
+	return nil
+}
+
+/*
+Lists the trash, oldest deletion first.
+*/
+func (state *Albums) GetTrash() ([]*TrashedAlbum, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	trash := make([]*TrashedAlbum, 0, len(state.trash))
+	for _, trashed := range state.trash {
+		trashCopy := *trashed
+		trash = append(trash, &trashCopy)
+	}
+
+	sort.Slice(trash, func(i, j int) bool {
+		return trash[i].DeletedAt.Before(trash[j].DeletedAt)
+	})
+
+	return trash, nil
+}
+
 func (state *Albums) deleteArtistAlbum(artistId, albumId string) error {
 	albums, ok := state.artistAlbums[artistId]
 	if !ok {
@@ -155,6 +331,84 @@ func (state *Albums) GetAll() ([]string, error) {
 	return albumIds, nil
 }
 
+/*
+Copies the albums and the artist index into the snapshot.
+*/
+func (state *Albums) snapshot(snap *catalogSnapshot) {
+	state.RLock()
+	defer state.RUnlock()
+
+	snap.Albums = make(map[string]*Album, len(state.albums))
+	for id, album := range state.albums {
+		snap.Albums[id] = album.clone()
+	}
+
+	snap.ArtistAlbums = copyIndex(state.artistAlbums)
+
+	snap.AlbumTrash = make(map[string]*TrashedAlbum, len(state.trash))
+	for id, trashed := range state.trash {
+		trashCopy := *trashed
+		snap.AlbumTrash[id] = &trashCopy
+	}
+}
+
+/*
+Replaces the albums and the artist index with the contents of the snapshot.
+*/
+func (state *Albums) restore(snap *catalogSnapshot) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.albums = make(map[string]*Album, len(snap.Albums))
+	for id, album := range snap.Albums {
+		state.albums[id] = album.clone()
+	}
+
+	state.artistAlbums = copyIndex(snap.ArtistAlbums)
+
+	state.trash = make(map[string]*TrashedAlbum, len(snap.AlbumTrash))
+	for id, trashed := range snap.AlbumTrash {
+		trashCopy := *trashed
+		state.trash[id] = &trashCopy
+	}
+}
+
+func (state *Albums) checkIndexes() []CatalogIssue {
+	state.RLock()
+	defer state.RUnlock()
+
+	ids := make([]string, 0, len(state.albums))
+	for id := range state.albums {
+		ids = append(ids, id)
+	}
+
+	return checkIndex("artistAlbums", "album", state.artistAlbums, ids, func(id string) ([]string, bool) {
+		album, ok := state.albums[id]
+		if !ok {
+			return nil, false
+		}
+		return []string{album.ArtistId}, true
+	})
+}
+
+/*
+Rebuilds the artist index from the albums.
+*/
+func (state *Albums) rebuildIndexes() error {
+	state.Lock()
+	defer state.Unlock()
+
+	state.artistAlbums = make(map[string][]string)
+	for _, album := range state.albums {
+		err := state.addArtistAlbum(album.ArtistId, album.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (state *Albums) GetArtistAlbums(artistId string) ([]string, error) {
 	state.Lock()
 	defer state.Unlock()
@@ -164,7 +418,53 @@ func (state *Albums) GetArtistAlbums(artistId string) ([]string, error) {
 		return nil, errors.New("Artist under id does not contain any albums")
 	}
 
-	return albums, nil
+	// Copy, the index is changed in place.
+	return append([]string(nil), albums...), nil
+}
+
+func (state *Albums) GetReleases(from, to PartialDate) ([]string, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	albums := make([]*Album, 0)
+	for _, album := range state.albums {
+		if releasedBetween(album.ReleaseDate, from, to) {
+			albums = append(albums, album)
+		}
+	}
+
+	sortReleases(albums)
+
+	albumIds := make([]string, len(albums))
+	for i, album := range albums {
+		albumIds[i] = album.Id
+	}
+
+	return albumIds, nil
+}
+
+/*
+Albums are not indexed by their label, so all of them are looked at.
+*/
+func (state *Albums) GetLabelAlbums(labelId string) ([]string, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	albums := make([]*Album, 0)
+	for _, album := range state.albums {
+		if album.LabelId == labelId {
+			albums = append(albums, album)
+		}
+	}
+
+	sortReleases(albums)
+
+	albumIds := make([]string, len(albums))
+	for i, album := range albums {
+		albumIds[i] = album.Id
+	}
+
+	return albumIds, nil
 }
 
 func (state *Albums) Update(album *Album) error {
@@ -178,9 +478,47 @@ func (state *Albums) Update(album *Album) error {
 		return errors.New("Unable to update album, given album Id does not exist")
 	}
 
+	err := checkVersion("album", album.Id, album.Version, oldAlbum.Version)
+	if err != nil {
+		return err
+	}
+
 	// Only need to update if the artists are different.
 	if album.ArtistId != oldAlbum.ArtistId {
-		err := state.deleteArtistAlbum(oldAlbum.ArtistId, oldAlbum.Id)
+		err = state.deleteArtistAlbum(oldAlbum.ArtistId, oldAlbum.Id)
+		if err != nil {
+			return err
+		}
+
+		err = state.addArtistAlbum(album.ArtistId, album.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	stored := album.clone()
+	stored.Version = oldAlbum.Version + 1
+	state.albums[album.Id] = stored
+
+	return nil
+}
+
+/*
+Stores the album exactly as given, version included, replacing any current copy.
+Used to undo changes.
+*/
+func (state *Albums) Revert(album *Album) error {
+	state.Lock()
+	defer state.Unlock()
+
+	oldAlbum, ok := state.albums[album.Id]
+	if !ok {
+		err := state.addArtistAlbum(album.ArtistId, album.Id)
+		if err != nil {
+			return err
+		}
+	} else if oldAlbum.ArtistId != album.ArtistId {
+		err := state.deleteArtistAlbum(oldAlbum.ArtistId, album.Id)
 		if err != nil {
 			return err
 		}
@@ -2,13 +2,22 @@ package main
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 )
 
+/*
+EndDate is when the artist died, or the band disbanded.
+ImageId is the artist's photo, see images.go.
+*/
 type Artist struct {
-	Id        string `json:"id"`
-	Name      string `json:"name"`
-	Birthdate string `json:"birthdate"`
+	Id        string      `json:"id"`
+	Name      string      `json:"name"`
+	Birthdate PartialDate `json:"birthdate"`
+	EndDate   PartialDate `json:"endDate"`
+	ImageId   string      `json:"imageId"`
+	Version   int64       `json:"version"`
 }
 
 func (artist *Artist) clone() *Artist {
@@ -16,17 +25,93 @@ func (artist *Artist) clone() *Artist {
 		Id:        artist.Id,
 		Name:      artist.Name,
 		Birthdate: artist.Birthdate,
+		EndDate:   artist.EndDate,
+		ImageId:   artist.ImageId,
+		Version:   artist.Version,
 	}
 }
 
+/*
+Checks the fields of an artist that is added or updated.
+*/
+func (artist *Artist) validate() error {
+	err := artist.Birthdate.validate("birthdate")
+	if err != nil {
+		return err
+	}
+
+	err = artist.EndDate.validate("endDate")
+	if err != nil {
+		return err
+	}
+
+	if !artist.EndDate.IsZero() && !artist.Birthdate.IsZero() && artist.EndDate.Before(artist.Birthdate) {
+		return &ValidationError{"endDate", "must not be before the birthdate"}
+	}
+
+	return validateMediaId("imageId", artist.ImageId)
+}
+
+/*
+An artist with the totals of their songs, as returned by /getArtist.
+*/
+type ArtistDetails struct {
+	Artist
+	Runtime    Duration `json:"runtime"`
+	TrackCount int      `json:"trackCount"`
+}
+
+/*
+Body of /getArtistsByBirthYear, the years include both ends.
+*/
+type BirthYearRequest struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+/*
+An artist in the trash.
+*/
+type TrashedArtist struct {
+	Artist
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+/*
+ArtistStore is the storage backend behind the artist end points.
+Artists is the in memory implementation.
+*/
+type ArtistStore interface {
+	Add(artist *Artist) error
+	// Moves the artist to the trash.
+	Delete(id string, deletedAt time.Time) error
+	// Moves the artist out of the trash.
+	Restore(id string) error
+	// Removes the artist for good, bypassing the trash.
+	Remove(id string) error
+	// Removes the artist from the trash for good.
+	Purge(id string) error
+	GetTrash() ([]*TrashedArtist, error)
+	Update(artist *Artist) error
+	Revert(artist *Artist) error
+	Get(id string) (*Artist, error)
+	GetAll() ([]string, error)
+	// Lists the artists born in the years from and to, including both, ordered by birthdate.
+	GetByBirthYear(from, to int) ([]string, error)
+}
+
+var _ ArtistStore = (*Artists)(nil)
+
 type Artists struct {
 	sync.RWMutex
 	artists map[string]*Artist
+	trash   map[string]*TrashedArtist
 }
 
 func NewArtists() *Artists {
 	artists := &Artists{
 		artists: make(map[string]*Artist),
+		trash:   make(map[string]*TrashedArtist),
 	}
 
 	return artists
@@ -40,15 +125,50 @@ func (state *Artists) Add(artist *Artist) error {
 	if _, ok := state.artists[artist.Id]; ok {
 		return errors.New("Artist by 'id' already exists")
 	}
+	if _, ok := state.trash[artist.Id]; ok {
+		return errors.New("Artist by 'id' is in the trash")
+	}
 
 	// Store the artist and release the lock.
 	// Copy the struct.
-	state.artists[artist.Id] = artist.clone()
+	stored := artist.clone()
+	stored.Version = 1
+	state.artists[artist.Id] = stored
+
+	return nil
+}
+
+func (state *Artists) Delete(id string, deletedAt time.Time) error {
+	state.Lock()
+	defer state.Unlock()
+
+	artist, ok := state.artists[id]
+	if !ok {
+		return errors.New("Artist does not exist")
+	}
+
+	delete(state.artists, id)
+	state.trash[id] = &TrashedArtist{*artist, deletedAt}
 
 	return nil
 }
 
-func (state *Artists) Delete(id string) error {
+func (state *Artists) Restore(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	trashed, ok := state.trash[id]
+	if !ok {
+		return errors.New("Artist is not in the trash")
+	}
+
+	delete(state.trash, id)
+	state.artists[id] = trashed.Artist.clone()
+
+	return nil
+}
+
+func (state *Artists) Remove(id string) error {
 	state.Lock()
 	defer state.Unlock()
 
@@ -61,17 +181,70 @@ func (state *Artists) Delete(id string) error {
 	return nil
 }
 
+func (state *Artists) Purge(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.trash[id]; !ok {
+		return errors.New("Artist is not in the trash")
+	}
+
+	delete(state.trash, id)
+
+	return nil
+}
+
+/*
+Lists the trash, oldest deletion first.
+*/
+func (state *Artists) GetTrash() ([]*TrashedArtist, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	trash := make([]*TrashedArtist, 0, len(state.trash))
+	for _, trashed := range state.trash {
+		trashCopy := *trashed
+		trash = append(trash, &trashCopy)
+	}
+
+	sort.Slice(trash, func(i, j int) bool {
+		return trash[i].DeletedAt.Before(trash[j].DeletedAt)
+	})
+
+	return trash, nil
+}
+
 func (state *Artists) Update(artist *Artist) error {
 	state.Lock()
 	defer state.Unlock()
 
 	// Grab the existing artist by it's id.
-	_, ok := state.artists[artist.Id]
+	oldArtist, ok := state.artists[artist.Id]
 	if !ok {
 		// Can't update an artist that doesn't exist.
 		return errors.New("Unable to update artist, given artist Id does not exist")
 	}
 
+	err := checkVersion("artist", artist.Id, artist.Version, oldArtist.Version)
+	if err != nil {
+		return err
+	}
+
+	stored := artist.clone()
+	stored.Version = oldArtist.Version + 1
+	state.artists[artist.Id] = stored
+
+	return nil
+}
+
+/*
+Stores the artist exactly as given, version included, replacing any current copy.
+Used to undo changes.
+*/
+func (state *Artists) Revert(artist *Artist) error {
+	state.Lock()
+	defer state.Unlock()
+
 	state.artists[artist.Id] = artist.clone()
 
 	return nil
@@ -89,6 +262,44 @@ func (state *Artists) Get(id string) (*Artist, error) {
 	return artist, nil
 }
 
+/*
+Copies the artists into the snapshot.
+*/
+func (state *Artists) snapshot(snap *catalogSnapshot) {
+	state.RLock()
+	defer state.RUnlock()
+
+	snap.Artists = make(map[string]*Artist, len(state.artists))
+	for id, artist := range state.artists {
+		snap.Artists[id] = artist.clone()
+	}
+
+	snap.ArtistTrash = make(map[string]*TrashedArtist, len(state.trash))
+	for id, trashed := range state.trash {
+		trashCopy := *trashed
+		snap.ArtistTrash[id] = &trashCopy
+	}
+}
+
+/*
+Replaces the artists with the contents of the snapshot.
+*/
+func (state *Artists) restore(snap *catalogSnapshot) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.artists = make(map[string]*Artist, len(snap.Artists))
+	for id, artist := range snap.Artists {
+		state.artists[id] = artist.clone()
+	}
+
+	state.trash = make(map[string]*TrashedArtist, len(snap.ArtistTrash))
+	for id, trashed := range snap.ArtistTrash {
+		trashCopy := *trashed
+		state.trash[id] = &trashCopy
+	}
+}
+
 func (state *Artists) GetAll() ([]string, error) {
 	state.Lock()
 	defer state.Unlock()
@@ -103,3 +314,30 @@ func (state *Artists) GetAll() ([]string, error) {
 
 	return artistIds, nil
 }
+
+func (state *Artists) GetByBirthYear(from, to int) ([]string, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	artists := make([]*Artist, 0)
+	for _, artist := range state.artists {
+		year := artist.Birthdate.Year
+		if year != 0 && year >= from && year <= to {
+			artists = append(artists, artist)
+		}
+	}
+
+	sort.Slice(artists, func(i, j int) bool {
+		if artists[i].Birthdate != artists[j].Birthdate {
+			return artists[i].Birthdate.String() < artists[j].Birthdate.String()
+		}
+		return artists[i].Id < artists[j].Id
+	})
+
+	artistIds := make([]string, len(artists))
+	for i, artist := range artists {
+		artistIds[i] = artist.Id
+	}
+
+	return artistIds, nil
+}
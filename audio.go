@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+Returned for an audio upload over the maxAudioSize setting.
+*/
+var AudioTooLargeError = errors.New("Audio file is too large")
+
+/*
+An uploaded audio file, as returned by the upload end point.
+Id is the hex SHA-256 of the file, as for images.
+*/
+type Audio struct {
+	Id          string `json:"id"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+
+	// Whether this upload stored the file, rather than finding it stored already.
+	created bool
+}
+
+/*
+Recognizes the audio formats songs can be uploaded in from the start of the file.
+Returns an empty string for anything else.
+*/
+func audioContentType(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return "audio/mpeg"
+	case len(header) >= 2 && header[0] == 0xff && header[1]&0xe0 == 0xe0:
+		// The frame sync of an MPEG audio frame without an ID3 tag.
+		return "audio/mpeg"
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return "audio/ogg"
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return "audio/wav"
+	case len(header) >= 8 && bytes.Equal(header[4:8], []byte("ftyp")):
+		return "audio/mp4"
+	}
+
+	return ""
+}
+
+/*
+AudioFiles keeps audio files on local disk, named by the hash of their content, like Images.
+Files are streamed to disk as they are uploaded, so they are never held in memory.
+An empty directory keeps no audio, see MediaDisabledError.
+*/
+type AudioFiles struct {
+	dir string
+}
+
+func NewAudioFiles(dir string) *AudioFiles {
+	return &AudioFiles{dir}
+}
+
+func (files *AudioFiles) path(id string) string {
+	return filepath.Join(files.dir, id[:2], id)
+}
+
+/*
+Stores the audio file read from body, unless it is already stored.
+Fails with AudioTooLargeError once more than maxSize bytes were read.
+*/
+func (files *AudioFiles) Put(body io.Reader, maxSize int64) (*Audio, error) {
+	if files.dir == "" {
+		return nil, MediaDisabledError
+	}
+
+	err := os.MkdirAll(files.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(files.dir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if size > maxSize {
+		return nil, AudioTooLargeError
+	}
+
+	header := make([]byte, 12)
+	n, _ := file.ReadAt(header, 0)
+
+	contentType := audioContentType(header[:n])
+	if contentType == "" {
+		return nil, &ValidationError{"audio", "must be an MP3, FLAC, Ogg, WAV or MP4 audio file"}
+	}
+
+	stored := &Audio{
+		Id:          hex.EncodeToString(hash.Sum(nil)),
+		ContentType: contentType,
+		Size:        size,
+	}
+
+	path := files.path(stored.Id)
+	if _, err := os.Stat(path); err == nil {
+		return stored, nil
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	stored.created = true
+	return stored, nil
+}
+
+/*
+Removes the stored audio file. Removing a file that is not stored is not an error.
+*/
+func (files *AudioFiles) Remove(id string) error {
+	if validateMediaId("audioId", id) != nil || id == "" || files.dir == "" {
+		return nil
+	}
+
+	err := os.Remove(files.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+/*
+Opens the stored audio file, with its content type.
+*/
+func (files *AudioFiles) Open(id string) (*os.File, string, error) {
+	if validateMediaId("audioId", id) != nil || id == "" || files.dir == "" {
+		return nil, "", errors.New("Audio does not exist")
+	}
+
+	file, err := os.Open(files.path(id))
+	if err != nil {
+		return nil, "", errors.New("Audio does not exist")
+	}
+
+	header := make([]byte, 12)
+	n, _ := file.ReadAt(header, 0)
+
+	return file, audioContentType(header[:n]), nil
+}
+
+/*
+Removes an audio file the upload stored when it ended up attached to no song, as when an import
+is skipped or the transaction attaching it fails. Files that were stored before the upload are
+kept, as old revisions may still name them. Nothing else removes audio files.
+*/
+func (state *State) releaseAudio(stored *Audio) {
+	if !stored.created {
+		return
+	}
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	referenced, err := state.audioReferenced(stored.Id)
+	if err != nil || referenced {
+		return
+	}
+
+	err = state.audio.Remove(stored.Id)
+	if err != nil {
+		state.log.Warn("Error removing unused audio %s: %s", stored.Id, err)
+	}
+}
+
+/*
+Whether a song, in the catalog or in the trash, has the audio file.
+*/
+func (state *State) audioReferenced(id string) (bool, error) {
+	songIds, err := state.songs.GetAll()
+	if err != nil {
+		return false, err
+	}
+
+	for _, songId := range songIds {
+		song, err := state.songs.Get(songId)
+		if err != nil {
+			return false, err
+		}
+
+		if song.AudioId == id {
+			return true, nil
+		}
+	}
+
+	trash, err := state.songs.GetTrash()
+	if err != nil {
+		return false, err
+	}
+
+	for _, trashed := range trash {
+		if trashed.AudioId == id {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (state *State) checkAudio(id string) error {
+	file, _, err := state.audio.Open(id)
+	if err != nil {
+		return &MissingReferenceError{"audio", id}
+	}
+
+	return file.Close()
+}
+
+/*
+Stores the audio file and attaches it to the song.
+A zero version replaces the audio whatever the song's version is.
+*/
+func (state *State) setSongAudio(actor, songId string, version int64, body io.Reader) (*Audio, error) {
+	// Checked before the upload is read, the transaction checks again.
+	err := state.checkSong(songId)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := state.audio.Put(body, GetConfig().GetMaxAudioSize())
+	if err != nil {
+		return nil, err
+	}
+
+	err = state.transact(actor, func(tx *catalogTx) error {
+		song, err := tx.state.songs.Get(songId)
+		if err != nil {
+			return err
+		}
+
+		song = song.clone()
+		song.AudioId = stored.Id
+		song.Version = version
+
+		return tx.updateSong(song)
+	})
+	if err != nil {
+		state.releaseAudio(stored)
+		return nil, err
+	}
+
+	return stored, nil
+}
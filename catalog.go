@@ -0,0 +1,680 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+Delete policies, for the albums and songs of a deleted artist or album.
+*/
+const (
+	// Refuse the delete while the artist or album has albums or songs.
+	DELETE_RESTRICT = "restrict"
+	// Delete the albums and songs along with it.
+	DELETE_CASCADE = "cascade"
+	// Leave the albums and songs referring to the deleted artist or album.
+	DELETE_ORPHAN = "orphan"
+)
+
+func validDeletePolicy(policy string) bool {
+	switch policy {
+	case DELETE_RESTRICT, DELETE_CASCADE, DELETE_ORPHAN:
+		return true
+	}
+
+	return false
+}
+
+/*
+Body of the delete end points.
+Either a bare id string, or an object naming the id and the delete policy.
+*/
+type deleteRequest struct {
+	Id     string `json:"id"`
+	Policy string `json:"policy"`
+}
+
+func (request *deleteRequest) UnmarshalJSON(data []byte) error {
+	var id string
+	if json.Unmarshal(data, &id) == nil {
+		request.Id = id
+		return nil
+	}
+
+	type plainDeleteRequest deleteRequest
+	return json.Unmarshal(data, (*plainDeleteRequest)(request))
+}
+
+/*
+The ids removed by a delete.
+*/
+type DeleteResult struct {
+	Artists []string `json:"artists"`
+	Albums  []string `json:"albums"`
+	Songs   []string `json:"songs"`
+}
+
+func newDeleteResult() *DeleteResult {
+	return &DeleteResult{
+		Artists: make([]string, 0),
+		Albums:  make([]string, 0),
+		Songs:   make([]string, 0),
+	}
+}
+
+/*
+Returned when the restrict policy refuses a delete.
+*/
+type DeleteRestrictedError struct {
+	Kind     string
+	Id       string
+	Children int
+}
+
+func (err *DeleteRestrictedError) Error() string {
+	switch err.Kind {
+	case "genre":
+		return fmt.Sprintf("Cannot delete genre '%s', it still has %d sub-genres or songs", err.Id, err.Children)
+	case "label":
+		return fmt.Sprintf("Cannot delete label '%s', it still has %d albums", err.Id, err.Children)
+	}
+
+	return fmt.Sprintf("Cannot delete %s '%s', it still has %d albums or songs", err.Kind, err.Id, err.Children)
+}
+
+/*
+Returned when an entity refers to an artist, album or song that does not exist.
+*/
+type MissingReferenceError struct {
+	Kind string
+	Id   string
+}
+
+func (err *MissingReferenceError) Error() string {
+	return fmt.Sprintf("Referenced %s '%s' does not exist", err.Kind, err.Id)
+}
+
+/*
+Returned when a field of an artist, album or song holds an invalid value.
+*/
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", err.Field, err.Reason)
+}
+
+func (state *State) checkArtist(id string) error {
+	_, err := state.artists.Get(id)
+	if err != nil {
+		return &MissingReferenceError{"artist", id}
+	}
+
+	return nil
+}
+
+func (state *State) checkAlbum(id string) error {
+	_, err := state.albums.Get(id)
+	if err != nil {
+		return &MissingReferenceError{"album", id}
+	}
+
+	return nil
+}
+
+func (state *State) checkSong(id string) error {
+	_, err := state.songs.Get(id)
+	if err != nil {
+		return &MissingReferenceError{"song", id}
+	}
+
+	return nil
+}
+
+/*
+The mutations below run in a catalog transaction, see txn.go,
+so a reference that was checked cannot be deleted before the change
+that relies on it is stored, and a cascade is applied all or nothing.
+*/
+
+func (state *State) addArtist(actor string, artist *Artist) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.addArtist(artist)
+	})
+}
+
+func (state *State) updateArtist(actor string, artist *Artist) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.updateArtist(artist)
+	})
+}
+
+func (state *State) deleteArtist(actor, id, policy string) (*DeleteResult, error) {
+	var result *DeleteResult
+
+	err := state.transact(actor, func(tx *catalogTx) error {
+		var err error
+		result, err = tx.deleteArtist(id, policy)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (state *State) addAlbum(actor string, album *Album) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.addAlbum(album)
+	})
+}
+
+func (state *State) updateAlbum(actor string, album *Album) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.updateAlbum(album)
+	})
+}
+
+func (state *State) deleteAlbum(actor, id, policy string) (*DeleteResult, error) {
+	var result *DeleteResult
+
+	err := state.transact(actor, func(tx *catalogTx) error {
+		var err error
+		result, err = tx.deleteAlbum(id, policy)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (state *State) addSong(actor string, song *Song) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.addSong(song)
+	})
+}
+
+func (state *State) updateSong(actor string, song *Song) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.updateSong(song)
+	})
+}
+
+func (state *State) deleteSong(actor, id string) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.removeSong(id)
+	})
+}
+
+func (tx *catalogTx) addArtist(artist *Artist) error {
+	err := artist.validate()
+	if err != nil {
+		return err
+	}
+
+	if artist.ImageId != "" {
+		err = tx.state.checkImage(artist.ImageId)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = assignId(&artist.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.artists.Add(artist)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.artists.Remove(artist.Id)
+	})
+
+	return tx.recordCurrent(REVISION_ARTIST, artist.Id, REVISION_ADD)
+}
+
+func (tx *catalogTx) updateArtist(artist *Artist) error {
+	err := artist.validate()
+	if err != nil {
+		return err
+	}
+
+	if artist.ImageId != "" {
+		err = tx.state.checkImage(artist.ImageId)
+		if err != nil {
+			return err
+		}
+	}
+
+	old, err := tx.state.artists.Get(artist.Id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = tx.state.artists.Update(artist)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.artists.Revert(old)
+	})
+
+	return tx.recordCurrent(REVISION_ARTIST, artist.Id, REVISION_UPDATE)
+}
+
+func (tx *catalogTx) removeArtist(id string, result *DeleteResult) error {
+	old, err := tx.state.artists.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.artists.Delete(id, tx.now)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.artists.Restore(id)
+	})
+
+	result.Artists = append(result.Artists, id)
+
+	err = tx.recordRevision(REVISION_ARTIST, id, REVISION_DELETE, old)
+	if err != nil {
+		return err
+	}
+
+	return tx.dropArtistRelationships(id)
+}
+
+func (tx *catalogTx) deleteArtist(id, policy string) (*DeleteResult, error) {
+	state := tx.state
+	result := newDeleteResult()
+
+	_, err := state.artists.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lookups fail when there is nothing under the artist.
+	albumIds, _ := state.albums.GetArtistAlbums(id)
+	songIds, _ := state.songs.GetArtistSongs(id)
+
+	switch policy {
+	case DELETE_RESTRICT:
+		if len(albumIds)+len(songIds) > 0 {
+			return nil, &DeleteRestrictedError{"artist", id, len(albumIds) + len(songIds)}
+		}
+
+	case DELETE_CASCADE:
+		// The artist's songs may be on other artists' albums, delete them first.
+		// Songs that only credit the artist lose the credit instead.
+		for _, songId := range songIds {
+			song, err := state.songs.Get(songId)
+			if err != nil {
+				return nil, err
+			}
+
+			if song.ArtistId != id {
+				err := tx.dropSongCredits(songId, id)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			err = tx.removeSong(songId)
+			if err != nil {
+				return nil, err
+			}
+
+			result.Songs = append(result.Songs, songId)
+		}
+
+		for _, albumId := range albumIds {
+			err := tx.cascadeAlbum(albumId, result)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := tx.dropAlbumCredits(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.removeArtist(id, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (tx *catalogTx) addAlbum(album *Album) error {
+	err := album.validate()
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkAlbumReferences(album)
+	if err != nil {
+		return err
+	}
+
+	err = assignId(&album.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.albums.Add(album)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.albums.Remove(album.Id)
+	})
+
+	return tx.recordCurrent(REVISION_ALBUM, album.Id, REVISION_ADD)
+}
+
+func (tx *catalogTx) updateAlbum(album *Album) error {
+	err := album.validate()
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkAlbumReferences(album)
+	if err != nil {
+		return err
+	}
+
+	old, err := tx.state.albums.Get(album.Id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = tx.state.albums.Update(album)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.albums.Revert(old)
+	})
+
+	return tx.recordCurrent(REVISION_ALBUM, album.Id, REVISION_UPDATE)
+}
+
+func (tx *catalogTx) removeAlbum(id string, result *DeleteResult) error {
+	old, err := tx.state.albums.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.albums.Delete(id, tx.now)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.albums.Restore(id)
+	})
+
+	result.Albums = append(result.Albums, id)
+
+	return tx.recordRevision(REVISION_ALBUM, id, REVISION_DELETE, old)
+}
+
+func (tx *catalogTx) deleteAlbum(id, policy string) (*DeleteResult, error) {
+	state := tx.state
+	result := newDeleteResult()
+
+	_, err := state.albums.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch policy {
+	case DELETE_RESTRICT:
+		songIds, _ := state.songs.GetAlbumSongs(id)
+		if len(songIds) > 0 {
+			return nil, &DeleteRestrictedError{"album", id, len(songIds)}
+		}
+
+	case DELETE_CASCADE:
+		err := tx.cascadeAlbum(id, result)
+		if err != nil {
+			return nil, err
+		}
+
+		return result, nil
+	}
+
+	err = tx.removeAlbum(id, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+/*
+Deletes an album and its songs, recording them in the result.
+*/
+func (tx *catalogTx) cascadeAlbum(id string, result *DeleteResult) error {
+	songIds, _ := tx.state.songs.GetAlbumSongs(id)
+
+	for _, songId := range songIds {
+		err := tx.removeSong(songId)
+		if err != nil {
+			return err
+		}
+
+		result.Songs = append(result.Songs, songId)
+	}
+
+	return tx.removeAlbum(id, result)
+}
+
+func (tx *catalogTx) addSong(song *Song) error {
+	err := song.validate()
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.resolveSongGenre(song)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkSongReferences(song)
+	if err != nil {
+		return err
+	}
+
+	err = assignId(&song.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.placeSong(song, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.songs.Add(song)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.songs.Remove(song.Id)
+	})
+
+	return tx.recordCurrent(REVISION_SONG, song.Id, REVISION_ADD)
+}
+
+func (tx *catalogTx) updateSong(song *Song) error {
+	err := song.validate()
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.resolveSongGenre(song)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkSongReferences(song)
+	if err != nil {
+		return err
+	}
+
+	old, err := tx.state.songs.Get(song.Id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = tx.state.placeSong(song, old)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.songs.Update(song)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.songs.Revert(old)
+	})
+
+	return tx.recordCurrent(REVISION_SONG, song.Id, REVISION_UPDATE)
+}
+
+func (tx *catalogTx) removeSong(id string) error {
+	old, err := tx.state.songs.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.songs.Delete(id, tx.now)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.songs.Restore(id)
+	})
+
+	err = tx.recordRevision(REVISION_SONG, id, REVISION_DELETE, old)
+	if err != nil {
+		return err
+	}
+
+	return tx.dropPlaylistSong(id)
+}
+
+/*
+Adds up the running time of the given songs.
+Songs that cannot be read are left out of both totals.
+*/
+func (state *State) runtime(songIds []string) (Duration, int) {
+	var total Duration
+	count := 0
+
+	for _, id := range songIds {
+		song, err := state.songs.Get(id)
+		if err != nil {
+			continue
+		}
+
+		total.Seconds += song.Time.Seconds
+		count++
+	}
+
+	return total, count
+}
+
+func (state *State) albumDetails(album *Album) *AlbumDetails {
+	// The lookup fails when the album has no songs.
+	songIds, _ := state.songs.GetAlbumSongs(album.Id)
+	runtime, count := state.runtime(songIds)
+
+	return &AlbumDetails{*album, runtime, count}
+}
+
+func (state *State) artistDetails(artist *Artist) *ArtistDetails {
+	// The lookup fails when the artist has no songs.
+	songIds, _ := state.songs.GetArtistSongs(artist.Id)
+	runtime, count := state.runtime(songIds)
+
+	return &ArtistDetails{*artist, runtime, count}
+}
+
+func (state *State) checkAlbumReferences(album *Album) error {
+	err := state.checkArtist(album.ArtistId)
+	if err != nil {
+		return err
+	}
+
+	if album.LabelId != "" {
+		err = state.checkLabel(album.LabelId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if album.ImageId != "" {
+		err = state.checkImage(album.ImageId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return state.checkCredits(album.Credits)
+}
+
+func (state *State) checkSongReferences(song *Song) error {
+	err := state.checkAlbum(song.AlbumId)
+	if err != nil {
+		return err
+	}
+
+	err = state.checkArtist(song.ArtistId)
+	if err != nil {
+		return err
+	}
+
+	if song.GenreId != "" {
+		err = state.checkGenre(song.GenreId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if song.AudioId != "" {
+		err = state.checkAudio(song.AudioId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return state.checkCredits(song.Credits)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// An index lists an id that is not in the primary map.
+	ISSUE_STALE_ID = "staleId"
+	// An index lists the same id more than once.
+	ISSUE_DUPLICATE_ID = "duplicateId"
+	// An index lists an id under the wrong artist or album.
+	ISSUE_MISFILED_ID = "misfiledId"
+	// An entity is missing from the index it belongs in.
+	ISSUE_UNINDEXED_ID = "unindexedId"
+	// An entity refers to another entity that does not exist.
+	ISSUE_MISSING_REFERENCE = "missingReference"
+)
+
+/*
+A single inconsistency found in the catalog.
+*/
+type CatalogIssue struct {
+	Issue  string `json:"issue"`
+	Index  string `json:"index,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Kind   string `json:"kind"`
+	Id     string `json:"id"`
+	Detail string `json:"detail"`
+}
+
+type CheckRequest struct {
+	Repair bool `json:"repair"`
+}
+
+/*
+Issues found by a check.
+When a repair was requested, Remaining lists what the rebuilt indexes did not fix.
+*/
+type CheckReport struct {
+	Issues    []CatalogIssue `json:"issues"`
+	Repaired  bool           `json:"repaired"`
+	Remaining []CatalogIssue `json:"remaining"`
+}
+
+/*
+Implemented by stores that keep secondary indexes beside their primary map.
+*/
+type indexedStore interface {
+	checkIndexes() []CatalogIssue
+	rebuildIndexes() error
+}
+
+/*
+Checks one id index against the owners each entity actually has.
+owners returns the keys an id belongs under, and false when the id does not exist.
+*/
+func checkIndex(
+	indexName string,
+	kind string,
+	index map[string][]string,
+	ids []string,
+	owners func(id string) ([]string, bool),
+) []CatalogIssue {
+	issues := make([]CatalogIssue, 0)
+	// The keys each id was found under.
+	indexed := make(map[string]map[string]bool)
+
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		seen := make(map[string]bool)
+
+		for _, id := range index[key] {
+			issue := CatalogIssue{Index: indexName, Key: key, Kind: kind, Id: id}
+
+			ownerKeys, ok := owners(id)
+			switch {
+			case seen[id]:
+				issue.Issue = ISSUE_DUPLICATE_ID
+				issue.Detail = fmt.Sprintf("Listed more than once under '%s'", key)
+			case !ok:
+				issue.Issue = ISSUE_STALE_ID
+				issue.Detail = fmt.Sprintf("Listed under '%s' but does not exist", key)
+			case !containsString(ownerKeys, key):
+				issue.Issue = ISSUE_MISFILED_ID
+				issue.Detail = fmt.Sprintf("Listed under '%s' but belongs to '%s'", key, strings.Join(ownerKeys, "', '"))
+			default:
+				if indexed[id] == nil {
+					indexed[id] = make(map[string]bool)
+				}
+				indexed[id][key] = true
+			}
+
+			if issue.Issue != "" {
+				issues = append(issues, issue)
+			}
+
+			seen[id] = true
+		}
+	}
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		ownerKeys, _ := owners(id)
+		for _, ownerKey := range ownerKeys {
+			if indexed[id][ownerKey] {
+				continue
+			}
+
+			issues = append(issues, CatalogIssue{
+				Issue:  ISSUE_UNINDEXED_ID,
+				Index:  indexName,
+				Key:    ownerKey,
+				Kind:   kind,
+				Id:     id,
+				Detail: fmt.Sprintf("Not listed under '%s'", ownerKey),
+			})
+		}
+	}
+
+	return issues
+}
+
+/*
+Scans every entity and index of the catalog.
+With repair set, the indexes are rebuilt from the primary maps and checked again.
+Missing references are only reported, fixing them needs a decision about the data.
+*/
+func (state *State) checkCatalog(repair bool) (*CheckReport, error) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	report := &CheckReport{}
+
+	issues, err := state.findIssues()
+	if err != nil {
+		return nil, err
+	}
+	report.Issues = issues
+
+	if !repair {
+		return report, nil
+	}
+
+	for _, store := range []interface{}{state.albums, state.songs} {
+		indexed, ok := store.(indexedStore)
+		if !ok {
+			continue
+		}
+
+		err := indexed.rebuildIndexes()
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.Repaired = true
+
+	report.Remaining, err = state.findIssues()
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+/*
+The caller must hold the catalog lock.
+*/
+func (state *State) findIssues() ([]CatalogIssue, error) {
+	issues := make([]CatalogIssue, 0)
+
+	for _, store := range []interface{}{state.albums, state.songs} {
+		if indexed, ok := store.(indexedStore); ok {
+			issues = append(issues, indexed.checkIndexes()...)
+		}
+	}
+
+	missing := func(kind, id, refKind, refId string) {
+		issues = append(issues, CatalogIssue{
+			Issue:  ISSUE_MISSING_REFERENCE,
+			Kind:   kind,
+			Id:     id,
+			Detail: fmt.Sprintf("Refers to %s '%s' which does not exist", refKind, refId),
+		})
+	}
+
+	artistIds, err := state.artists.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(artistIds)
+
+	for _, id := range artistIds {
+		artist, err := state.artists.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if artist.ImageId != "" && state.checkImage(artist.ImageId) != nil {
+			missing("artist", id, "image", artist.ImageId)
+		}
+	}
+
+	albumIds, err := state.albums.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(albumIds)
+
+	for _, id := range albumIds {
+		album, err := state.albums.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if state.checkArtist(album.ArtistId) != nil {
+			missing("album", id, "artist", album.ArtistId)
+		}
+		for _, credit := range album.Credits {
+			if state.checkArtist(credit.ArtistId) != nil {
+				missing("album", id, "artist", credit.ArtistId)
+			}
+		}
+		if album.LabelId != "" && state.checkLabel(album.LabelId) != nil {
+			missing("album", id, "label", album.LabelId)
+		}
+		if album.ImageId != "" && state.checkImage(album.ImageId) != nil {
+			missing("album", id, "image", album.ImageId)
+		}
+	}
+
+	songIds, err := state.songs.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(songIds)
+
+	for _, id := range songIds {
+		song, err := state.songs.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if state.checkAlbum(song.AlbumId) != nil {
+			missing("song", id, "album", song.AlbumId)
+		}
+		if state.checkArtist(song.ArtistId) != nil {
+			missing("song", id, "artist", song.ArtistId)
+		}
+		for _, credit := range song.Credits {
+			if state.checkArtist(credit.ArtistId) != nil {
+				missing("song", id, "artist", credit.ArtistId)
+			}
+		}
+		if song.GenreId != "" && state.checkGenre(song.GenreId) != nil {
+			missing("song", id, "genre", song.GenreId)
+		}
+		if song.AudioId != "" && state.checkAudio(song.AudioId) != nil {
+			missing("song", id, "audio", song.AudioId)
+		}
+	}
+
+	genres, err := state.allGenres()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, genre := range genres {
+		if genre.ParentId != "" && state.checkGenre(genre.ParentId) != nil {
+			missing("genre", genre.Id, "genre", genre.ParentId)
+		}
+	}
+
+	playlistIds, err := state.playlists.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range playlistIds {
+		playlist, err := state.playlists.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, songId := range playlist.SongIds {
+			if state.checkSong(songId) != nil {
+				missing("playlist", id, "song", songId)
+			}
+		}
+	}
+
+	relationshipIds, err := state.relationships.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range relationshipIds {
+		relationship, err := state.relationships.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if state.checkArtist(relationship.ArtistId) != nil {
+			missing("relationship", id, "artist", relationship.ArtistId)
+		}
+		if state.checkArtist(relationship.RelatedId) != nil {
+			missing("relationship", id, "artist", relationship.RelatedId)
+		}
+	}
+
+	return issues, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckCatalog(test *testing.T) {
+	albums := NewAlbums()
+	artists := NewArtists()
+	songs := NewSongs()
+
+	state, err := NewStateWith(albums, artists, songs)
+	if err != nil {
+		test.Fatalf("Unable to create state: %s", err)
+	}
+
+	artists.Add(&Artist{Id: "checkArtist"})
+	albums.Add(&Album{Id: "checkAlbum", ArtistId: "checkArtist"})
+	songs.Add(&Song{Id: "checkSong", AlbumId: "checkAlbum", ArtistId: "checkArtist"})
+	songs.Add(&Song{Id: "checkOrphan", AlbumId: "checkAlbum", ArtistId: "checkMissingArtist"})
+
+	report, err := state.checkCatalog(false)
+	if err != nil {
+		test.Fatalf("Unable to check catalog: %s", err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Issue != ISSUE_MISSING_REFERENCE {
+		test.Fatalf("Expected only the missing artist reference, got %#v", report.Issues)
+	}
+
+	// Drift the indexes.
+	songs.albumSongs["checkAlbum"] = append(songs.albumSongs["checkAlbum"], "checkSong", "checkGone")
+	songs.artistSongs["checkArtist"] = nil
+	albums.artistAlbums["checkOther"] = []string{"checkAlbum"}
+
+	report, err = state.checkCatalog(false)
+	if err != nil {
+		test.Fatalf("Unable to check catalog: %s", err)
+	}
+
+	found := make(map[string]int)
+	for _, issue := range report.Issues {
+		found[issue.Issue]++
+	}
+
+	expected := map[string]int{
+		ISSUE_DUPLICATE_ID:      1,
+		ISSUE_STALE_ID:          1,
+		ISSUE_UNINDEXED_ID:      1,
+		ISSUE_MISFILED_ID:       1,
+		ISSUE_MISSING_REFERENCE: 1,
+	}
+	for issue, count := range expected {
+		if found[issue] != count {
+			test.Errorf("Expected %d %s issues, got %#v", count, issue, report.Issues)
+		}
+	}
+
+	report, err = state.checkCatalog(true)
+	if err != nil {
+		test.Fatalf("Unable to repair catalog: %s", err)
+	}
+	if !report.Repaired {
+		test.Errorf("Repair was not reported")
+	}
+	if len(report.Remaining) != 1 || report.Remaining[0].Issue != ISSUE_MISSING_REFERENCE {
+		test.Errorf("Expected only the missing reference after repair, got %#v", report.Remaining)
+	}
+}
+
+func TestDeleteWithIndexDrift(test *testing.T) {
+	albums := NewAlbums()
+	artists := NewArtists()
+	songs := NewSongs()
+
+	state, err := NewStateWith(albums, artists, songs)
+	if err != nil {
+		test.Fatalf("Unable to create state: %s", err)
+	}
+
+	artists.Add(&Artist{Id: "driftArtist"})
+	albums.Add(&Album{Id: "driftAlbum", ArtistId: "driftArtist"})
+	songs.Add(&Song{Id: "driftSong", AlbumId: "driftAlbum", ArtistId: "driftArtist"})
+
+	// Drift the indexes.
+	delete(songs.albumSongs, "driftAlbum")
+	songs.artistSongs["driftArtist"] = nil
+	albums.artistAlbums["driftArtist"] = nil
+
+	report, err := state.checkCatalog(false)
+	if err != nil {
+		test.Fatalf("Unable to check catalog: %s", err)
+	}
+	if len(report.Issues) == 0 {
+		test.Errorf("Expected the drift reported")
+	}
+
+	if err := songs.Delete("driftSong", time.Now()); err != nil {
+		test.Errorf("Unable to delete a song missing from the indexes: %s", err)
+	}
+	if err := albums.Delete("driftAlbum", time.Now()); err != nil {
+		test.Errorf("Unable to delete an album missing from the indexes: %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Default address of the server the commands talk to.
+*/
+func defaultServer() string {
+	config := GetConfig()
+	return fmt.Sprintf("http://%s:%d/", config.GetHttpHostname(), config.GetHttpPort())
+}
+
+/*
+Posts a JSON request to an end point of the running server and decodes the reply.
+*/
+func postCommand(server, endPoint string, request, reply interface{}) error {
+	buffer, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return postBodyCommand(server, endPoint, "application/json", bytes.NewReader(buffer), reply)
+}
+
+/*
+Posts a body as it is to an end point of the running server and decodes the JSON reply.
+*/
+func postBodyCommand(server, endPoint, contentType string, content io.Reader, reply interface{}) error {
+	resp, err := http.Post(server+endPoint, contentType, content)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status + ": " + string(bytes.TrimSpace(body)))
+	}
+
+	return json.Unmarshal(body, reply)
+}
+
+/*
+music-webapp check [-repair] [-server url]
+Checks the catalog of a running server, exiting 1 when issues remain.
+*/
+func checkCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "rebuild the indexes from the primary maps")
+	server := flags.String("server", defaultServer(), "address of the server")
+	flags.Parse(args)
+
+	report := new(CheckReport)
+	err := postCommand(*server, "checkCatalog", CheckRequest{Repair: *repair}, report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to check catalog: %s\n", err)
+		return 2
+	}
+
+	for _, issue := range report.Issues {
+		fmt.Printf("%s\t%s %s\t%s\n", issue.Issue, issue.Kind, issue.Id, issue.Detail)
+	}
+	fmt.Printf("%d issues found\n", len(report.Issues))
+
+	remaining := report.Issues
+	if report.Repaired {
+		remaining = report.Remaining
+		fmt.Printf("Repaired indexes, %d issues remain\n", len(remaining))
+	}
+
+	if len(remaining) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+/*
+music-webapp import [-server url] path...
+Imports the MP3 files given, and those under the directories given, into the catalog of a running server.
+Prints what was created, matched and skipped, exiting 1 when a file could not be imported.
+*/
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	server := flags.String("server", defaultServer(), "address of the server")
+	flags.Parse(args)
+
+	var paths []string
+	for _, root := range flags.Args() {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Files named on the command line are imported whatever their extension.
+			if path == root && !info.IsDir() || !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".mp3") {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read %s: %s\n", root, err)
+			return 2
+		}
+	}
+
+	// Counts by kind and then status.
+	totals := make(map[string]map[string]int)
+	count := func(kind, status string) {
+		if totals[kind] == nil {
+			totals[kind] = make(map[string]int)
+		}
+		totals[kind][status]++
+	}
+
+	failed := 0
+	for _, path := range paths {
+		report, err := importFile(*server, path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to import %s: %s\n", path, err)
+			failed++
+			continue
+		}
+
+		if report.Status == IMPORT_SKIPPED {
+			fmt.Printf("%s\t%s\t%s\n", report.Status, path, report.Reason)
+			count(REVISION_SONG, IMPORT_SKIPPED)
+			failed++
+			continue
+		}
+
+		fmt.Printf("%s\t%s\t%s / %s / %s\n", report.Status, path, report.Tags.Artist, report.Tags.Album, report.Tags.Title)
+		for _, record := range report.Records {
+			count(record.Kind, record.Status)
+		}
+	}
+
+	for _, kind := range []string{REVISION_ARTIST, REVISION_ALBUM, REVISION_SONG} {
+		fmt.Printf("%ss: %d created, %d matched", kind, totals[kind][IMPORT_CREATED], totals[kind][IMPORT_MATCHED])
+		if kind == REVISION_SONG {
+			fmt.Printf(", %d skipped", totals[kind][IMPORT_SKIPPED])
+		}
+		fmt.Println()
+	}
+
+	if failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func importFile(server, path string) (*ImportReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	report := new(ImportReport)
+	err = postBodyCommand(server, "importSong", "audio/mpeg", file, report)
+	if err != nil {
+		return nil, err
+	}
+
+	report.File = path
+	return report, nil
+}
@@ -4,12 +4,30 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	STORAGE_MEMORY = "memory"
+	STORAGE_SQLITE = "sqlite"
 )
 
 type configState struct {
-	HttpPort     int
-	HttpHostname string
-	LogLevel     string
+	HttpPort         int
+	HttpHostname     string
+	LogLevel         string
+	DataDir          string
+	MediaDir         string
+	ThumbnailSizes   []int
+	MaxAudioSize     int64
+	SnapshotInterval string
+	Storage          string
+	DeletePolicy     string
+	TrashRetention   string
+	RefuseClientIds  bool
+	RequireVersion   bool
+	DefaultCurrency  string
 }
 
 type Config struct {
@@ -19,7 +37,12 @@ type Config struct {
 var config *Config
 
 func init() {
-	file, err := os.Open("config/default.json")
+	path := os.Getenv("MUSIC_WEBAPP_CONFIG")
+	if path == "" {
+		path = "config/default.json"
+	}
+
+	file, err := os.Open(path)
 	if err != nil {
 		panic(err)
 	}
@@ -35,6 +58,13 @@ func init() {
 	}
 
 	config.GetLogLevel()
+	config.GetSnapshotInterval()
+	config.GetStorage()
+	config.GetDeletePolicy()
+	config.GetTrashRetention()
+	config.GetDefaultCurrency()
+	config.GetThumbnailSizes()
+	config.GetMaxAudioSize()
 }
 
 func GetConfig() *Config {
@@ -49,6 +79,159 @@ func (config *Config) GetHttpPort() int {
 	return config.state.HttpPort
 }
 
+/*
+Directory holding the write-ahead log and snapshots.
+An empty directory keeps the catalog in memory only.
+*/
+func (config *Config) GetDataDir() string {
+	return config.state.DataDir
+}
+
+/*
+Directory holding uploaded images, the media directory under the data directory when not set.
+Empty when neither is set, which disables uploads rather than writing to the working directory.
+*/
+func (config *Config) GetMediaDir() string {
+	if config.state.MediaDir == "" {
+		if config.state.DataDir == "" {
+			return ""
+		}
+
+		return filepath.Join(config.state.DataDir, "media")
+	}
+
+	return config.state.MediaDir
+}
+
+/*
+The sizes in pixels that images may be scaled down to, see thumbnails.go.
+64, 128, 256 and 512 when not set.
+*/
+func (config *Config) GetThumbnailSizes() []int {
+	if len(config.state.ThumbnailSizes) == 0 {
+		return []int{64, 128, 256, 512}
+	}
+
+	for _, size := range config.state.ThumbnailSizes {
+		if size < 1 || size > 4096 {
+			panic(errors.New("Invalid thumbnailSizes"))
+		}
+	}
+
+	return config.state.ThumbnailSizes
+}
+
+/*
+The largest audio file accepted by an upload, in bytes. 200 MiB when not set.
+*/
+func (config *Config) GetMaxAudioSize() int64 {
+	if config.state.MaxAudioSize == 0 {
+		return 200 << 20
+	}
+
+	if config.state.MaxAudioSize < 0 {
+		panic(errors.New("Invalid maxAudioSize"))
+	}
+
+	return config.state.MaxAudioSize
+}
+
+/*
+How often a snapshot of the catalog is written to the data directory.
+Zero disables snapshots, leaving the whole log to be replayed on startup.
+*/
+func (config *Config) GetSnapshotInterval() time.Duration {
+	if config.state.SnapshotInterval == "" {
+		return 0
+	}
+
+	interval, err := time.ParseDuration(config.state.SnapshotInterval)
+	if err != nil || interval < 0 {
+		panic(errors.New("Invalid snapshotInterval"))
+	}
+
+	return interval
+}
+
+/*
+The storage backend of the catalog, STORAGE_MEMORY when not set.
+*/
+func (config *Config) GetStorage() string {
+	switch config.state.Storage {
+	case "", STORAGE_MEMORY:
+		return STORAGE_MEMORY
+	case STORAGE_SQLITE:
+		if config.state.DataDir == "" {
+			panic(errors.New("Storage sqlite requires a dataDir"))
+		}
+		return STORAGE_SQLITE
+	default:
+		panic(errors.New("Invalid storage"))
+	}
+}
+
+/*
+What happens to the albums and songs of a deleted artist or album,
+when the request does not say. DELETE_ORPHAN when not set.
+*/
+func (config *Config) GetDeletePolicy() string {
+	if config.state.DeletePolicy == "" {
+		return DELETE_ORPHAN
+	}
+
+	if !validDeletePolicy(config.state.DeletePolicy) {
+		panic(errors.New("Invalid deletePolicy"))
+	}
+
+	return config.state.DeletePolicy
+}
+
+/*
+How long deleted artists, albums and songs stay in the trash
+before a purge without a date removes them. 30 days when not set.
+*/
+func (config *Config) GetTrashRetention() time.Duration {
+	if config.state.TrashRetention == "" {
+		return 30 * 24 * time.Hour
+	}
+
+	retention, err := time.ParseDuration(config.state.TrashRetention)
+	if err != nil || retention < 0 {
+		panic(errors.New("Invalid trashRetention"))
+	}
+
+	return retention
+}
+
+/*
+Whether adds must leave the id to the server.
+*/
+func (config *Config) GetRefuseClientIds() bool {
+	return config.state.RefuseClientIds
+}
+
+/*
+Whether updates must name the version they were based on, see requireVersion in versions.go.
+*/
+func (config *Config) GetRequireVersion() bool {
+	return config.state.RequireVersion
+}
+
+/*
+The currency of prices given as a plain number, USD when not set.
+*/
+func (config *Config) GetDefaultCurrency() string {
+	if config.state.DefaultCurrency == "" {
+		return "USD"
+	}
+
+	if (Price{Currency: config.state.DefaultCurrency}).validate() != nil {
+		panic(errors.New("Invalid defaultCurrency"))
+	}
+
+	return config.state.DefaultCurrency
+}
+
 func (config *Config) GetLogLevel() int {
 	switch config.state.LogLevel {
 	case "FATAL":
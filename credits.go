@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+/*
+Roles an artist is credited with on a song or album.
+*/
+const (
+	CREDIT_PRIMARY  = "primary"
+	CREDIT_FEATURED = "featured"
+	CREDIT_PRODUCER = "producer"
+	CREDIT_COMPOSER = "composer"
+	CREDIT_REMIXER  = "remixer"
+)
+
+func validCreditRole(role string) bool {
+	switch role {
+	case CREDIT_PRIMARY, CREDIT_FEATURED, CREDIT_PRODUCER, CREDIT_COMPOSER, CREDIT_REMIXER:
+		return true
+	}
+
+	return false
+}
+
+/*
+An artist credited on a song or album, in a role.
+The ArtistId of the song or album is its primary artist and need not be listed.
+*/
+type Credit struct {
+	ArtistId string `json:"artistId"`
+	Role     string `json:"role"`
+}
+
+func validateCredits(credits []Credit) error {
+	seen := make(map[Credit]bool, len(credits))
+
+	for _, credit := range credits {
+		if credit.ArtistId == "" {
+			return &ValidationError{"credits", "every credit needs an artistId"}
+		}
+		if !validCreditRole(credit.Role) {
+			return &ValidationError{"credits", fmt.Sprintf("'%s' is not a role", credit.Role)}
+		}
+		if seen[credit] {
+			return &ValidationError{"credits", fmt.Sprintf("artist '%s' is credited as %s twice", credit.ArtistId, credit.Role)}
+		}
+
+		seen[credit] = true
+	}
+
+	return nil
+}
+
+/*
+Lists the primary artist and every credited artist once, in credit order.
+*/
+func creditedArtists(artistId string, credits []Credit) []string {
+	ids := []string{artistId}
+	seen := map[string]bool{artistId: true}
+
+	for _, credit := range credits {
+		if !seen[credit.ArtistId] {
+			ids = append(ids, credit.ArtistId)
+			seen[credit.ArtistId] = true
+		}
+	}
+
+	return ids
+}
+
+/*
+Whether the artist is credited in the role, the primary artist counting as primary.
+An empty role matches any credit.
+*/
+func hasCredit(artistId string, credits []Credit, creditedId, role string) bool {
+	if artistId == creditedId && (role == "" || role == CREDIT_PRIMARY) {
+		return true
+	}
+
+	for _, credit := range credits {
+		if credit.ArtistId == creditedId && (role == "" || credit.Role == role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func copyCredits(credits []Credit) []Credit {
+	if credits == nil {
+		return nil
+	}
+
+	return append([]Credit(nil), credits...)
+}
+
+/*
+Drops every credit of the artist.
+*/
+func withoutCredits(credits []Credit, artistId string) []Credit {
+	kept := make([]Credit, 0, len(credits))
+	for _, credit := range credits {
+		if credit.ArtistId != artistId {
+			kept = append(kept, credit)
+		}
+	}
+
+	return kept
+}
+
+/*
+Removes every credit of the artist from the song, for a cascading artist delete.
+*/
+func (tx *catalogTx) dropSongCredits(songId, artistId string) error {
+	old, err := tx.state.songs.Get(songId)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	song := old.clone()
+	song.Credits = withoutCredits(song.Credits, artistId)
+
+	err = tx.state.songs.Update(song)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.songs.Revert(old)
+	})
+
+	return tx.recordCurrent(REVISION_SONG, songId, REVISION_UPDATE)
+}
+
+/*
+Removes every credit of the artist from the albums, for a cascading artist delete.
+Albums are not indexed by their credits, so all of them are looked at.
+*/
+func (tx *catalogTx) dropAlbumCredits(artistId string) error {
+	albumIds, err := tx.state.albums.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range albumIds {
+		old, err := tx.state.albums.Get(id)
+		if err != nil {
+			return err
+		}
+		if !hasCredit("", old.Credits, artistId, "") {
+			continue
+		}
+		old = old.clone()
+
+		album := old.clone()
+		album.Credits = withoutCredits(album.Credits, artistId)
+
+		err = tx.state.albums.Update(album)
+		if err != nil {
+			return err
+		}
+
+		tx.onRollback(func() error {
+			return tx.state.albums.Revert(old)
+		})
+
+		err = tx.recordCurrent(REVISION_ALBUM, id, REVISION_UPDATE)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (state *State) checkCredits(credits []Credit) error {
+	for _, credit := range credits {
+		err := state.checkArtist(credit.ArtistId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Body of /getArtistSongs.
+Either a bare artist id string, or an object naming the artist and the role to filter by.
+*/
+type ArtistSongsRequest struct {
+	ArtistId string `json:"artistId"`
+	Role     string `json:"role"`
+}
+
+func (request *ArtistSongsRequest) UnmarshalJSON(data []byte) error {
+	var id string
+	if json.Unmarshal(data, &id) == nil {
+		request.ArtistId = id
+		return nil
+	}
+
+	type plainArtistSongsRequest ArtistSongsRequest
+	return json.Unmarshal(data, (*plainArtistSongsRequest)(request))
+}
+
+/*
+Lists the songs the artist is credited on, in the given role when there is one.
+*/
+func (state *State) getArtistSongs(request *ArtistSongsRequest) ([]string, error) {
+	if request.Role != "" && !validCreditRole(request.Role) {
+		return nil, &ValidationError{"role", fmt.Sprintf("'%s' is not a role", request.Role)}
+	}
+
+	songIds, err := state.songs.GetArtistSongs(request.ArtistId)
+	if err != nil || request.Role == "" {
+		return songIds, err
+	}
+
+	filtered := make([]string, 0, len(songIds))
+	for _, id := range songIds {
+		song, err := state.songs.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if hasCredit(song.ArtistId, song.Credits, request.ArtistId, request.Role) {
+			filtered = append(filtered, id)
+		}
+	}
+
+	return filtered, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A date known to the year, the month or the day, such as a birthdate.
+It is written as "YYYY", "YYYY-MM" or "YYYY-MM-DD". The zero PartialDate means no date was given.
+*/
+type PartialDate struct {
+	Year  int
+	Month int
+	Day   int
+
+	// A date stored before dates were parsed that cannot be read, kept as it was.
+	// It is written back as the same string, and refused by validate.
+	legacy string
+}
+
+func (date PartialDate) IsZero() bool {
+	return date == PartialDate{}
+}
+
+func (date PartialDate) String() string {
+	switch {
+	case date.legacy != "":
+		return date.legacy
+	case date.Year == 0:
+		return ""
+	case date.Month == 0:
+		return fmt.Sprintf("%04d", date.Year)
+	case date.Day == 0:
+		return fmt.Sprintf("%04d-%02d", date.Year, date.Month)
+	}
+
+	return fmt.Sprintf("%04d-%02d-%02d", date.Year, date.Month, date.Day)
+}
+
+func (date PartialDate) validate(field string) error {
+	if date.legacy != "" {
+		_, err := parsePartialDate(date.legacy)
+		if err != nil {
+			return &ValidationError{field, err.Error()}
+		}
+	}
+
+	return nil
+}
+
+/*
+Whether the date is before other, compared to the precision both dates have,
+so 1990 is neither before nor after 1990-05.
+*/
+func (date PartialDate) Before(other PartialDate) bool {
+	if date.Year != other.Year {
+		return date.Year < other.Year
+	}
+	if date.Month == 0 || other.Month == 0 || date.Month != other.Month {
+		return date.Month != 0 && other.Month != 0 && date.Month < other.Month
+	}
+
+	return date.Day != 0 && other.Day != 0 && date.Day < other.Day
+}
+
+/*
+Whether the date falls between from and to, both included and compared like Before.
+A zero from or to leaves that end open.
+*/
+func (date PartialDate) Within(from, to PartialDate) bool {
+	return (from.IsZero() || !date.Before(from)) && (to.IsZero() || !to.Before(date))
+}
+
+func (date *PartialDate) UnmarshalJSON(data []byte) error {
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return err
+	}
+
+	date.setText(text)
+
+	return nil
+}
+
+func (date PartialDate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(date.String())
+}
+
+/*
+Sets the date from its string form, keeping text that cannot be parsed as a legacy date.
+*/
+func (date *PartialDate) setText(text string) {
+	parsed, err := parsePartialDate(text)
+	if err != nil {
+		*date = PartialDate{legacy: text}
+		return
+	}
+
+	*date = parsed
+}
+
+func parsePartialDate(text string) (PartialDate, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return PartialDate{}, nil
+	}
+
+	invalid := fmt.Errorf("'%s' is not YYYY, YYYY-MM or YYYY-MM-DD", text)
+
+	parts := strings.Split(text, "-")
+	if len(parts) > 3 || len(parts[0]) != 4 {
+		return PartialDate{}, invalid
+	}
+
+	var values [3]int
+	for i, part := range parts {
+		if i > 0 && len(part) != 2 {
+			return PartialDate{}, invalid
+		}
+
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 {
+			return PartialDate{}, invalid
+		}
+
+		values[i] = value
+	}
+
+	date := PartialDate{Year: values[0], Month: values[1], Day: values[2]}
+
+	if date.Year == 0 || len(parts) > 1 && (date.Month < 1 || date.Month > 12) {
+		return PartialDate{}, invalid
+	}
+	if len(parts) > 2 {
+		// Normalizing the date moves days past the end of the month into the next one.
+		full := time.Date(date.Year, time.Month(date.Month), date.Day, 0, 0, 0, 0, time.UTC)
+		if date.Day < 1 || full.Day() != date.Day {
+			return PartialDate{}, fmt.Errorf("'%s' is not a day of the month", text)
+		}
+	}
+
+	return date, nil
+}
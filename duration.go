@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+A length of time in whole seconds, such as the running time of a song.
+It is written as "m:ss", or "h:mm:ss" from an hour on, and read from those forms,
+from a number of seconds, or from a string of seconds. The zero Duration means no time was given.
+*/
+type Duration struct {
+	Seconds int64
+
+	// A time stored before times were parsed that cannot be read, kept as it was.
+	// It is written back as the same string, and refused by validate.
+	legacy string
+}
+
+func (duration Duration) IsZero() bool {
+	return duration == Duration{}
+}
+
+func (duration Duration) String() string {
+	if duration.legacy != "" {
+		return duration.legacy
+	}
+	if duration.Seconds == 0 {
+		return ""
+	}
+
+	hours := duration.Seconds / 3600
+	minutes := duration.Seconds / 60 % 60
+	seconds := duration.Seconds % 60
+
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+	}
+
+	return fmt.Sprintf("%d:%02d", minutes, seconds)
+}
+
+func (duration Duration) validate(field string) error {
+	if duration.Seconds < 0 {
+		return &ValidationError{field, "must not be negative"}
+	}
+
+	if duration.legacy != "" {
+		_, err := parseDuration(duration.legacy)
+		if err != nil {
+			return &ValidationError{field, err.Error()}
+		}
+	}
+
+	return nil
+}
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var seconds int64
+	if json.Unmarshal(data, &seconds) == nil {
+		if seconds < 0 {
+			return fmt.Errorf("Negative duration %d", seconds)
+		}
+
+		*duration = Duration{Seconds: seconds}
+		return nil
+	}
+
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return err
+	}
+
+	duration.setText(text)
+
+	return nil
+}
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(duration.String())
+}
+
+/*
+Sets the duration from its string form, keeping text that cannot be parsed as a legacy time.
+*/
+func (duration *Duration) setText(text string) {
+	seconds, err := parseDuration(text)
+	if err != nil {
+		*duration = Duration{legacy: text}
+		return
+	}
+
+	*duration = Duration{Seconds: seconds}
+}
+
+/*
+Parses "mm:ss", "h:mm:ss" or a number of seconds.
+*/
+func parseDuration(text string) (int64, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return 0, nil
+	}
+
+	parts := strings.Split(text, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("'%s' is not mm:ss, h:mm:ss or seconds", text)
+	}
+
+	var seconds int64
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("'%s' is not mm:ss, h:mm:ss or seconds", text)
+		}
+
+		// Only the leading part may exceed its unit, and the ones after it have two digits.
+		if i > 0 && (value >= 60 || len(part) != 2) {
+			return 0, fmt.Errorf("'%s' is not mm:ss, h:mm:ss or seconds", text)
+		}
+
+		seconds = seconds*60 + int64(value)
+	}
+
+	return seconds, nil
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+/*
+A genre of music. Genres form a tree through ParentId, an empty ParentId is a top level genre.
+Aliases are other names the genre is known by, and are matched like the name.
+*/
+type Genre struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Aliases  []string `json:"aliases,omitempty"`
+	ParentId string   `json:"parentId"`
+	Version  int64    `json:"version"`
+}
+
+func (genre *Genre) clone() *Genre {
+	return &Genre{
+		Id:       genre.Id,
+		Name:     genre.Name,
+		Aliases:  append([]string(nil), genre.Aliases...),
+		ParentId: genre.ParentId,
+		Version:  genre.Version,
+	}
+}
+
+/*
+Checks the fields of a genre that is added or updated.
+*/
+func (genre *Genre) validate() error {
+	if normalizeGenreName(genre.Name) == "" {
+		return &ValidationError{"name", "must have a letter or digit"}
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range genre.names() {
+		key := normalizeGenreName(name)
+		if key == "" {
+			return &ValidationError{"aliases", "must have a letter or digit"}
+		}
+		if seen[key] {
+			return &ValidationError{"aliases", fmt.Sprintf("'%s' is given twice", name)}
+		}
+
+		seen[key] = true
+	}
+
+	if genre.ParentId != "" && genre.ParentId == genre.Id {
+		return &ValidationError{"parentId", "a genre cannot be its own parent"}
+	}
+
+	return nil
+}
+
+/*
+The name and aliases of the genre.
+*/
+func (genre *Genre) names() []string {
+	return append([]string{genre.Name}, genre.Aliases...)
+}
+
+/*
+Reduces a genre name to its letters and digits in lower case,
+so "Hip-Hop", "hip hop" and "HipHop" are the same name.
+*/
+func normalizeGenreName(name string) string {
+	var builder strings.Builder
+	for _, letter := range name {
+		if unicode.IsLetter(letter) || unicode.IsDigit(letter) {
+			builder.WriteRune(unicode.ToLower(letter))
+		}
+	}
+
+	return builder.String()
+}
+
+/*
+Returned when a genre name or alias matches one of another genre.
+*/
+type GenreNameTakenError struct {
+	Name    string
+	GenreId string
+}
+
+func (err *GenreNameTakenError) Error() string {
+	return fmt.Sprintf("Genre name '%s' is taken by genre '%s'", err.Name, err.GenreId)
+}
+
+/*
+GenreStore is the storage backend behind the genre end points.
+Genres is the in memory implementation.
+*/
+type GenreStore interface {
+	Add(genre *Genre) error
+	Update(genre *Genre) error
+	Revert(genre *Genre) error
+	Remove(id string) error
+	Get(id string) (*Genre, error)
+	GetAll() ([]string, error)
+}
+
+var _ GenreStore = (*Genres)(nil)
+
+type Genres struct {
+	sync.RWMutex
+	genres map[string]*Genre
+}
+
+func NewGenres() *Genres {
+	genres := &Genres{
+		genres: make(map[string]*Genre),
+	}
+
+	return genres
+}
+
+func (state *Genres) Add(genre *Genre) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.genres[genre.Id]; ok {
+		return errors.New("Genre by 'id' already exists")
+	}
+
+	stored := genre.clone()
+	stored.Version = 1
+	state.genres[genre.Id] = stored
+
+	return nil
+}
+
+func (state *Genres) Update(genre *Genre) error {
+	state.Lock()
+	defer state.Unlock()
+
+	oldGenre, ok := state.genres[genre.Id]
+	if !ok {
+		return errors.New("Unable to update genre, given genre Id does not exist")
+	}
+
+	err := checkVersion("genre", genre.Id, genre.Version, oldGenre.Version)
+	if err != nil {
+		return err
+	}
+
+	stored := genre.clone()
+	stored.Version = oldGenre.Version + 1
+	state.genres[genre.Id] = stored
+
+	return nil
+}
+
+/*
+Stores the genre exactly as given, version included, replacing any current copy.
+Used to undo changes.
+*/
+func (state *Genres) Revert(genre *Genre) error {
+	state.Lock()
+	defer state.Unlock()
+
+	state.genres[genre.Id] = genre.clone()
+
+	return nil
+}
+
+func (state *Genres) Remove(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.genres[id]; !ok {
+		return errors.New("Genre does not exist")
+	}
+
+	delete(state.genres, id)
+
+	return nil
+}
+
+func (state *Genres) Get(id string) (*Genre, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	genre, ok := state.genres[id]
+	if !ok {
+		return nil, errors.New("Genre does not exist")
+	}
+
+	return genre.clone(), nil
+}
+
+func (state *Genres) GetAll() ([]string, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	ids := make([]string, 0, len(state.genres))
+	for id := range state.genres {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (state *Genres) snapshot(snap *catalogSnapshot) {
+	state.RLock()
+	defer state.RUnlock()
+
+	snap.Genres = make(map[string]*Genre, len(state.genres))
+	for id, genre := range state.genres {
+		snap.Genres[id] = genre.clone()
+	}
+}
+
+func (state *Genres) restore(snap *catalogSnapshot) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.genres = make(map[string]*Genre, len(snap.Genres))
+	for id, genre := range snap.Genres {
+		state.genres[id] = genre.clone()
+	}
+}
+
+/*
+Reads every genre, for the lookups that walk the tree or match names.
+*/
+func (state *State) allGenres() ([]*Genre, error) {
+	ids, err := state.genres.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	genres := make([]*Genre, 0, len(ids))
+	for _, id := range ids {
+		genre, err := state.genres.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		genres = append(genres, genre)
+	}
+
+	return genres, nil
+}
+
+/*
+Finds the genre with the given name or alias, nil when there is none.
+*/
+func (state *State) findGenre(name string) (*Genre, error) {
+	genres, err := state.allGenres()
+	if err != nil {
+		return nil, err
+	}
+
+	key := normalizeGenreName(name)
+	for _, genre := range genres {
+		for _, genreName := range genre.names() {
+			if normalizeGenreName(genreName) == key {
+				return genre, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (state *State) checkGenre(id string) error {
+	_, err := state.genres.Get(id)
+	if err != nil {
+		return &MissingReferenceError{"genre", id}
+	}
+
+	return nil
+}
+
+/*
+Checks that the names of a genre are free, and that its parent exists without making a cycle.
+*/
+func (state *State) checkGenreTree(genre *Genre) error {
+	genres, err := state.allGenres()
+	if err != nil {
+		return err
+	}
+
+	byId := make(map[string]*Genre, len(genres))
+	for _, other := range genres {
+		byId[other.Id] = other
+		if other.Id == genre.Id {
+			continue
+		}
+
+		for _, name := range genre.names() {
+			for _, otherName := range other.names() {
+				if normalizeGenreName(name) == normalizeGenreName(otherName) {
+					return &GenreNameTakenError{name, other.Id}
+				}
+			}
+		}
+	}
+
+	// Walk up from the parent, a tree has fewer steps than genres.
+	parentId := genre.ParentId
+	for steps := 0; parentId != ""; steps++ {
+		parent, ok := byId[parentId]
+		if !ok {
+			return &MissingReferenceError{"genre", parentId}
+		}
+		if parentId == genre.Id || steps > len(byId) {
+			return &ValidationError{"parentId", fmt.Sprintf("genre '%s' is below this genre", genre.ParentId)}
+		}
+
+		parentId = parent.ParentId
+	}
+
+	return nil
+}
+
+/*
+Lists the genre and every genre below it, the genre first.
+*/
+func (state *State) genreTree(id string) ([]string, error) {
+	genres, err := state.allGenres()
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[string][]string)
+	for _, genre := range genres {
+		if genre.ParentId != "" {
+			children[genre.ParentId] = append(children[genre.ParentId], genre.Id)
+		}
+	}
+
+	tree := []string{id}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+
+	return tree, nil
+}
+
+/*
+Points a song given a genre by name, as songs were before genres existed, at the matching genre.
+A song given a genre id takes the genre's name.
+*/
+func (state *State) resolveSongGenre(song *Song) error {
+	if song.GenreId == "" {
+		if song.Genre == "" {
+			return nil
+		}
+
+		genre, err := state.findGenre(song.Genre)
+		if err != nil || genre == nil {
+			return err
+		}
+
+		song.GenreId = genre.Id
+	}
+
+	genre, err := state.genres.Get(song.GenreId)
+	if err != nil {
+		return &MissingReferenceError{"genre", song.GenreId}
+	}
+
+	song.Genre = genre.Name
+
+	return nil
+}
+
+func (state *State) addGenre(actor string, genre *Genre) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.addGenre(genre)
+	})
+}
+
+func (state *State) updateGenre(actor string, genre *Genre) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.updateGenre(genre)
+	})
+}
+
+func (state *State) deleteGenre(actor, id string) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.deleteGenre(id)
+	})
+}
+
+func (tx *catalogTx) addGenre(genre *Genre) error {
+	err := genre.validate()
+	if err != nil {
+		return err
+	}
+
+	err = assignId(&genre.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkGenreTree(genre)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.genres.Add(genre)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.genres.Remove(genre.Id)
+	})
+
+	return tx.recordCurrent(REVISION_GENRE, genre.Id, REVISION_ADD)
+}
+
+func (tx *catalogTx) updateGenre(genre *Genre) error {
+	err := genre.validate()
+	if err != nil {
+		return err
+	}
+
+	old, err := tx.state.genres.Get(genre.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkGenreTree(genre)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.genres.Update(genre)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.genres.Revert(old)
+	})
+
+	err = tx.recordCurrent(REVISION_GENRE, genre.Id, REVISION_UPDATE)
+	if err != nil {
+		return err
+	}
+
+	// Songs carry the name of their genre, so a rename goes to them too.
+	// The lookup fails when the genre has no songs.
+	songIds, _ := tx.state.songs.GetGenreSongs(genre.Id)
+	for _, songId := range songIds {
+		changed, err := tx.refreshSongGenre(songId)
+		if err != nil {
+			return err
+		}
+
+		if changed {
+			err = tx.recordCurrent(REVISION_SONG, songId, REVISION_UPDATE)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Gives the song the current name of its genre. When the genre is gone the song
+no longer refers to it, and keeps the name as its free text genre.
+Returns whether the song changed.
+*/
+func (tx *catalogTx) refreshSongGenre(songId string) (bool, error) {
+	old, err := tx.state.songs.Get(songId)
+	if err != nil {
+		return false, err
+	}
+	if old.GenreId == "" {
+		return false, nil
+	}
+
+	song := old.clone()
+	genre, err := tx.state.genres.Get(song.GenreId)
+	if err != nil {
+		song.GenreId = ""
+	} else if song.Genre != genre.Name {
+		song.Genre = genre.Name
+	} else {
+		return false, nil
+	}
+	old = old.clone()
+
+	err = tx.state.songs.Update(song)
+	if err != nil {
+		return false, err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.songs.Revert(old)
+	})
+
+	return true, nil
+}
+
+/*
+Removes a genre for good, genres have no trash.
+A genre with sub-genres or songs cannot be deleted. Songs in the trash do not count,
+they lose the genre when restored, see refreshSongGenre.
+*/
+func (tx *catalogTx) deleteGenre(id string) error {
+	old, err := tx.state.genres.Get(id)
+	if err != nil {
+		return err
+	}
+
+	tree, err := tx.state.genreTree(id)
+	if err != nil {
+		return err
+	}
+
+	// The lookup fails when the genre has no songs.
+	songIds, _ := tx.state.songs.GetGenreSongs(id)
+	if len(tree)-1+len(songIds) > 0 {
+		return &DeleteRestrictedError{"genre", id, len(tree) - 1 + len(songIds)}
+	}
+
+	err = tx.state.genres.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.genres.Revert(old)
+	})
+
+	return tx.recordRevision(REVISION_GENRE, id, REVISION_DELETE, old)
+}
+
+/*
+Lists the songs of a genre and of every genre below it.
+*/
+func (state *State) getGenreSongs(id string) ([]string, error) {
+	_, err := state.genres.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := state.genreTree(id)
+	if err != nil {
+		return nil, err
+	}
+
+	songIds := make([]string, 0)
+	for _, genreId := range tree {
+		// The lookup fails when the genre has no songs.
+		ids, _ := state.songs.GetGenreSongs(genreId)
+		songIds = append(songIds, ids...)
+	}
+
+	return songIds, nil
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+/*
+The tags read from an MP3 file, see ReadID3.
+AlbumArtist is empty unless the file names one apart from the artist.
+Track and Disc are zero when not tagged, and Duration is zero when the length could not be worked out.
+*/
+type ID3Tags struct {
+	Title       string   `json:"title"`
+	Artist      string   `json:"artist"`
+	AlbumArtist string   `json:"albumArtist,omitempty"`
+	Album       string   `json:"album"`
+	Genre       string   `json:"genre"`
+	Track       int      `json:"track"`
+	Disc        int      `json:"disc"`
+	Duration    Duration `json:"duration"`
+}
+
+/*
+The genres of ID3v1 by number, with the Winamp extensions.
+ID3v2 tags refer to them as "(17)" or "17".
+*/
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop",
+	"Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B", "Rap",
+	"Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska", "Death Metal", "Pranks",
+	"Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance",
+	"Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock",
+	"Ethnic", "Gothic", "Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap", "Pop/Funk", "Jungle",
+	"Native American", "Cabaret", "New Wave", "Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi",
+	"Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+	"Folk", "Folk-Rock", "National Folk", "Swing", "Fast Fusion", "Bebob", "Latin", "Revival",
+	"Celtic", "Bluegrass", "Avantgarde", "Gothic Rock", "Progressive Rock", "Psychedelic Rock", "Symphonic Rock", "Slow Rock",
+	"Big Band", "Chorus", "Easy Listening", "Acoustic", "Humour", "Speech", "Chanson", "Opera",
+	"Chamber Music", "Sonata", "Symphony", "Booty Bass", "Primus", "Porn Groove", "Satire", "Slow Jam",
+	"Club", "Tango", "Samba", "Folklore", "Ballad", "Power Ballad", "Rhythmic Soul", "Freestyle",
+	"Duet", "Punk Rock", "Drum Solo", "A capella", "Euro-House", "Dance Hall",
+}
+
+/*
+The ID3v2 text frames read, by the field they fill.
+ID3v2.2 names frames with three letters, later versions with four.
+*/
+var id3v22Frames = map[string]string{
+	"TT2": "title", "TP1": "artist", "TP2": "albumArtist", "TAL": "album",
+	"TCO": "genre", "TRK": "track", "TPA": "disc", "TLE": "length",
+}
+
+var id3v23Frames = map[string]string{
+	"TIT2": "title", "TPE1": "artist", "TPE2": "albumArtist", "TALB": "album",
+	"TCON": "genre", "TRCK": "track", "TPOS": "disc", "TLEN": "length",
+}
+
+/*
+Reads the ID3v2 and ID3v1 tags of the MP3 file of the given size.
+ID3v2 tags of versions 2.2 to 2.4 are read, and ID3v1 fills what they leave out.
+The duration is taken from the TLEN frame, or else from the MPEG audio frames.
+Fails when the file has neither tags nor MPEG audio.
+*/
+func ReadID3(file io.ReaderAt, size int64) (*ID3Tags, error) {
+	tags := new(ID3Tags)
+	fields := make(map[string]string)
+
+	// Where the audio frames start and end, between the tags.
+	audioStart, audioEnd := int64(0), size
+	tagged := false
+
+	header := make([]byte, 10)
+	if n, _ := file.ReadAt(header, 0); n == 10 && bytes.HasPrefix(header, []byte("ID3")) {
+		tagSize := int64(syncsafe(header[6:10]))
+		if 10+tagSize > size {
+			return nil, errors.New("ID3v2 tag is longer than the file")
+		}
+
+		tag := make([]byte, tagSize)
+		_, err := file.ReadAt(tag, 10)
+		if err != nil {
+			return nil, err
+		}
+
+		readID3v2(header[3], header[5], tag, fields)
+
+		audioStart = 10 + tagSize
+		if header[3] == 4 && header[5]&0x10 != 0 {
+			// A footer repeats the header after the tag.
+			audioStart += 10
+		}
+		tagged = true
+	}
+
+	if size-audioStart >= 128 {
+		trailer := make([]byte, 128)
+		_, err := file.ReadAt(trailer, size-128)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.HasPrefix(trailer, []byte("TAG")) {
+			readID3v1(trailer, fields)
+			audioEnd = size - 128
+			tagged = true
+		}
+	}
+
+	tags.Title = fields["title"]
+	tags.Artist = fields["artist"]
+	tags.AlbumArtist = fields["albumArtist"]
+	if strings.EqualFold(tags.AlbumArtist, tags.Artist) {
+		tags.AlbumArtist = ""
+	}
+	tags.Album = fields["album"]
+	tags.Genre = id3Genre(fields["genre"])
+	tags.Track = leadingNumber(fields["track"])
+	tags.Disc = leadingNumber(fields["disc"])
+
+	if milliseconds := leadingNumber(fields["length"]); milliseconds > 0 {
+		// Rounded to the nearest second, without overflowing a length near the largest int.
+		tags.Duration = Duration{Seconds: int64(milliseconds/1000 + milliseconds%1000/500)}
+		return tags, nil
+	}
+
+	seconds, ok := mpegDuration(file, audioStart, audioEnd)
+	if !ok && !tagged {
+		return nil, errors.New("Not an MP3 file")
+	}
+	tags.Duration = Duration{Seconds: seconds}
+
+	return tags, nil
+}
+
+/*
+Reads a 28 bit integer stored 7 bits to a byte, as ID3v2 stores sizes.
+*/
+func syncsafe(data []byte) int {
+	size := 0
+	for _, b := range data {
+		size = size<<7 | int(b&0x7f)
+	}
+
+	return size
+}
+
+/*
+Undoes unsynchronisation, which puts a zero byte after every 0xff byte.
+*/
+func removeUnsync(data []byte) []byte {
+	return bytes.Replace(data, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+/*
+Reads the text frames of an ID3v2 tag of the given major version into fields,
+keeping the first of each. tag is the tag after its 10 byte header.
+*/
+func readID3v2(version, flags byte, tag []byte, fields map[string]string) {
+	if version < 2 || version > 4 {
+		return
+	}
+	// In ID3v2.2 the flag marks a compression scheme that was never defined.
+	if version == 2 && flags&0x40 != 0 {
+		return
+	}
+
+	// Before ID3v2.4 unsynchronisation applies to the whole tag, from it to each frame.
+	if flags&0x80 != 0 && version < 4 {
+		tag = removeUnsync(tag)
+	}
+
+	if flags&0x40 != 0 && len(tag) >= 4 {
+		var extended int
+		if version == 3 {
+			extended = 4 + int(binary.BigEndian.Uint32(tag))
+		} else {
+			extended = syncsafe(tag[:4])
+		}
+		if extended > len(tag) {
+			return
+		}
+		tag = tag[extended:]
+	}
+
+	names := id3v23Frames
+	headerSize := 10
+	if version == 2 {
+		names = id3v22Frames
+		headerSize = 6
+	}
+
+	for len(tag) >= headerSize && tag[0] != 0 {
+		var id string
+		var size int
+		var formatFlags byte
+
+		switch version {
+		case 2:
+			id = string(tag[:3])
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			id = string(tag[:4])
+			size = int(binary.BigEndian.Uint32(tag[4:8]))
+			formatFlags = tag[9]
+		default:
+			id = string(tag[:4])
+			size = syncsafe(tag[4:8])
+			formatFlags = tag[9]
+		}
+
+		if size < 0 || headerSize+size > len(tag) {
+			return
+		}
+		data := tag[headerSize : headerSize+size]
+		tag = tag[headerSize+size:]
+
+		field, ok := names[id]
+		if !ok || fields[field] != "" {
+			continue
+		}
+
+		switch version {
+		case 3:
+			// Compressed or encrypted frames are skipped, a grouping byte leads the data.
+			if formatFlags&0xc0 != 0 {
+				continue
+			}
+			if formatFlags&0x20 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+		case 4:
+			if formatFlags&0x0c != 0 {
+				continue
+			}
+			if formatFlags&0x40 != 0 && len(data) > 0 {
+				data = data[1:]
+			}
+			if formatFlags&0x01 != 0 && len(data) >= 4 {
+				data = data[4:]
+			}
+			if formatFlags&0x02 != 0 || flags&0x80 != 0 {
+				data = removeUnsync(data)
+			}
+		}
+
+		fields[field] = decodeID3Text(data)
+	}
+}
+
+/*
+Decodes the text of an ID3v2 text frame, led by a byte naming its encoding.
+Only the first of several values is kept.
+*/
+func decodeID3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	var text string
+	switch data[0] {
+	case 1, 2:
+		text = decodeUTF16(data[1:], data[0] == 2)
+	case 3:
+		text = string(data[1:])
+	default:
+		text = decodeLatin1(data[1:])
+	}
+
+	if end := strings.IndexByte(text, 0); end >= 0 {
+		text = text[:end]
+	}
+
+	return strings.TrimSpace(text)
+}
+
+/*
+Decodes UTF-16 text, big endian unless a byte order mark says otherwise.
+*/
+func decodeUTF16(data []byte, bigEndian bool) string {
+	order := binary.ByteOrder(binary.BigEndian)
+	if !bigEndian && len(data) >= 2 {
+		switch {
+		case data[0] == 0xff && data[1] == 0xfe:
+			order = binary.LittleEndian
+			data = data[2:]
+		case data[0] == 0xfe && data[1] == 0xff:
+			data = data[2:]
+		}
+	}
+
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		unit := order.Uint16(data[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+
+	return string(runes)
+}
+
+/*
+Reads the 128 byte ID3v1 tag at the end of a file into the fields ID3v2 left empty.
+ID3v1.1 keeps the track number in the last byte of the comment.
+*/
+func readID3v1(tag []byte, fields map[string]string) {
+	text := func(data []byte) string {
+		if end := bytes.IndexByte(data, 0); end >= 0 {
+			data = data[:end]
+		}
+		return strings.TrimSpace(decodeLatin1(data))
+	}
+
+	v1 := map[string]string{
+		"title":  text(tag[3:33]),
+		"artist": text(tag[33:63]),
+		"album":  text(tag[63:93]),
+	}
+	if comment := tag[97:127]; comment[28] == 0 && comment[29] != 0 {
+		v1["track"] = strconv.Itoa(int(comment[29]))
+	}
+	if genre := int(tag[127]); genre < len(id3v1Genres) {
+		v1["genre"] = strconv.Itoa(genre)
+	}
+
+	for field, value := range v1 {
+		if fields[field] == "" {
+			fields[field] = value
+		}
+	}
+}
+
+/*
+Reads a genre as ID3v2 writes it: a name, a number of an ID3v1 genre,
+or such a number in parentheses, followed by a more specific name.
+*/
+func id3Genre(text string) string {
+	if strings.HasPrefix(text, "((") {
+		// An escaped parenthesis starting a name.
+		return text[1:]
+	}
+
+	if strings.HasPrefix(text, "(") {
+		end := strings.IndexByte(text, ')')
+		if end > 0 {
+			refinement := strings.TrimSpace(text[end+1:])
+			if refinement != "" && !strings.HasPrefix(refinement, "(") {
+				return refinement
+			}
+			text = text[1:end]
+		}
+	}
+
+	switch text {
+	case "RX":
+		return "Remix"
+	case "CR":
+		return "Cover"
+	}
+
+	if number, err := strconv.Atoi(text); err == nil {
+		if number >= 0 && number < len(id3v1Genres) {
+			return id3v1Genres[number]
+		}
+		return ""
+	}
+
+	return text
+}
+
+/*
+Reads the number a text starts with, such as 3 from the track "3/12".
+Zero when there is none, or when it has too many digits for an int.
+*/
+func leadingNumber(text string) int {
+	end := 0
+	for end < len(text) && '0' <= text[end] && text[end] <= '9' {
+		end++
+	}
+
+	number, err := strconv.Atoi(text[:end])
+	if err != nil {
+		return 0
+	}
+
+	return number
+}
+
+/*
+Kilobits per second by bitrate index, for MPEG-1 and then MPEG-2 and 2.5, by layer.
+*/
+var mpegBitrates = [2][3][15]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+}
+
+/*
+Samples per second by sample rate index, for MPEG-1, 2 and 2.5.
+*/
+var mpegSampleRates = [3][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+	{11025, 12000, 8000},
+}
+
+/*
+The header of an MPEG audio frame.
+version is 0 for MPEG-1, 1 for MPEG-2 and 2 for MPEG-2.5.
+*/
+type mpegFrame struct {
+	version    int
+	layer      int
+	bitrate    int
+	sampleRate int
+	padding    int
+	mono       bool
+}
+
+func parseMpegFrame(header []byte) (*mpegFrame, bool) {
+	if len(header) < 4 || header[0] != 0xff || header[1]&0xe0 != 0xe0 {
+		return nil, false
+	}
+
+	versionBits := header[1] >> 3 & 3
+	layerBits := header[1] >> 1 & 3
+	bitrateIndex := int(header[2] >> 4)
+	rateIndex := int(header[2] >> 2 & 3)
+	// Reserved values, and free format bitrates, which cannot be timed.
+	if versionBits == 1 || layerBits == 0 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return nil, false
+	}
+
+	frame := &mpegFrame{
+		layer:   4 - int(layerBits),
+		padding: int(header[2] >> 1 & 1),
+		mono:    header[3]>>6 == 3,
+	}
+	switch versionBits {
+	case 3:
+		frame.version = 0
+	case 2:
+		frame.version = 1
+	default:
+		frame.version = 2
+	}
+
+	frame.bitrate = mpegBitrates[minInt(frame.version, 1)][frame.layer-1][bitrateIndex] * 1000
+	frame.sampleRate = mpegSampleRates[frame.version][rateIndex]
+
+	return frame, true
+}
+
+func (frame *mpegFrame) samples() int {
+	switch {
+	case frame.layer == 1:
+		return 384
+	case frame.layer == 3 && frame.version != 0:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+/*
+The length of the frame in bytes, header included.
+*/
+func (frame *mpegFrame) length() int {
+	if frame.layer == 1 {
+		return (12*frame.bitrate/frame.sampleRate + frame.padding) * 4
+	}
+
+	return frame.samples()/8*frame.bitrate/frame.sampleRate + frame.padding
+}
+
+/*
+Where the Xing or Info header of a variable bitrate file sits in its first frame, after the side information.
+*/
+func (frame *mpegFrame) xingOffset() int {
+	switch {
+	case frame.version == 0 && !frame.mono:
+		return 4 + 32
+	case frame.version == 0 || !frame.mono:
+		return 4 + 17
+	default:
+		return 4 + 9
+	}
+}
+
+/*
+Works out the playing time of the MPEG audio between start and end, in whole seconds.
+The frame count of a Xing, Info or VBRI header gives the time of variable bitrate files,
+otherwise the bitrate of the first frame is taken for the whole file.
+*/
+func mpegDuration(file io.ReaderAt, start, end int64) (int64, bool) {
+	buffer := make([]byte, 64<<10)
+	if int64(len(buffer)) > end-start {
+		buffer = buffer[:maxInt(int(end-start), 0)]
+	}
+	n, _ := file.ReadAt(buffer, start)
+	buffer = buffer[:n]
+
+	for i := 0; i+4 <= len(buffer); i++ {
+		frame, ok := parseMpegFrame(buffer[i:])
+		if !ok {
+			continue
+		}
+
+		// A sync word inside other data is not followed by another frame.
+		next := i + frame.length()
+		if next+4 <= len(buffer) {
+			if _, ok := parseMpegFrame(buffer[next:]); !ok {
+				continue
+			}
+		}
+
+		frames := 0
+		if offset := i + frame.xingOffset(); offset+12 <= len(buffer) {
+			tag := string(buffer[offset : offset+4])
+			if (tag == "Xing" || tag == "Info") && buffer[offset+7]&1 != 0 {
+				frames = int(binary.BigEndian.Uint32(buffer[offset+8:]))
+			}
+		}
+		if offset := i + 4 + 32; offset+18 <= len(buffer) && string(buffer[offset:offset+4]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(buffer[offset+14:]))
+		}
+
+		if frames > 0 {
+			samples := int64(frames) * int64(frame.samples())
+			return (samples + int64(frame.sampleRate)/2) / int64(frame.sampleRate), true
+		}
+
+		bits := (end - start - int64(i)) * 8
+		return (bits + int64(frame.bitrate)/2) / int64(frame.bitrate), true
+	}
+
+	return 0, false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+)
+
+/*
+A text frame of an ID3v2 tag of the given version, with the text in the encoding named by its first byte.
+*/
+func id3Frame(version byte, id string, flags byte, data []byte) []byte {
+	switch version {
+	case 2:
+		return append([]byte{id[0], id[1], id[2], byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+	case 3:
+		frame := append([]byte(id), 0, 0, 0, 0, 0, flags)
+		binary.BigEndian.PutUint32(frame[4:], uint32(len(data)))
+		return append(frame, data...)
+	default:
+		frame := append([]byte(id), 0, 0, 0, 0, 0, flags)
+		copy(frame[4:], syncsafeBytes(len(data)))
+		return append(frame, data...)
+	}
+}
+
+func latin1Frame(version byte, id, text string) []byte {
+	return id3Frame(version, id, 0, append([]byte{0}, text...))
+}
+
+func syncsafeBytes(size int) []byte {
+	return []byte{byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+}
+
+func id3v2Tag(version byte, frames ...[]byte) []byte {
+	// Padding follows the frames.
+	body := append(bytes.Join(frames, nil), make([]byte, 16)...)
+	header := append([]byte{'I', 'D', '3', version, 0, 0}, syncsafeBytes(len(body))...)
+	return append(header, body...)
+}
+
+func id3v1Tag(title, artist, album string, track, genre byte) []byte {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[3:33], title)
+	copy(tag[33:63], artist)
+	copy(tag[63:93], album)
+	tag[126] = track
+	tag[127] = genre
+	return tag
+}
+
+/*
+About the given number of seconds of 128 kbit/s MPEG-1 layer 3 frames at 44.1 kHz.
+*/
+func mpegFrames(seconds int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+	return bytes.Repeat(frame, seconds*128000/8/len(frame))
+}
+
+func TestReadID3(test *testing.T) {
+	utf16Title := []byte{1, 0xff, 0xfe}
+	for _, unit := range utf16.Encode([]rune("Ünïcødé")) {
+		utf16Title = append(utf16Title, byte(unit), byte(unit>>8))
+	}
+
+	// A Xing header counting 1000 frames of 1152 samples, in a frame with room for it.
+	vbr := make([]byte, 417)
+	copy(vbr, []byte{0xff, 0xfb, 0x90, 0x00})
+	copy(vbr[36:], "Xing\x00\x00\x00\x01\x00\x00\x03\xe8")
+	vbr = append(vbr, mpegFrames(1)...)
+
+	cases := []struct {
+		name string
+		file []byte
+		tags ID3Tags
+	}{
+		{
+			"ID3v2.3 over ID3v1",
+			bytes.Join([][]byte{
+				id3v2Tag(3,
+					latin1Frame(3, "TIT2", "Song Title"),
+					latin1Frame(3, "TPE1", "Some Artist"),
+					latin1Frame(3, "TPE2", "Various Artists"),
+					latin1Frame(3, "TALB", "Some Album"),
+					latin1Frame(3, "TCON", "(17)"),
+					latin1Frame(3, "TRCK", "2/10"),
+					latin1Frame(3, "TPOS", "1/2"),
+				),
+				mpegFrames(3),
+				id3v1Tag("Other Title", "Other Artist", "Other Album", 7, 8),
+			}, nil),
+			ID3Tags{Title: "Song Title", Artist: "Some Artist", AlbumArtist: "Various Artists", Album: "Some Album",
+				Genre: "Rock", Track: 2, Disc: 1, Duration: Duration{Seconds: 3}},
+		},
+		{
+			"ID3v2.2 with a length",
+			append(id3v2Tag(2,
+				latin1Frame(2, "TT2", "Old Title"),
+				latin1Frame(2, "TP1", "Old Artist"),
+				latin1Frame(2, "TAL", "Old Album"),
+				latin1Frame(2, "TCO", "(13)Synth Pop"),
+				latin1Frame(2, "TLE", "215400"),
+			), mpegFrames(1)...),
+			ID3Tags{Title: "Old Title", Artist: "Old Artist", Album: "Old Album", Genre: "Synth Pop", Duration: Duration{Seconds: 215}},
+		},
+		{
+			"ID3v2.4 in UTF-16 and UTF-8",
+			append(id3v2Tag(4,
+				id3Frame(4, "TIT2", 0, utf16Title),
+				id3Frame(4, "TPE1", 0, []byte("\x03Bjørk\x00Someone Else")),
+				// With a data length indicator before the text.
+				id3Frame(4, "TALB", 0x01, append(syncsafeBytes(10), "\x03Homogenic"...)),
+				latin1Frame(4, "TCON", "52"),
+				latin1Frame(4, "TRCK", "4"),
+			), mpegFrames(2)...),
+			ID3Tags{Title: "Ünïcødé", Artist: "Bjørk", Album: "Homogenic", Genre: "Electronic", Track: 4, Duration: Duration{Seconds: 2}},
+		},
+		{
+			"ID3v1.1 with a Xing header",
+			append(vbr, id3v1Tag("V1 Title", "V1 Artist", "V1 Album", 5, 8)...),
+			ID3Tags{Title: "V1 Title", Artist: "V1 Artist", Album: "V1 Album", Genre: "Jazz", Track: 5, Duration: Duration{Seconds: 26}},
+		},
+		{
+			"ID3v2.3 with a length too large for an int",
+			append(id3v2Tag(3,
+				latin1Frame(3, "TIT2", "Long Title"),
+				latin1Frame(3, "TLEN", "99999999999999999999"),
+			), mpegFrames(2)...),
+			ID3Tags{Title: "Long Title", Duration: Duration{Seconds: 2}},
+		},
+		{
+			"ID3v2.3 with the largest length",
+			append(id3v2Tag(3,
+				latin1Frame(3, "TIT2", "Longest Title"),
+				latin1Frame(3, "TLEN", "9223372036854775807"),
+			), mpegFrames(1)...),
+			ID3Tags{Title: "Longest Title", Duration: Duration{Seconds: 9223372036854776}},
+		},
+		{
+			"Untagged",
+			mpegFrames(4),
+			ID3Tags{Duration: Duration{Seconds: 4}},
+		},
+	}
+
+	for _, c := range cases {
+		tags, err := ReadID3(bytes.NewReader(c.file), int64(len(c.file)))
+		if err != nil {
+			test.Errorf("%s: unable to read tags: %s", c.name, err)
+			continue
+		}
+		if *tags != c.tags {
+			test.Errorf("%s: expected %#v, got %#v", c.name, c.tags, *tags)
+		}
+		if err := tags.Duration.validate("time"); err != nil {
+			test.Errorf("%s: expected a valid duration: %s", c.name, err)
+		}
+	}
+
+	if _, err := ReadID3(bytes.NewReader([]byte("not an mp3 file")), 15); err == nil {
+		test.Errorf("Expected an error reading a text file")
+	}
+
+	if err := (Duration{Seconds: -1}).validate("time"); err == nil {
+		test.Errorf("Expected a negative duration to be invalid")
+	}
+}
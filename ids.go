@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+Crockford's base32 alphabet, which leaves out I, L, O and U.
+*/
+const ID_ALPHABET = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+/*
+Returned for an add that names its own id while the refuseClientIds setting is on.
+*/
+var ClientIdRefusedError = errors.New("Ids are assigned by the server, leave 'id' empty")
+
+/*
+Generates ULIDs: 48 bits of milliseconds since the epoch followed by 80 random bits,
+written as 26 characters of base32. Ids sort in the order they were generated,
+also within the same millisecond, where the random part is incremented instead.
+*/
+type idGenerator struct {
+	sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+var idGen idGenerator
+
+func newId() (string, error) {
+	return idGen.next(time.Now())
+}
+
+func (generator *idGenerator) next(now time.Time) (string, error) {
+	generator.Lock()
+	defer generator.Unlock()
+
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+
+	if ms <= generator.lastMs {
+		// Keep ids monotonic, also when the clock steps back.
+		ms = generator.lastMs
+		if !incrementEntropy(&generator.entropy) {
+			return "", errors.New("Id space of this millisecond is exhausted")
+		}
+	} else {
+		_, err := rand.Read(generator.entropy[:])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	generator.lastMs = ms
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> uint(40-8*i))
+	}
+	copy(id[6:], generator.entropy[:])
+
+	return encodeId(id), nil
+}
+
+func incrementEntropy(entropy *[10]byte) bool {
+	for i := len(entropy) - 1; i >= 0; i-- {
+		entropy[i]++
+		if entropy[i] != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Encodes 128 bits as 26 base32 characters, the first holding only the top 3 bits.
+*/
+func encodeId(id [16]byte) string {
+	var encoded [26]byte
+
+	// Walk the bits from the least significant end, 5 at a time.
+	var buffer uint
+	var bits uint
+	pos := len(encoded) - 1
+	for i := len(id) - 1; i >= 0; i-- {
+		buffer |= uint(id[i]) << bits
+		bits += 8
+
+		for bits >= 5 {
+			encoded[pos] = ID_ALPHABET[buffer&31]
+			pos--
+			buffer >>= 5
+			bits -= 5
+		}
+	}
+	encoded[pos] = ID_ALPHABET[buffer&31]
+
+	return string(encoded[:])
+}
+
+/*
+Fills in a generated id when the client left it empty, or refuses the client's id
+when the refuseClientIds setting is on.
+*/
+func assignId(id *string) error {
+	if *id != "" {
+		if GetConfig().GetRefuseClientIds() {
+			return ClientIdRefusedError
+		}
+
+		return nil
+	}
+
+	generated, err := newId()
+	if err != nil {
+		return err
+	}
+
+	*id = generated
+
+	return nil
+}
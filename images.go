@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+The largest image accepted by an upload, in bytes.
+*/
+const MAX_IMAGE_SIZE = 10 << 20
+
+/*
+The most pixels an uploaded image may have, so that decoding it for a thumbnail stays cheap.
+*/
+const MAX_IMAGE_PIXELS = 50 << 20
+
+/*
+The content types accepted by an upload, with the image format that decodes them.
+*/
+var imageFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+}
+
+/*
+An uploaded image, as returned by the upload end points.
+Id is the hex SHA-256 of the file, so the same file always gets the same id.
+*/
+type Image struct {
+	Id          string `json:"id"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int    `json:"size"`
+}
+
+/*
+Checks the id of an image or audio file, the hex SHA-256 of the file.
+*/
+func validateMediaId(field, id string) error {
+	if id == "" {
+		return nil
+	}
+
+	if len(id) != sha256.Size*2 {
+		return &ValidationError{field, "must be the hex SHA-256 of the file"}
+	}
+
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return &ValidationError{field, "must be the hex SHA-256 of the file"}
+		}
+	}
+
+	return nil
+}
+
+/*
+Returned by an upload when there is no directory to keep media in, see Config.GetMediaDir.
+*/
+var MediaDisabledError = errors.New("Uploads are disabled, no mediaDir or dataDir is set")
+
+/*
+Images keeps image files on local disk, named by the hash of their content.
+A file is written once, however often it is uploaded, and never changes.
+Images are not removed when nothing refers to them any more.
+An empty directory keeps no images, see MediaDisabledError.
+*/
+type Images struct {
+	dir string
+	// Held while generating a thumbnail, so a burst of requests for a new one only decodes the image once.
+	thumbnailLock sync.Mutex
+}
+
+func NewImages(dir string) *Images {
+	return &Images{dir: dir}
+}
+
+/*
+Files are spread over subdirectories named by the first two characters of the id.
+*/
+func (images *Images) path(id string) string {
+	return filepath.Join(images.dir, id[:2], id)
+}
+
+/*
+Checks that data is a JPEG or PNG image and stores it, unless it is already stored.
+*/
+func (images *Images) Put(data []byte) (*Image, error) {
+	if images.dir == "" {
+		return nil, MediaDisabledError
+	}
+
+	contentType := http.DetectContentType(data)
+	format, ok := imageFormats[contentType]
+	if !ok {
+		return nil, &ValidationError{"image", "must be a JPEG or PNG image"}
+	}
+
+	imageConfig, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return nil, &ValidationError{"image", "cannot be decoded"}
+	}
+	if imageConfig.Width*imageConfig.Height > MAX_IMAGE_PIXELS {
+		return nil, &ValidationError{"image", "has too many pixels"}
+	}
+
+	sum := sha256.Sum256(data)
+	stored := &Image{
+		Id:          hex.EncodeToString(sum[:]),
+		ContentType: contentType,
+		Width:       imageConfig.Width,
+		Height:      imageConfig.Height,
+		Size:        len(data),
+	}
+
+	path := images.path(stored.Id)
+	if _, err := os.Stat(path); err == nil {
+		return stored, nil
+	}
+
+	err = writeFileAtomic(path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+/*
+Writes the file aside and renames it into place, so a partly written file is never served.
+*/
+func writeFileAtomic(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), ".upload-")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return nil
+}
+
+/*
+Opens the stored image file.
+*/
+func (images *Images) Open(id string) (*os.File, error) {
+	if validateMediaId("imageId", id) != nil || id == "" || images.dir == "" {
+		return nil, errors.New("Image does not exist")
+	}
+
+	file, err := os.Open(images.path(id))
+	if err != nil {
+		return nil, errors.New("Image does not exist")
+	}
+
+	return file, nil
+}
+
+func (state *State) checkImage(id string) error {
+	file, err := state.images.Open(id)
+	if err != nil {
+		return &MissingReferenceError{"image", id}
+	}
+
+	return file.Close()
+}
+
+/*
+Stores the image and makes it the cover art of the album.
+A zero version replaces the cover whatever the album's version is.
+*/
+func (state *State) setAlbumImage(actor, albumId string, version int64, data []byte) (*Image, error) {
+	stored, err := state.images.Put(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = state.transact(actor, func(tx *catalogTx) error {
+		album, err := tx.state.albums.Get(albumId)
+		if err != nil {
+			return err
+		}
+
+		album = album.clone()
+		album.ImageId = stored.Id
+		album.Version = version
+
+		return tx.updateAlbum(album)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+/*
+Stores the image and makes it the photo of the artist, see setAlbumImage.
+*/
+func (state *State) setArtistImage(actor, artistId string, version int64, data []byte) (*Image, error) {
+	stored, err := state.images.Put(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = state.transact(actor, func(tx *catalogTx) error {
+		artist, err := tx.state.artists.Get(artistId)
+		if err != nil {
+			return err
+		}
+
+		artist = artist.clone()
+		artist.ImageId = stored.Id
+		artist.Version = version
+
+		return tx.updateArtist(artist)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io"
+	"strings"
+)
+
+/*
+What an import did with an artist, album or song.
+*/
+const (
+	IMPORT_CREATED = "created"
+	IMPORT_MATCHED = "matched"
+	IMPORT_SKIPPED = "skipped"
+)
+
+/*
+An artist, album or song an import created or matched.
+Kind is "artist", "album" or "song", like the kinds of revisions.
+*/
+type ImportedRecord struct {
+	Kind   string `json:"kind"`
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+/*
+The result of importing one MP3 file, as returned by /importSong.
+Status is what happened to the song: created, matched, or skipped with the reason.
+File is only set by the import command, to the path it read.
+*/
+type ImportReport struct {
+	File    string           `json:"file,omitempty"`
+	Tags    *ID3Tags         `json:"tags"`
+	AudioId string           `json:"audioId"`
+	Status  string           `json:"status"`
+	Reason  string           `json:"reason,omitempty"`
+	Records []ImportedRecord `json:"records"`
+}
+
+func (report *ImportReport) record(kind, id, name, status string) {
+	for _, record := range report.Records {
+		if record.Kind == kind && record.Id == id {
+			return
+		}
+	}
+
+	report.Records = append(report.Records, ImportedRecord{kind, id, name, status})
+}
+
+func (report *ImportReport) skip(reason string) *ImportReport {
+	report.Status = IMPORT_SKIPPED
+	report.Reason = reason
+	report.Records = nil
+	return report
+}
+
+/*
+Names match ignoring case and surrounding spaces.
+*/
+func sameName(a, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+/*
+Stores the MP3 file read from body and files it under the artist, album and song its ID3 tags name.
+Artists are matched by name, albums by name among the albums of their artist and songs by name
+among the songs of their album, and whatever does not exist yet is created.
+A matched song without audio gets the file. Files missing a title, artist or album are skipped,
+as are songs whose track is taken, and nothing is created for them.
+The stored file is removed again when no song ends up with it.
+*/
+func (state *State) importSong(actor string, body io.Reader) (*ImportReport, error) {
+	stored, err := state.audio.Put(body, GetConfig().GetMaxAudioSize())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{AudioId: stored.Id, Records: []ImportedRecord{}}
+	defer func() {
+		// A created song has the file, a matched one only when it had no audio yet.
+		if report.Status != IMPORT_CREATED {
+			state.releaseAudio(stored)
+		}
+	}()
+
+	if stored.ContentType != "audio/mpeg" {
+		return nil, &ValidationError{"audio", "must be an MP3 file"}
+	}
+
+	file, _, err := state.audio.Open(stored.Id)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := ReadID3(file, stored.Size)
+	file.Close()
+	if err != nil {
+		return nil, &ValidationError{"audio", err.Error()}
+	}
+
+	report.Tags = tags
+
+	switch {
+	case strings.TrimSpace(tags.Title) == "":
+		return report.skip("The file has no title tag"), nil
+	case strings.TrimSpace(tags.Artist) == "":
+		return report.skip("The file has no artist tag"), nil
+	case strings.TrimSpace(tags.Album) == "":
+		return report.skip("The file has no album tag"), nil
+	}
+
+	err = state.transact(actor, func(tx *catalogTx) error {
+		artist, err := tx.importArtist(tags.Artist, report)
+		if err != nil {
+			return err
+		}
+
+		albumArtist := artist
+		if tags.AlbumArtist != "" {
+			albumArtist, err = tx.importArtist(tags.AlbumArtist, report)
+			if err != nil {
+				return err
+			}
+		}
+
+		album, err := tx.importAlbum(albumArtist.Id, tags.Album, report)
+		if err != nil {
+			return err
+		}
+
+		return tx.importSong(artist.Id, album.Id, tags, stored.Id, report)
+	})
+
+	switch err.(type) {
+	case nil:
+		return report, nil
+	case *TrackTakenError, *ValidationError:
+		return report.skip(err.Error()), nil
+	default:
+		return nil, err
+	}
+}
+
+func (tx *catalogTx) importArtist(name string, report *ImportReport) (*Artist, error) {
+	ids, err := tx.state.artists.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		artist, err := tx.state.artists.Get(id)
+		if err == nil && sameName(artist.Name, name) {
+			report.record(REVISION_ARTIST, artist.Id, artist.Name, IMPORT_MATCHED)
+			return artist, nil
+		}
+	}
+
+	artist := &Artist{Name: strings.TrimSpace(name)}
+	err = tx.addArtist(artist)
+	if err != nil {
+		return nil, err
+	}
+
+	report.record(REVISION_ARTIST, artist.Id, artist.Name, IMPORT_CREATED)
+	return artist, nil
+}
+
+func (tx *catalogTx) importAlbum(artistId, name string, report *ImportReport) (*Album, error) {
+	// Fails when the artist has no albums yet.
+	ids, _ := tx.state.albums.GetArtistAlbums(artistId)
+
+	for _, id := range ids {
+		album, err := tx.state.albums.Get(id)
+		if err == nil && sameName(album.Name, name) {
+			report.record(REVISION_ALBUM, album.Id, album.Name, IMPORT_MATCHED)
+			return album, nil
+		}
+	}
+
+	album := &Album{Name: strings.TrimSpace(name), ArtistId: artistId}
+	err := tx.addAlbum(album)
+	if err != nil {
+		return nil, err
+	}
+
+	report.record(REVISION_ALBUM, album.Id, album.Name, IMPORT_CREATED)
+	return album, nil
+}
+
+func (tx *catalogTx) importSong(artistId, albumId string, tags *ID3Tags, audioId string, report *ImportReport) error {
+	// Fails when the album has no songs yet.
+	ids, _ := tx.state.songs.GetAlbumSongs(albumId)
+
+	for _, id := range ids {
+		song, err := tx.state.songs.Get(id)
+		if err != nil || !sameName(song.Name, tags.Title) {
+			continue
+		}
+
+		if song.AudioId == "" {
+			song = song.clone()
+			song.AudioId = audioId
+			song.Version = 0
+
+			err = tx.updateSong(song)
+			if err != nil {
+				return err
+			}
+		}
+
+		report.Status = IMPORT_MATCHED
+		report.record(REVISION_SONG, song.Id, song.Name, IMPORT_MATCHED)
+		return nil
+	}
+
+	song := &Song{
+		Name:     strings.TrimSpace(tags.Title),
+		Genre:    tags.Genre,
+		Time:     tags.Duration,
+		Disc:     tags.Disc,
+		Track:    tags.Track,
+		AlbumId:  albumId,
+		ArtistId: artistId,
+		AudioId:  audioId,
+	}
+	err := tx.addSong(song)
+	if err != nil {
+		return err
+	}
+
+	report.Status = IMPORT_CREATED
+	report.record(REVISION_SONG, song.Id, song.Name, IMPORT_CREATED)
+	return nil
+}
@@ -1,13 +1,39 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
+/*
+Commands run instead of the server when named as the first argument.
+*/
+var commands = map[string]func(args []string) int{
+	"check":  checkCommand,
+	"import": importCommand,
+}
+
 func main() {
-	ch := make(chan os.Signal)
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command %s\n", os.Args[1])
+			os.Exit(2)
+		}
+
+		os.Exit(command(os.Args[2:]))
+	}
+
+	state := NewStore(nil)
+
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	<-ch
+
+	err := state.Close()
+	if err != nil {
+		state.log.Error("Error closing store: %s", err)
+	}
 }
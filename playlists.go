@@ -0,0 +1,499 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+An ordered list of songs kept by its owner. A song may be listed more than once,
+so songs in a playlist are addressed by their position, counted from 0.
+*/
+type Playlist struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Owner       string   `json:"owner"`
+	SongIds     []string `json:"songIds"`
+	Version     int64    `json:"version"`
+}
+
+func (playlist *Playlist) clone() *Playlist {
+	return &Playlist{
+		Id:          playlist.Id,
+		Name:        playlist.Name,
+		Description: playlist.Description,
+		Owner:       playlist.Owner,
+		SongIds:     append([]string{}, playlist.SongIds...),
+		Version:     playlist.Version,
+	}
+}
+
+func (playlist *Playlist) validate() error {
+	if strings.TrimSpace(playlist.Name) == "" {
+		return &ValidationError{"name", "must not be empty"}
+	}
+
+	return nil
+}
+
+/*
+Checks a position to insert at, which may be one past the last song.
+*/
+func (playlist *Playlist) checkInsert(position int) error {
+	if position < 0 || position > len(playlist.SongIds) {
+		return &ValidationError{"position", fmt.Sprintf("%d is outside the playlist of %d songs", position, len(playlist.SongIds))}
+	}
+
+	return nil
+}
+
+/*
+Checks the position of a song in the playlist.
+*/
+func (playlist *Playlist) checkPosition(field string, position int) error {
+	if position < 0 || position >= len(playlist.SongIds) {
+		return &ValidationError{field, fmt.Sprintf("%d is outside the playlist of %d songs", position, len(playlist.SongIds))}
+	}
+
+	return nil
+}
+
+/*
+PlaylistStore is the storage backend behind the playlist end points.
+Playlists is the in memory implementation.
+*/
+type PlaylistStore interface {
+	Add(playlist *Playlist) error
+	Update(playlist *Playlist) error
+	Revert(playlist *Playlist) error
+	Remove(id string) error
+	Get(id string) (*Playlist, error)
+	GetAll() ([]string, error)
+}
+
+var _ PlaylistStore = (*Playlists)(nil)
+
+type Playlists struct {
+	sync.RWMutex
+	playlists map[string]*Playlist
+}
+
+func NewPlaylists() *Playlists {
+	playlists := &Playlists{
+		playlists: make(map[string]*Playlist),
+	}
+
+	return playlists
+}
+
+func (state *Playlists) Add(playlist *Playlist) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.playlists[playlist.Id]; ok {
+		return errors.New("Playlist by 'id' already exists")
+	}
+
+	stored := playlist.clone()
+	stored.Version = 1
+	state.playlists[playlist.Id] = stored
+
+	return nil
+}
+
+func (state *Playlists) Update(playlist *Playlist) error {
+	state.Lock()
+	defer state.Unlock()
+
+	oldPlaylist, ok := state.playlists[playlist.Id]
+	if !ok {
+		return errors.New("Unable to update playlist, given playlist Id does not exist")
+	}
+
+	err := checkVersion("playlist", playlist.Id, playlist.Version, oldPlaylist.Version)
+	if err != nil {
+		return err
+	}
+
+	stored := playlist.clone()
+	stored.Version = oldPlaylist.Version + 1
+	state.playlists[playlist.Id] = stored
+
+	return nil
+}
+
+/*
+Stores the playlist exactly as given, version included, replacing any current copy.
+Used to undo changes.
+*/
+func (state *Playlists) Revert(playlist *Playlist) error {
+	state.Lock()
+	defer state.Unlock()
+
+	state.playlists[playlist.Id] = playlist.clone()
+
+	return nil
+}
+
+func (state *Playlists) Remove(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.playlists[id]; !ok {
+		return errors.New("Playlist does not exist")
+	}
+
+	delete(state.playlists, id)
+
+	return nil
+}
+
+func (state *Playlists) Get(id string) (*Playlist, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	playlist, ok := state.playlists[id]
+	if !ok {
+		return nil, errors.New("Playlist does not exist")
+	}
+
+	return playlist.clone(), nil
+}
+
+func (state *Playlists) GetAll() ([]string, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	ids := make([]string, 0, len(state.playlists))
+	for id := range state.playlists {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (state *Playlists) snapshot(snap *catalogSnapshot) {
+	state.RLock()
+	defer state.RUnlock()
+
+	snap.Playlists = make(map[string]*Playlist, len(state.playlists))
+	for id, playlist := range state.playlists {
+		snap.Playlists[id] = playlist.clone()
+	}
+}
+
+func (state *Playlists) restore(snap *catalogSnapshot) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.playlists = make(map[string]*Playlist, len(snap.Playlists))
+	for id, playlist := range snap.Playlists {
+		state.playlists[id] = playlist.clone()
+	}
+}
+
+/*
+Body of /renamePlaylist. The description is left as it is when not given.
+*/
+type PlaylistRenameRequest struct {
+	PlaylistId  string  `json:"playlistId"`
+	Name        string  `json:"name"`
+	Description *string `json:"description"`
+	Version     int64   `json:"version"`
+}
+
+/*
+Body of /appendToPlaylist and /insertIntoPlaylist.
+The songs are appended when no position is given.
+*/
+type PlaylistSongsRequest struct {
+	PlaylistId string   `json:"playlistId"`
+	SongIds    []string `json:"songIds"`
+	Position   *int     `json:"position"`
+	Version    int64    `json:"version"`
+}
+
+/*
+Body of /movePlaylistSong, moving the song at From so it ends up at To.
+*/
+type PlaylistMoveRequest struct {
+	PlaylistId string `json:"playlistId"`
+	From       int    `json:"from"`
+	To         int    `json:"to"`
+	Version    int64  `json:"version"`
+}
+
+/*
+Body of /removeFromPlaylist.
+*/
+type PlaylistRemoveRequest struct {
+	PlaylistId string `json:"playlistId"`
+	Position   int    `json:"position"`
+	Version    int64  `json:"version"`
+}
+
+/*
+A change to one playlist, as made by the playlist edit end points.
+*/
+type playlistEdit interface {
+	playlistId() string
+	version() *int64
+	apply(state *State, playlist *Playlist) error
+}
+
+func (request *PlaylistRenameRequest) playlistId() string { return request.PlaylistId }
+func (request *PlaylistRenameRequest) version() *int64    { return &request.Version }
+
+func (request *PlaylistRenameRequest) apply(state *State, playlist *Playlist) error {
+	playlist.Name = request.Name
+	if request.Description != nil {
+		playlist.Description = *request.Description
+	}
+
+	return nil
+}
+
+func (request *PlaylistSongsRequest) playlistId() string { return request.PlaylistId }
+func (request *PlaylistSongsRequest) version() *int64    { return &request.Version }
+
+func (request *PlaylistSongsRequest) apply(state *State, playlist *Playlist) error {
+	err := state.checkPlaylistSongs(request.SongIds)
+	if err != nil {
+		return err
+	}
+
+	if request.Position == nil {
+		playlist.SongIds = append(playlist.SongIds, request.SongIds...)
+		return nil
+	}
+
+	position := *request.Position
+	err = playlist.checkInsert(position)
+	if err != nil {
+		return err
+	}
+
+	songIds := make([]string, 0, len(playlist.SongIds)+len(request.SongIds))
+	songIds = append(songIds, playlist.SongIds[:position]...)
+	songIds = append(songIds, request.SongIds...)
+	playlist.SongIds = append(songIds, playlist.SongIds[position:]...)
+
+	return nil
+}
+
+func (request *PlaylistMoveRequest) playlistId() string { return request.PlaylistId }
+func (request *PlaylistMoveRequest) version() *int64    { return &request.Version }
+
+func (request *PlaylistMoveRequest) apply(state *State, playlist *Playlist) error {
+	err := playlist.checkPosition("from", request.From)
+	if err != nil {
+		return err
+	}
+
+	err = playlist.checkPosition("to", request.To)
+	if err != nil {
+		return err
+	}
+
+	songId := playlist.SongIds[request.From]
+	songIds := append(playlist.SongIds[:request.From:request.From], playlist.SongIds[request.From+1:]...)
+
+	moved := make([]string, 0, len(playlist.SongIds))
+	moved = append(moved, songIds[:request.To]...)
+	moved = append(moved, songId)
+	playlist.SongIds = append(moved, songIds[request.To:]...)
+
+	return nil
+}
+
+func (request *PlaylistRemoveRequest) playlistId() string { return request.PlaylistId }
+func (request *PlaylistRemoveRequest) version() *int64    { return &request.Version }
+
+func (request *PlaylistRemoveRequest) apply(state *State, playlist *Playlist) error {
+	err := playlist.checkPosition("position", request.Position)
+	if err != nil {
+		return err
+	}
+
+	playlist.SongIds = append(playlist.SongIds[:request.Position:request.Position], playlist.SongIds[request.Position+1:]...)
+
+	return nil
+}
+
+func (state *State) checkPlaylistSongs(songIds []string) error {
+	for _, id := range songIds {
+		err := state.checkSong(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (state *State) addPlaylist(actor string, playlist *Playlist) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.addPlaylist(playlist)
+	})
+}
+
+func (state *State) editPlaylist(actor string, edit playlistEdit) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.editPlaylist(edit)
+	})
+}
+
+func (state *State) deletePlaylist(actor, id string) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.deletePlaylist(id)
+	})
+}
+
+/*
+Adds a playlist, owned by the actor when no owner is given.
+*/
+func (tx *catalogTx) addPlaylist(playlist *Playlist) error {
+	err := playlist.validate()
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkPlaylistSongs(playlist.SongIds)
+	if err != nil {
+		return err
+	}
+
+	err = assignId(&playlist.Id)
+	if err != nil {
+		return err
+	}
+
+	if playlist.Owner == "" {
+		playlist.Owner = tx.actor
+	}
+
+	err = tx.state.playlists.Add(playlist)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.playlists.Remove(playlist.Id)
+	})
+
+	return tx.recordCurrent(REVISION_PLAYLIST, playlist.Id, REVISION_ADD)
+}
+
+func (tx *catalogTx) editPlaylist(edit playlistEdit) error {
+	old, err := tx.state.playlists.Get(edit.playlistId())
+	if err != nil {
+		return err
+	}
+
+	playlist := old.clone()
+	playlist.Version = *edit.version()
+
+	err = edit.apply(tx.state, playlist)
+	if err != nil {
+		return err
+	}
+
+	return tx.updatePlaylist(old, playlist)
+}
+
+func (tx *catalogTx) updatePlaylist(old, playlist *Playlist) error {
+	err := playlist.validate()
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.playlists.Update(playlist)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.playlists.Revert(old)
+	})
+
+	return tx.recordCurrent(REVISION_PLAYLIST, playlist.Id, REVISION_UPDATE)
+}
+
+/*
+Removes a playlist for good, playlists have no trash.
+*/
+func (tx *catalogTx) deletePlaylist(id string) error {
+	old, err := tx.state.playlists.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.playlists.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.playlists.Revert(old)
+	})
+
+	return tx.recordRevision(REVISION_PLAYLIST, id, REVISION_DELETE, old)
+}
+
+/*
+Takes a deleted song out of every playlist listing it.
+Restoring the song does not put it back. Playlists are not indexed by their songs,
+so all of them are looked at.
+*/
+func (tx *catalogTx) dropPlaylistSong(songId string) error {
+	playlistIds, err := tx.state.playlists.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range playlistIds {
+		old, err := tx.state.playlists.Get(id)
+		if err != nil {
+			return err
+		}
+		if !containsString(old.SongIds, songId) {
+			continue
+		}
+
+		playlist := old.clone()
+		playlist.SongIds = make([]string, 0, len(old.SongIds))
+		for _, id := range old.SongIds {
+			if id != songId {
+				playlist.SongIds = append(playlist.SongIds, id)
+			}
+		}
+
+		err = tx.updatePlaylist(old, playlist)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Body of /insertIntoPlaylist, which needs the position.
+*/
+type playlistInsertRequest struct {
+	PlaylistSongsRequest
+}
+
+func (request *playlistInsertRequest) apply(state *State, playlist *Playlist) error {
+	if request.Position == nil {
+		return &ValidationError{"position", "is required"}
+	}
+
+	return request.PlaylistSongsRequest.apply(state, playlist)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Digits after the decimal point of the currencies that do not use two.
+*/
+var currencyExponents = map[string]int{
+	"BHD": 3,
+	"CLP": 0,
+	"ISK": 0,
+	"JOD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"VND": 0,
+}
+
+/*
+Currency symbols accepted in prices written as a string.
+*/
+var currencySymbols = map[string]string{
+	"$": "USD",
+	"€": "EUR",
+	"£": "GBP",
+	"¥": "JPY",
+}
+
+func currencyExponent(currency string) int {
+	if exponent, ok := currencyExponents[currency]; ok {
+		return exponent
+	}
+
+	return 2
+}
+
+/*
+A price as an ISO 4217 currency code and an amount in the currency's minor unit,
+so 9.99 USD is {"currency": "USD", "amount": 999}.
+The zero Price means no price was given.
+*/
+type Price struct {
+	Currency string `json:"currency"`
+	Amount   int64  `json:"amount"`
+
+	// A price stored before prices were structured that cannot be parsed, kept as it was.
+	// It is written back as the same string, and refused by validate.
+	legacy string
+}
+
+func (price Price) IsZero() bool {
+	return price == Price{}
+}
+
+/*
+Formats the price as a decimal amount and currency code, such as "9.99 USD".
+*/
+func (price Price) String() string {
+	if price.legacy != "" {
+		return price.legacy
+	}
+	if price.IsZero() {
+		return ""
+	}
+
+	exponent := currencyExponent(price.Currency)
+	if exponent == 0 {
+		return fmt.Sprintf("%d %s", price.Amount, price.Currency)
+	}
+
+	scale := int64(1)
+	for i := 0; i < exponent; i++ {
+		scale *= 10
+	}
+
+	return fmt.Sprintf("%d.%0*d %s", price.Amount/scale, exponent, price.Amount%scale, price.Currency)
+}
+
+func (price Price) validate() error {
+	if price.legacy != "" {
+		_, err := parsePrice(price.legacy)
+		return err
+	}
+	if price.IsZero() {
+		return nil
+	}
+
+	if len(price.Currency) != 3 || strings.ToUpper(price.Currency) != price.Currency {
+		return &ValidationError{"price", fmt.Sprintf("'%s' is not a currency code", price.Currency)}
+	}
+	for _, letter := range price.Currency {
+		if letter < 'A' || letter > 'Z' {
+			return &ValidationError{"price", fmt.Sprintf("'%s' is not a currency code", price.Currency)}
+		}
+	}
+
+	if price.Amount < 0 {
+		return &ValidationError{"price", "must not be negative"}
+	}
+
+	return nil
+}
+
+/*
+Accepts the object form, and the string form prices had before,
+such as "9.99", "$9.99" or "9.99 EUR". A plain number is in the configured default currency.
+*/
+func (price *Price) UnmarshalJSON(data []byte) error {
+	var text string
+	if json.Unmarshal(data, &text) == nil {
+		price.setText(text)
+		return nil
+	}
+
+	type plainPrice Price
+	return json.Unmarshal(data, (*plainPrice)(price))
+}
+
+func (price Price) MarshalJSON() ([]byte, error) {
+	if price.legacy != "" {
+		return json.Marshal(price.legacy)
+	}
+
+	type plainPrice Price
+	return json.Marshal(plainPrice(price))
+}
+
+/*
+Sets the price from its string form, keeping text that cannot be parsed as a legacy price.
+*/
+func (price *Price) setText(text string) {
+	parsed, err := parsePrice(text)
+	if err != nil {
+		*price = Price{legacy: text}
+		return
+	}
+
+	*price = parsed
+}
+
+func parsePrice(text string) (Price, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return Price{}, nil
+	}
+
+	currency := ""
+
+	for symbol, code := range currencySymbols {
+		if strings.HasPrefix(text, symbol) {
+			currency = code
+			text = strings.TrimSpace(strings.TrimPrefix(text, symbol))
+			break
+		}
+	}
+
+	if currency == "" {
+		fields := strings.Fields(text)
+		switch {
+		case len(fields) == 2 && isLetters(fields[0]):
+			currency, text = strings.ToUpper(fields[0]), fields[1]
+		case len(fields) == 2 && isLetters(fields[1]):
+			currency, text = strings.ToUpper(fields[1]), fields[0]
+		default:
+			currency = GetConfig().GetDefaultCurrency()
+		}
+	}
+
+	amount, err := parseMinorUnits(text, currencyExponent(currency))
+	if err != nil {
+		return Price{}, &ValidationError{"price", err.Error()}
+	}
+
+	price := Price{Currency: currency, Amount: amount}
+
+	return price, price.validate()
+}
+
+func isLetters(text string) bool {
+	for _, letter := range text {
+		if (letter < 'A' || letter > 'Z') && (letter < 'a' || letter > 'z') {
+			return false
+		}
+	}
+
+	return text != ""
+}
+
+/*
+Parses a decimal amount such as "9.99" into minor units, refusing more digits than the currency has.
+*/
+func parseMinorUnits(text string, exponent int) (int64, error) {
+	whole, fraction := text, ""
+	if dot := strings.IndexByte(text, '.'); dot != -1 {
+		whole, fraction = text[:dot], text[dot+1:]
+	}
+
+	if len(fraction) > exponent {
+		return 0, fmt.Errorf("'%s' has more than %d decimals", text, exponent)
+	}
+	for len(fraction) < exponent {
+		fraction += "0"
+	}
+
+	amount, err := strconv.ParseUint(whole+fraction, 10, 63)
+	if err != nil || whole == "" {
+		return 0, fmt.Errorf("'%s' is not an amount", text)
+	}
+
+	return int64(amount), nil
+}
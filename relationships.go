@@ -0,0 +1,465 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The kinds of relationship between two artists.
+Each reads from the artist to the related artist, the artist is a member of the related artist.
+*/
+const (
+	RELATIONSHIP_MEMBER_OF       = "member-of"
+	RELATIONSHIP_ALIAS_OF        = "alias-of"
+	RELATIONSHIP_SIDE_PROJECT_OF = "side-project-of"
+)
+
+func validRelationshipKind(kind string) bool {
+	switch kind {
+	case RELATIONSHIP_MEMBER_OF, RELATIONSHIP_ALIAS_OF, RELATIONSHIP_SIDE_PROJECT_OF:
+		return true
+	}
+
+	return false
+}
+
+/*
+A typed link from one artist to another.
+From and To are when a member joined and left, and are only given for member-of.
+*/
+type Relationship struct {
+	Id        string      `json:"id"`
+	Kind      string      `json:"kind"`
+	ArtistId  string      `json:"artistId"`
+	RelatedId string      `json:"relatedId"`
+	From      PartialDate `json:"from"`
+	To        PartialDate `json:"to"`
+	Version   int64       `json:"version"`
+}
+
+func (relationship *Relationship) clone() *Relationship {
+	relationshipCopy := *relationship
+	return &relationshipCopy
+}
+
+func (relationship *Relationship) validate() error {
+	if !validRelationshipKind(relationship.Kind) {
+		return &ValidationError{"kind", fmt.Sprintf("'%s' is not a relationship", relationship.Kind)}
+	}
+	if relationship.ArtistId == relationship.RelatedId {
+		return &ValidationError{"relatedId", "an artist cannot be related to itself"}
+	}
+
+	err := relationship.From.validate("from")
+	if err != nil {
+		return err
+	}
+
+	err = relationship.To.validate("to")
+	if err != nil {
+		return err
+	}
+
+	if relationship.Kind != RELATIONSHIP_MEMBER_OF && !(relationship.From.IsZero() && relationship.To.IsZero()) {
+		return &ValidationError{"from", "only members have dates"}
+	}
+	if !relationship.From.IsZero() && !relationship.To.IsZero() && relationship.To.Before(relationship.From) {
+		return &ValidationError{"to", "must not be before from"}
+	}
+
+	return nil
+}
+
+/*
+Whether both relationships link the same artists the same way at some common time.
+*/
+func (relationship *Relationship) overlaps(other *Relationship) bool {
+	if relationship.Kind != other.Kind || relationship.ArtistId != other.ArtistId || relationship.RelatedId != other.RelatedId {
+		return false
+	}
+
+	endsBefore := func(first, second *Relationship) bool {
+		return !first.To.IsZero() && first.To.Before(second.From)
+	}
+
+	return !endsBefore(relationship, other) && !endsBefore(other, relationship)
+}
+
+/*
+Returned when a relationship repeats one already stored for the same time.
+*/
+type RelationshipConflictError struct {
+	RelationshipId string
+}
+
+func (err *RelationshipConflictError) Error() string {
+	return fmt.Sprintf("Overlaps relationship '%s'", err.RelationshipId)
+}
+
+/*
+RelationshipStore is the storage backend behind the relationship end points.
+Relationships is the in memory implementation.
+*/
+type RelationshipStore interface {
+	Add(relationship *Relationship) error
+	Update(relationship *Relationship) error
+	Revert(relationship *Relationship) error
+	Remove(id string) error
+	Get(id string) (*Relationship, error)
+	GetAll() ([]string, error)
+	// Lists the relationships the artist is on either side of.
+	GetArtistRelationships(artistId string) ([]*Relationship, error)
+}
+
+var _ RelationshipStore = (*Relationships)(nil)
+
+type Relationships struct {
+	sync.RWMutex
+	relationships map[string]*Relationship
+}
+
+func NewRelationships() *Relationships {
+	relationships := &Relationships{
+		relationships: make(map[string]*Relationship),
+	}
+
+	return relationships
+}
+
+func (state *Relationships) Add(relationship *Relationship) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.relationships[relationship.Id]; ok {
+		return errors.New("Relationship by 'id' already exists")
+	}
+
+	stored := relationship.clone()
+	stored.Version = 1
+	state.relationships[relationship.Id] = stored
+
+	return nil
+}
+
+func (state *Relationships) Update(relationship *Relationship) error {
+	state.Lock()
+	defer state.Unlock()
+
+	oldRelationship, ok := state.relationships[relationship.Id]
+	if !ok {
+		return errors.New("Unable to update relationship, given relationship Id does not exist")
+	}
+
+	err := checkVersion("relationship", relationship.Id, relationship.Version, oldRelationship.Version)
+	if err != nil {
+		return err
+	}
+
+	stored := relationship.clone()
+	stored.Version = oldRelationship.Version + 1
+	state.relationships[relationship.Id] = stored
+
+	return nil
+}
+
+/*
+Stores the relationship exactly as given, version included, replacing any current copy.
+Used to undo changes.
+*/
+func (state *Relationships) Revert(relationship *Relationship) error {
+	state.Lock()
+	defer state.Unlock()
+
+	state.relationships[relationship.Id] = relationship.clone()
+
+	return nil
+}
+
+func (state *Relationships) Remove(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.relationships[id]; !ok {
+		return errors.New("Relationship does not exist")
+	}
+
+	delete(state.relationships, id)
+
+	return nil
+}
+
+func (state *Relationships) Get(id string) (*Relationship, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	relationship, ok := state.relationships[id]
+	if !ok {
+		return nil, errors.New("Relationship does not exist")
+	}
+
+	return relationship.clone(), nil
+}
+
+func (state *Relationships) GetAll() ([]string, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	ids := make([]string, 0, len(state.relationships))
+	for id := range state.relationships {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+/*
+Relationships are not indexed by artist, so all of them are looked at.
+*/
+func (state *Relationships) GetArtistRelationships(artistId string) ([]*Relationship, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	relationships := make([]*Relationship, 0)
+	for _, relationship := range state.relationships {
+		if relationship.ArtistId == artistId || relationship.RelatedId == artistId {
+			relationships = append(relationships, relationship.clone())
+		}
+	}
+
+	sortRelationships(relationships)
+
+	return relationships, nil
+}
+
+func (state *Relationships) snapshot(snap *catalogSnapshot) {
+	state.RLock()
+	defer state.RUnlock()
+
+	snap.Relationships = make(map[string]*Relationship, len(state.relationships))
+	for id, relationship := range state.relationships {
+		snap.Relationships[id] = relationship.clone()
+	}
+}
+
+func (state *Relationships) restore(snap *catalogSnapshot) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.relationships = make(map[string]*Relationship, len(snap.Relationships))
+	for id, relationship := range snap.Relationships {
+		state.relationships[id] = relationship.clone()
+	}
+}
+
+/*
+Sorts relationships by kind, then by when they began, then by id.
+*/
+func sortRelationships(relationships []*Relationship) {
+	sort.Slice(relationships, func(i, j int) bool {
+		first, second := relationships[i], relationships[j]
+		if first.Kind != second.Kind {
+			return first.Kind < second.Kind
+		}
+		if first.From != second.From {
+			return first.From.String() < second.From.String()
+		}
+		return first.Id < second.Id
+	})
+}
+
+/*
+Checks that both artists exist and that no stored relationship overlaps the given one.
+*/
+func (state *State) checkRelationship(relationship *Relationship) error {
+	err := state.checkArtist(relationship.ArtistId)
+	if err != nil {
+		return err
+	}
+
+	err = state.checkArtist(relationship.RelatedId)
+	if err != nil {
+		return err
+	}
+
+	others, err := state.relationships.GetArtistRelationships(relationship.ArtistId)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range others {
+		if other.Id != relationship.Id && relationship.overlaps(other) {
+			return &RelationshipConflictError{other.Id}
+		}
+	}
+
+	return nil
+}
+
+func (state *State) addRelationship(actor string, relationship *Relationship) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.addRelationship(relationship)
+	})
+}
+
+func (state *State) updateRelationship(actor string, relationship *Relationship) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.updateRelationship(relationship)
+	})
+}
+
+func (state *State) deleteRelationship(actor, id string) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.removeRelationship(id)
+	})
+}
+
+func (tx *catalogTx) addRelationship(relationship *Relationship) error {
+	err := relationship.validate()
+	if err != nil {
+		return err
+	}
+
+	err = assignId(&relationship.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkRelationship(relationship)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.relationships.Add(relationship)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.relationships.Remove(relationship.Id)
+	})
+
+	return tx.recordCurrent(REVISION_RELATIONSHIP, relationship.Id, REVISION_ADD)
+}
+
+func (tx *catalogTx) updateRelationship(relationship *Relationship) error {
+	err := relationship.validate()
+	if err != nil {
+		return err
+	}
+
+	old, err := tx.state.relationships.Get(relationship.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.checkRelationship(relationship)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.relationships.Update(relationship)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.relationships.Revert(old)
+	})
+
+	return tx.recordCurrent(REVISION_RELATIONSHIP, relationship.Id, REVISION_UPDATE)
+}
+
+/*
+Removes a relationship for good, relationships have no trash.
+*/
+func (tx *catalogTx) removeRelationship(id string) error {
+	old, err := tx.state.relationships.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.relationships.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.relationships.Revert(old)
+	})
+
+	return tx.recordRevision(REVISION_RELATIONSHIP, id, REVISION_DELETE, old)
+}
+
+/*
+Removes every relationship of a deleted artist.
+Restoring the artist does not bring them back.
+*/
+func (tx *catalogTx) dropArtistRelationships(artistId string) error {
+	relationships, err := tx.state.relationships.GetArtistRelationships(artistId)
+	if err != nil {
+		return err
+	}
+
+	for _, relationship := range relationships {
+		err := tx.removeRelationship(relationship.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (state *State) getArtistRelationships(artistId string) ([]*Relationship, error) {
+	err := state.checkArtist(artistId)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.relationships.GetArtistRelationships(artistId)
+}
+
+/*
+Body of /getLineup. The lineup is the current one when no date is given.
+*/
+type LineupRequest struct {
+	ArtistId string      `json:"artistId"`
+	At       PartialDate `json:"at"`
+}
+
+/*
+Lists the member-of relationships of the artist's members at the date, see PartialDate.Within.
+*/
+func (state *State) getLineup(request *LineupRequest) ([]*Relationship, error) {
+	err := request.At.validate("at")
+	if err != nil {
+		return nil, err
+	}
+
+	at := request.At
+	if at.IsZero() {
+		now := time.Now()
+		at = PartialDate{Year: now.Year(), Month: int(now.Month()), Day: now.Day()}
+	}
+
+	relationships, err := state.getArtistRelationships(request.ArtistId)
+	if err != nil {
+		return nil, err
+	}
+
+	lineup := make([]*Relationship, 0)
+	for _, relationship := range relationships {
+		if relationship.Kind == RELATIONSHIP_MEMBER_OF && relationship.RelatedId == request.ArtistId &&
+			at.Within(relationship.From, relationship.To) {
+			lineup = append(lineup, relationship)
+		}
+	}
+
+	return lineup, nil
+}
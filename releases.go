@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+The kinds of release an album can be.
+*/
+const (
+	RELEASE_ALBUM       = "album"
+	RELEASE_EP          = "ep"
+	RELEASE_SINGLE      = "single"
+	RELEASE_COMPILATION = "compilation"
+	RELEASE_LIVE        = "live"
+)
+
+func validReleaseType(releaseType string) bool {
+	switch releaseType {
+	case RELEASE_ALBUM, RELEASE_EP, RELEASE_SINGLE, RELEASE_COMPILATION, RELEASE_LIVE:
+		return true
+	}
+
+	return false
+}
+
+/*
+Whether an album released on the date falls between from and to, see PartialDate.Within.
+Albums without a release date are never in range.
+*/
+func releasedBetween(date, from, to PartialDate) bool {
+	return !date.IsZero() && date.Within(from, to)
+}
+
+/*
+Sorts albums newest release first, albums without a release date last.
+*/
+func sortReleases(albums []*Album) {
+	sort.Slice(albums, func(i, j int) bool {
+		if albums[i].ReleaseDate != albums[j].ReleaseDate {
+			return albums[i].ReleaseDate.String() > albums[j].ReleaseDate.String()
+		}
+		return albums[i].Id < albums[j].Id
+	})
+}
+
+/*
+Body of /getReleases. Either end may be left out.
+*/
+type ReleasesRequest struct {
+	From PartialDate `json:"from"`
+	To   PartialDate `json:"to"`
+}
+
+func (request *ReleasesRequest) validate() error {
+	err := request.From.validate("from")
+	if err != nil {
+		return err
+	}
+
+	err = request.To.validate("to")
+	if err != nil {
+		return err
+	}
+
+	if !request.From.IsZero() && !request.To.IsZero() && request.To.Before(request.From) {
+		return &ValidationError{"to", "must not be before from"}
+	}
+
+	return nil
+}
+
+func (state *State) getReleases(request *ReleasesRequest) ([]string, error) {
+	err := request.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return state.albums.GetReleases(request.From, request.To)
+}
+
+func (state *State) getLabelAlbums(labelId string) ([]string, error) {
+	_, err := state.labels.Get(labelId)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.albums.GetLabelAlbums(labelId)
+}
+
+/*
+A record label that releases albums.
+*/
+type Label struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Version int64  `json:"version"`
+}
+
+func (label *Label) clone() *Label {
+	labelCopy := *label
+	return &labelCopy
+}
+
+func (label *Label) validate() error {
+	if strings.TrimSpace(label.Name) == "" {
+		return &ValidationError{"name", "must not be empty"}
+	}
+
+	return nil
+}
+
+/*
+LabelStore is the storage backend behind the label end points.
+Labels is the in memory implementation.
+*/
+type LabelStore interface {
+	Add(label *Label) error
+	Update(label *Label) error
+	Revert(label *Label) error
+	Remove(id string) error
+	Get(id string) (*Label, error)
+	GetAll() ([]string, error)
+}
+
+var _ LabelStore = (*Labels)(nil)
+
+type Labels struct {
+	sync.RWMutex
+	labels map[string]*Label
+}
+
+func NewLabels() *Labels {
+	labels := &Labels{
+		labels: make(map[string]*Label),
+	}
+
+	return labels
+}
+
+func (state *Labels) Add(label *Label) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.labels[label.Id]; ok {
+		return errors.New("Label by 'id' already exists")
+	}
+
+	stored := label.clone()
+	stored.Version = 1
+	state.labels[label.Id] = stored
+
+	return nil
+}
+
+func (state *Labels) Update(label *Label) error {
+	state.Lock()
+	defer state.Unlock()
+
+	oldLabel, ok := state.labels[label.Id]
+	if !ok {
+		return errors.New("Unable to update label, given label Id does not exist")
+	}
+
+	err := checkVersion("label", label.Id, label.Version, oldLabel.Version)
+	if err != nil {
+		return err
+	}
+
+	stored := label.clone()
+	stored.Version = oldLabel.Version + 1
+	state.labels[label.Id] = stored
+
+	return nil
+}
+
+/*
+Stores the label exactly as given, version included, replacing any current copy.
+Used to undo changes.
+*/
+func (state *Labels) Revert(label *Label) error {
+	state.Lock()
+	defer state.Unlock()
+
+	state.labels[label.Id] = label.clone()
+
+	return nil
+}
+
+func (state *Labels) Remove(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.labels[id]; !ok {
+		return errors.New("Label does not exist")
+	}
+
+	delete(state.labels, id)
+
+	return nil
+}
+
+func (state *Labels) Get(id string) (*Label, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	label, ok := state.labels[id]
+	if !ok {
+		return nil, errors.New("Label does not exist")
+	}
+
+	return label.clone(), nil
+}
+
+func (state *Labels) GetAll() ([]string, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	ids := make([]string, 0, len(state.labels))
+	for id := range state.labels {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+func (state *Labels) snapshot(snap *catalogSnapshot) {
+	state.RLock()
+	defer state.RUnlock()
+
+	snap.Labels = make(map[string]*Label, len(state.labels))
+	for id, label := range state.labels {
+		snap.Labels[id] = label.clone()
+	}
+}
+
+func (state *Labels) restore(snap *catalogSnapshot) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.labels = make(map[string]*Label, len(snap.Labels))
+	for id, label := range snap.Labels {
+		state.labels[id] = label.clone()
+	}
+}
+
+func (state *State) checkLabel(id string) error {
+	_, err := state.labels.Get(id)
+	if err != nil {
+		return &MissingReferenceError{"label", id}
+	}
+
+	return nil
+}
+
+func (state *State) addLabel(actor string, label *Label) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.addLabel(label)
+	})
+}
+
+func (state *State) updateLabel(actor string, label *Label) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.updateLabel(label)
+	})
+}
+
+func (state *State) deleteLabel(actor, id string) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.deleteLabel(id)
+	})
+}
+
+func (tx *catalogTx) addLabel(label *Label) error {
+	err := label.validate()
+	if err != nil {
+		return err
+	}
+
+	err = assignId(&label.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.labels.Add(label)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.labels.Remove(label.Id)
+	})
+
+	return tx.recordCurrent(REVISION_LABEL, label.Id, REVISION_ADD)
+}
+
+func (tx *catalogTx) updateLabel(label *Label) error {
+	err := label.validate()
+	if err != nil {
+		return err
+	}
+
+	old, err := tx.state.labels.Get(label.Id)
+	if err != nil {
+		return err
+	}
+
+	err = tx.state.labels.Update(label)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.labels.Revert(old)
+	})
+
+	return tx.recordCurrent(REVISION_LABEL, label.Id, REVISION_UPDATE)
+}
+
+/*
+Removes a label for good, labels have no trash.
+A label that still has albums cannot be deleted.
+*/
+func (tx *catalogTx) deleteLabel(id string) error {
+	old, err := tx.state.labels.Get(id)
+	if err != nil {
+		return err
+	}
+
+	albumIds, err := tx.state.albums.GetLabelAlbums(id)
+	if err != nil {
+		return err
+	}
+	if len(albumIds) > 0 {
+		return &DeleteRestrictedError{"label", id, len(albumIds)}
+	}
+
+	err = tx.state.labels.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.labels.Revert(old)
+	})
+
+	return tx.recordRevision(REVISION_LABEL, id, REVISION_DELETE, old)
+}
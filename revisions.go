@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	REVISION_ARTIST       = "artist"
+	REVISION_ALBUM        = "album"
+	REVISION_SONG         = "song"
+	REVISION_GENRE        = "genre"
+	REVISION_PLAYLIST     = "playlist"
+	REVISION_LABEL        = "label"
+	REVISION_RELATIONSHIP = "relationship"
+
+	REVISION_ADD     = "add"
+	REVISION_UPDATE  = "update"
+	REVISION_DELETE  = "delete"
+	REVISION_RESTORE = "restore"
+	REVISION_PURGE   = "purge"
+)
+
+/*
+One change to an artist, album, song, genre, playlist, label or relationship.
+Data is the entity as it was after the change, or as it was deleted.
+A purge has no data.
+*/
+type Revision struct {
+	Kind   string          `json:"kind"`
+	Id     string          `json:"id"`
+	Number int             `json:"number"`
+	Time   time.Time       `json:"time"`
+	Actor  string          `json:"actor"`
+	Op     string          `json:"op"`
+	Data   json.RawMessage `json:"data"`
+}
+
+/*
+Whether the entity existed after this revision, outside of the trash.
+*/
+func (revision *Revision) live() bool {
+	switch revision.Op {
+	case REVISION_DELETE, REVISION_PURGE:
+		return false
+	}
+
+	return true
+}
+
+/*
+RevisionStore keeps the history of every artist, album, song, genre, playlist, label and relationship.
+Revisions is the in memory implementation.
+*/
+type RevisionStore interface {
+	// Appends a revision, numbering it after the last one of the entity.
+	Add(revision *Revision) error
+	// Drops the last revision of an entity, to undo an Add.
+	RemoveLast(kind, id string) error
+	// Lists the revisions of an entity, oldest first.
+	Get(kind, id string) ([]*Revision, error)
+}
+
+var _ RevisionStore = (*Revisions)(nil)
+
+type Revisions struct {
+	sync.RWMutex
+	revisions map[string][]*Revision
+}
+
+func NewRevisions() *Revisions {
+	revisions := &Revisions{
+		revisions: make(map[string][]*Revision),
+	}
+
+	return revisions
+}
+
+func revisionKey(kind, id string) string {
+	return kind + "/" + id
+}
+
+func (state *Revisions) Add(revision *Revision) error {
+	state.Lock()
+	defer state.Unlock()
+
+	key := revisionKey(revision.Kind, revision.Id)
+	revision.Number = len(state.revisions[key]) + 1
+
+	revisionCopy := *revision
+	state.revisions[key] = append(state.revisions[key], &revisionCopy)
+
+	return nil
+}
+
+func (state *Revisions) RemoveLast(kind, id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	key := revisionKey(kind, id)
+	revisions := state.revisions[key]
+	if len(revisions) == 0 {
+		return errors.New("Entity has no revisions")
+	}
+
+	if len(revisions) == 1 {
+		delete(state.revisions, key)
+	} else {
+		state.revisions[key] = revisions[:len(revisions)-1]
+	}
+
+	return nil
+}
+
+func (state *Revisions) Get(kind, id string) ([]*Revision, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	revisions, ok := state.revisions[revisionKey(kind, id)]
+	if !ok {
+		return nil, errors.New("Entity has no revisions")
+	}
+
+	revisionsCopy := make([]*Revision, len(revisions))
+	for i, revision := range revisions {
+		revisionCopy := *revision
+		revisionsCopy[i] = &revisionCopy
+	}
+
+	return revisionsCopy, nil
+}
+
+func (state *Revisions) snapshot(snap *catalogSnapshot) {
+	state.RLock()
+	defer state.RUnlock()
+
+	snap.Revisions = make(map[string][]*Revision, len(state.revisions))
+	for key, revisions := range state.revisions {
+		snap.Revisions[key] = append([]*Revision(nil), revisions...)
+	}
+}
+
+func (state *Revisions) restore(snap *catalogSnapshot) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.revisions = make(map[string][]*Revision, len(snap.Revisions))
+	for key, revisions := range snap.Revisions {
+		state.revisions[key] = append([]*Revision(nil), revisions...)
+	}
+}
+
+/*
+Names an entity, and for the diff and point in time end points the revisions or time to read.
+*/
+type RevisionRequest struct {
+	Kind string     `json:"kind"`
+	Id   string     `json:"id"`
+	From int        `json:"from"`
+	To   int        `json:"to"`
+	At   *time.Time `json:"at"`
+}
+
+/*
+A field that differs between two revisions, null where the field is missing.
+*/
+type FieldChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from"`
+	To    json.RawMessage `json:"to"`
+}
+
+/*
+Records a change to an entity in the revision history, as part of the transaction.
+*/
+func (tx *catalogTx) recordRevision(kind, id, op string, entity interface{}) error {
+	var data json.RawMessage
+	if entity != nil {
+		var err error
+		data, err = json.Marshal(entity)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tx.state.revisions.Add(&Revision{
+		Kind:  kind,
+		Id:    id,
+		Time:  tx.now,
+		Actor: tx.actor,
+		Op:    op,
+		Data:  data,
+	})
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.revisions.RemoveLast(kind, id)
+	})
+
+	return nil
+}
+
+/*
+Records the entity as it is now stored, so the revision holds the new version.
+*/
+func (tx *catalogTx) recordCurrent(kind, id, op string) error {
+	var entity interface{}
+	var err error
+
+	switch kind {
+	case REVISION_ARTIST:
+		entity, err = tx.state.artists.Get(id)
+	case REVISION_ALBUM:
+		entity, err = tx.state.albums.Get(id)
+	case REVISION_GENRE:
+		entity, err = tx.state.genres.Get(id)
+	case REVISION_PLAYLIST:
+		entity, err = tx.state.playlists.Get(id)
+	case REVISION_LABEL:
+		entity, err = tx.state.labels.Get(id)
+	case REVISION_RELATIONSHIP:
+		entity, err = tx.state.relationships.Get(id)
+	default:
+		entity, err = tx.state.songs.Get(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.recordRevision(kind, id, op, entity)
+}
+
+func validRevisionKind(kind string) bool {
+	switch kind {
+	case REVISION_ARTIST, REVISION_ALBUM, REVISION_SONG, REVISION_GENRE, REVISION_PLAYLIST, REVISION_LABEL, REVISION_RELATIONSHIP:
+		return true
+	}
+
+	return false
+}
+
+func (state *State) getRevisions(kind, id string) ([]*Revision, error) {
+	if !validRevisionKind(kind) {
+		return nil, fmt.Errorf("Unknown kind '%s'", kind)
+	}
+
+	return state.revisions.Get(kind, id)
+}
+
+/*
+Compares the data of two revisions of an entity, field by field.
+*/
+func (state *State) diffRevisions(kind, id string, from, to int) ([]FieldChange, error) {
+	revisions, err := state.getRevisions(kind, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if from < 1 || from > len(revisions) || to < 1 || to > len(revisions) {
+		return nil, fmt.Errorf("Revisions of %s '%s' are numbered 1 to %d", kind, id, len(revisions))
+	}
+
+	fromFields, err := revisionFields(revisions[from-1])
+	if err != nil {
+		return nil, err
+	}
+
+	toFields, err := revisionFields(revisions[to-1])
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fromFields)+len(toFields))
+	for name := range fromFields {
+		names = append(names, name)
+	}
+	for name := range toFields {
+		if _, ok := fromFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make([]FieldChange, 0)
+	for _, name := range names {
+		fromValue, toValue := fromFields[name], toFields[name]
+		if bytes.Equal(fromValue, toValue) {
+			continue
+		}
+
+		changes = append(changes, FieldChange{name, fromValue, toValue})
+	}
+
+	return changes, nil
+}
+
+func revisionFields(revision *Revision) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if revision.Data == nil {
+		return fields, nil
+	}
+
+	err := json.Unmarshal(revision.Data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+/*
+Finds the revision in effect at the given time.
+Returns nil when the entity did not exist then, or was in the trash.
+*/
+func (state *State) getRevisionAt(kind, id string, at time.Time) (*Revision, error) {
+	revisions, err := state.getRevisions(kind, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var current *Revision
+	for _, revision := range revisions {
+		if revision.Time.After(at) {
+			break
+		}
+
+		current = revision
+	}
+
+	if current == nil || !current.live() {
+		return nil, nil
+	}
+
+	return current, nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Number of snapshots kept on disk.
+The older one is a fallback in case the newest cannot be read,
+so the log segments after it are kept as well.
+*/
+const SNAPSHOT_RETAIN = 2
+
+/*
+A point in time copy of the in memory stores and their indexes.
+Seq is the last write-ahead log record included in the snapshot.
+*/
+type catalogSnapshot struct {
+	Seq          uint64              `json:"seq"`
+	Time         time.Time           `json:"time"`
+	Artists      map[string]*Artist  `json:"artists"`
+	Albums       map[string]*Album   `json:"albums"`
+	ArtistAlbums map[string][]string `json:"artistAlbums"`
+	Songs        map[string]*Song    `json:"songs"`
+	AlbumSongs   map[string][]string `json:"albumSongs"`
+	ArtistSongs  map[string][]string `json:"artistSongs"`
+
+	ArtistTrash map[string]*TrashedArtist `json:"artistTrash"`
+	AlbumTrash  map[string]*TrashedAlbum  `json:"albumTrash"`
+	SongTrash   map[string]*TrashedSong   `json:"songTrash"`
+
+	Revisions map[string][]*Revision `json:"revisions"`
+
+	Genres     map[string]*Genre   `json:"genres"`
+	GenreSongs map[string][]string `json:"genreSongs"`
+
+	Playlists     map[string]*Playlist     `json:"playlists"`
+	Labels        map[string]*Label        `json:"labels"`
+	Relationships map[string]*Relationship `json:"relationships"`
+}
+
+func copyIndex(index map[string][]string) map[string][]string {
+	indexCopy := make(map[string][]string, len(index))
+	for key, ids := range index {
+		indexCopy[key] = append([]string(nil), ids...)
+	}
+
+	return indexCopy
+}
+
+/*
+Snapshots periodically writes the in memory stores to disk
+and removes the log segments the snapshot makes redundant.
+*/
+type Snapshots struct {
+	log           *Log
+	dir           string
+	wal           *Wal
+	albums        *Albums
+	artists       *Artists
+	songs         *Songs
+	revisions     *Revisions
+	genres        *Genres
+	playlists     *Playlists
+	labels        *Labels
+	relationships *Relationships
+
+	lastSeq uint64
+	stop    chan struct{}
+	done    sync.WaitGroup
+}
+
+func NewSnapshots(
+	dir string,
+	wal *Wal,
+	albums *Albums,
+	artists *Artists,
+	songs *Songs,
+	revisions *Revisions,
+	genres *Genres,
+	playlists *Playlists,
+	labels *Labels,
+	relationships *Relationships,
+) *Snapshots {
+	config := GetConfig()
+
+	snapshots := &Snapshots{
+		log:           NewLogger("snapshot", config.GetLogLevel()),
+		dir:           dir,
+		wal:           wal,
+		albums:        albums,
+		artists:       artists,
+		songs:         songs,
+		revisions:     revisions,
+		genres:        genres,
+		playlists:     playlists,
+		labels:        labels,
+		relationships: relationships,
+	}
+
+	return snapshots
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("snapshot-%020d.json", seq)
+}
+
+/*
+Lists the sequence numbers of the snapshots on disk, newest first.
+*/
+func (snapshots *Snapshots) list() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(snapshots.dir, "snapshot-*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]uint64, 0, len(names))
+	for _, name := range names {
+		var seq uint64
+		_, err := fmt.Sscanf(filepath.Base(name), "snapshot-%d.json", &seq)
+		if err != nil {
+			snapshots.log.Warn("Ignoring unknown file %s in %s", name, snapshots.dir)
+			continue
+		}
+
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] > seqs[j] })
+
+	return seqs, nil
+}
+
+/*
+Restores the stores from the newest readable snapshot.
+Returns the sequence number the write-ahead log should be replayed after,
+which is 0 when there is no snapshot.
+*/
+func (snapshots *Snapshots) Load() (uint64, error) {
+	seqs, err := snapshots.list()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, seq := range seqs {
+		path := filepath.Join(snapshots.dir, snapshotName(seq))
+
+		snap, err := readSnapshot(path)
+		if err != nil {
+			snapshots.log.Warn("Skipping unreadable snapshot %s: %s", path, err)
+			continue
+		}
+		if snap.Seq != seq {
+			snapshots.log.Warn("Skipping snapshot %s, it holds seq %d", path, snap.Seq)
+			continue
+		}
+
+		snapshots.artists.restore(snap)
+		snapshots.albums.restore(snap)
+		snapshots.songs.restore(snap)
+		snapshots.revisions.restore(snap)
+		snapshots.genres.restore(snap)
+		snapshots.playlists.restore(snap)
+		snapshots.labels.restore(snap)
+		snapshots.relationships.restore(snap)
+		snapshots.lastSeq = seq
+
+		snapshots.log.Info("Loaded snapshot %s from %s", path, snap.Time.Format(time.RFC822))
+
+		return seq, nil
+	}
+
+	return 0, nil
+}
+
+func readSnapshot(path string) (*catalogSnapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	snap := new(catalogSnapshot)
+	err = json.NewDecoder(file).Decode(snap)
+	if err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+/*
+Writes a snapshot of the stores, then removes old snapshots and log segments.
+Nothing is written when no records were logged since the last snapshot.
+*/
+func (snapshots *Snapshots) Take() error {
+	// Holding the log lock keeps mutations out while the stores are copied,
+	// so the copy matches the log exactly up to seq.
+	snapshots.wal.Lock()
+
+	// Mid transaction the stores hold changes that are not logged yet.
+	seq := snapshots.wal.seq
+	if seq == snapshots.lastSeq || snapshots.wal.batch != nil {
+		snapshots.wal.Unlock()
+		return nil
+	}
+
+	snap := &catalogSnapshot{
+		Seq:  seq,
+		Time: time.Now(),
+	}
+	snapshots.artists.snapshot(snap)
+	snapshots.albums.snapshot(snap)
+	snapshots.songs.snapshot(snap)
+	snapshots.revisions.snapshot(snap)
+	snapshots.genres.snapshot(snap)
+	snapshots.playlists.snapshot(snap)
+	snapshots.labels.snapshot(snap)
+	snapshots.relationships.snapshot(snap)
+
+	err := snapshots.wal.rotate()
+	snapshots.wal.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = snapshots.write(snap)
+	if err != nil {
+		return err
+	}
+
+	snapshots.lastSeq = seq
+	snapshots.log.Info("Wrote snapshot at seq %d", seq)
+
+	return snapshots.prune()
+}
+
+func (snapshots *Snapshots) write(snap *catalogSnapshot) error {
+	path := filepath.Join(snapshots.dir, snapshotName(snap.Seq))
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(file).Encode(snap)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(snapshots.dir)
+}
+
+/*
+Removes all but the newest snapshots, and the log segments older than all of them.
+*/
+func (snapshots *Snapshots) prune() error {
+	seqs, err := snapshots.list()
+	if err != nil {
+		return err
+	}
+
+	if len(seqs) > SNAPSHOT_RETAIN {
+		for _, seq := range seqs[SNAPSHOT_RETAIN:] {
+			path := filepath.Join(snapshots.dir, snapshotName(seq))
+			err := os.Remove(path)
+			if err != nil {
+				return err
+			}
+
+			snapshots.log.Debug("Removed snapshot %s", path)
+		}
+
+		seqs = seqs[:SNAPSHOT_RETAIN]
+	}
+
+	return snapshots.wal.Truncate(seqs[len(seqs)-1])
+}
+
+/*
+Takes a snapshot on every tick of the interval until Stop is called.
+*/
+func (snapshots *Snapshots) Start(interval time.Duration) {
+	snapshots.stop = make(chan struct{})
+	snapshots.done.Add(1)
+
+	go func() {
+		defer snapshots.done.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := snapshots.Take()
+				if err != nil {
+					snapshots.log.Error("Error writing snapshot: %s", err)
+				}
+			case <-snapshots.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (snapshots *Snapshots) Stop() {
+	if snapshots.stop == nil {
+		return
+	}
+
+	close(snapshots.stop)
+	snapshots.done.Wait()
+	snapshots.stop = nil
+}
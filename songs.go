@@ -2,17 +2,33 @@ package main
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 )
 
+/*
+A song is numbered by Disc and Track within its album, see tracks.go.
+Songs stored before numbering have a zero Track, and play after the numbered ones.
+ArtistId is the primary artist, Credits lists the other artists on the song, see credits.go.
+GenreId refers to a genre, see genres.go. Genre is the free text genre songs had before,
+and holds the name of the genre when there is one.
+AudioId is the song's audio file, see audio.go.
+*/
 type Song struct {
-	Id       string `json:"id"`
-	Name     string `json:"name"`
-	Genre    string `json:"genre"`
-	Time     string `json:"time"`
-	Price    string `json:"price"`
-	AlbumId  string `json:"albumId"`
-	ArtistId string `json:"artistId"`
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Genre    string   `json:"genre"`
+	GenreId  string   `json:"genreId"`
+	Time     Duration `json:"time"`
+	Price    Price    `json:"price"`
+	Disc     int      `json:"disc"`
+	Track    int      `json:"track"`
+	AlbumId  string   `json:"albumId"`
+	ArtistId string   `json:"artistId"`
+	Credits  []Credit `json:"credits,omitempty"`
+	AudioId  string   `json:"audioId"`
+	Version  int64    `json:"version"`
 }
 
 func (song *Song) clone() *Song {
@@ -20,18 +36,122 @@ func (song *Song) clone() *Song {
 		Id:       song.Id,
 		Name:     song.Name,
 		Genre:    song.Genre,
+		GenreId:  song.GenreId,
 		Time:     song.Time,
 		Price:    song.Price,
+		Disc:     song.Disc,
+		Track:    song.Track,
 		AlbumId:  song.AlbumId,
 		ArtistId: song.ArtistId,
+		Credits:  copyCredits(song.Credits),
+		AudioId:  song.AudioId,
+		Version:  song.Version,
 	}
 }
 
+/*
+Lists the primary and credited artists of the song, each once.
+*/
+func (song *Song) artistIds() []string {
+	return creditedArtists(song.ArtistId, song.Credits)
+}
+
+/*
+Checks the fields of a song that is added or updated.
+*/
+func (song *Song) validate() error {
+	err := song.Price.validate()
+	if err != nil {
+		return err
+	}
+
+	if song.Disc < 0 {
+		return &ValidationError{"disc", "must not be negative"}
+	}
+	if song.Track < 0 {
+		return &ValidationError{"track", "must not be negative"}
+	}
+
+	err = validateCredits(song.Credits)
+	if err != nil {
+		return err
+	}
+
+	err = validateMediaId("audioId", song.AudioId)
+	if err != nil {
+		return err
+	}
+
+	return song.Time.validate("time")
+}
+
+/*
+Whether the song plays before other on their album.
+Numbered songs go by disc and track, unnumbered ones after them by id.
+A song missing from a broken index, given as nil, plays last.
+*/
+func (song *Song) playsBefore(other *Song) bool {
+	if song == nil || other == nil {
+		return other == nil && song != nil
+	}
+	if (song.Track == 0) != (other.Track == 0) {
+		return song.Track != 0
+	}
+	if song.Disc != other.Disc {
+		return song.Disc < other.Disc
+	}
+	if song.Track != other.Track {
+		return song.Track < other.Track
+	}
+
+	return song.Id < other.Id
+}
+
+/*
+A song in the trash.
+*/
+type TrashedSong struct {
+	Song
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+/*
+SongStore is the storage backend behind the song end points.
+Songs is the in memory implementation.
+*/
+type SongStore interface {
+	Add(song *Song) error
+	// Moves the song to the trash.
+	Delete(id string, deletedAt time.Time) error
+	// Moves the song out of the trash.
+	Restore(id string) error
+	// Removes the song for good, bypassing the trash.
+	Remove(id string) error
+	// Removes the song from the trash for good.
+	Purge(id string) error
+	GetTrash() ([]*TrashedSong, error)
+	Update(song *Song) error
+	Revert(song *Song) error
+	Get(id string) (*Song, error)
+	GetAll() ([]string, error)
+	// Lists the songs of the album in play order.
+	GetAlbumSongs(albumId string) ([]string, error)
+	GetArtistSongs(artistId string) ([]string, error)
+	GetGenreSongs(genreId string) ([]string, error)
+}
+
+var _ SongStore = (*Songs)(nil)
+
 type Songs struct {
 	sync.RWMutex
-	songs       map[string]*Song
-	albumSongs  map[string][]string
+	songs map[string]*Song
+	// Kept in play order.
+	albumSongs map[string][]string
+	// Lists each song under every artist it credits.
 	artistSongs map[string][]string
+	genreSongs  map[string][]string
+	trash       map[string]*TrashedSong
+	log         *Log
 }
 
 func NewSongs() *Songs {
@@ -39,6 +159,9 @@ func NewSongs() *Songs {
 		songs:       make(map[string]*Song),
 		albumSongs:  make(map[string][]string),
 		artistSongs: make(map[string][]string),
+		genreSongs:  make(map[string][]string),
+		trash:       make(map[string]*TrashedSong),
+		log:         NewLogger("songs", GetConfig().GetLogLevel()),
 	}
 
 	return songs
@@ -52,46 +175,78 @@ func (state *Songs) Add(song *Song) error {
 	if _, ok := state.songs[song.Id]; ok {
 		return errors.New("Song by 'id' already exists")
 	}
+	if _, ok := state.trash[song.Id]; ok {
+		return errors.New("Song by 'id' is in the trash")
+	}
 
-	// Add this song to the artist.
-	err := state.addArtistSong(song.ArtistId, song.Id)
+	// Add this song to the artists.
+	err := state.addArtistSongs(song)
 	if err != nil {
 		return err
 	}
 
-	// Add this song to the artist.
-	err = state.addAlbumSong(song.AlbumId, song.Id)
+	// Add this song to the album.
+	err = state.addAlbumSong(song)
 	if err != nil {
 		return err
 	}
 
+	state.addGenreSong(song)
+
 	// Store the song and release the lock.
 	// Copy the struct.
-	state.songs[song.Id] = song.clone()
+	stored := song.clone()
+	stored.Version = 1
+	state.songs[song.Id] = stored
 
 	return nil
 }
 
-func (state *Songs) addAlbumSong(albumId, songId string) error {
-	songs, ok := state.albumSongs[albumId]
-	if ok {
-		// Only insert if unique.
-		for _, id := range songs {
-			if id == songId {
-				return errors.New("Song id already exists under that album")
-			}
+/*
+Inserts the song into its album in play order.
+The song itself may not be stored yet, the others on the album are.
+*/
+func (state *Songs) addAlbumSong(song *Song) error {
+	songs := state.albumSongs[song.AlbumId]
+
+	// Only insert if unique.
+	index := len(songs)
+	for i, id := range songs {
+		if id == song.Id {
+			return errors.New("Song id already exists under that album")
 		}
+		if index == len(songs) && song.playsBefore(state.songs[id]) {
+			index = i
+		}
+	}
 
-		songs = append(songs, songId)
-		state.albumSongs[albumId] = songs
-		return nil
+	songs = append(songs, "")
+	copy(songs[index+1:], songs[index:])
+	songs[index] = song.Id
+
+	state.albumSongs[song.AlbumId] = songs
+	return nil
+}
+
+func (state *Songs) addArtistSongs(song *Song) error {
+	for _, artistId := range song.artistIds() {
+		err := state.addArtistSong(artistId, song.Id)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Does not exist. Create it.
-	songs = make([]string, 1)
-	songs[0] = songId
+	return nil
+}
+
+func (state *Songs) deleteArtistSongs(song *Song) error {
+	for _, artistId := range song.artistIds() {
+		err := state.deleteArtistSong(artistId, song.Id)
+		if err != nil {
+			return err
+		}
+	}
 
-	state.albumSongs[albumId] = songs
 	return nil
 }
 
@@ -118,19 +273,138 @@ func (state *Songs) addArtistSong(artistId, songId string) error {
 	return nil
 }
 
-func (state *Songs) Delete(id string) error {
+func (state *Songs) Delete(id string, deletedAt time.Time) error {
+	state.Lock()
+	defer state.Unlock()
+
+	song, ok := state.songs[id]
+	if !ok {
+		return errors.New("Song does not exist")
+	}
+
+	state.unindexSong(song)
+
+	delete(state.songs, id)
+	state.trash[id] = &TrashedSong{*song, deletedAt}
+
+	return nil
+}
+
+func (state *Songs) Restore(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	trashed, ok := state.trash[id]
+	if !ok {
+		return errors.New("Song is not in the trash")
+	}
+
+	err := state.addArtistSongs(&trashed.Song)
+	if err != nil {
+		return err
+	}
+
+	err = state.addAlbumSong(&trashed.Song)
+	if err != nil {
+		return err
+	}
+
+	state.addGenreSong(&trashed.Song)
+
+	delete(state.trash, id)
+	state.songs[id] = trashed.Song.clone()
+
+	return nil
+}
+
+func (state *Songs) Remove(id string) error {
 	state.Lock()
 	defer state.Unlock()
 
-	if _, ok := state.songs[id]; !ok {
+	song, ok := state.songs[id]
+	if !ok {
 		return errors.New("Song does not exist")
 	}
 
+	state.unindexSong(song)
+
 	delete(state.songs, id)
 
 	return nil
 }
 
+/*
+Removes the song from its artists, album and genre.
+An entry already missing is index drift for check to report, it does not keep the song from going.
+*/
+func (state *Songs) unindexSong(song *Song) {
+	for _, artistId := range song.artistIds() {
+		err := state.deleteArtistSong(artistId, song.Id)
+		if err != nil {
+			state.log.Warn("Song %s was not indexed under artist %s: %s", song.Id, artistId, err)
+		}
+	}
+
+	err := state.deleteAlbumSong(song.AlbumId, song.Id)
+	if err != nil {
+		state.log.Warn("Song %s was not indexed under album %s: %s", song.Id, song.AlbumId, err)
+	}
+
+	state.deleteGenreSong(song)
+}
+
+/*
+Songs without a genre are not indexed.
+*/
+func (state *Songs) addGenreSong(song *Song) {
+	if song.GenreId != "" {
+		state.genreSongs[song.GenreId] = append(state.genreSongs[song.GenreId], song.Id)
+	}
+}
+
+func (state *Songs) deleteGenreSong(song *Song) {
+	songs := state.genreSongs[song.GenreId]
+	for i, id := range songs {
+		if id == song.Id {
+			state.genreSongs[song.GenreId] = append(songs[:i], songs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (state *Songs) Purge(id string) error {
+	state.Lock()
+	defer state.Unlock()
+
+	if _, ok := state.trash[id]; !ok {
+		return errors.New("Song is not in the trash")
+	}
+
+	delete(state.trash, id)
+
+	return nil
+}
+
+/*
+Lists the trash, oldest deletion first.
+*/
+func (state *Songs) GetTrash() ([]*TrashedSong, error) {
+	state.RLock()
+	defer state.RUnlock()
+
+	trash := make([]*TrashedSong, 0, len(state.trash))
+	for _, trashed := range state.trash {
+		trashCopy := *trashed
+		trash = append(trash, &trashCopy)
+	}
+
+	sort.Slice(trash, func(i, j int) bool {
+		return trash[i].DeletedAt.Before(trash[j].DeletedAt)
+	})
+
+	return trash, nil
+}
+
 func (state *Songs) deleteAlbumSong(albumId, songId string) error {
 	songs, ok := state.albumSongs[albumId]
 	if !ok {
@@ -150,9 +424,8 @@ func (state *Songs) deleteAlbumSong(albumId, songId string) error {
 		return errors.New("Song id not found under that album.")
 	}
 
-	// Found the song id, slice the array.
-	songs[index] = songs[len(songs)-1]
-	songs = songs[:len(songs)-1]
+	// Found the song id, keep the ones after it in order.
+	songs = append(songs[:index], songs[index+1:]...)
 
 	state.albumSongs[albumId] = songs
 
@@ -208,7 +481,21 @@ func (state *Songs) GetAlbumSongs(albumId string) ([]string, error) {
 		return nil, errors.New("Album under id does not contain any songs")
 	}
 
-	return songs, nil
+	// Copy, the index is changed in place.
+	return append([]string(nil), songs...), nil
+}
+
+func (state *Songs) GetGenreSongs(genreId string) ([]string, error) {
+	state.Lock()
+	defer state.Unlock()
+
+	songs, ok := state.genreSongs[genreId]
+	if !ok || len(songs) == 0 {
+		return nil, errors.New("Genre under id does not contain any songs")
+	}
+
+	// Copy, the index is changed in place.
+	return append([]string(nil), songs...), nil
 }
 
 func (state *Songs) GetArtistSongs(artistId string) ([]string, error) {
@@ -220,7 +507,122 @@ func (state *Songs) GetArtistSongs(artistId string) ([]string, error) {
 		return nil, errors.New("Artist under id does not contain any songs")
 	}
 
-	return songs, nil
+	// Copy, the index is changed in place.
+	return append([]string(nil), songs...), nil
+}
+
+/*
+Copies the songs and the album, artist and genre indexes into the snapshot.
+*/
+func (state *Songs) snapshot(snap *catalogSnapshot) {
+	state.RLock()
+	defer state.RUnlock()
+
+	snap.Songs = make(map[string]*Song, len(state.songs))
+	for id, song := range state.songs {
+		snap.Songs[id] = song.clone()
+	}
+
+	snap.AlbumSongs = copyIndex(state.albumSongs)
+	snap.ArtistSongs = copyIndex(state.artistSongs)
+	snap.GenreSongs = copyIndex(state.genreSongs)
+
+	snap.SongTrash = make(map[string]*TrashedSong, len(state.trash))
+	for id, trashed := range state.trash {
+		trashCopy := *trashed
+		snap.SongTrash[id] = &trashCopy
+	}
+}
+
+/*
+Replaces the songs and the album, artist and genre indexes with the contents of the snapshot.
+*/
+func (state *Songs) restore(snap *catalogSnapshot) {
+	state.Lock()
+	defer state.Unlock()
+
+	state.songs = make(map[string]*Song, len(snap.Songs))
+	for id, song := range snap.Songs {
+		state.songs[id] = song.clone()
+	}
+
+	state.albumSongs = copyIndex(snap.AlbumSongs)
+	state.artistSongs = copyIndex(snap.ArtistSongs)
+	state.genreSongs = copyIndex(snap.GenreSongs)
+
+	// Snapshots from before numbering list the album songs in any order.
+	for _, songs := range state.albumSongs {
+		sort.Slice(songs, func(i, j int) bool {
+			return state.songs[songs[i]].playsBefore(state.songs[songs[j]])
+		})
+	}
+
+	state.trash = make(map[string]*TrashedSong, len(snap.SongTrash))
+	for id, trashed := range snap.SongTrash {
+		trashCopy := *trashed
+		state.trash[id] = &trashCopy
+	}
+}
+
+func (state *Songs) checkIndexes() []CatalogIssue {
+	state.RLock()
+	defer state.RUnlock()
+
+	ids := make([]string, 0, len(state.songs))
+	for id := range state.songs {
+		ids = append(ids, id)
+	}
+
+	issues := checkIndex("albumSongs", "song", state.albumSongs, ids, func(id string) ([]string, bool) {
+		song, ok := state.songs[id]
+		if !ok {
+			return nil, false
+		}
+		return []string{song.AlbumId}, true
+	})
+
+	issues = append(issues, checkIndex("artistSongs", "song", state.artistSongs, ids, func(id string) ([]string, bool) {
+		song, ok := state.songs[id]
+		if !ok {
+			return nil, false
+		}
+		return song.artistIds(), true
+	})...)
+
+	return append(issues, checkIndex("genreSongs", "song", state.genreSongs, ids, func(id string) ([]string, bool) {
+		song, ok := state.songs[id]
+		if !ok || song.GenreId == "" {
+			return nil, ok
+		}
+		return []string{song.GenreId}, true
+	})...)
+}
+
+/*
+Rebuilds the album, artist and genre indexes from the songs.
+*/
+func (state *Songs) rebuildIndexes() error {
+	state.Lock()
+	defer state.Unlock()
+
+	state.albumSongs = make(map[string][]string)
+	state.artistSongs = make(map[string][]string)
+	state.genreSongs = make(map[string][]string)
+	for _, song := range state.songs {
+		err := state.addAlbumSong(song)
+		if err != nil {
+			return err
+		}
+
+		err = state.addArtistSongs(song)
+		if err != nil {
+			return err
+		}
+
+		state.addGenreSong(song)
+	}
+
+	return nil
 }
 
 func (state *Songs) GetAll() ([]string, error) {
@@ -249,32 +651,120 @@ func (state *Songs) Update(song *Song) error {
 		return errors.New("Unable to update song, given song Id does not exist")
 	}
 
-	// Only need to update if the albums are different.
-	if song.AlbumId != oldSong.AlbumId {
-		err := state.deleteAlbumSong(oldSong.AlbumId, oldSong.Id)
+	err := checkVersion("song", song.Id, song.Version, oldSong.Version)
+	if err != nil {
+		return err
+	}
+
+	// Only need to update if the album or the place on it changed.
+	if movedOnAlbum(oldSong, song) {
+		err = state.deleteAlbumSong(oldSong.AlbumId, oldSong.Id)
 		if err != nil {
 			return err
 		}
 
-		err = state.addAlbumSong(song.AlbumId, song.Id)
+		err = state.addAlbumSong(song)
 		if err != nil {
 			return err
 		}
 	}
 	// Only need to update if the artists are different.
-	if song.ArtistId != oldSong.ArtistId {
-		err := state.deleteArtistSong(oldSong.ArtistId, oldSong.Id)
+	if !sameArtists(oldSong, song) {
+		err = state.deleteArtistSongs(oldSong)
+		if err != nil {
+			return err
+		}
+
+		err = state.addArtistSongs(song)
+		if err != nil {
+			return err
+		}
+	}
+	if oldSong.GenreId != song.GenreId {
+		state.deleteGenreSong(oldSong)
+		state.addGenreSong(song)
+	}
+
+	stored := song.clone()
+	stored.Version = oldSong.Version + 1
+	state.songs[song.Id] = stored
+
+	return nil
+}
+
+/*
+Stores the song exactly as given, version included, replacing any current copy.
+Used to undo changes.
+*/
+func (state *Songs) Revert(song *Song) error {
+	state.Lock()
+	defer state.Unlock()
+
+	oldSong, ok := state.songs[song.Id]
+	if !ok {
+		err := state.addArtistSongs(song)
 		if err != nil {
 			return err
 		}
 
-		err = state.addArtistSong(song.ArtistId, song.Id)
+		err = state.addAlbumSong(song)
 		if err != nil {
 			return err
 		}
+
+		state.addGenreSong(song)
+
+		state.songs[song.Id] = song.clone()
+		return nil
+	}
+
+	if movedOnAlbum(oldSong, song) {
+		err := state.deleteAlbumSong(oldSong.AlbumId, song.Id)
+		if err != nil {
+			return err
+		}
+
+		err = state.addAlbumSong(song)
+		if err != nil {
+			return err
+		}
+	}
+	if !sameArtists(oldSong, song) {
+		err := state.deleteArtistSongs(oldSong)
+		if err != nil {
+			return err
+		}
+
+		err = state.addArtistSongs(song)
+		if err != nil {
+			return err
+		}
+	}
+	if oldSong.GenreId != song.GenreId {
+		state.deleteGenreSong(oldSong)
+		state.addGenreSong(song)
 	}
 
 	state.songs[song.Id] = song.clone()
 
 	return nil
 }
+
+func sameArtists(oldSong, song *Song) bool {
+	oldIds, ids := oldSong.artistIds(), song.artistIds()
+	if len(oldIds) != len(ids) {
+		return false
+	}
+
+	for i := range ids {
+		if oldIds[i] != ids[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func movedOnAlbum(oldSong, song *Song) bool {
+	return oldSong.AlbumId != song.AlbumId || oldSong.Disc != song.Disc || oldSong.Track != song.Track
+}
@@ -0,0 +1,1518 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/*
+Schema migrations, applied in order.
+PRAGMA user_version records how many have been applied to a database file.
+*/
+var sqliteMigrations = []string{
+	`CREATE TABLE artists (
+		id        TEXT PRIMARY KEY,
+		name      TEXT NOT NULL,
+		birthdate TEXT NOT NULL
+	);
+
+	CREATE TABLE albums (
+		id        TEXT PRIMARY KEY,
+		name      TEXT NOT NULL,
+		price     TEXT NOT NULL,
+		artist_id TEXT NOT NULL REFERENCES artists(id)
+	);
+	CREATE INDEX albums_artist_id ON albums(artist_id);
+
+	CREATE TABLE songs (
+		id        TEXT PRIMARY KEY,
+		name      TEXT NOT NULL,
+		genre     TEXT NOT NULL,
+		time      TEXT NOT NULL,
+		price     TEXT NOT NULL,
+		album_id  TEXT NOT NULL REFERENCES albums(id),
+		artist_id TEXT NOT NULL REFERENCES artists(id)
+	);
+	CREATE INDEX songs_album_id ON songs(album_id);
+	CREATE INDEX songs_artist_id ON songs(artist_id);`,
+
+	`ALTER TABLE artists ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+	ALTER TABLE albums ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+	ALTER TABLE songs ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+
+	// Rows in the trash keep their place, so foreign keys still hold for orphans.
+	`ALTER TABLE artists ADD COLUMN deleted_at TEXT;
+	ALTER TABLE albums ADD COLUMN deleted_at TEXT;
+	ALTER TABLE songs ADD COLUMN deleted_at TEXT;`,
+
+	`CREATE TABLE revisions (
+		kind      TEXT NOT NULL,
+		entity_id TEXT NOT NULL,
+		number    INTEGER NOT NULL,
+		time      TEXT NOT NULL,
+		actor     TEXT NOT NULL,
+		op        TEXT NOT NULL,
+		data      TEXT,
+		PRIMARY KEY (kind, entity_id, number)
+	);`,
+
+	`ALTER TABLE artists ADD COLUMN end_date TEXT NOT NULL DEFAULT '';`,
+
+	// Places on an album are checked by the catalog, a reorder moves songs through shared places.
+	`ALTER TABLE songs ADD COLUMN disc INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE songs ADD COLUMN track INTEGER NOT NULL DEFAULT 0;`,
+
+	`CREATE TABLE song_credits (
+		song_id   TEXT NOT NULL REFERENCES songs(id) ON DELETE CASCADE,
+		position  INTEGER NOT NULL,
+		artist_id TEXT NOT NULL REFERENCES artists(id),
+		role      TEXT NOT NULL,
+		PRIMARY KEY (song_id, position)
+	);
+	CREATE INDEX song_credits_artist_id ON song_credits(artist_id);
+	CREATE TABLE album_credits (
+		album_id  TEXT NOT NULL REFERENCES albums(id) ON DELETE CASCADE,
+		position  INTEGER NOT NULL,
+		artist_id TEXT NOT NULL REFERENCES artists(id),
+		role      TEXT NOT NULL,
+		PRIMARY KEY (album_id, position)
+	);
+	CREATE INDEX album_credits_artist_id ON album_credits(artist_id);`,
+
+	// Songs without a genre keep an empty genre_id, so the catalog checks the reference.
+	`CREATE TABLE genres (
+		id        TEXT PRIMARY KEY,
+		name      TEXT NOT NULL,
+		aliases   TEXT NOT NULL,
+		parent_id TEXT NOT NULL,
+		version   INTEGER NOT NULL
+	);
+	ALTER TABLE songs ADD COLUMN genre_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX songs_genre_id ON songs(genre_id);`,
+
+	`CREATE TABLE playlists (
+		id          TEXT PRIMARY KEY,
+		name        TEXT NOT NULL,
+		description TEXT NOT NULL,
+		owner       TEXT NOT NULL,
+		version     INTEGER NOT NULL
+	);
+	CREATE TABLE playlist_songs (
+		playlist_id TEXT NOT NULL REFERENCES playlists(id) ON DELETE CASCADE,
+		position    INTEGER NOT NULL,
+		song_id     TEXT NOT NULL REFERENCES songs(id),
+		PRIMARY KEY (playlist_id, position)
+	);
+	CREATE INDEX playlist_songs_song_id ON playlist_songs(song_id);`,
+
+	// Albums without a label keep an empty label_id, so the catalog checks the reference.
+	`CREATE TABLE labels (
+		id      TEXT PRIMARY KEY,
+		name    TEXT NOT NULL,
+		version INTEGER NOT NULL
+	);
+	ALTER TABLE albums ADD COLUMN release_date TEXT NOT NULL DEFAULT '';
+	ALTER TABLE albums ADD COLUMN release_type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE albums ADD COLUMN label_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX albums_label_id ON albums(label_id);`,
+
+	`CREATE TABLE relationships (
+		id         TEXT PRIMARY KEY,
+		kind       TEXT NOT NULL,
+		artist_id  TEXT NOT NULL REFERENCES artists(id),
+		related_id TEXT NOT NULL REFERENCES artists(id),
+		from_date  TEXT NOT NULL,
+		to_date    TEXT NOT NULL,
+		version    INTEGER NOT NULL
+	);
+	CREATE INDEX relationships_artist_id ON relationships(artist_id);
+	CREATE INDEX relationships_related_id ON relationships(related_id);`,
+
+	// The images themselves are files in the media directory, see images.go.
+	`ALTER TABLE artists ADD COLUMN image_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE albums ADD COLUMN image_id TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE songs ADD COLUMN audio_id TEXT NOT NULL DEFAULT '';`,
+}
+
+func init() {
+	openSqliteStores = OpenSqlite
+}
+
+/*
+Opens the catalog database at path, creating or migrating the schema as needed.
+*/
+func OpenSqlite(path string) (AlbumStore, ArtistStore, SongStore, RevisionStore, GenreStore, PlaylistStore, LabelStore, RelationshipStore, io.Closer, error) {
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=1&_busy_timeout=5000&_journal_mode=WAL", path)
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+	}
+
+	err = migrateSqlite(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, nil, nil, nil, nil, nil, nil, nil, err
+	}
+
+	return &sqliteAlbums{db}, &sqliteArtists{db}, &sqliteSongs{db}, &sqliteRevisions{db}, &sqliteGenres{db}, &sqlitePlaylists{db}, &sqliteLabels{db}, &sqliteRelationships{db}, &sqliteBackend{db}, nil
+}
+
+func migrateSqlite(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for version < len(sqliteMigrations) {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqliteMigrations[version])
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Unable to apply sqlite migration %d: %s", version+1, err)
+		}
+
+		version++
+
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+What the stores run their statements on: the database,
+or the transaction of the catalog transaction they are bound to, see sqliteBackend.
+*/
+type sqliteConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+/*
+The sqlite database behind the stores.
+Each catalog transaction runs as a single transaction of the database, committed once
+at its end, so a crash never leaves part of a catalog transaction on disk.
+*/
+type sqliteBackend struct {
+	db *sql.DB
+}
+
+func (backend *sqliteBackend) Begin(state *State) (*State, backendTx, error) {
+	tx, err := backend.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bound := state.withStores(
+		&sqliteAlbums{tx}, &sqliteArtists{tx}, &sqliteSongs{tx}, &sqliteRevisions{tx},
+		&sqliteGenres{tx}, &sqlitePlaylists{tx}, &sqliteLabels{tx}, &sqliteRelationships{tx},
+	)
+
+	return bound, tx, nil
+}
+
+func (backend *sqliteBackend) Close() error {
+	return backend.db.Close()
+}
+
+/*
+Runs fn all or nothing.
+Outside a catalog transaction fn gets a transaction of its own. Inside one it runs
+within a savepoint, so a failing fn leaves the rest of the catalog transaction as it was.
+*/
+func sqliteTx(db sqliteConn, fn func(tx *sql.Tx) error) error {
+	if tx, ok := db.(*sql.Tx); ok {
+		_, err := tx.Exec("SAVEPOINT store")
+		if err != nil {
+			return err
+		}
+
+		err = fn(tx)
+		if err != nil {
+			tx.Exec("ROLLBACK TO store")
+			tx.Exec("RELEASE store")
+			return err
+		}
+
+		_, err = tx.Exec("RELEASE store")
+		return err
+	}
+
+	tx, err := db.(*sql.DB).Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/*
+Checks that an id is free to add, neither in use nor in the trash.
+*/
+func sqliteCheckAdd(tx *sql.Tx, kind, table, id string) error {
+	var trashed bool
+	err := tx.QueryRow("SELECT deleted_at IS NOT NULL FROM "+table+" WHERE id = ?", id).Scan(&trashed)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if trashed {
+		return fmt.Errorf("%s by 'id' is in the trash", kind)
+	}
+
+	return fmt.Errorf("%s by 'id' already exists", kind)
+}
+
+/*
+Runs a statement that must change exactly the row of one id, failing with notFound otherwise.
+*/
+func sqliteExecId(db sqliteConn, notFound, query string, args ...interface{}) error {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New(notFound)
+	}
+
+	return nil
+}
+
+/*
+Replaces the credits of a song or album, kind names the table, song_credits or album_credits.
+*/
+func sqliteSetCredits(tx *sql.Tx, kind, id string, credits []Credit) error {
+	_, err := tx.Exec("DELETE FROM "+kind+"_credits WHERE "+kind+"_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	for i, credit := range credits {
+		_, err := tx.Exec(
+			"INSERT INTO "+kind+"_credits ("+kind+"_id, position, artist_id, role) VALUES (?, ?, ?, ?)",
+			id, i, credit.ArtistId, credit.Role,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sqliteGetCredits(db sqliteConn, kind, id string) ([]Credit, error) {
+	rows, err := db.Query("SELECT artist_id, role FROM "+kind+"_credits WHERE "+kind+"_id = ? ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credits []Credit
+	for rows.Next() {
+		var credit Credit
+		err := rows.Scan(&credit.ArtistId, &credit.Role)
+		if err != nil {
+			return nil, err
+		}
+
+		credits = append(credits, credit)
+	}
+
+	return credits, rows.Err()
+}
+
+func sqliteFormatTime(at time.Time) string {
+	return at.UTC().Format(time.RFC3339Nano)
+}
+
+func sqliteParseTime(at string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, at)
+}
+
+/*
+Checks the version an update was based on against the stored row.
+Returns false when the row does not exist.
+*/
+func sqliteCheckVersion(tx *sql.Tx, kind, table, id string, version int64) (bool, error) {
+	var current int64
+	err := tx.QueryRow("SELECT version FROM "+table+" WHERE id = ? AND deleted_at IS NULL", id).Scan(&current)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, checkVersion(kind, id, version, current)
+}
+
+func sqliteIds(db sqliteConn, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+/*
+Prices are stored in the price column in their string form, such as "9.99 USD".
+Rows written before prices had a currency are read in the default currency.
+*/
+func (price Price) Value() (driver.Value, error) {
+	return price.String(), nil
+}
+
+func (price *Price) Scan(src interface{}) error {
+	var text string
+	switch src := src.(type) {
+	case string:
+		text = src
+	case []byte:
+		text = string(src)
+	default:
+		return fmt.Errorf("Cannot read a price from %T", src)
+	}
+
+	price.setText(text)
+
+	return nil
+}
+
+/*
+Song times are stored in the time column in their string form, such as "3:45".
+*/
+func (duration Duration) Value() (driver.Value, error) {
+	return duration.String(), nil
+}
+
+func (duration *Duration) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		duration.setText(src)
+	case []byte:
+		duration.setText(string(src))
+	default:
+		return fmt.Errorf("Cannot read a duration from %T", src)
+	}
+
+	return nil
+}
+
+/*
+Dates are stored in their string form, such as "1970" or "1970-05-01", so they sort in date order.
+*/
+func (date PartialDate) Value() (driver.Value, error) {
+	return date.String(), nil
+}
+
+func (date *PartialDate) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		date.setText(src)
+	case []byte:
+		date.setText(string(src))
+	default:
+		return fmt.Errorf("Cannot read a date from %T", src)
+	}
+
+	return nil
+}
+
+type sqliteArtists struct {
+	db sqliteConn
+}
+
+func (store *sqliteArtists) Add(artist *Artist) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		err := sqliteCheckAdd(tx, "Artist", "artists", artist.Id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO artists (id, name, birthdate, end_date, image_id, version) VALUES (?, ?, ?, ?, ?, 1)",
+			artist.Id, artist.Name, artist.Birthdate, artist.EndDate, artist.ImageId,
+		)
+		return err
+	})
+}
+
+func (store *sqliteArtists) Delete(id string, deletedAt time.Time) error {
+	return sqliteExecId(
+		store.db, "Artist does not exist",
+		"UPDATE artists SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL",
+		sqliteFormatTime(deletedAt), id,
+	)
+}
+
+func (store *sqliteArtists) Restore(id string) error {
+	return sqliteExecId(
+		store.db, "Artist is not in the trash",
+		"UPDATE artists SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL",
+		id,
+	)
+}
+
+func (store *sqliteArtists) Remove(id string) error {
+	return sqliteExecId(store.db, "Artist does not exist", "DELETE FROM artists WHERE id = ? AND deleted_at IS NULL", id)
+}
+
+func (store *sqliteArtists) Purge(id string) error {
+	return sqliteExecId(store.db, "Artist is not in the trash", "DELETE FROM artists WHERE id = ? AND deleted_at IS NOT NULL", id)
+}
+
+func (store *sqliteArtists) Update(artist *Artist) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		exists, err := sqliteCheckVersion(tx, "artist", "artists", artist.Id, artist.Version)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("Unable to update artist, given artist Id does not exist")
+		}
+
+		_, err = tx.Exec(
+			"UPDATE artists SET name = ?, birthdate = ?, end_date = ?, image_id = ?, version = version + 1 WHERE id = ?",
+			artist.Name, artist.Birthdate, artist.EndDate, artist.ImageId, artist.Id,
+		)
+		return err
+	})
+}
+
+func (store *sqliteArtists) Revert(artist *Artist) error {
+	_, err := store.db.Exec(
+		`INSERT INTO artists (id, name, birthdate, end_date, image_id, version) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name, birthdate = excluded.birthdate, end_date = excluded.end_date,
+			image_id = excluded.image_id, version = excluded.version`,
+		artist.Id, artist.Name, artist.Birthdate, artist.EndDate, artist.ImageId, artist.Version,
+	)
+	return err
+}
+
+func (store *sqliteArtists) Get(id string) (*Artist, error) {
+	artist := new(Artist)
+
+	err := store.db.QueryRow(
+		"SELECT id, name, birthdate, end_date, image_id, version FROM artists WHERE id = ? AND deleted_at IS NULL",
+		id,
+	).Scan(&artist.Id, &artist.Name, &artist.Birthdate, &artist.EndDate, &artist.ImageId, &artist.Version)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Artist does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return artist, nil
+}
+
+func (store *sqliteArtists) GetAll() ([]string, error) {
+	return sqliteIds(store.db, "SELECT id FROM artists WHERE deleted_at IS NULL")
+}
+
+func (store *sqliteArtists) GetByBirthYear(from, to int) ([]string, error) {
+	return sqliteIds(
+		store.db,
+		`SELECT id FROM artists
+		WHERE deleted_at IS NULL AND birthdate != '' AND CAST(substr(birthdate, 1, 4) AS INTEGER) BETWEEN ? AND ?
+		ORDER BY birthdate, id`,
+		from, to,
+	)
+}
+
+func (store *sqliteArtists) GetTrash() ([]*TrashedArtist, error) {
+	rows, err := store.db.Query(
+		`SELECT id, name, birthdate, end_date, image_id, version, deleted_at
+		FROM artists WHERE deleted_at IS NOT NULL ORDER BY deleted_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trash := make([]*TrashedArtist, 0)
+	for rows.Next() {
+		trashed := new(TrashedArtist)
+		var deletedAt string
+
+		err := rows.Scan(
+			&trashed.Id, &trashed.Name, &trashed.Birthdate, &trashed.EndDate, &trashed.ImageId, &trashed.Version, &deletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		trashed.DeletedAt, err = sqliteParseTime(deletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		trash = append(trash, trashed)
+	}
+
+	return trash, rows.Err()
+}
+
+type sqliteAlbums struct {
+	db sqliteConn
+}
+
+func (store *sqliteAlbums) Add(album *Album) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		err := sqliteCheckAdd(tx, "Album", "albums", album.Id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO albums (id, name, price, artist_id, release_date, release_type, label_id, image_id, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1)`,
+			album.Id, album.Name, album.Price, album.ArtistId, album.ReleaseDate, album.ReleaseType, album.LabelId, album.ImageId,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetCredits(tx, "album", album.Id, album.Credits)
+	})
+}
+
+func (store *sqliteAlbums) Delete(id string, deletedAt time.Time) error {
+	return sqliteExecId(
+		store.db, "Album does not exist",
+		"UPDATE albums SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL",
+		sqliteFormatTime(deletedAt), id,
+	)
+}
+
+func (store *sqliteAlbums) Restore(id string) error {
+	return sqliteExecId(
+		store.db, "Album is not in the trash",
+		"UPDATE albums SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL",
+		id,
+	)
+}
+
+func (store *sqliteAlbums) Remove(id string) error {
+	return sqliteExecId(store.db, "Album does not exist", "DELETE FROM albums WHERE id = ? AND deleted_at IS NULL", id)
+}
+
+func (store *sqliteAlbums) Purge(id string) error {
+	return sqliteExecId(store.db, "Album is not in the trash", "DELETE FROM albums WHERE id = ? AND deleted_at IS NOT NULL", id)
+}
+
+func (store *sqliteAlbums) Update(album *Album) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		exists, err := sqliteCheckVersion(tx, "album", "albums", album.Id, album.Version)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("Unable to update album, given album Id does not exist")
+		}
+
+		_, err = tx.Exec(
+			`UPDATE albums SET name = ?, price = ?, artist_id = ?, release_date = ?, release_type = ?, label_id = ?,
+			image_id = ?, version = version + 1 WHERE id = ?`,
+			album.Name, album.Price, album.ArtistId, album.ReleaseDate, album.ReleaseType, album.LabelId, album.ImageId, album.Id,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetCredits(tx, "album", album.Id, album.Credits)
+	})
+}
+
+func (store *sqliteAlbums) Revert(album *Album) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`INSERT INTO albums (id, name, price, artist_id, release_date, release_type, label_id, image_id, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				name = excluded.name, price = excluded.price, artist_id = excluded.artist_id,
+				release_date = excluded.release_date, release_type = excluded.release_type,
+				label_id = excluded.label_id, image_id = excluded.image_id, version = excluded.version`,
+			album.Id, album.Name, album.Price, album.ArtistId,
+			album.ReleaseDate, album.ReleaseType, album.LabelId, album.ImageId, album.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetCredits(tx, "album", album.Id, album.Credits)
+	})
+}
+
+func (store *sqliteAlbums) Get(id string) (*Album, error) {
+	album := new(Album)
+
+	err := store.db.QueryRow(
+		`SELECT id, name, price, artist_id, release_date, release_type, label_id, image_id, version
+		FROM albums WHERE id = ? AND deleted_at IS NULL`,
+		id,
+	).Scan(
+		&album.Id, &album.Name, &album.Price, &album.ArtistId,
+		&album.ReleaseDate, &album.ReleaseType, &album.LabelId, &album.ImageId, &album.Version,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Album does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	album.Credits, err = sqliteGetCredits(store.db, "album", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return album, nil
+}
+
+func (store *sqliteAlbums) GetAll() ([]string, error) {
+	return sqliteIds(store.db, "SELECT id FROM albums WHERE deleted_at IS NULL")
+}
+
+func (store *sqliteAlbums) GetTrash() ([]*TrashedAlbum, error) {
+	rows, err := store.db.Query(
+		`SELECT id, name, price, artist_id, release_date, release_type, label_id, image_id, version, deleted_at
+		FROM albums WHERE deleted_at IS NOT NULL ORDER BY deleted_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trash := make([]*TrashedAlbum, 0)
+	for rows.Next() {
+		trashed := new(TrashedAlbum)
+		var deletedAt string
+
+		err := rows.Scan(
+			&trashed.Id, &trashed.Name, &trashed.Price, &trashed.ArtistId,
+			&trashed.ReleaseDate, &trashed.ReleaseType, &trashed.LabelId, &trashed.ImageId, &trashed.Version, &deletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		trashed.DeletedAt, err = sqliteParseTime(deletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		trash = append(trash, trashed)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, trashed := range trash {
+		trashed.Credits, err = sqliteGetCredits(store.db, "album", trashed.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trash, nil
+}
+
+func (store *sqliteAlbums) GetArtistAlbums(artistId string) ([]string, error) {
+	albums, err := sqliteIds(store.db, "SELECT id FROM albums WHERE artist_id = ? AND deleted_at IS NULL ORDER BY rowid", artistId)
+	if err != nil {
+		return nil, err
+	}
+	if len(albums) == 0 {
+		return nil, errors.New("Artist under id does not contain any albums")
+	}
+
+	return albums, nil
+}
+
+/*
+Release dates are stored to the precision they have, so the range is checked on the rows read.
+*/
+func (store *sqliteAlbums) GetReleases(from, to PartialDate) ([]string, error) {
+	rows, err := store.db.Query(
+		"SELECT id, release_date FROM albums WHERE deleted_at IS NULL AND release_date != '' ORDER BY release_date DESC, id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := make([]string, 0)
+	for rows.Next() {
+		var id string
+		var releaseDate PartialDate
+
+		err := rows.Scan(&id, &releaseDate)
+		if err != nil {
+			return nil, err
+		}
+
+		if releasedBetween(releaseDate, from, to) {
+			albums = append(albums, id)
+		}
+	}
+
+	return albums, rows.Err()
+}
+
+func (store *sqliteAlbums) GetLabelAlbums(labelId string) ([]string, error) {
+	return sqliteIds(
+		store.db,
+		"SELECT id FROM albums WHERE label_id = ? AND deleted_at IS NULL ORDER BY release_date DESC, id",
+		labelId,
+	)
+}
+
+type sqliteSongs struct {
+	db sqliteConn
+}
+
+func (store *sqliteSongs) Add(song *Song) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		err := sqliteCheckAdd(tx, "Song", "songs", song.Id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO songs (id, name, genre, genre_id, time, price, disc, track, album_id, artist_id, audio_id, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`,
+			song.Id, song.Name, song.Genre, song.GenreId, song.Time, song.Price, song.Disc, song.Track,
+			song.AlbumId, song.ArtistId, song.AudioId,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetCredits(tx, "song", song.Id, song.Credits)
+	})
+}
+
+func (store *sqliteSongs) Delete(id string, deletedAt time.Time) error {
+	return sqliteExecId(
+		store.db, "Song does not exist",
+		"UPDATE songs SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL",
+		sqliteFormatTime(deletedAt), id,
+	)
+}
+
+func (store *sqliteSongs) Restore(id string) error {
+	return sqliteExecId(
+		store.db, "Song is not in the trash",
+		"UPDATE songs SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL",
+		id,
+	)
+}
+
+func (store *sqliteSongs) Remove(id string) error {
+	return sqliteExecId(store.db, "Song does not exist", "DELETE FROM songs WHERE id = ? AND deleted_at IS NULL", id)
+}
+
+func (store *sqliteSongs) Purge(id string) error {
+	return sqliteExecId(store.db, "Song is not in the trash", "DELETE FROM songs WHERE id = ? AND deleted_at IS NOT NULL", id)
+}
+
+func (store *sqliteSongs) Update(song *Song) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		exists, err := sqliteCheckVersion(tx, "song", "songs", song.Id, song.Version)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("Unable to update song, given song Id does not exist")
+		}
+
+		_, err = tx.Exec(
+			`UPDATE songs SET name = ?, genre = ?, genre_id = ?, time = ?, price = ?, disc = ?, track = ?,
+			album_id = ?, artist_id = ?, audio_id = ?, version = version + 1 WHERE id = ?`,
+			song.Name, song.Genre, song.GenreId, song.Time, song.Price, song.Disc, song.Track,
+			song.AlbumId, song.ArtistId, song.AudioId, song.Id,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetCredits(tx, "song", song.Id, song.Credits)
+	})
+}
+
+func (store *sqliteSongs) Revert(song *Song) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`INSERT INTO songs (id, name, genre, genre_id, time, price, disc, track, album_id, artist_id, audio_id, version)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				name = excluded.name, genre = excluded.genre, genre_id = excluded.genre_id, time = excluded.time,
+				price = excluded.price, disc = excluded.disc, track = excluded.track,
+				album_id = excluded.album_id, artist_id = excluded.artist_id, audio_id = excluded.audio_id,
+				version = excluded.version`,
+			song.Id, song.Name, song.Genre, song.GenreId, song.Time, song.Price, song.Disc, song.Track,
+			song.AlbumId, song.ArtistId, song.AudioId, song.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetCredits(tx, "song", song.Id, song.Credits)
+	})
+}
+
+func (store *sqliteSongs) Get(id string) (*Song, error) {
+	song := new(Song)
+
+	err := store.db.QueryRow(
+		`SELECT id, name, genre, genre_id, time, price, disc, track, album_id, artist_id, audio_id, version
+		FROM songs WHERE id = ? AND deleted_at IS NULL`,
+		id,
+	).Scan(
+		&song.Id, &song.Name, &song.Genre, &song.GenreId, &song.Time, &song.Price, &song.Disc, &song.Track,
+		&song.AlbumId, &song.ArtistId, &song.AudioId, &song.Version,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Song does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	song.Credits, err = sqliteGetCredits(store.db, "song", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return song, nil
+}
+
+func (store *sqliteSongs) GetAll() ([]string, error) {
+	return sqliteIds(store.db, "SELECT id FROM songs WHERE deleted_at IS NULL")
+}
+
+func (store *sqliteSongs) GetTrash() ([]*TrashedSong, error) {
+	rows, err := store.db.Query(
+		`SELECT id, name, genre, genre_id, time, price, disc, track, album_id, artist_id, audio_id, version, deleted_at
+		FROM songs WHERE deleted_at IS NOT NULL ORDER BY deleted_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trash := make([]*TrashedSong, 0)
+	for rows.Next() {
+		trashed := new(TrashedSong)
+		var deletedAt string
+
+		err := rows.Scan(
+			&trashed.Id, &trashed.Name, &trashed.Genre, &trashed.GenreId, &trashed.Time, &trashed.Price, &trashed.Disc, &trashed.Track,
+			&trashed.AlbumId, &trashed.ArtistId, &trashed.AudioId, &trashed.Version, &deletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		trashed.DeletedAt, err = sqliteParseTime(deletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		trash = append(trash, trashed)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, trashed := range trash {
+		trashed.Credits, err = sqliteGetCredits(store.db, "song", trashed.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return trash, nil
+}
+
+func (store *sqliteSongs) GetAlbumSongs(albumId string) ([]string, error) {
+	// Unnumbered songs play after the numbered ones, see Song.playsBefore.
+	songs, err := sqliteIds(
+		store.db,
+		"SELECT id FROM songs WHERE album_id = ? AND deleted_at IS NULL ORDER BY track = 0, disc, track, id",
+		albumId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(songs) == 0 {
+		return nil, errors.New("Album under id does not contain any songs")
+	}
+
+	return songs, nil
+}
+
+func (store *sqliteSongs) GetArtistSongs(artistId string) ([]string, error) {
+	songs, err := sqliteIds(
+		store.db,
+		`SELECT id FROM songs WHERE deleted_at IS NULL
+		AND (artist_id = ? OR id IN (SELECT song_id FROM song_credits WHERE artist_id = ?))
+		ORDER BY rowid`,
+		artistId, artistId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(songs) == 0 {
+		return nil, errors.New("Artist under id does not contain any songs")
+	}
+
+	return songs, nil
+}
+
+func (store *sqliteSongs) GetGenreSongs(genreId string) ([]string, error) {
+	songs, err := sqliteIds(
+		store.db,
+		"SELECT id FROM songs WHERE genre_id = ? AND deleted_at IS NULL ORDER BY rowid",
+		genreId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(songs) == 0 {
+		return nil, errors.New("Genre under id does not contain any songs")
+	}
+
+	return songs, nil
+}
+
+type sqliteRevisions struct {
+	db sqliteConn
+}
+
+func (store *sqliteRevisions) Add(revision *Revision) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		var last int
+		err := tx.QueryRow(
+			"SELECT COALESCE(MAX(number), 0) FROM revisions WHERE kind = ? AND entity_id = ?",
+			revision.Kind, revision.Id,
+		).Scan(&last)
+		if err != nil {
+			return err
+		}
+
+		revision.Number = last + 1
+
+		var data interface{}
+		if revision.Data != nil {
+			data = string(revision.Data)
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO revisions (kind, entity_id, number, time, actor, op, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			revision.Kind, revision.Id, revision.Number,
+			sqliteFormatTime(revision.Time), revision.Actor, revision.Op, data,
+		)
+		return err
+	})
+}
+
+func (store *sqliteRevisions) RemoveLast(kind, id string) error {
+	return sqliteExecId(
+		store.db, "Entity has no revisions",
+		`DELETE FROM revisions WHERE kind = ? AND entity_id = ? AND number =
+			(SELECT MAX(number) FROM revisions WHERE kind = ? AND entity_id = ?)`,
+		kind, id, kind, id,
+	)
+}
+
+func (store *sqliteRevisions) Get(kind, id string) ([]*Revision, error) {
+	rows, err := store.db.Query(
+		`SELECT number, time, actor, op, data FROM revisions
+		WHERE kind = ? AND entity_id = ? ORDER BY number`,
+		kind, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]*Revision, 0)
+	for rows.Next() {
+		revision := &Revision{Kind: kind, Id: id}
+		var at string
+		var data sql.NullString
+
+		err := rows.Scan(&revision.Number, &at, &revision.Actor, &revision.Op, &data)
+		if err != nil {
+			return nil, err
+		}
+
+		revision.Time, err = sqliteParseTime(at)
+		if err != nil {
+			return nil, err
+		}
+
+		if data.Valid {
+			revision.Data = []byte(data.String)
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		return nil, errors.New("Entity has no revisions")
+	}
+
+	return revisions, nil
+}
+
+/*
+Aliases are stored in the aliases column as a JSON array.
+*/
+type sqliteGenres struct {
+	db sqliteConn
+}
+
+func (store *sqliteGenres) Add(genre *Genre) error {
+	aliases, err := json.Marshal(genre.Aliases)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.db.Exec(
+		"INSERT INTO genres (id, name, aliases, parent_id, version) VALUES (?, ?, ?, ?, 1)",
+		genre.Id, genre.Name, string(aliases), genre.ParentId,
+	)
+	return err
+}
+
+func (store *sqliteGenres) Update(genre *Genre) error {
+	aliases, err := json.Marshal(genre.Aliases)
+	if err != nil {
+		return err
+	}
+
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		var current int64
+		err := tx.QueryRow("SELECT version FROM genres WHERE id = ?", genre.Id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return errors.New("Unable to update genre, given genre Id does not exist")
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkVersion("genre", genre.Id, genre.Version, current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE genres SET name = ?, aliases = ?, parent_id = ?, version = version + 1 WHERE id = ?",
+			genre.Name, string(aliases), genre.ParentId, genre.Id,
+		)
+		return err
+	})
+}
+
+func (store *sqliteGenres) Revert(genre *Genre) error {
+	aliases, err := json.Marshal(genre.Aliases)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.db.Exec(
+		`INSERT INTO genres (id, name, aliases, parent_id, version) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name, aliases = excluded.aliases, parent_id = excluded.parent_id,
+			version = excluded.version`,
+		genre.Id, genre.Name, string(aliases), genre.ParentId, genre.Version,
+	)
+	return err
+}
+
+func (store *sqliteGenres) Remove(id string) error {
+	return sqliteExecId(store.db, "Genre does not exist", "DELETE FROM genres WHERE id = ?", id)
+}
+
+func (store *sqliteGenres) Get(id string) (*Genre, error) {
+	genre := new(Genre)
+	var aliases string
+
+	err := store.db.QueryRow(
+		"SELECT id, name, aliases, parent_id, version FROM genres WHERE id = ?",
+		id,
+	).Scan(&genre.Id, &genre.Name, &aliases, &genre.ParentId, &genre.Version)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Genre does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(aliases), &genre.Aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	return genre, nil
+}
+
+func (store *sqliteGenres) GetAll() ([]string, error) {
+	return sqliteIds(store.db, "SELECT id FROM genres ORDER BY id")
+}
+
+type sqlitePlaylists struct {
+	db sqliteConn
+}
+
+/*
+Replaces the songs of a playlist.
+*/
+func sqliteSetPlaylistSongs(tx *sql.Tx, id string, songIds []string) error {
+	_, err := tx.Exec("DELETE FROM playlist_songs WHERE playlist_id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	for i, songId := range songIds {
+		_, err := tx.Exec("INSERT INTO playlist_songs (playlist_id, position, song_id) VALUES (?, ?, ?)", id, i, songId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *sqlitePlaylists) Add(playlist *Playlist) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			"INSERT INTO playlists (id, name, description, owner, version) VALUES (?, ?, ?, ?, 1)",
+			playlist.Id, playlist.Name, playlist.Description, playlist.Owner,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetPlaylistSongs(tx, playlist.Id, playlist.SongIds)
+	})
+}
+
+func (store *sqlitePlaylists) Update(playlist *Playlist) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		var current int64
+		err := tx.QueryRow("SELECT version FROM playlists WHERE id = ?", playlist.Id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return errors.New("Unable to update playlist, given playlist Id does not exist")
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkVersion("playlist", playlist.Id, playlist.Version, current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE playlists SET name = ?, description = ?, owner = ?, version = version + 1 WHERE id = ?",
+			playlist.Name, playlist.Description, playlist.Owner, playlist.Id,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetPlaylistSongs(tx, playlist.Id, playlist.SongIds)
+	})
+}
+
+func (store *sqlitePlaylists) Revert(playlist *Playlist) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`INSERT INTO playlists (id, name, description, owner, version) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				name = excluded.name, description = excluded.description, owner = excluded.owner,
+				version = excluded.version`,
+			playlist.Id, playlist.Name, playlist.Description, playlist.Owner, playlist.Version,
+		)
+		if err != nil {
+			return err
+		}
+
+		return sqliteSetPlaylistSongs(tx, playlist.Id, playlist.SongIds)
+	})
+}
+
+func (store *sqlitePlaylists) Remove(id string) error {
+	return sqliteExecId(store.db, "Playlist does not exist", "DELETE FROM playlists WHERE id = ?", id)
+}
+
+func (store *sqlitePlaylists) Get(id string) (*Playlist, error) {
+	playlist := new(Playlist)
+
+	err := store.db.QueryRow(
+		"SELECT id, name, description, owner, version FROM playlists WHERE id = ?",
+		id,
+	).Scan(&playlist.Id, &playlist.Name, &playlist.Description, &playlist.Owner, &playlist.Version)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Playlist does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	playlist.SongIds, err = sqliteIds(store.db, "SELECT song_id FROM playlist_songs WHERE playlist_id = ? ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return playlist, nil
+}
+
+func (store *sqlitePlaylists) GetAll() ([]string, error) {
+	return sqliteIds(store.db, "SELECT id FROM playlists ORDER BY id")
+}
+
+type sqliteLabels struct {
+	db sqliteConn
+}
+
+func (store *sqliteLabels) Add(label *Label) error {
+	_, err := store.db.Exec("INSERT INTO labels (id, name, version) VALUES (?, ?, 1)", label.Id, label.Name)
+	return err
+}
+
+func (store *sqliteLabels) Update(label *Label) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		var current int64
+		err := tx.QueryRow("SELECT version FROM labels WHERE id = ?", label.Id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return errors.New("Unable to update label, given label Id does not exist")
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkVersion("label", label.Id, label.Version, current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE labels SET name = ?, version = version + 1 WHERE id = ?", label.Name, label.Id)
+		return err
+	})
+}
+
+func (store *sqliteLabels) Revert(label *Label) error {
+	_, err := store.db.Exec(
+		`INSERT INTO labels (id, name, version) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET name = excluded.name, version = excluded.version`,
+		label.Id, label.Name, label.Version,
+	)
+	return err
+}
+
+func (store *sqliteLabels) Remove(id string) error {
+	return sqliteExecId(store.db, "Label does not exist", "DELETE FROM labels WHERE id = ?", id)
+}
+
+func (store *sqliteLabels) Get(id string) (*Label, error) {
+	label := new(Label)
+
+	err := store.db.QueryRow("SELECT id, name, version FROM labels WHERE id = ?", id).Scan(&label.Id, &label.Name, &label.Version)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Label does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return label, nil
+}
+
+func (store *sqliteLabels) GetAll() ([]string, error) {
+	return sqliteIds(store.db, "SELECT id FROM labels ORDER BY id")
+}
+
+type sqliteRelationships struct {
+	db sqliteConn
+}
+
+func (store *sqliteRelationships) Add(relationship *Relationship) error {
+	_, err := store.db.Exec(
+		`INSERT INTO relationships (id, kind, artist_id, related_id, from_date, to_date, version)
+		VALUES (?, ?, ?, ?, ?, ?, 1)`,
+		relationship.Id, relationship.Kind, relationship.ArtistId, relationship.RelatedId, relationship.From, relationship.To,
+	)
+	return err
+}
+
+func (store *sqliteRelationships) Update(relationship *Relationship) error {
+	return sqliteTx(store.db, func(tx *sql.Tx) error {
+		var current int64
+		err := tx.QueryRow("SELECT version FROM relationships WHERE id = ?", relationship.Id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return errors.New("Unable to update relationship, given relationship Id does not exist")
+		}
+		if err != nil {
+			return err
+		}
+
+		err = checkVersion("relationship", relationship.Id, relationship.Version, current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`UPDATE relationships SET kind = ?, artist_id = ?, related_id = ?, from_date = ?, to_date = ?, version = version + 1
+			WHERE id = ?`,
+			relationship.Kind, relationship.ArtistId, relationship.RelatedId, relationship.From, relationship.To, relationship.Id,
+		)
+		return err
+	})
+}
+
+func (store *sqliteRelationships) Revert(relationship *Relationship) error {
+	_, err := store.db.Exec(
+		`INSERT INTO relationships (id, kind, artist_id, related_id, from_date, to_date, version)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			kind = excluded.kind, artist_id = excluded.artist_id, related_id = excluded.related_id,
+			from_date = excluded.from_date, to_date = excluded.to_date, version = excluded.version`,
+		relationship.Id, relationship.Kind, relationship.ArtistId, relationship.RelatedId,
+		relationship.From, relationship.To, relationship.Version,
+	)
+	return err
+}
+
+func (store *sqliteRelationships) Remove(id string) error {
+	return sqliteExecId(store.db, "Relationship does not exist", "DELETE FROM relationships WHERE id = ?", id)
+}
+
+func (store *sqliteRelationships) Get(id string) (*Relationship, error) {
+	relationship := new(Relationship)
+
+	err := store.db.QueryRow(
+		"SELECT id, kind, artist_id, related_id, from_date, to_date, version FROM relationships WHERE id = ?",
+		id,
+	).Scan(
+		&relationship.Id, &relationship.Kind, &relationship.ArtistId, &relationship.RelatedId,
+		&relationship.From, &relationship.To, &relationship.Version,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Relationship does not exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return relationship, nil
+}
+
+func (store *sqliteRelationships) GetAll() ([]string, error) {
+	return sqliteIds(store.db, "SELECT id FROM relationships ORDER BY id")
+}
+
+func (store *sqliteRelationships) GetArtistRelationships(artistId string) ([]*Relationship, error) {
+	rows, err := store.db.Query(
+		`SELECT id, kind, artist_id, related_id, from_date, to_date, version
+		FROM relationships WHERE artist_id = ? OR related_id = ?`,
+		artistId, artistId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	relationships := make([]*Relationship, 0)
+	for rows.Next() {
+		relationship := new(Relationship)
+		err := rows.Scan(
+			&relationship.Id, &relationship.Kind, &relationship.ArtistId, &relationship.RelatedId,
+			&relationship.From, &relationship.To, &relationship.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		relationships = append(relationships, relationship)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	sortRelationships(relationships)
+
+	return relationships, nil
+}
@@ -0,0 +1,96 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+A State on a new sqlite catalog in dir.
+*/
+func openTestSqlite(test *testing.T, dir string) *State {
+	albums, artists, songs, revisions, genres, playlists, labels, relationships, db, err := OpenSqlite(filepath.Join(dir, "catalog.db"))
+	if err != nil {
+		test.Fatalf("Unable to open sqlite: %s", err)
+	}
+
+	state, err := NewStateWith(albums, artists, songs)
+	if err != nil {
+		db.Close()
+		test.Fatalf("Unable to create state: %s", err)
+	}
+	state.revisions = revisions
+	state.genres = genres
+	state.playlists = playlists
+	state.labels = labels
+	state.relationships = relationships
+	state.db = db
+
+	return state
+}
+
+func TestSqliteTransaction(test *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		test.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := openTestSqlite(test, dir)
+	defer state.db.Close()
+
+	failure := errors.New("Failing on purpose")
+	err = state.transact("test", func(tx *catalogTx) error {
+		err := tx.addArtist(&Artist{Id: "sqliteTxArtist", Name: "sqliteTxArtist"})
+		if err != nil {
+			return err
+		}
+
+		// Nothing is committed before the transaction ends.
+		if _, err := state.artists.Get("sqliteTxArtist"); err == nil {
+			test.Errorf("Expected the artist to be invisible outside the transaction")
+		}
+		if _, err := tx.state.artists.Get("sqliteTxArtist"); err != nil {
+			test.Errorf("Expected the artist to be visible inside the transaction: %s", err)
+		}
+
+		return failure
+	})
+	if err != failure {
+		test.Fatalf("Expected the transaction to fail, got %v", err)
+	}
+
+	if _, err := state.artists.Get("sqliteTxArtist"); err == nil {
+		test.Errorf("Expected the artist to be rolled back")
+	}
+	if _, err := state.revisions.Get(REVISION_ARTIST, "sqliteTxArtist"); err == nil {
+		test.Errorf("Expected the revision to be rolled back")
+	}
+
+	err = state.addArtist("test", &Artist{Id: "sqliteTxArtist", Name: "sqliteTxArtist"})
+	if err != nil {
+		test.Fatalf("Unable to add artist: %s", err)
+	}
+	if _, err := state.artists.Get("sqliteTxArtist"); err != nil {
+		test.Errorf("Expected the committed artist: %s", err)
+	}
+}
+
+func TestSqlitePurgeReferenced(test *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite")
+	if err != nil {
+		test.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := openTestSqlite(test, dir)
+	defer state.db.Close()
+
+	checkPurgeReferenced(test, state)
+}
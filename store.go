@@ -2,54 +2,372 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type State struct {
-	log     *Log
-	albums  *Albums
-	artists *Artists
-	songs   *Songs
+	// Held while changing the catalog, see transact in txn.go,
+	// and for reading while answering a read, see readCommitted.
+	lock sync.RWMutex
+
+	log           *Log
+	albums        AlbumStore
+	artists       ArtistStore
+	songs         SongStore
+	revisions     RevisionStore
+	genres        GenreStore
+	playlists     PlaylistStore
+	labels        LabelStore
+	relationships RelationshipStore
+	images        *Images
+	audio         *AudioFiles
+
+	wal       *Wal
+	snapshots *Snapshots
+	db        io.Closer
 }
 
+/*
+Opens the sqlite storage backend.
+Set by sqlite.go, which is only built with -tags sqlite.
+*/
+var openSqliteStores func(path string) (AlbumStore, ArtistStore, SongStore, RevisionStore, GenreStore, PlaylistStore, LabelStore, RelationshipStore, io.Closer, error)
+
+/*
+Creates the State from the configured storage.
+*/
 func NewState() (*State, error) {
 	config := GetConfig()
 
+	switch config.GetStorage() {
+	case STORAGE_SQLITE:
+		return newSqliteState()
+	default:
+		return newMemoryState()
+	}
+}
+
+func newSqliteState() (*State, error) {
+	config := GetConfig()
+
+	if openSqliteStores == nil {
+		return nil, errors.New("Storage sqlite is not available, build with -tags sqlite")
+	}
+
+	dataDir := config.GetDataDir()
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	albums, artists, songs, revisions, genres, playlists, labels, relationships, db, err := openSqliteStores(filepath.Join(dataDir, "catalog.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := NewStateWith(albums, artists, songs)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	state.revisions = revisions
+	state.genres = genres
+	state.playlists = playlists
+	state.labels = labels
+	state.relationships = relationships
+	state.db = db
+
+	return state, nil
+}
+
+/*
+Creates a State keeping the catalog in memory.
+When a data directory is configured, the newest snapshot is loaded and
+the write-ahead log after it is replayed into the in memory stores
+before they are handed to the State.
+*/
+func newMemoryState() (*State, error) {
+	config := GetConfig()
+
+	albums := NewAlbums()
+	artists := NewArtists()
+	songs := NewSongs()
+	revisions := NewRevisions()
+	genres := NewGenres()
+	playlists := NewPlaylists()
+	labels := NewLabels()
+	relationships := NewRelationships()
+
+	dataDir := config.GetDataDir()
+	if dataDir == "" {
+		return NewStateWith(albums, artists, songs)
+	}
+
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := OpenWal(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := NewSnapshots(dataDir, wal, albums, artists, songs, revisions, genres, playlists, labels, relationships)
+
+	seq, err := snapshots.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	err = wal.Replay(seq, func(record *walRecord) error {
+		return replayWalRecord(albums, artists, songs, revisions, genres, playlists, labels, relationships, record)
+	})
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	state, err := NewStateWith(
+		&walAlbums{albums, wal},
+		&walArtists{artists, wal},
+		&walSongs{songs, wal},
+	)
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	state.revisions = &walRevisions{revisions, wal}
+	state.genres = &walGenres{genres, wal}
+	state.playlists = &walPlaylists{playlists, wal}
+	state.labels = &walLabels{labels, wal}
+	state.relationships = &walRelationships{relationships, wal}
+	state.wal = wal
+	state.snapshots = snapshots
+
+	interval := config.GetSnapshotInterval()
+	if interval > 0 {
+		snapshots.Start(interval)
+	}
+
+	return state, nil
+}
+
+/*
+Creates a State on top of the given storage backends.
+The revision history, genres, playlists, labels and relationships are kept in memory,
+unless the caller replaces them.
+*/
+func NewStateWith(albums AlbumStore, artists ArtistStore, songs SongStore) (*State, error) {
+	config := GetConfig()
+
 	state := &State{
-		log:     NewLogger("store", config.GetLogLevel()),
-		albums:  NewAlbums(),
-		artists: NewArtists(),
-		songs:   NewSongs(),
+		log:           NewLogger("store", config.GetLogLevel()),
+		albums:        albums,
+		artists:       artists,
+		songs:         songs,
+		revisions:     NewRevisions(),
+		genres:        NewGenres(),
+		playlists:     NewPlaylists(),
+		labels:        NewLabels(),
+		relationships: NewRelationships(),
+		images:        NewImages(config.GetMediaDir()),
+		audio:         NewAudioFiles(""),
+	}
+	if mediaDir := config.GetMediaDir(); mediaDir != "" {
+		state.audio = NewAudioFiles(filepath.Join(mediaDir, "audio"))
 	}
 
 	return state, nil
 }
 
+/*
+A copy of the State working on the given stores, such as stores bound to a transaction of the backend.
+*/
+func (state *State) withStores(
+	albums AlbumStore,
+	artists ArtistStore,
+	songs SongStore,
+	revisions RevisionStore,
+	genres GenreStore,
+	playlists PlaylistStore,
+	labels LabelStore,
+	relationships RelationshipStore,
+) *State {
+	return &State{
+		log:           state.log,
+		albums:        albums,
+		artists:       artists,
+		songs:         songs,
+		revisions:     revisions,
+		genres:        genres,
+		playlists:     playlists,
+		labels:        labels,
+		relationships: relationships,
+		images:        state.images,
+		audio:         state.audio,
+		wal:           state.wal,
+		snapshots:     state.snapshots,
+		db:            state.db,
+	}
+}
+
+/*
+Releases the storage held by the State.
+*/
+func (state *State) Close() error {
+	if state.db != nil {
+		return state.db.Close()
+	}
+
+	if state.wal == nil {
+		return nil
+	}
+
+	if state.snapshots.stop != nil {
+		state.snapshots.Stop()
+
+		// Leave a fresh snapshot behind so the next start has little to replay.
+		err := state.snapshots.Take()
+		if err != nil {
+			state.log.Error("Error writing snapshot on close: %s", err)
+		}
+	}
+
+	return state.wal.Close()
+}
+
+/*
+Who made a request, for the revision history.
+Taken from the X-Actor header, or the remote address when it is not set.
+*/
+func requestActor(req *http.Request) string {
+	actor := req.Header.Get("X-Actor")
+	if actor == "" {
+		return req.RemoteAddr
+	}
+
+	return actor
+}
+
 /*
 Writes an error response to the http.ResponseWriter
 */
 func (state *State) writeRespError(resp http.ResponseWriter, errResp string) {
+	state.writeRespErrorStatus(resp, 422, errResp)
+}
+
+/*
+Writes an error response with the given status code to the http.ResponseWriter
+*/
+func (state *State) writeRespErrorStatus(resp http.ResponseWriter, status int, errResp string) {
 	// Set the header.
 	resp.Header().Set(
 		"Content-Type",
 		"application/json;charset=UTF-8",
 	)
 
-	resp.WriteHeader(422)
+	resp.WriteHeader(status)
 	err := json.NewEncoder(resp).Encode(errResp)
 	if err != nil {
 		state.log.Warn("Error writing error response %s: %s", errResp, err)
 	}
 }
 
+/*
+Writes an error response for a failed store operation.
+Errors the client can act on are passed through, anything else is reported as errResp.
+*/
+func (state *State) writeStoreError(resp http.ResponseWriter, err error, errResp string) {
+	if err == ClientIdRefusedError {
+		state.writeRespError(resp, err.Error())
+		return
+	}
+
+	if err == MediaDisabledError {
+		state.writeRespErrorStatus(resp, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	switch err.(type) {
+	case *MissingReferenceError, *ValidationError:
+		state.writeRespError(resp, err.Error())
+	case *DeleteRestrictedError, *VersionConflictError, *TrackTakenError, *GenreNameTakenError, *RelationshipConflictError:
+		state.writeRespErrorStatus(resp, http.StatusConflict, err.Error())
+	default:
+		state.writeRespError(resp, errResp)
+	}
+}
+
+/*
+Applies the If-Match header of an update request to the version of the update.
+Returns whether the header was given, and false for ok when the response was
+already written because the header is invalid, contradicts the body, or is
+missing along with the version when the requireVersion setting is on.
+*/
+func (state *State) readIfMatch(resp http.ResponseWriter, req *http.Request, version *int64) (bool, bool) {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		err := requireVersion(*version)
+		if err != nil {
+			state.log.Warn("Update without a version from %s", req.RemoteAddr)
+			state.writeRespErrorStatus(resp, http.StatusPreconditionRequired, err.Error())
+			return false, false
+		}
+
+		return false, true
+	}
+
+	ifMatch, err := parseIfMatch(header)
+	if err != nil {
+		state.log.Warn("Error reading If-Match from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid If-Match header")
+		return true, false
+	}
+
+	if ifMatch != 0 && *version != 0 && ifMatch != *version {
+		state.log.Warn("If-Match %d does not match version %d from %s", ifMatch, *version, req.RemoteAddr)
+		state.writeRespErrorStatus(resp, http.StatusPreconditionFailed, "If-Match does not match the version")
+		return true, false
+	}
+
+	if ifMatch != 0 {
+		*version = ifMatch
+	}
+
+	return true, true
+}
+
+/*
+Writes the error response of a failed update.
+A stale version is 412 Precondition Failed when the client sent If-Match,
+and 409 Conflict when it came from the body.
+*/
+func (state *State) writeUpdateError(resp http.ResponseWriter, err error, ifMatch bool, errResp string) {
+	if _, ok := err.(*VersionConflictError); ok && ifMatch {
+		state.writeRespErrorStatus(resp, http.StatusPreconditionFailed, err.Error())
+		return
+	}
+
+	state.writeStoreError(resp, err, errResp)
+}
+
 /*
 http end point for adding a new album.
-val addAlbum: Album -> unit
+val addAlbum: Album -> Album
 */
 func (state *State) addAlbumHandle(resp http.ResponseWriter, req *http.Request) {
 	state.log.Info("Got request for addAlbum")
@@ -57,10 +375,8 @@ func (state *State) addAlbumHandle(resp http.ResponseWriter, req *http.Request)
 	var album Album
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -72,21 +388,33 @@ func (state *State) addAlbumHandle(resp http.ResponseWriter, req *http.Request)
 	}
 
 	// Try to create the album.
-	err = state.albums.Add(&album)
+	err = state.addAlbum(requestActor(req), &album)
 	if err != nil {
 		state.log.Warn("Error adding album %#v for %s: %s", album, req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot add new album")
+		state.writeStoreError(resp, err, "Cannot add new album")
 		return
 	}
 
 	state.log.Info("Added album %#v", album)
 
+	// Respond with the album as stored, with its id and version.
+	created, err := state.albums.Get(album.Id)
+	if err != nil {
+		// Deleted again in the meantime.
+		created = &album
+	}
+
+	resp.Header().Set("ETag", formatETag(created.Version))
 	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*created)
+	if err != nil {
+		state.log.Warn("Error writing addAlbum response %#v to %s: %s", *created, req.RemoteAddr, err)
+	}
 }
 
 /*
 http end point for adding a new artist
-val addArtist: Artist -> unit
+val addArtist: Artist -> Artist
 */
 func (state *State) addArtistHandle(resp http.ResponseWriter, req *http.Request) {
 	state.log.Info("Got request for addArtist")
@@ -94,10 +422,8 @@ func (state *State) addArtistHandle(resp http.ResponseWriter, req *http.Request)
 	var artist Artist
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
-	if err != nil {
-		state.log.Warn("Error reading body from %s", req.RemoteAddr)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -109,21 +435,33 @@ func (state *State) addArtistHandle(resp http.ResponseWriter, req *http.Request)
 	}
 
 	// Try to create the artist.
-	err = state.artists.Add(&artist)
+	err = state.addArtist(requestActor(req), &artist)
 	if err != nil {
 		state.log.Warn("Error storing artist %#v for %s: %s", artist, req.RemoteAddr, err)
-		state.writeRespError(resp, "Unable to store artist")
+		state.writeStoreError(resp, err, "Unable to store artist")
 		return
 	}
 
 	state.log.Info("Added artist %#v", artist)
 
+	// Respond with the artist as stored, with its id and version.
+	created, err := state.artists.Get(artist.Id)
+	if err != nil {
+		// Deleted again in the meantime.
+		created = &artist
+	}
+
+	resp.Header().Set("ETag", formatETag(created.Version))
 	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*created)
+	if err != nil {
+		state.log.Warn("Error writing addArtist response %#v to %s: %s", *created, req.RemoteAddr, err)
+	}
 }
 
 /*
 http end point for adding a new song
-val addSong: Song -> unit
+val addSong: Song -> Song
 */
 func (state *State) addSongHandle(resp http.ResponseWriter, req *http.Request) {
 	state.log.Info("Got request for addSong")
@@ -131,10 +469,8 @@ func (state *State) addSongHandle(resp http.ResponseWriter, req *http.Request) {
 	var song Song
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -146,85 +482,123 @@ func (state *State) addSongHandle(resp http.ResponseWriter, req *http.Request) {
 	}
 
 	// Try to create the song.
-	err = state.songs.Add(&song)
+	err = state.addSong(requestActor(req), &song)
 	if err != nil {
 		state.log.Warn("Error adding song %#v for %s: %s", song, req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot add new song")
+		state.writeStoreError(resp, err, "Cannot add new song")
 		return
 	}
 
 	state.log.Info("Added song %#v", song)
 
+	// Respond with the song as stored, with its id and version.
+	created, err := state.songs.Get(song.Id)
+	if err != nil {
+		// Deleted again in the meantime.
+		created = &song
+	}
+
+	resp.Header().Set("ETag", formatETag(created.Version))
 	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*created)
+	if err != nil {
+		state.log.Warn("Error writing addSong response %#v to %s: %s", *created, req.RemoteAddr, err)
+	}
 }
 
 /*
 http end point for deleting an album
-val deleteAlbum: string -> unit
+val deleteAlbum: string | DeleteRequest -> DeleteResult
 */
 func (state *State) deleteAlbumHandle(resp http.ResponseWriter, req *http.Request) {
 	state.log.Info("Got request for deleteAlbum")
 
-	var id string
+	var request deleteRequest
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
-	err = json.Unmarshal(body, &id)
+	err = json.Unmarshal(body, &request)
 	if err != nil {
 		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
 		state.writeRespError(resp, "Invalid JSON")
 		return
 	}
 
+	if request.Policy == "" {
+		request.Policy = GetConfig().GetDeletePolicy()
+	}
+	if !validDeletePolicy(request.Policy) {
+		state.log.Warn("Invalid delete policy %s from %s", request.Policy, req.RemoteAddr)
+		state.writeRespError(resp, "Invalid delete policy")
+		return
+	}
+
 	// Try to delete the album.
-	err = state.albums.Delete(id)
+	result, err := state.deleteAlbum(requestActor(req), request.Id, request.Policy)
 	if err != nil {
-		state.log.Warn("Error deleting album %s for %s: %s", id, req.RemoteAddr, err)
-		state.writeRespError(resp, "Unable to delete album")
+		state.log.Warn("Error deleting album %s for %s: %s", request.Id, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to delete album")
 		return
 	}
 
+	state.log.Info("Deleted album %s with policy %s: %#v", request.Id, request.Policy, *result)
+
 	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(result)
+	if err != nil {
+		state.log.Warn("Error writing deleteAlbum response %#v to %s: %s", *result, req.RemoteAddr, err)
+	}
 }
 
 /*
-val deleteArtist: string -> unit
+val deleteArtist: string | DeleteRequest -> DeleteResult
 */
 func (state *State) deleteArtistHandle(resp http.ResponseWriter, req *http.Request) {
 	state.log.Info("Got request for deleteArtist")
 
-	var id string
+	var request deleteRequest
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
-	err = json.Unmarshal(body, &id)
+	err = json.Unmarshal(body, &request)
 	if err != nil {
 		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
 		state.writeRespError(resp, "Invalid JSON")
 		return
 	}
 
+	if request.Policy == "" {
+		request.Policy = GetConfig().GetDeletePolicy()
+	}
+	if !validDeletePolicy(request.Policy) {
+		state.log.Warn("Invalid delete policy %s from %s", request.Policy, req.RemoteAddr)
+		state.writeRespError(resp, "Invalid delete policy")
+		return
+	}
+
 	// Try to delete the artist.
-	err = state.artists.Delete(id)
+	result, err := state.deleteArtist(requestActor(req), request.Id, request.Policy)
 	if err != nil {
-		state.log.Warn("Error deleting artist %s for %s: %s", id, req.RemoteAddr, err)
-		state.writeRespError(resp, "Unable to delete artist")
+		state.log.Warn("Error deleting artist %s for %s: %s", request.Id, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to delete artist")
 		return
 	}
 
+	state.log.Info("Deleted artist %s with policy %s: %#v", request.Id, request.Policy, *result)
+
 	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(result)
+	if err != nil {
+		state.log.Warn("Error writing deleteArtist response %#v to %s: %s", *result, req.RemoteAddr, err)
+	}
 }
 
 /*
@@ -236,10 +610,8 @@ func (state *State) deleteSongHandle(resp http.ResponseWriter, req *http.Request
 	var id string
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -251,7 +623,7 @@ func (state *State) deleteSongHandle(resp http.ResponseWriter, req *http.Request
 	}
 
 	// Try to delete the song.
-	err = state.songs.Delete(id)
+	err = state.deleteSong(requestActor(req), id)
 	if err != nil {
 		state.log.Warn("Error deleting song %s for %s: %s", id, req.RemoteAddr, err)
 		state.writeRespError(resp, "Unable to delete song")
@@ -270,10 +642,8 @@ func (state *State) getAlbumHandle(resp http.ResponseWriter, req *http.Request)
 	var id string
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -291,8 +661,9 @@ func (state *State) getAlbumHandle(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	resp.Header().Set("ETag", formatETag(album.Version))
 	resp.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(resp).Encode(*album)
+	err = json.NewEncoder(resp).Encode(state.albumDetails(album))
 	if err != nil {
 		state.log.Warn(
 			"Error writing getAlbum response %#v to %s: %s",
@@ -313,10 +684,8 @@ func (state *State) getArtistHandle(resp http.ResponseWriter, req *http.Request)
 	var id string
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -334,8 +703,9 @@ func (state *State) getArtistHandle(resp http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	resp.Header().Set("ETag", formatETag(artist.Version))
 	resp.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(resp).Encode(*artist)
+	err = json.NewEncoder(resp).Encode(state.artistDetails(artist))
 	if err != nil {
 		state.log.Warn("Error writeing getArtist response %#v to %s: %s", *artist, req.RemoteAddr, err)
 	}
@@ -350,10 +720,8 @@ func (state *State) getSongHandle(resp http.ResponseWriter, req *http.Request) {
 	var id string
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -371,6 +739,7 @@ func (state *State) getSongHandle(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	resp.Header().Set("ETag", formatETag(song.Version))
 	resp.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(resp).Encode(*song)
 	if err != nil {
@@ -444,6 +813,81 @@ func (state *State) getAllArtistsHandle(resp http.ResponseWriter, req *http.Requ
 	}
 }
 
+/*
+val getArtistsByBirthYear: BirthYearRequest -> []string
+Returns the ids of the artists born from the year from to the year to, ordered by birthdate.
+*/
+func (state *State) getArtistsByBirthYearHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getArtistsByBirthYear")
+
+	var request BirthYearRequest
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	if request.To < request.From {
+		state.writeRespError(resp, "'to' must not be before 'from'")
+		return
+	}
+
+	artists, err := state.artists.GetByBirthYear(request.From, request.To)
+	if err != nil {
+		state.log.Warn("Error getting artists born %d to %d for %s: %s", request.From, request.To, req.RemoteAddr, err)
+		state.writeRespError(resp, "Error retrieving artists")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(artists)
+	if err != nil {
+		state.log.Warn("Error writing getArtistsByBirthYear response %#v to %s: %s", artists, req.RemoteAddr, err)
+	}
+}
+
+/*
+val reorderAlbumSongs: ReorderRequest -> unit
+Renumbers every song of the album in one change.
+*/
+func (state *State) reorderAlbumSongsHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for reorderAlbumSongs")
+
+	var request ReorderRequest
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.reorderAlbumSongs(requestActor(req), &request)
+	if err != nil {
+		state.log.Warn("Error reordering songs of album %s for %s: %s", request.AlbumId, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to reorder songs")
+		return
+	}
+
+	state.log.Info("Reordered songs of album '%s'", request.AlbumId)
+
+	resp.WriteHeader(http.StatusOK)
+}
+
 /*
 val getArtistAlbums: string -> []string
 Takes the id of the artist.
@@ -455,10 +899,8 @@ func (state *State) getArtistAlbumsHandle(resp http.ResponseWriter, req *http.Re
 	var artistId string
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -494,10 +936,8 @@ func (state *State) getAlbumSongsHandle(resp http.ResponseWriter, req *http.Requ
 	var albumId string
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -523,41 +963,39 @@ func (state *State) getAlbumSongsHandle(resp http.ResponseWriter, req *http.Requ
 }
 
 /*
-val getArtistSongs: string -> []string
-Takes the id of the artist.
-Returns the array of song ids.
+val getArtistSongs: string | ArtistSongsRequest -> []string
+Takes the id of the artist, or an ArtistSongsRequest to filter by role.
+Returns the array of ids of the songs the artist is credited on.
 */
 func (state *State) getArtistSongsHandle(resp http.ResponseWriter, req *http.Request) {
 	state.log.Info("Got request for getArtistSongs")
 
-	var artistId string
+	var request ArtistSongsRequest
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
-	err = json.Unmarshal(body, &artistId)
+	err = json.Unmarshal(body, &request)
 	if err != nil {
 		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
 		state.writeRespError(resp, "Invalid JSON")
 		return
 	}
 
-	songs, err := state.songs.GetArtistSongs(artistId)
+	songs, err := state.getArtistSongs(&request)
 	if err != nil {
-		state.log.Warn("Error retrieving artist %s songs for %s: %s", artistId, req.RemoteAddr, err)
-		state.writeRespError(resp, "Error retrieving artist's songs")
+		state.log.Warn("Error retrieving artist %s songs for %s: %s", request.ArtistId, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Error retrieving artist's songs")
 		return
 	}
 
 	resp.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(resp).Encode(songs)
 	if err != nil {
-		state.log.Warn("Error writing getArtistSongs of artist %s for %s: %s", artistId, req.RemoteAddr, err)
+		state.log.Warn("Error writing getArtistSongs of artist %s for %s: %s", request.ArtistId, req.RemoteAddr, err)
 	}
 }
 
@@ -570,10 +1008,8 @@ func (state *State) updateAlbumHandle(resp http.ResponseWriter, req *http.Reques
 	var album Album
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -584,13 +1020,21 @@ func (state *State) updateAlbumHandle(resp http.ResponseWriter, req *http.Reques
 		return
 	}
 
-	err = state.albums.Update(&album)
+	ifMatch, ok := state.readIfMatch(resp, req, &album.Version)
+	if !ok {
+		return
+	}
+
+	err = state.updateAlbum(requestActor(req), &album)
 	if err != nil {
 		state.log.Warn("Error updating album %#v for %s: %s", album, req.RemoteAddr, err)
-		state.writeRespError(resp, "Unable to update album")
+		state.writeUpdateError(resp, err, ifMatch, "Unable to update album")
 		return
 	}
 
+	if updated, err := state.albums.Get(album.Id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
 	resp.WriteHeader(http.StatusOK)
 }
 
@@ -603,10 +1047,8 @@ func (state *State) updateArtistHandle(resp http.ResponseWriter, req *http.Reque
 	var artist Artist
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
-	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+	body, ok := state.readBody(resp, req)
+	if !ok {
 		return
 	}
 
@@ -617,13 +1059,21 @@ func (state *State) updateArtistHandle(resp http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	err = state.artists.Update(&artist)
+	ifMatch, ok := state.readIfMatch(resp, req, &artist.Version)
+	if !ok {
+		return
+	}
+
+	err = state.updateArtist(requestActor(req), &artist)
 	if err != nil {
 		state.log.Warn("Error updating artist %#v for %s: %s", artist, req.RemoteAddr, err)
-		state.writeRespError(resp, "Unable to update artist")
+		state.writeUpdateError(resp, err, ifMatch, "Unable to update artist")
 		return
 	}
 
+	if updated, err := state.artists.Get(artist.Id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
 	resp.WriteHeader(http.StatusOK)
 }
 
@@ -633,28 +1083,1485 @@ func (state *State) updateSongHandle(resp http.ResponseWriter, req *http.Request
 	var song Song
 	var err error
 
-	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<10))
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &song)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	ifMatch, ok := state.readIfMatch(resp, req, &song.Version)
+	if !ok {
+		return
+	}
+
+	err = state.updateSong(requestActor(req), &song)
+	if err != nil {
+		state.log.Warn("Error updating song %#v for %s: %s", song, req.RemoteAddr, err)
+		state.writeUpdateError(resp, err, ifMatch, "Unable to update song")
+		return
+	}
+
+	if updated, err := state.songs.Get(song.Id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val transaction: TxRequest -> TxResult
+Applies all operations or none of them.
+Responds 200 when committed, 422 with the same result when rolled back.
+*/
+func (state *State) transactionHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for transaction")
+
+	var request TxRequest
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	result := state.runTransaction(requestActor(req), &request)
+	status := http.StatusOK
+	if !result.Committed {
+		state.log.Warn("Rolled back transaction of %d operations for %s", len(request.Operations), req.RemoteAddr)
+		status = 422
+	} else {
+		state.log.Info("Committed transaction of %d operations", len(request.Operations))
+	}
+
+	resp.Header().Set(
+		"Content-Type",
+		"application/json;charset=UTF-8",
+	)
+	resp.WriteHeader(status)
+	err = json.NewEncoder(resp).Encode(result)
+	if err != nil {
+		state.log.Warn("Error writing transaction response to %s: %s", req.RemoteAddr, err)
+	}
+}
+
+/*
+val checkCatalog: CheckRequest -> CheckReport
+Takes an optional CheckRequest, an empty body only checks.
+*/
+func (state *State) checkCatalogHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for checkCatalog")
+
+	var request CheckRequest
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &request)
+		if err != nil {
+			state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+			state.writeRespError(resp, "Invalid JSON")
+			return
+		}
+	}
+
+	report, err := state.checkCatalog(request.Repair)
+	if err != nil {
+		state.log.Error("Error checking catalog for %s: %s", req.RemoteAddr, err)
+		state.writeRespErrorStatus(resp, http.StatusInternalServerError, "Unable to check catalog")
+		return
+	}
+
+	state.log.Info("Checked catalog, found %d issues, repair %t", len(report.Issues), request.Repair)
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(report)
+	if err != nil {
+		state.log.Warn("Error writing checkCatalog response to %s: %s", req.RemoteAddr, err)
+	}
+}
+
+/*
+val getTrash: () -> Trash
+*/
+func (state *State) getTrashHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getTrash")
+
+	trash, err := state.getTrash()
+	if err != nil {
+		state.log.Error("Error listing trash for %s: %s", req.RemoteAddr, err)
+		state.writeRespErrorStatus(resp, http.StatusInternalServerError, "Unable to list trash")
+		return
+	}
+
+	resp.Header().Set(
+		"Content-Type",
+		"application/json;charset=UTF-8",
+	)
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(trash)
+	if err != nil {
+		state.log.Warn("Error writing getTrash response to %s: %s", req.RemoteAddr, err)
+	}
+}
+
+/*
+val restoreFromTrash: RestoreRequest -> ()
+*/
+func (state *State) restoreFromTrashHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for restoreFromTrash")
+
+	var request RestoreRequest
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.restore(requestActor(req), &request)
+	if err != nil {
+		state.log.Warn("Error restoring %s from trash for %s: %s", request.Kind, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, fmt.Sprintf("Unable to restore %s", request.Kind))
+		return
+	}
+
+	state.log.Info("Restored %s '%s' from trash", request.Kind, request.Id)
+
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val purgeTrash: PurgeRequest -> DeleteResult
+Takes an optional PurgeRequest, an empty body purges what is past the retention.
+*/
+func (state *State) purgeTrashHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for purgeTrash")
+
+	var request PurgeRequest
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &request)
+		if err != nil {
+			state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+			state.writeRespError(resp, "Invalid JSON")
+			return
+		}
+	}
+
+	before := time.Now().Add(-GetConfig().GetTrashRetention())
+	if request.Before != nil {
+		before = *request.Before
+	}
+
+	result, err := state.purgeTrash(requestActor(req), before)
+	if err != nil {
+		state.log.Error("Error purging trash for %s: %s", req.RemoteAddr, err)
+		state.writeRespErrorStatus(resp, http.StatusInternalServerError, "Unable to purge trash")
+		return
+	}
+
+	state.log.Info(
+		"Purged %d artists, %d albums and %d songs deleted before %s",
+		len(result.Artists), len(result.Albums), len(result.Songs), before,
+	)
+
+	resp.Header().Set(
+		"Content-Type",
+		"application/json;charset=UTF-8",
+	)
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(result)
+	if err != nil {
+		state.log.Warn("Error writing purgeTrash response to %s: %s", req.RemoteAddr, err)
+	}
+}
+
+/*
+Reads the RevisionRequest body of the revision end points.
+Returns false when the response was already written.
+*/
+func (state *State) readRevisionRequest(resp http.ResponseWriter, req *http.Request, request *RevisionRequest) bool {
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return false
+	}
+
+	err := json.Unmarshal(body, request)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return false
+	}
+
+	return true
+}
+
+func (state *State) writeRevisionResponse(resp http.ResponseWriter, req *http.Request, endPoint string, value interface{}) {
+	resp.Header().Set(
+		"Content-Type",
+		"application/json;charset=UTF-8",
+	)
+	resp.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(resp).Encode(value)
+	if err != nil {
+		state.log.Warn("Error writing %s response to %s: %s", endPoint, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getRevisions: RevisionRequest -> []Revision
+*/
+func (state *State) getRevisionsHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getRevisions")
+
+	var request RevisionRequest
+	if !state.readRevisionRequest(resp, req, &request) {
+		return
+	}
+
+	revisions, err := state.getRevisions(request.Kind, request.Id)
+	if err != nil {
+		state.log.Warn("Error getting revisions of %s '%s' for %s: %s", request.Kind, request.Id, req.RemoteAddr, err)
+		state.writeRespErrorStatus(resp, http.StatusNotFound, err.Error())
+		return
+	}
+
+	state.writeRevisionResponse(resp, req, "getRevisions", revisions)
+}
+
+/*
+val diffRevisions: RevisionRequest -> []FieldChange
+*/
+func (state *State) diffRevisionsHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for diffRevisions")
+
+	var request RevisionRequest
+	if !state.readRevisionRequest(resp, req, &request) {
+		return
+	}
+
+	changes, err := state.diffRevisions(request.Kind, request.Id, request.From, request.To)
+	if err != nil {
+		state.log.Warn("Error diffing revisions of %s '%s' for %s: %s", request.Kind, request.Id, req.RemoteAddr, err)
+		state.writeRespError(resp, err.Error())
+		return
+	}
+
+	state.writeRevisionResponse(resp, req, "diffRevisions", changes)
+}
+
+/*
+val getRevisionAt: RevisionRequest -> Revision
+Responds 404 when the entity did not exist at the time, or was in the trash.
+*/
+func (state *State) getRevisionAtHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getRevisionAt")
+
+	var request RevisionRequest
+	if !state.readRevisionRequest(resp, req, &request) {
+		return
+	}
+
+	if request.At == nil {
+		state.writeRespError(resp, "Missing 'at'")
+		return
+	}
+
+	revision, err := state.getRevisionAt(request.Kind, request.Id, *request.At)
+	if err == nil && revision == nil {
+		err = fmt.Errorf("%s '%s' did not exist at %s", request.Kind, request.Id, request.At.Format(time.RFC3339))
+	}
+	if err != nil {
+		state.log.Warn("Error getting revision of %s '%s' for %s: %s", request.Kind, request.Id, req.RemoteAddr, err)
+		state.writeRespErrorStatus(resp, http.StatusNotFound, err.Error())
+		return
+	}
+
+	state.writeRevisionResponse(resp, req, "getRevisionAt", revision)
+}
+
+/*
+http end point for adding a new genre
+val addGenre: Genre -> Genre
+*/
+func (state *State) addGenreHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for addGenre")
+
+	var genre Genre
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &genre)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.addGenre(requestActor(req), &genre)
+	if err != nil {
+		state.log.Warn("Error storing genre %#v for %s: %s", genre, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to store genre")
+		return
+	}
+
+	state.log.Info("Added genre %#v", genre)
+
+	created, err := state.genres.Get(genre.Id)
+	if err != nil {
+		// Deleted again in the meantime.
+		created = &genre
+	}
+
+	resp.Header().Set("ETag", formatETag(created.Version))
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*created)
+	if err != nil {
+		state.log.Warn("Error writing addGenre response %#v to %s: %s", *created, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getGenre: string -> Genre
+*/
+func (state *State) getGenreHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getGenre")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	genre, err := state.genres.Get(id)
+	if err != nil {
+		state.log.Warn("Error getting genre %s from %s: %s", id, req.RemoteAddr, err)
+		state.writeRespError(resp, "Genre does not exist")
+		return
+	}
+
+	resp.Header().Set("ETag", formatETag(genre.Version))
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*genre)
+	if err != nil {
+		state.log.Warn("Error writing getGenre response %#v to %s: %s", *genre, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getAllGenres: () -> []string
+*/
+func (state *State) getAllGenresHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getAllGenres")
+
+	var err error
+
+	genres, err := state.genres.GetAll()
+	if err != nil {
+		state.log.Warn("Error getting all genres for %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Error retrieving genres")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(genres)
+	if err != nil {
+		state.log.Warn("Error writing getAllGenres response %#v to %s: %s", genres, req.RemoteAddr, err)
+	}
+}
+
+/*
+val updateGenre: Genre -> unit
+*/
+func (state *State) updateGenreHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for updateGenre")
+
+	var genre Genre
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &genre)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	ifMatch, ok := state.readIfMatch(resp, req, &genre.Version)
+	if !ok {
+		return
+	}
+
+	err = state.updateGenre(requestActor(req), &genre)
+	if err != nil {
+		state.log.Warn("Error updating genre %#v for %s: %s", genre, req.RemoteAddr, err)
+		state.writeUpdateError(resp, err, ifMatch, "Unable to update genre")
+		return
+	}
+
+	if updated, err := state.genres.Get(genre.Id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val deleteGenre: string -> unit
+A genre with sub-genres or songs is not deleted.
+*/
+func (state *State) deleteGenreHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for deleteGenre")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.deleteGenre(requestActor(req), id)
+	if err != nil {
+		state.log.Warn("Error deleting genre %s for %s: %s", id, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to delete genre")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val getGenreSongs: string -> []string
+Takes the id of the genre.
+Returns the array of ids of the songs in the genre and in every genre below it.
+*/
+func (state *State) getGenreSongsHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getGenreSongs")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	songs, err := state.getGenreSongs(id)
+	if err != nil {
+		state.log.Warn("Error retrieving genre %s songs for %s: %s", id, req.RemoteAddr, err)
+		state.writeRespError(resp, "Genre does not exist")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(songs)
+	if err != nil {
+		state.log.Warn("Error writing getGenreSongs of genre %s for %s: %s", id, req.RemoteAddr, err)
+	}
+}
+
+/*
+http end point for adding a new playlist
+val addPlaylist: Playlist -> Playlist
+*/
+func (state *State) addPlaylistHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for addPlaylist")
+
+	var playlist Playlist
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &playlist)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.addPlaylist(requestActor(req), &playlist)
+	if err != nil {
+		state.log.Warn("Error storing playlist %#v for %s: %s", playlist, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to store playlist")
+		return
+	}
+
+	state.log.Info("Added playlist %s", playlist.Id)
+
+	created, err := state.playlists.Get(playlist.Id)
+	if err != nil {
+		// Deleted again in the meantime.
+		created = &playlist
+	}
+
+	resp.Header().Set("ETag", formatETag(created.Version))
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*created)
+	if err != nil {
+		state.log.Warn("Error writing addPlaylist response %#v to %s: %s", *created, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getPlaylist: string -> Playlist
+*/
+func (state *State) getPlaylistHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getPlaylist")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	playlist, err := state.playlists.Get(id)
+	if err != nil {
+		state.log.Warn("Error getting playlist %s from %s: %s", id, req.RemoteAddr, err)
+		state.writeRespError(resp, "Playlist does not exist")
+		return
+	}
+
+	resp.Header().Set("ETag", formatETag(playlist.Version))
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*playlist)
+	if err != nil {
+		state.log.Warn("Error writing getPlaylist response %#v to %s: %s", *playlist, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getAllPlaylists: () -> []string
+*/
+func (state *State) getAllPlaylistsHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getAllPlaylists")
+
+	var err error
+
+	playlists, err := state.playlists.GetAll()
+	if err != nil {
+		state.log.Warn("Error getting all playlists for %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Error retrieving playlists")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(playlists)
+	if err != nil {
+		state.log.Warn("Error writing getAllPlaylists response %#v to %s: %s", playlists, req.RemoteAddr, err)
+	}
+}
+
+/*
+Handles the end points that change one playlist, reading the body into edit.
+The version to update may be given in the body or as If-Match.
+*/
+func (state *State) editPlaylistHandle(resp http.ResponseWriter, req *http.Request, endPoint string, edit playlistEdit) {
+	state.log.Info("Got request for %s", endPoint)
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err := json.Unmarshal(body, edit)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	ifMatch, ok := state.readIfMatch(resp, req, edit.version())
+	if !ok {
+		return
+	}
+
+	err = state.editPlaylist(requestActor(req), edit)
+	if err != nil {
+		state.log.Warn("Error in %s of playlist %s for %s: %s", endPoint, edit.playlistId(), req.RemoteAddr, err)
+		state.writeUpdateError(resp, err, ifMatch, "Unable to update playlist")
+		return
+	}
+
+	if updated, err := state.playlists.Get(edit.playlistId()); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val renamePlaylist: PlaylistRenameRequest -> unit
+*/
+func (state *State) renamePlaylistHandle(resp http.ResponseWriter, req *http.Request) {
+	state.editPlaylistHandle(resp, req, "renamePlaylist", &PlaylistRenameRequest{})
+}
+
+/*
+val appendToPlaylist: PlaylistSongsRequest -> unit
+*/
+func (state *State) appendToPlaylistHandle(resp http.ResponseWriter, req *http.Request) {
+	state.editPlaylistHandle(resp, req, "appendToPlaylist", &PlaylistSongsRequest{})
+}
+
+/*
+val insertIntoPlaylist: PlaylistSongsRequest -> unit
+*/
+func (state *State) insertIntoPlaylistHandle(resp http.ResponseWriter, req *http.Request) {
+	state.editPlaylistHandle(resp, req, "insertIntoPlaylist", &playlistInsertRequest{})
+}
+
+/*
+val movePlaylistSong: PlaylistMoveRequest -> unit
+*/
+func (state *State) movePlaylistSongHandle(resp http.ResponseWriter, req *http.Request) {
+	state.editPlaylistHandle(resp, req, "movePlaylistSong", &PlaylistMoveRequest{})
+}
+
+/*
+val removeFromPlaylist: PlaylistRemoveRequest -> unit
+*/
+func (state *State) removeFromPlaylistHandle(resp http.ResponseWriter, req *http.Request) {
+	state.editPlaylistHandle(resp, req, "removeFromPlaylist", &PlaylistRemoveRequest{})
+}
+
+/*
+val deletePlaylist: string -> unit
+*/
+func (state *State) deletePlaylistHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for deletePlaylist")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.deletePlaylist(requestActor(req), id)
+	if err != nil {
+		state.log.Warn("Error deleting playlist %s for %s: %s", id, req.RemoteAddr, err)
+		state.writeRespError(resp, "Unable to delete playlist")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+http end point for adding a new label
+val addLabel: Label -> Label
+*/
+func (state *State) addLabelHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for addLabel")
+
+	var label Label
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &label)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.addLabel(requestActor(req), &label)
+	if err != nil {
+		state.log.Warn("Error storing label %#v for %s: %s", label, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to store label")
+		return
+	}
+
+	state.log.Info("Added label %#v", label)
+
+	created, err := state.labels.Get(label.Id)
+	if err != nil {
+		// Deleted again in the meantime.
+		created = &label
+	}
+
+	resp.Header().Set("ETag", formatETag(created.Version))
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*created)
+	if err != nil {
+		state.log.Warn("Error writing addLabel response %#v to %s: %s", *created, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getLabel: string -> Label
+*/
+func (state *State) getLabelHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getLabel")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	label, err := state.labels.Get(id)
+	if err != nil {
+		state.log.Warn("Error getting label %s from %s: %s", id, req.RemoteAddr, err)
+		state.writeRespError(resp, "Label does not exist")
+		return
+	}
+
+	resp.Header().Set("ETag", formatETag(label.Version))
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*label)
+	if err != nil {
+		state.log.Warn("Error writing getLabel response %#v to %s: %s", *label, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getAllLabels: () -> []string
+*/
+func (state *State) getAllLabelsHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getAllLabels")
+
+	var err error
+
+	labels, err := state.labels.GetAll()
+	if err != nil {
+		state.log.Warn("Error getting all labels for %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Error retrieving labels")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(labels)
+	if err != nil {
+		state.log.Warn("Error writing getAllLabels response %#v to %s: %s", labels, req.RemoteAddr, err)
+	}
+}
+
+/*
+val updateLabel: Label -> unit
+*/
+func (state *State) updateLabelHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for updateLabel")
+
+	var label Label
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &label)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	ifMatch, ok := state.readIfMatch(resp, req, &label.Version)
+	if !ok {
+		return
+	}
+
+	err = state.updateLabel(requestActor(req), &label)
+	if err != nil {
+		state.log.Warn("Error updating label %#v for %s: %s", label, req.RemoteAddr, err)
+		state.writeUpdateError(resp, err, ifMatch, "Unable to update label")
+		return
+	}
+
+	if updated, err := state.labels.Get(label.Id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val deleteLabel: string -> unit
+A label with albums is not deleted.
+*/
+func (state *State) deleteLabelHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for deleteLabel")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.deleteLabel(requestActor(req), id)
+	if err != nil {
+		state.log.Warn("Error deleting label %s for %s: %s", id, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to delete label")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val getLabelAlbums: string -> []string
+Takes the id of the label.
+Returns the array of ids of the albums the label released, newest first.
+*/
+func (state *State) getLabelAlbumsHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getLabelAlbums")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	albums, err := state.getLabelAlbums(id)
+	if err != nil {
+		state.log.Warn("Error retrieving label %s albums for %s: %s", id, req.RemoteAddr, err)
+		state.writeRespError(resp, "Label does not exist")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(albums)
+	if err != nil {
+		state.log.Warn("Error writing getLabelAlbums of label %s for %s: %s", id, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getReleases: ReleasesRequest -> []string
+Returns the ids of the albums released from the date from to the date to, newest first.
+*/
+func (state *State) getReleasesHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getReleases")
+
+	var request ReleasesRequest
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	albums, err := state.getReleases(&request)
+	if err != nil {
+		state.log.Warn("Error retrieving releases %#v for %s: %s", request, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Error retrieving releases")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(albums)
+	if err != nil {
+		state.log.Warn("Error writing getReleases response %#v to %s: %s", albums, req.RemoteAddr, err)
+	}
+}
+
+/*
+http end point for adding a new relationship
+val addRelationship: Relationship -> Relationship
+*/
+func (state *State) addRelationshipHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for addRelationship")
+
+	var relationship Relationship
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &relationship)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.addRelationship(requestActor(req), &relationship)
+	if err != nil {
+		state.log.Warn("Error storing relationship %#v for %s: %s", relationship, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to store relationship")
+		return
+	}
+
+	state.log.Info("Added relationship %#v", relationship)
+
+	created, err := state.relationships.Get(relationship.Id)
+	if err != nil {
+		// Deleted again in the meantime.
+		created = &relationship
+	}
+
+	resp.Header().Set("ETag", formatETag(created.Version))
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*created)
+	if err != nil {
+		state.log.Warn("Error writing addRelationship response %#v to %s: %s", *created, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getRelationship: string -> Relationship
+*/
+func (state *State) getRelationshipHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getRelationship")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
 	if err != nil {
-		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
-		state.writeRespError(resp, "Cannot read body from request")
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
 		return
 	}
 
-	err = json.Unmarshal(body, &song)
+	relationship, err := state.relationships.Get(id)
+	if err != nil {
+		state.log.Warn("Error getting relationship %s from %s: %s", id, req.RemoteAddr, err)
+		state.writeRespError(resp, "Relationship does not exist")
+		return
+	}
+
+	resp.Header().Set("ETag", formatETag(relationship.Version))
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*relationship)
+	if err != nil {
+		state.log.Warn("Error writing getRelationship response %#v to %s: %s", *relationship, req.RemoteAddr, err)
+	}
+}
+
+/*
+val updateRelationship: Relationship -> unit
+*/
+func (state *State) updateRelationshipHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for updateRelationship")
+
+	var relationship Relationship
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &relationship)
 	if err != nil {
 		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
 		state.writeRespError(resp, "Invalid JSON")
 		return
 	}
 
-	err = state.songs.Update(&song)
+	ifMatch, ok := state.readIfMatch(resp, req, &relationship.Version)
+	if !ok {
+		return
+	}
+
+	err = state.updateRelationship(requestActor(req), &relationship)
 	if err != nil {
-		state.log.Warn("Error updating song %#v for %s: %s", song, req.RemoteAddr, err)
-		state.writeRespError(resp, "Unable to update song")
+		state.log.Warn("Error updating relationship %#v for %s: %s", relationship, req.RemoteAddr, err)
+		state.writeUpdateError(resp, err, ifMatch, "Unable to update relationship")
+		return
+	}
+
+	if updated, err := state.relationships.Get(relationship.Id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val deleteRelationship: string -> unit
+*/
+func (state *State) deleteRelationshipHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for deleteRelationship")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	err = state.deleteRelationship(requestActor(req), id)
+	if err != nil {
+		state.log.Warn("Error deleting relationship %s for %s: %s", id, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to delete relationship")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+}
+
+/*
+val getArtistRelationships: string -> []Relationship
+Takes the id of the artist.
+Returns the relationships the artist is on either side of.
+*/
+func (state *State) getArtistRelationshipsHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getArtistRelationships")
+
+	var id string
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &id)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	relationships, err := state.getArtistRelationships(id)
+	if err != nil {
+		state.log.Warn("Error retrieving artist %s relationships for %s: %s", id, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Error retrieving relationships")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(relationships)
+	if err != nil {
+		state.log.Warn("Error writing getArtistRelationships of artist %s for %s: %s", id, req.RemoteAddr, err)
+	}
+}
+
+/*
+val getLineup: LineupRequest -> []Relationship
+Returns the member-of relationships of the members of the artist at the date at, today when left out.
+*/
+func (state *State) getLineupHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for getLineup")
+
+	var request LineupRequest
+	var err error
+
+	body, ok := state.readBody(resp, req)
+	if !ok {
+		return
+	}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		state.log.Warn("Error deserializing json from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Invalid JSON")
+		return
+	}
+
+	lineup, err := state.getLineup(&request)
+	if err != nil {
+		state.log.Warn("Error retrieving lineup %#v for %s: %s", request, req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Error retrieving lineup")
+		return
+	}
+
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(lineup)
+	if err != nil {
+		state.log.Warn("Error writing getLineup response %#v to %s: %s", lineup, req.RemoteAddr, err)
+	}
+}
+
+/*
+The largest JSON body an end point accepts, in bytes.
+*/
+const MAX_BODY_SIZE = 1 << 20
+
+/*
+Reads the JSON body of a request, failing with 413 when it is over MAX_BODY_SIZE
+rather than reading a body cut short.
+Returns false when the response was already written.
+*/
+func (state *State) readBody(resp http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, MAX_BODY_SIZE+1))
+	if err != nil {
+		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Cannot read body from request")
+		return nil, false
+	}
+
+	if len(body) > MAX_BODY_SIZE {
+		state.log.Warn("Body from %s is over %d bytes", req.RemoteAddr, MAX_BODY_SIZE)
+		state.writeRespErrorStatus(resp, http.StatusRequestEntityTooLarge, "Body is too large")
+		return nil, false
+	}
+
+	return body, true
+}
+
+/*
+Reads the body of an image upload, failing with 413 when it is over MAX_IMAGE_SIZE.
+*/
+func (state *State) readImage(resp http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, MAX_IMAGE_SIZE+1))
+	if err != nil {
+		state.log.Warn("Error reading body from %s: %s", req.RemoteAddr, err)
+		state.writeRespError(resp, "Cannot read body from request")
+		return nil, false
+	}
+
+	if len(data) > MAX_IMAGE_SIZE {
+		state.log.Warn("Image from %s is over %d bytes", req.RemoteAddr, MAX_IMAGE_SIZE)
+		state.writeRespErrorStatus(resp, http.StatusRequestEntityTooLarge, "Image is too large")
+		return nil, false
+	}
+
+	return data, true
+}
+
+/*
+http end point for setting the cover art of an album
+val uploadAlbumImage: bytes -> Image
+Takes the id of the album as the id query parameter, and the JPEG or PNG file as the body.
+*/
+func (state *State) uploadAlbumImageHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for uploadAlbumImage")
+
+	id := req.URL.Query().Get("id")
+
+	data, ok := state.readImage(resp, req)
+	if !ok {
+		return
+	}
+
+	var version int64
+	ifMatch, ok := state.readIfMatch(resp, req, &version)
+	if !ok {
+		return
+	}
+
+	stored, err := state.setAlbumImage(requestActor(req), id, version, data)
+	if err != nil {
+		state.log.Warn("Error setting album %s image for %s: %s", id, req.RemoteAddr, err)
+		state.writeUpdateError(resp, err, ifMatch, "Unable to set album image")
+		return
+	}
+
+	state.log.Info("Set album %s image to %s", id, stored.Id)
+
+	if updated, err := state.albums.Get(id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*stored)
+	if err != nil {
+		state.log.Warn("Error writing uploadAlbumImage response %#v to %s: %s", *stored, req.RemoteAddr, err)
+	}
+}
+
+/*
+http end point for setting the photo of an artist
+val uploadArtistImage: bytes -> Image
+Takes the id of the artist as the id query parameter, and the JPEG or PNG file as the body.
+*/
+func (state *State) uploadArtistImageHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for uploadArtistImage")
+
+	id := req.URL.Query().Get("id")
+
+	data, ok := state.readImage(resp, req)
+	if !ok {
+		return
+	}
+
+	var version int64
+	ifMatch, ok := state.readIfMatch(resp, req, &version)
+	if !ok {
+		return
+	}
+
+	stored, err := state.setArtistImage(requestActor(req), id, version, data)
+	if err != nil {
+		state.log.Warn("Error setting artist %s image for %s: %s", id, req.RemoteAddr, err)
+		state.writeUpdateError(resp, err, ifMatch, "Unable to set artist image")
+		return
+	}
+
+	state.log.Info("Set artist %s image to %s", id, stored.Id)
+
+	if updated, err := state.artists.Get(id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*stored)
+	if err != nil {
+		state.log.Warn("Error writing uploadArtistImage response %#v to %s: %s", *stored, req.RemoteAddr, err)
+	}
+}
+
+/*
+GET /images/<id>[?size=<size>]
+Serves a stored image, or its thumbnail of one of the configured sizes.
+Images never change, so they may be cached for good.
+*/
+func (state *State) getImageHandle(resp http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/images/")
+	etag := id
+
+	var file *os.File
+	var err error
+
+	if sizeParam := req.URL.Query().Get("size"); sizeParam != "" {
+		size, parseErr := strconv.Atoi(sizeParam)
+		if parseErr != nil || !containsInt(GetConfig().GetThumbnailSizes(), size) {
+			state.log.Warn("Invalid image size %s from %s", sizeParam, req.RemoteAddr)
+			state.writeRespErrorStatus(resp, http.StatusNotFound, "Image does not exist in that size")
+			return
+		}
+
+		etag = fmt.Sprintf("%s-%d", id, size)
+		file, err = state.images.OpenThumbnail(id, size)
+	} else {
+		file, err = state.images.Open(id)
+	}
+	if err != nil {
+		state.log.Warn("Error getting image %s for %s: %s", etag, req.RemoteAddr, err)
+		state.writeRespErrorStatus(resp, http.StatusNotFound, "Image does not exist")
 		return
 	}
+	defer file.Close()
+
+	resp.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	resp.Header().Set("ETag", strconv.Quote(etag))
+	// The content type is sniffed from the file, which was checked to be a JPEG or PNG when stored.
+	http.ServeContent(resp, req, "", time.Time{}, file)
+}
+
+/*
+http end point for attaching an audio file to a song
+val uploadSongAudio: bytes -> Audio
+Takes the id of the song as the id query parameter, and the audio file as the body.
+The body is streamed to disk, up to the maxAudioSize setting.
+*/
+func (state *State) uploadSongAudioHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for uploadSongAudio")
+
+	id := req.URL.Query().Get("id")
+
+	var version int64
+	ifMatch, ok := state.readIfMatch(resp, req, &version)
+	if !ok {
+		return
+	}
+
+	stored, err := state.setSongAudio(requestActor(req), id, version, req.Body)
+	if err == AudioTooLargeError {
+		state.log.Warn("Audio from %s is over %d bytes", req.RemoteAddr, GetConfig().GetMaxAudioSize())
+		state.writeRespErrorStatus(resp, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if err != nil {
+		state.log.Warn("Error setting song %s audio for %s: %s", id, req.RemoteAddr, err)
+		state.writeUpdateError(resp, err, ifMatch, "Unable to set song audio")
+		return
+	}
+
+	state.log.Info("Set song %s audio to %s", id, stored.Id)
+
+	if updated, err := state.songs.Get(id); err == nil {
+		resp.Header().Set("ETag", formatETag(updated.Version))
+	}
+	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*stored)
+	if err != nil {
+		state.log.Warn("Error writing uploadSongAudio response %#v to %s: %s", *stored, req.RemoteAddr, err)
+	}
+}
+
+/*
+GET /streamSong?id=<id>
+Serves the audio file of a song, answering Range requests with 206 Partial Content so players can seek.
+*/
+func (state *State) streamSongHandle(resp http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+
+	// Only the lookup is locked, the file may take long to send.
+	state.lock.RLock()
+	song, err := state.songs.Get(id)
+	state.lock.RUnlock()
+	if err != nil || song.AudioId == "" {
+		state.log.Warn("No audio for song %s from %s", id, req.RemoteAddr)
+		state.writeRespErrorStatus(resp, http.StatusNotFound, "Song has no audio")
+		return
+	}
+
+	file, contentType, err := state.audio.Open(song.AudioId)
+	if err != nil {
+		state.log.Warn("Error opening audio %s of song %s for %s: %s", song.AudioId, id, req.RemoteAddr, err)
+		state.writeRespErrorStatus(resp, http.StatusNotFound, "Song has no audio")
+		return
+	}
+	defer file.Close()
+
+	resp.Header().Set("Content-Type", contentType)
+	// The audio id changes with the file, so If-Range only resumes the same file.
+	resp.Header().Set("ETag", strconv.Quote(song.AudioId))
+	http.ServeContent(resp, req, "", time.Time{}, file)
+}
+
+/*
+http end point for importing an MP3 file
+val importSong: bytes -> ImportReport
+Takes the MP3 file as the body, streamed to disk up to the maxAudioSize setting.
+Creates or matches the artist, album and song its ID3 tags name, see import.go.
+*/
+func (state *State) importSongHandle(resp http.ResponseWriter, req *http.Request) {
+	state.log.Info("Got request for importSong")
+
+	report, err := state.importSong(requestActor(req), req.Body)
+	if err == AudioTooLargeError {
+		state.log.Warn("Audio from %s is over %d bytes", req.RemoteAddr, GetConfig().GetMaxAudioSize())
+		state.writeRespErrorStatus(resp, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if err != nil {
+		state.log.Warn("Error importing song for %s: %s", req.RemoteAddr, err)
+		state.writeStoreError(resp, err, "Unable to import song")
+		return
+	}
+
+	state.log.Info("Imported audio %s as %s song", report.AudioId, report.Status)
 
 	resp.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(resp).Encode(*report)
+	if err != nil {
+		state.log.Warn("Error writing importSong response %#v to %s: %s", *report, req.RemoteAddr, err)
+	}
 }
 
 func (state *State) notFoundHandle(resp http.ResponseWriter, req *http.Request) {
@@ -677,12 +2584,10 @@ func (ln tcpListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
-func NewStore(errChan chan<- error) {
-	state, err := NewState()
-	if err != nil {
-		panic(err)
-	}
-
+/*
+Routes every end point to its handler.
+*/
+func (state *State) newServeMux() *http.ServeMux {
 	serveMux := http.NewServeMux()
 
 	serveMux.HandleFunc("/addAlbum", state.addAlbumHandle)
@@ -693,24 +2598,88 @@ func NewStore(errChan chan<- error) {
 	serveMux.HandleFunc("/deleteArtist", state.deleteArtistHandle)
 	serveMux.HandleFunc("/deleteSong", state.deleteSongHandle)
 
-	serveMux.HandleFunc("/getAlbum", state.getAlbumHandle)
-	serveMux.HandleFunc("/getArtist", state.getArtistHandle)
-	serveMux.HandleFunc("/getSong", state.getSongHandle)
+	serveMux.HandleFunc("/getAlbum", state.readCommitted(state.getAlbumHandle))
+	serveMux.HandleFunc("/getArtist", state.readCommitted(state.getArtistHandle))
+	serveMux.HandleFunc("/getSong", state.readCommitted(state.getSongHandle))
 
-	serveMux.HandleFunc("/getAllSongs", state.getAllSongsHandle)
-	serveMux.HandleFunc("/getAllAlbums", state.getAllAlbumsHandle)
-	serveMux.HandleFunc("/getAllArtists", state.getAllArtistsHandle)
+	serveMux.HandleFunc("/getAllSongs", state.readCommitted(state.getAllSongsHandle))
+	serveMux.HandleFunc("/getAllAlbums", state.readCommitted(state.getAllAlbumsHandle))
+	serveMux.HandleFunc("/getAllArtists", state.readCommitted(state.getAllArtistsHandle))
 
-	serveMux.HandleFunc("/getAlbumSongs", state.getAlbumSongsHandle)
-	serveMux.HandleFunc("/getArtistAlbums", state.getArtistAlbumsHandle)
-	serveMux.HandleFunc("/getArtistSongs", state.getArtistSongsHandle)
+	serveMux.HandleFunc("/getAlbumSongs", state.readCommitted(state.getAlbumSongsHandle))
+	serveMux.HandleFunc("/reorderAlbumSongs", state.reorderAlbumSongsHandle)
+	serveMux.HandleFunc("/getArtistAlbums", state.readCommitted(state.getArtistAlbumsHandle))
+	serveMux.HandleFunc("/getArtistSongs", state.readCommitted(state.getArtistSongsHandle))
+	serveMux.HandleFunc("/getArtistsByBirthYear", state.readCommitted(state.getArtistsByBirthYearHandle))
 
 	serveMux.HandleFunc("/updateAlbum", state.updateAlbumHandle)
 	serveMux.HandleFunc("/updateArtist", state.updateArtistHandle)
 	serveMux.HandleFunc("/updateSong", state.updateSongHandle)
 
+	serveMux.HandleFunc("/transaction", state.transactionHandle)
+
+	serveMux.HandleFunc("/checkCatalog", state.checkCatalogHandle)
+
+	serveMux.HandleFunc("/getTrash", state.readCommitted(state.getTrashHandle))
+	serveMux.HandleFunc("/restoreFromTrash", state.restoreFromTrashHandle)
+	serveMux.HandleFunc("/purgeTrash", state.purgeTrashHandle)
+
+	serveMux.HandleFunc("/getRevisions", state.readCommitted(state.getRevisionsHandle))
+	serveMux.HandleFunc("/diffRevisions", state.readCommitted(state.diffRevisionsHandle))
+	serveMux.HandleFunc("/getRevisionAt", state.readCommitted(state.getRevisionAtHandle))
+
+	serveMux.HandleFunc("/addGenre", state.addGenreHandle)
+	serveMux.HandleFunc("/getGenre", state.readCommitted(state.getGenreHandle))
+	serveMux.HandleFunc("/getAllGenres", state.readCommitted(state.getAllGenresHandle))
+	serveMux.HandleFunc("/updateGenre", state.updateGenreHandle)
+	serveMux.HandleFunc("/deleteGenre", state.deleteGenreHandle)
+	serveMux.HandleFunc("/getGenreSongs", state.readCommitted(state.getGenreSongsHandle))
+
+	serveMux.HandleFunc("/addPlaylist", state.addPlaylistHandle)
+	serveMux.HandleFunc("/getPlaylist", state.readCommitted(state.getPlaylistHandle))
+	serveMux.HandleFunc("/getAllPlaylists", state.readCommitted(state.getAllPlaylistsHandle))
+	serveMux.HandleFunc("/renamePlaylist", state.renamePlaylistHandle)
+	serveMux.HandleFunc("/appendToPlaylist", state.appendToPlaylistHandle)
+	serveMux.HandleFunc("/insertIntoPlaylist", state.insertIntoPlaylistHandle)
+	serveMux.HandleFunc("/movePlaylistSong", state.movePlaylistSongHandle)
+	serveMux.HandleFunc("/removeFromPlaylist", state.removeFromPlaylistHandle)
+	serveMux.HandleFunc("/deletePlaylist", state.deletePlaylistHandle)
+
+	serveMux.HandleFunc("/addLabel", state.addLabelHandle)
+	serveMux.HandleFunc("/getLabel", state.readCommitted(state.getLabelHandle))
+	serveMux.HandleFunc("/getAllLabels", state.readCommitted(state.getAllLabelsHandle))
+	serveMux.HandleFunc("/updateLabel", state.updateLabelHandle)
+	serveMux.HandleFunc("/deleteLabel", state.deleteLabelHandle)
+	serveMux.HandleFunc("/getLabelAlbums", state.readCommitted(state.getLabelAlbumsHandle))
+	serveMux.HandleFunc("/getReleases", state.readCommitted(state.getReleasesHandle))
+
+	serveMux.HandleFunc("/addRelationship", state.addRelationshipHandle)
+	serveMux.HandleFunc("/getRelationship", state.readCommitted(state.getRelationshipHandle))
+	serveMux.HandleFunc("/updateRelationship", state.updateRelationshipHandle)
+	serveMux.HandleFunc("/deleteRelationship", state.deleteRelationshipHandle)
+	serveMux.HandleFunc("/getArtistRelationships", state.readCommitted(state.getArtistRelationshipsHandle))
+	serveMux.HandleFunc("/getLineup", state.readCommitted(state.getLineupHandle))
+
+	serveMux.HandleFunc("/uploadAlbumImage", state.uploadAlbumImageHandle)
+	serveMux.HandleFunc("/uploadArtistImage", state.uploadArtistImageHandle)
+	serveMux.HandleFunc("/images/", state.getImageHandle)
+	serveMux.HandleFunc("/uploadSongAudio", state.uploadSongAudioHandle)
+	serveMux.HandleFunc("/streamSong", state.streamSongHandle)
+	serveMux.HandleFunc("/importSong", state.importSongHandle)
+
 	serveMux.HandleFunc("/", state.notFoundHandle)
 
+	return serveMux
+}
+
+func NewStore(errChan chan<- error) *State {
+	state, err := NewState()
+	if err != nil {
+		panic(err)
+	}
+
+	serveMux := state.newServeMux()
+
 	state.log.Info("Starting http server")
 
 	server := &http.Server{
@@ -737,8 +2706,6 @@ func NewStore(errChan chan<- error) {
 			}
 		}
 	}()
-}
 
-func init() {
-	NewStore(nil)
+	return state
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sort"
@@ -34,6 +35,23 @@ func addAlbum(album *Album) error {
 	return nil
 }
 
+/*
+Adds an album and its artist with the given ids, unless already added by another test.
+*/
+func ensureAlbum(id, artistId string) error {
+	_, err := getAlbum(id)
+	if err == nil {
+		return nil
+	}
+
+	err = ensureArtist(artistId)
+	if err != nil {
+		return err
+	}
+
+	return addAlbum(&Album{Id: id, Name: id, Price: Price{Currency: "USD", Amount: 100}, ArtistId: artistId})
+}
+
 func deleteAlbum(id string) error {
 	buffer, err := json.Marshal(id)
 	if err != nil {
@@ -186,12 +204,18 @@ func TestAddAlbum(test *testing.T) {
 	album := Album{
 		Id:       "testAddId",
 		Name:     "testAdd",
-		Price:    "100",
+		Price:    Price{Currency: "USD", Amount: 100},
 		ArtistId: "testAddAlbumArtist",
 	}
 
 	test.Log("Adding album")
-	err := addAlbum(&album)
+	err := ensureArtist(album.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add artist %s: %s", album.ArtistId, err)
+		test.FailNow()
+	}
+
+	err = addAlbum(&album)
 	if err != nil {
 		test.Errorf("Unable to add album %#v: %s", album, err)
 		test.FailNow()
@@ -203,11 +227,17 @@ func TestDeleteAlbum(test *testing.T) {
 	album := Album{
 		Id:       "testDeleteAlbumId",
 		Name:     "testDelete",
-		Price:    "100",
+		Price:    Price{Currency: "USD", Amount: 100},
 		ArtistId: "testAddAlbumArtist",
 	}
 
-	err := addAlbum(&album)
+	err := ensureArtist(album.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add artist %s: %s", album.ArtistId, err)
+		test.FailNow()
+	}
+
+	err = addAlbum(&album)
 	if err != nil {
 		test.Errorf("Unable to add album %#v: %s", album, err)
 		test.FailNow()
@@ -232,11 +262,17 @@ func TestGetAlbum(test *testing.T) {
 	albumI := Album{
 		Id:       "testGetId",
 		Name:     "testGet",
-		Price:    "100",
+		Price:    Price{Currency: "USD", Amount: 100},
 		ArtistId: "testAddAlbumArtist",
 	}
 
-	err := addAlbum(&albumI)
+	err := ensureArtist(albumI.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add artist %s: %s", albumI.ArtistId, err)
+		test.FailNow()
+	}
+
+	err = addAlbum(&albumI)
 	if err != nil {
 		test.Errorf("Unable to add album %#v: %s", albumI, err)
 		test.FailNow()
@@ -276,11 +312,17 @@ func TestGetAllAlbums(test *testing.T) {
 	albumI := Album{
 		Id:       "testGetAllAlbumsId",
 		Name:     "testGetAllAlbums",
-		Price:    "testGetAllAlbumsPrice",
+		Price:    Price{Currency: "EUR", Amount: 1299},
 		ArtistId: "testGetAllAlbumsArtistId",
 	}
 
-	err := addAlbum(&albumI)
+	err := ensureArtist(albumI.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add artist %s: %s", albumI.ArtistId, err)
+		test.FailNow()
+	}
+
+	err = addAlbum(&albumI)
 	if err != nil {
 		test.Errorf("Unable to add album %#v: %s", albumI, err)
 		test.FailNow()
@@ -302,18 +344,24 @@ func TestGetArtistAlbums(test *testing.T) {
 	album0 := Album{
 		Id:       "testGetArtistAlbumsId0",
 		Name:     "testGetArtistAlbums0",
-		Price:    "100",
+		Price:    Price{Currency: "USD", Amount: 100},
 		ArtistId: "testGetArtistAlbumsArtist",
 	}
 	album1 := Album{
 		Id:       "testGetArtistAlbumsId1",
 		Name:     "testGetArtistAlbums1",
-		Price:    "100",
+		Price:    Price{Currency: "USD", Amount: 100},
 		ArtistId: "testGetArtistAlbumsArtist",
 	}
 
+	err := ensureArtist(album0.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add artist %s: %s", album0.ArtistId, err)
+		test.FailNow()
+	}
+
 	// Add the albums first.
-	err := addAlbum(&album0)
+	err = addAlbum(&album0)
 	if err != nil {
 		test.Errorf("Unable to add album %#v: %s", album0, err)
 		test.FailNow()
@@ -354,12 +402,18 @@ func TestUpdateAlbum(test *testing.T) {
 	album := Album{
 		Id:       "testUpdateId",
 		Name:     "testUpdate",
-		Price:    "100",
+		Price:    Price{Currency: "USD", Amount: 100},
 		ArtistId: "testAddAlbumArtist",
 	}
 
+	err := ensureArtist(album.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add artist %s: %s", album.ArtistId, err)
+		test.FailNow()
+	}
+
 	// First, add the album.
-	err := addAlbum(&album)
+	err = addAlbum(&album)
 	if err != nil {
 		test.Errorf("Unable to add album %#v: %s", album, err)
 		test.FailNow()
@@ -385,3 +439,274 @@ func TestUpdateAlbum(test *testing.T) {
 		test.FailNow()
 	}
 }
+
+func TestAddAlbumMissingArtist(test *testing.T) {
+	album := Album{
+		Id:       "testAddAlbumMissingArtistId",
+		Name:     "testAddAlbumMissingArtist",
+		Price:    Price{Currency: "USD", Amount: 100},
+		ArtistId: "testAddAlbumMissingArtistArtist",
+	}
+
+	err := addAlbum(&album)
+	if err == nil {
+		test.Errorf("Album %#v was added without its artist", album)
+		test.FailNow()
+	}
+}
+
+func TestUpdateAlbumMissingArtist(test *testing.T) {
+	album := Album{
+		Id:       "testUpdateAlbumMissingArtistId",
+		Name:     "testUpdateAlbumMissingArtist",
+		Price:    Price{Currency: "USD", Amount: 100},
+		ArtistId: "testAddAlbumArtist",
+	}
+
+	err := ensureArtist(album.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add artist %s: %s", album.ArtistId, err)
+		test.FailNow()
+	}
+
+	err = addAlbum(&album)
+	if err != nil {
+		test.Errorf("Unable to add album %#v: %s", album, err)
+		test.FailNow()
+	}
+
+	// Move the album to an artist that does not exist.
+	album.ArtistId = "testUpdateAlbumMissingArtistArtist"
+	err = updateAlbum(&album)
+	if err == nil {
+		test.Errorf("Album %#v was updated to a missing artist", album)
+		test.FailNow()
+	}
+}
+
+func TestAddAlbumPrice(test *testing.T) {
+	err := ensureArtist("testAddAlbumPriceArtist")
+	if err != nil {
+		test.Fatalf("Unable to add artist: %s", err)
+	}
+
+	prices := []struct {
+		json  string
+		price Price
+		ok    bool
+	}{
+		{`"$9.99"`, Price{Currency: "USD", Amount: 999}, true},
+		{`"12.50 EUR"`, Price{Currency: "EUR", Amount: 1250}, true},
+		{`"1500 JPY"`, Price{Currency: "JPY", Amount: 1500}, true},
+		{`"4"`, Price{Currency: "USD", Amount: 400}, true},
+		{`{"currency": "GBP", "amount": 799}`, Price{Currency: "GBP", Amount: 799}, true},
+		{`"cheap"`, Price{}, false},
+		{`"9.999"`, Price{}, false},
+		{`{"currency": "usd", "amount": 100}`, Price{}, false},
+		{`{"currency": "USD", "amount": -1}`, Price{}, false},
+	}
+
+	for i, price := range prices {
+		id := "testAddAlbumPrice" + string(rune('A'+i))
+		body := `{"id": "` + id + `", "albumId": "testAddAlbumPriceArtist", "price": ` + price.json + `}`
+
+		resp, err := http.Post(TEST_SERVER_END_POINT+"addAlbum", "application/x-www-form-urlencoded", bytes.NewReader([]byte(body)))
+		if err != nil {
+			test.Fatalf("Unable to add album: %s", err)
+		}
+		resp.Body.Close()
+
+		if !price.ok {
+			if resp.StatusCode != 422 {
+				test.Errorf("Expected 422 for price %s, got %s", price.json, resp.Status)
+			}
+			continue
+		}
+
+		album, err := getAlbum(id)
+		if err != nil {
+			test.Errorf("Album with price %s was not added: %s", price.json, err)
+			continue
+		}
+		if album.Price != price.price {
+			test.Errorf("Price %s was stored as %#v", price.json, album.Price)
+		}
+	}
+}
+
+func getAlbumDetails(id string) (*AlbumDetails, error) {
+	buffer, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(TEST_SERVER_END_POINT+"getAlbum", "application/x-www-form-urlencoded", bytes.NewReader(buffer))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Expected 200 OK but got " + resp.Status)
+	}
+
+	details := new(AlbumDetails)
+	err = json.NewDecoder(resp.Body).Decode(details)
+	if err != nil {
+		return nil, err
+	}
+
+	return details, nil
+}
+
+func TestGetAlbumRuntime(test *testing.T) {
+	for _, id := range []string{"testGetAlbumRuntimeA", "testGetAlbumRuntimeB"} {
+		err := ensureAlbum(id, "testGetAlbumRuntimeArtist")
+		if err != nil {
+			test.Fatalf("Unable to add album %s: %s", id, err)
+		}
+	}
+
+	times := []string{`"3:30"`, `"215"`, `61`, `"1:02:03"`}
+	for i, time := range times {
+		body := fmt.Sprintf(
+			`{"id": "testGetAlbumRuntimeSong%d", "albumId": "testGetAlbumRuntimeA", "artistId": "testGetAlbumRuntimeArtist", "time": %s}`,
+			i, time,
+		)
+
+		resp, err := http.Post(TEST_SERVER_END_POINT+"addSong", "application/x-www-form-urlencoded", bytes.NewReader([]byte(body)))
+		if err != nil {
+			test.Fatalf("Unable to add song: %s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			test.Fatalf("Unable to add song with time %s: %s", time, resp.Status)
+		}
+	}
+
+	for _, time := range []string{`"3:75"`, `"3:5"`, `"soon"`, `-5`} {
+		body := `{"id": "testGetAlbumRuntimeBad", "albumId": "testGetAlbumRuntimeA", "artistId": "testGetAlbumRuntimeArtist", "time": ` + time + `}`
+
+		resp, err := http.Post(TEST_SERVER_END_POINT+"addSong", "application/x-www-form-urlencoded", bytes.NewReader([]byte(body)))
+		if err != nil {
+			test.Fatalf("Unable to add song: %s", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 422 {
+			test.Errorf("Expected 422 for time %s, got %s", time, resp.Status)
+		}
+	}
+
+	details, err := getAlbumDetails("testGetAlbumRuntimeA")
+	if err != nil {
+		test.Fatalf("Unable to get album: %s", err)
+	}
+	if details.TrackCount != 4 || details.Runtime.Seconds != 210+215+61+3723 {
+		test.Errorf("Expected 4 tracks of 4209 seconds, got %d of %d", details.TrackCount, details.Runtime.Seconds)
+	}
+	if details.Runtime.String() != "1:10:09" {
+		test.Errorf("Expected runtime 1:10:09, got %s", details.Runtime)
+	}
+
+	// Move the longest song to the other album, and delete another.
+	song, err := getSong("testGetAlbumRuntimeSong3")
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	song.AlbumId = "testGetAlbumRuntimeB"
+	song.Version = 0
+	if err := updateSong(song); err != nil {
+		test.Fatalf("Unable to move song: %s", err)
+	}
+	if err := deleteSong("testGetAlbumRuntimeSong2"); err != nil {
+		test.Fatalf("Unable to delete song: %s", err)
+	}
+
+	details, err = getAlbumDetails("testGetAlbumRuntimeA")
+	if err != nil {
+		test.Fatalf("Unable to get album: %s", err)
+	}
+	if details.TrackCount != 2 || details.Runtime.Seconds != 210+215 {
+		test.Errorf("Expected 2 tracks of 425 seconds, got %d of %d", details.TrackCount, details.Runtime.Seconds)
+	}
+
+	details, err = getAlbumDetails("testGetAlbumRuntimeB")
+	if err != nil {
+		test.Fatalf("Unable to get album: %s", err)
+	}
+	if details.TrackCount != 1 || details.Runtime.Seconds != 3723 {
+		test.Errorf("Expected 1 track of 3723 seconds, got %d of %d", details.TrackCount, details.Runtime.Seconds)
+	}
+}
+
+func TestAlbumReleases(test *testing.T) {
+	artistId := "testReleasesArtist"
+	if err := ensureArtist(artistId); err != nil {
+		test.Fatalf("Unable to add artist %s: %s", artistId, err)
+	}
+
+	label := Label{Id: "testReleasesLabel", Name: "Test Records"}
+	if status, err := postAs("test", "addLabel", label, &label); err != nil || status != 200 {
+		test.Fatalf("Unable to add label: %d, %v", status, err)
+	}
+
+	albums := []Album{
+		{Id: "testReleasesEp", ReleaseDate: PartialDate{Year: 2031, Month: 3}, ReleaseType: RELEASE_EP, LabelId: label.Id},
+		{Id: "testReleasesLive", ReleaseDate: PartialDate{Year: 2031, Month: 11, Day: 2}, ReleaseType: RELEASE_LIVE, LabelId: label.Id},
+		{Id: "testReleasesSingle", ReleaseDate: PartialDate{Year: 2032}, ReleaseType: RELEASE_SINGLE},
+	}
+	for _, album := range albums {
+		album.Name, album.ArtistId = album.Id, artistId
+		if err := addAlbum(&album); err != nil {
+			test.Fatalf("Unable to add album %s: %s", album.Id, err)
+		}
+	}
+
+	ranges := []struct {
+		request  string
+		expected []string
+	}{
+		{`{"from": "2031", "to": "2031-06"}`, []string{"testReleasesEp"}},
+		{`{"from": "2031-11-01"}`, []string{"testReleasesSingle", "testReleasesLive"}},
+		{`{"from": "2031", "to": "2032"}`, []string{"testReleasesSingle", "testReleasesLive", "testReleasesEp"}},
+	}
+	for _, r := range ranges {
+		var ids []string
+		if status, err := postAs("test", "getReleases", json.RawMessage(r.request), &ids); err != nil || status != 200 {
+			test.Fatalf("Unable to get releases %s: %d, %v", r.request, status, err)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(r.expected) {
+			test.Errorf("Expected releases %v for %s, got %v", r.expected, r.request, ids)
+		}
+	}
+
+	if status, _ := postAs("test", "getReleases", json.RawMessage(`{"from": "2032", "to": "2031"}`), nil); status != 422 {
+		test.Errorf("Expected 422 for a reversed range, got %d", status)
+	}
+
+	var ids []string
+	if status, err := postAs("test", "getLabelAlbums", label.Id, &ids); err != nil || status != 200 {
+		test.Fatalf("Unable to get label albums: %d, %v", status, err)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint([]string{"testReleasesLive", "testReleasesEp"}) {
+		test.Errorf("Expected the label's albums newest first, got %v", ids)
+	}
+
+	invalid := []Album{
+		{Name: "testReleasesBadType", ArtistId: artistId, ReleaseType: "bootleg"},
+		{Name: "testReleasesBadDate", ArtistId: artistId, ReleaseDate: PartialDate{legacy: "someday"}},
+		{Name: "testReleasesNoLabel", ArtistId: artistId, LabelId: "testReleasesNobody"},
+	}
+	for _, album := range invalid {
+		if status, _ := postAs("test", "addAlbum", album, nil); status != 422 {
+			test.Errorf("Expected 422 adding %s, got %d", album.Name, status)
+		}
+	}
+
+	if status, _ := postAs("test", "deleteLabel", label.Id, nil); status != 409 {
+		test.Errorf("Expected 409 deleting a label with albums, got %d", status)
+	}
+}
@@ -33,6 +33,18 @@ func AddArtist(artist *Artist) error {
 	return nil
 }
 
+/*
+Adds an artist with the given id, unless it was already added by another test.
+*/
+func ensureArtist(id string) error {
+	_, err := getArtist(id)
+	if err == nil {
+		return nil
+	}
+
+	return AddArtist(&Artist{Id: id, Name: id})
+}
+
 func deleteArtist(id string) error {
 	buffer, err := json.Marshal(id)
 	if err != nil {
@@ -57,6 +69,41 @@ func deleteArtist(id string) error {
 	return nil
 }
 
+func deleteArtistWithPolicy(id, policy string) (*DeleteResult, error) {
+	buffer, err := json.Marshal(deleteRequest{Id: id, Policy: policy})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(
+		TEST_SERVER_END_POINT+"deleteArtist",
+		"application/x-www-form-urlencoded",
+		bytes.NewReader(buffer),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Expected 200 OK but got " + resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(DeleteResult)
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func getArtist(id string) (*Artist, error) {
 	buffer, err := json.Marshal(id)
 	if err != nil {
@@ -150,7 +197,7 @@ func TestAddArtist(test *testing.T) {
 	artist := Artist{
 		Id:        "testAddId",
 		Name:      "testAdd",
-		Birthdate: "1234",
+		Birthdate: PartialDate{Year: 1234},
 	}
 
 	test.Log("Adding artist")
@@ -166,7 +213,7 @@ func TestDeleteArtist(test *testing.T) {
 	artist := Artist{
 		Id:        "testDeleteArtistId",
 		Name:      "testDelete",
-		Birthdate: "1234",
+		Birthdate: PartialDate{Year: 1234},
 	}
 
 	err := AddArtist(&artist)
@@ -194,7 +241,7 @@ func TestGetArtist(test *testing.T) {
 	artistI := Artist{
 		Id:        "testGetId",
 		Name:      "testGet",
-		Birthdate: "1234",
+		Birthdate: PartialDate{Year: 1234},
 	}
 
 	err := AddArtist(&artistI)
@@ -233,7 +280,7 @@ func TestGetAllArtists(test *testing.T) {
 	artistI := Artist{
 		Id:        "testGetAllArtistsId",
 		Name:      "testGetAllArtists",
-		Birthdate: "testGetAllArtistsBirthdate",
+		Birthdate: PartialDate{Year: 1980, Month: 7},
 	}
 
 	err := AddArtist(&artistI)
@@ -258,7 +305,7 @@ func TestUpdateArtist(test *testing.T) {
 	artist := Artist{
 		Id:        "testUpdateId",
 		Name:      "testUpdate",
-		Birthdate: "1234",
+		Birthdate: PartialDate{Year: 1234},
 	}
 
 	// First, add the artist.
@@ -288,3 +335,267 @@ func TestUpdateArtist(test *testing.T) {
 		test.FailNow()
 	}
 }
+
+func TestDeleteArtistRestrict(test *testing.T) {
+	err := ensureAlbum("testDeleteArtistRestrictAlbum", "testDeleteArtistRestrictId")
+	if err != nil {
+		test.Errorf("Unable to add album: %s", err)
+		test.FailNow()
+	}
+
+	_, err = deleteArtistWithPolicy("testDeleteArtistRestrictId", DELETE_RESTRICT)
+	if err == nil {
+		test.Errorf("Artist with albums was deleted under the restrict policy")
+		test.FailNow()
+	}
+
+	_, err = getArtist("testDeleteArtistRestrictId")
+	if err != nil {
+		test.Errorf("Artist is gone after a refused delete: %s", err)
+		test.FailNow()
+	}
+}
+
+func TestDeleteArtistCascade(test *testing.T) {
+	song := Song{
+		Id:       "testDeleteArtistCascadeSong",
+		Name:     "testDeleteArtistCascadeSong",
+		AlbumId:  "testDeleteArtistCascadeAlbum",
+		ArtistId: "testDeleteArtistCascadeId",
+	}
+
+	err := ensureAlbum(song.AlbumId, song.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add album: %s", err)
+		test.FailNow()
+	}
+
+	err = addSong(&song)
+	if err != nil {
+		test.Errorf("Unable to add song %#v: %s", song, err)
+		test.FailNow()
+	}
+
+	result, err := deleteArtistWithPolicy(song.ArtistId, DELETE_CASCADE)
+	if err != nil {
+		test.Errorf("Unable to cascade delete artist %s: %s", song.ArtistId, err)
+		test.FailNow()
+	}
+
+	if len(result.Artists) != 1 || len(result.Albums) != 1 || len(result.Songs) != 1 {
+		test.Errorf("Unexpected cascade result %#v", *result)
+	}
+
+	_, err = getAlbum(song.AlbumId)
+	if err == nil {
+		test.Errorf("Album %s should have been deleted, it was not.", song.AlbumId)
+	}
+
+	_, err = getSong(song.Id)
+	if err == nil {
+		test.Errorf("Song %s should have been deleted, it was not.", song.Id)
+	}
+}
+
+func updateArtistStatus(artist *Artist, ifMatch string) (int, error) {
+	buffer, err := json.Marshal(artist)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", TEST_SERVER_END_POINT+"updateArtist", bytes.NewReader(buffer))
+	if err != nil {
+		return 0, err
+	}
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func TestUpdateArtistVersion(test *testing.T) {
+	artist := Artist{
+		Id:   "testUpdateArtistVersionId",
+		Name: "testUpdateArtistVersion",
+	}
+
+	err := AddArtist(&artist)
+	if err != nil {
+		test.Errorf("Unable to add artist %#v: %s", artist, err)
+		test.FailNow()
+	}
+
+	resp, err := http.Post(TEST_SERVER_END_POINT+"getArtist", "application/x-www-form-urlencoded", bytes.NewReader([]byte(`"testUpdateArtistVersionId"`)))
+	if err != nil {
+		test.Errorf("Unable to get artist: %s", err)
+		test.FailNow()
+	}
+	resp.Body.Close()
+
+	if etag := resp.Header.Get("ETag"); etag != `"1"` {
+		test.Errorf("Expected ETag \"1\" for a new artist, got %s", etag)
+	}
+
+	// Based on version 1, which is current.
+	artist.Version = 1
+	artist.Name = "testUpdateArtistVersion_updated"
+	status, err := updateArtistStatus(&artist, "")
+	if err != nil || status != http.StatusOK {
+		test.Errorf("Unable to update artist at its current version: %d %v", status, err)
+		test.FailNow()
+	}
+
+	// Version 1 is now stale.
+	status, err = updateArtistStatus(&artist, "")
+	if err != nil || status != http.StatusConflict {
+		test.Errorf("Expected 409 for a stale version, got %d %v", status, err)
+	}
+
+	artist.Version = 0
+	status, err = updateArtistStatus(&artist, `"1"`)
+	if err != nil || status != http.StatusPreconditionFailed {
+		test.Errorf("Expected 412 for a stale If-Match, got %d %v", status, err)
+	}
+
+	status, err = updateArtistStatus(&artist, `"2"`)
+	if err != nil || status != http.StatusOK {
+		test.Errorf("Unable to update artist with a current If-Match: %d %v", status, err)
+	}
+
+	artistF, err := getArtist(artist.Id)
+	if err != nil {
+		test.Errorf("Unable to get artist %s: %s", artist.Id, err)
+		test.FailNow()
+	}
+	if artistF.Version != 3 {
+		test.Errorf("Expected version 3 after two updates, got %d", artistF.Version)
+	}
+}
+
+func TestRequireVersion(test *testing.T) {
+	artist := Artist{
+		Id:   "testRequireVersionId",
+		Name: "testRequireVersion",
+	}
+
+	err := AddArtist(&artist)
+	if err != nil {
+		test.Fatalf("Unable to add artist %#v: %s", artist, err)
+	}
+
+	config.state.RequireVersion = true
+	defer func() {
+		config.state.RequireVersion = false
+	}()
+
+	artist.Name = "testRequireVersion_updated"
+	status, err := updateArtistStatus(&artist, "")
+	if err != nil || status != http.StatusPreconditionRequired {
+		test.Errorf("Expected 428 for an update without a version, got %d %v", status, err)
+	}
+
+	result, err := transaction(&TxRequest{Operations: []TxOperation{
+		txOperation("updateArtist", artist),
+	}})
+	if err != nil || result.Committed || result.Results[0].Status != TX_FAILED {
+		test.Errorf("Expected the transaction without a version to fail, got %#v %v", result, err)
+	}
+
+	status, err = updateArtistStatus(&artist, "*")
+	if err != nil || status != http.StatusOK {
+		test.Errorf("Unable to update artist with If-Match *: %d %v", status, err)
+	}
+
+	artist.Version = 2
+	status, err = updateArtistStatus(&artist, "")
+	if err != nil || status != http.StatusOK {
+		test.Errorf("Unable to update artist with a version: %d %v", status, err)
+	}
+}
+
+func TestAddArtistGeneratedId(test *testing.T) {
+	created := make([]Artist, 2)
+
+	for i := range created {
+		resp, err := http.Post(
+			TEST_SERVER_END_POINT+"addArtist",
+			"application/x-www-form-urlencoded",
+			bytes.NewReader([]byte(`{"name": "testAddArtistGeneratedId"}`)),
+		)
+		if err != nil {
+			test.Fatalf("Unable to add artist: %s", err)
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&created[i])
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			test.Fatalf("Expected the created artist, got %s: %v", resp.Status, err)
+		}
+	}
+
+	if len(created[0].Id) != 26 || created[0].Version != 1 {
+		test.Errorf("Expected a 26 character id at version 1, got %#v", created[0])
+	}
+	if created[1].Id <= created[0].Id {
+		test.Errorf("Expected ids to sort in creation order: %s, %s", created[0].Id, created[1].Id)
+	}
+
+	artist, err := getArtist(created[1].Id)
+	if err != nil || artist.Name != "testAddArtistGeneratedId" {
+		test.Errorf("Unable to get artist by its generated id: %v", err)
+	}
+}
+
+func TestGetArtistsByBirthYear(test *testing.T) {
+	artists := []Artist{
+		{Id: "testBirthYearLate", Name: "testBirthYearLate", Birthdate: PartialDate{Year: 1802, Month: 3}},
+		{Id: "testBirthYearEarly", Name: "testBirthYearEarly", Birthdate: PartialDate{Year: 1801, Month: 6, Day: 2}},
+		{Id: "testBirthYearOutside", Name: "testBirthYearOutside", Birthdate: PartialDate{Year: 1803}},
+	}
+
+	for i := range artists {
+		if err := AddArtist(&artists[i]); err != nil {
+			test.Fatalf("Unable to add artist %s: %s", artists[i].Id, err)
+		}
+	}
+
+	var ids []string
+	if status, err := postAs("test", "getArtistsByBirthYear", BirthYearRequest{From: 1801, To: 1802}, &ids); err != nil || status != 200 {
+		test.Fatalf("Unable to get artists by birth year: %d, %v", status, err)
+	}
+	if len(ids) != 2 || ids[0] != "testBirthYearEarly" || ids[1] != "testBirthYearLate" {
+		test.Errorf("Expected the artists born 1801 to 1802 in birthdate order, got %v", ids)
+	}
+
+	if status, _ := postAs("test", "getArtistsByBirthYear", BirthYearRequest{From: 1802, To: 1801}, nil); status != 422 {
+		test.Errorf("Expected 422 for a reversed range, got %d", status)
+	}
+
+	invalid := []string{
+		`{"name": "testInvalidBirthdate", "birthdate": "1990-02-30"}`,
+		`{"name": "testInvalidBirthdate", "birthdate": "last spring"}`,
+		`{"name": "testInvalidBirthdate", "birthdate": "1990-05", "endDate": "1989"}`,
+	}
+	for _, body := range invalid {
+		var artist map[string]interface{}
+		json.Unmarshal([]byte(body), &artist)
+
+		if status, _ := postAs("test", "addArtist", artist, nil); status != 422 {
+			test.Errorf("Expected 422 adding %s, got %d", body, status)
+		}
+	}
+
+	// An end date in the birth year cannot be ordered against a birthdate with a month.
+	artist := Artist{Name: "testSameYearEndDate", Birthdate: PartialDate{Year: 1990, Month: 5}, EndDate: PartialDate{Year: 1990}}
+	if status, _ := postAs("test", "addArtist", artist, nil); status != 200 {
+		test.Errorf("Expected 200 adding an end date in the birth year, got %d", status)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func uploadAudio(id string, data []byte, ifMatch string, result *Audio) (int, error) {
+	req, err := http.NewRequest("POST", TEST_SERVER_END_POINT+"uploadSongAudio?id="+id, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "audio/mpeg")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	return resp.StatusCode, err
+}
+
+func streamSong(id, byteRange string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("GET", TEST_SERVER_END_POINT+"streamSong?id="+id, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+func TestSongAudio(test *testing.T) {
+	albumId, artistId := "testAudioAlbum", "testAudioArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	song := Song{Id: "testAudioSong", Name: "testAudioSong", AlbumId: albumId, ArtistId: artistId}
+	if err := addSong(&song); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	// Well over the 1 KB the JSON end points read.
+	data := append([]byte("ID3"), bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x00}, 4096)...)
+
+	var audio Audio
+	if status, err := uploadAudio(song.Id, data, "", &audio); err != nil || status != 200 {
+		test.Fatalf("Unable to upload audio: %d, %v", status, err)
+	}
+	if audio.ContentType != "audio/mpeg" || audio.Size != int64(len(data)) {
+		test.Errorf("Expected %d bytes of audio/mpeg, got %#v", len(data), audio)
+	}
+
+	stored, err := getSong(song.Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	if stored.AudioId != audio.Id {
+		test.Errorf("Expected the song audio %s, got %s", audio.Id, stored.AudioId)
+	}
+
+	resp, served, err := streamSong(song.Id, "")
+	if err != nil || resp.StatusCode != 200 || !bytes.Equal(served, data) {
+		test.Fatalf("Expected the whole file, got %v, %v", resp, err)
+	}
+	if resp.Header.Get("Content-Type") != "audio/mpeg" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		test.Errorf("Expected seekable audio/mpeg, got %v", resp.Header)
+	}
+
+	resp, served, err = streamSong(song.Id, "bytes=100-199")
+	if err != nil || resp.StatusCode != http.StatusPartialContent || !bytes.Equal(served, data[100:200]) {
+		test.Fatalf("Expected 206 with bytes 100 to 199, got %v, %v", resp, err)
+	}
+	if contentRange := resp.Header.Get("Content-Range"); contentRange != "bytes 100-199/16387" {
+		test.Errorf("Expected the Content-Range of the part, got %s", contentRange)
+	}
+
+	if resp, _, err := streamSong(song.Id, "bytes=20000-"); err != nil || resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		test.Errorf("Expected 416 for a range past the end, got %v, %v", resp, err)
+	}
+
+	if status, _ := uploadAudio(song.Id, []byte("not audio at all"), "", nil); status != 422 {
+		test.Errorf("Expected 422 uploading a text file, got %d", status)
+	}
+
+	if status, _ := uploadAudio("testAudioNobody", data, "", nil); status != 422 {
+		test.Errorf("Expected 422 uploading for a missing song, got %d", status)
+	}
+
+	silent := Song{Id: "testAudioSilent", Name: "testAudioSilent", AlbumId: albumId, ArtistId: artistId}
+	if err := addSong(&silent); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+	if resp, _, err := streamSong(silent.Id, ""); err != nil || resp.StatusCode != http.StatusNotFound {
+		test.Errorf("Expected 404 streaming a song without audio, got %v, %v", resp, err)
+	}
+}
+
+func TestSongAudioIfMatch(test *testing.T) {
+	albumId, artistId := "testAudioIfMatchAlbum", "testAudioIfMatchArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	song := Song{Id: "testAudioIfMatchSong", Name: "testAudioIfMatchSong", AlbumId: albumId, ArtistId: artistId}
+	if err := addSong(&song); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	added, err := getSong(song.Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+
+	data := append([]byte("ID3"), bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x00}, 512)...)
+	stale := formatETag(added.Version)
+	if status, err := uploadAudio(song.Id, data, stale, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to upload audio with a current If-Match: %d, %v", status, err)
+	}
+
+	// The version the first upload was based on is now stale.
+	if status, err := uploadAudio(song.Id, data, stale, nil); err != nil || status != http.StatusPreconditionFailed {
+		test.Errorf("Expected 412 for a stale If-Match, got %d, %v", status, err)
+	}
+
+	updated, err := getSong(song.Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	if updated.Version != added.Version+1 {
+		test.Errorf("Expected version %d after one upload, got %d", added.Version+1, updated.Version)
+	}
+}
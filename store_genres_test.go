@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGenres(test *testing.T) {
+	rock := Genre{Id: "testGenreRock", Name: "Test Rock"}
+	if status, err := postAs("test", "addGenre", rock, &rock); err != nil || status != 200 {
+		test.Fatalf("Unable to add genre: %d, %v", status, err)
+	}
+
+	punk := Genre{Id: "testGenrePunk", Name: "Test Punk-Rock", Aliases: []string{"Test Punk"}, ParentId: rock.Id}
+	if status, err := postAs("test", "addGenre", punk, &punk); err != nil || status != 200 {
+		test.Fatalf("Unable to add sub-genre: %d, %v", status, err)
+	}
+
+	// Names match whatever the case, spacing and punctuation.
+	taken := Genre{Name: "test punk rock"}
+	if status, _ := postAs("test", "addGenre", taken, nil); status != 409 {
+		test.Errorf("Expected 409 adding a taken name, got %d", status)
+	}
+
+	orphan := Genre{Name: "Test Orphan", ParentId: "testGenreNobody"}
+	if status, _ := postAs("test", "addGenre", orphan, nil); status != 422 {
+		test.Errorf("Expected 422 adding a genre with a missing parent, got %d", status)
+	}
+
+	// Putting the rock genre below the punk genre would make a cycle.
+	rock.ParentId = punk.Id
+	if status, _ := postAs("test", "updateGenre", rock, nil); status != 422 {
+		test.Errorf("Expected 422 for a cycle, got %d", status)
+	}
+	rock.ParentId = ""
+
+	albumId, artistId := "testGenresAlbum", "testGenresArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	rockSong := Song{Id: "testGenreRockSong", Name: "testGenreRockSong", GenreId: rock.Id, AlbumId: albumId, ArtistId: artistId}
+	if err := addSong(&rockSong); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	// A genre given by name, as before genres existed, is matched to the genre.
+	punkSong := Song{Id: "testGenrePunkSong", Name: "testGenrePunkSong", Genre: "TEST PUNK", AlbumId: albumId, ArtistId: artistId}
+	if err := addSong(&punkSong); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	stored, err := getSong(punkSong.Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	if stored.GenreId != punk.Id || stored.Genre != punk.Name {
+		test.Errorf("Expected the song in genre %s named %s, got %s named %s", punk.Id, punk.Name, stored.GenreId, stored.Genre)
+	}
+
+	var ids []string
+	if status, err := postAs("test", "getGenreSongs", rock.Id, &ids); err != nil || status != 200 {
+		test.Fatalf("Unable to get genre songs: %d, %v", status, err)
+	}
+	if len(ids) != 2 || ids[0] != rockSong.Id || ids[1] != punkSong.Id {
+		test.Errorf("Expected the songs of the genre and its sub-genre, got %v", ids)
+	}
+
+	if status, err := postAs("test", "getGenreSongs", punk.Id, &ids); err != nil || status != 200 || len(ids) != 1 {
+		test.Errorf("Expected only the sub-genre's song, got %d, %v, %v", status, ids, err)
+	}
+
+	missing := Song{Name: "testGenreMissing", GenreId: "testGenreNobody", AlbumId: albumId, ArtistId: artistId}
+	if status, _ := postAs("test", "addSong", missing, nil); status != 422 {
+		test.Errorf("Expected 422 adding a song with a missing genre, got %d", status)
+	}
+
+	if status, _ := postAs("test", "deleteGenre", rock.Id, nil); status != 409 {
+		test.Errorf("Expected 409 deleting a genre with a sub-genre, got %d", status)
+	}
+
+	if err := deleteSong(punkSong.Id); err != nil {
+		test.Fatalf("Unable to delete song: %s", err)
+	}
+	if status, _ := postAs("test", "deleteGenre", punk.Id, nil); status != 200 {
+		test.Errorf("Expected the emptied sub-genre to be deleted, got %d", status)
+	}
+	if status, _ := postAs("test", "getGenre", punk.Id, nil); status == 200 {
+		test.Errorf("Expected the deleted genre to be gone")
+	}
+
+	// The song in the trash comes back without the deleted genre, keeping its name.
+	if status, err := postTrash("restoreFromTrash", RestoreRequest{TRASH_SONG, punkSong.Id}, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to restore song: %d, %v", status, err)
+	}
+	restored, err := getSong(punkSong.Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	if restored.GenreId != "" || restored.Genre != punk.Name {
+		test.Errorf("Expected the song without a genre id, named %s, got %s named %s", punk.Name, restored.GenreId, restored.Genre)
+	}
+}
+
+func TestGenreRename(test *testing.T) {
+	genre := Genre{Id: "testGenreRename", Name: "Test Rename"}
+	if status, err := postAs("test", "addGenre", genre, &genre); err != nil || status != 200 {
+		test.Fatalf("Unable to add genre: %d, %v", status, err)
+	}
+
+	albumId, artistId := "testGenreRenameAlbum", "testGenreRenameArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	songs := []Song{
+		{Id: "testGenreRenameSong", Name: "testGenreRenameSong", GenreId: genre.Id, AlbumId: albumId, ArtistId: artistId},
+		{Id: "testGenreRenameTrashed", Name: "testGenreRenameTrashed", GenreId: genre.Id, AlbumId: albumId, ArtistId: artistId},
+	}
+	for i := range songs {
+		if err := addSong(&songs[i]); err != nil {
+			test.Fatalf("Unable to add song: %s", err)
+		}
+	}
+	if err := deleteSong(songs[1].Id); err != nil {
+		test.Fatalf("Unable to delete song: %s", err)
+	}
+
+	genre.Name = "Test Renamed"
+	if status, err := postAs("test", "updateGenre", genre, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to rename genre: %d, %v", status, err)
+	}
+
+	stored, err := getSong(songs[0].Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	if stored.Genre != genre.Name {
+		test.Errorf("Expected the song's genre renamed to %s, got %s", genre.Name, stored.Genre)
+	}
+
+	// The song in the trash picks up the new name when it comes back.
+	if status, err := postTrash("restoreFromTrash", RestoreRequest{TRASH_SONG, songs[1].Id}, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to restore song: %d, %v", status, err)
+	}
+	restored, err := getSong(songs[1].Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	if restored.GenreId != genre.Id || restored.Genre != genre.Name {
+		test.Errorf("Expected the restored song in genre %s named %s, got %s named %s", genre.Id, genre.Name, restored.GenreId, restored.Genre)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func testPng(width, height int) ([]byte, error) {
+	picture := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			picture.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+
+	var buffer bytes.Buffer
+	err := png.Encode(&buffer, picture)
+	return buffer.Bytes(), err
+}
+
+func uploadImage(endPoint, id string, data []byte, ifMatch string, result *Image) (int, error) {
+	req, err := http.NewRequest("POST", TEST_SERVER_END_POINT+endPoint+"?id="+id, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "image/png")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	return resp.StatusCode, err
+}
+
+func TestImages(test *testing.T) {
+	albumId, artistId := "testImagesAlbum", "testImagesArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	data, err := testPng(40, 30)
+	if err != nil {
+		test.Fatalf("Unable to encode image: %s", err)
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	var cover Image
+	if status, err := uploadImage("uploadAlbumImage", albumId, data, "", &cover); err != nil || status != 200 {
+		test.Fatalf("Unable to upload album image: %d, %v", status, err)
+	}
+	if cover.Id != hash || cover.ContentType != "image/png" || cover.Width != 40 || cover.Height != 30 {
+		test.Errorf("Expected a 40x30 png stored as %s, got %#v", hash, cover)
+	}
+
+	album, err := getAlbum(albumId)
+	if err != nil {
+		test.Fatalf("Unable to get album: %s", err)
+	}
+	if album.ImageId != hash {
+		test.Errorf("Expected the album image %s, got %s", hash, album.ImageId)
+	}
+
+	// The same file is stored once, under the same id.
+	var photo Image
+	if status, err := uploadImage("uploadArtistImage", artistId, data, "", &photo); err != nil || status != 200 || photo.Id != hash {
+		test.Errorf("Expected the artist image %s, got %d, %v, %#v", hash, status, err, photo)
+	}
+
+	if status, _ := uploadImage("uploadAlbumImage", albumId, []byte("not an image"), "", nil); status != 422 {
+		test.Errorf("Expected 422 uploading a text file, got %d", status)
+	}
+
+	if status, _ := uploadImage("uploadAlbumImage", "testImagesNobody", data, "", nil); status != 422 {
+		test.Errorf("Expected 422 uploading for a missing album, got %d", status)
+	}
+
+	album.ImageId = hex.EncodeToString(make([]byte, sha256.Size))
+	if status, _ := postAs("test", "updateAlbum", album, nil); status != 422 {
+		test.Errorf("Expected 422 referring to a missing image, got %d", status)
+	}
+
+	resp, err := http.Get(TEST_SERVER_END_POINT + "images/" + hash)
+	if err != nil {
+		test.Fatalf("Unable to get image: %s", err)
+	}
+	served, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != 200 || !bytes.Equal(served, data) {
+		test.Fatalf("Expected the image back, got %d, %v", resp.StatusCode, err)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "image/png" {
+		test.Errorf("Expected content type image/png, got %s", contentType)
+	}
+	if cacheControl := resp.Header.Get("Cache-Control"); cacheControl != "public, max-age=31536000, immutable" {
+		test.Errorf("Expected a long-lived Cache-Control, got %s", cacheControl)
+	}
+
+	req, err := http.NewRequest("GET", TEST_SERVER_END_POINT+"images/"+hash, nil)
+	if err != nil {
+		test.Fatalf("Unable to create request: %s", err)
+	}
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		test.Fatalf("Unable to get image: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		test.Errorf("Expected 304 for a cached image, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(TEST_SERVER_END_POINT + "images/" + hex.EncodeToString(make([]byte, sha256.Size)))
+	if err != nil {
+		test.Fatalf("Unable to get image: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		test.Errorf("Expected 404 for a missing image, got %d", resp.StatusCode)
+	}
+}
+
+func TestImageIfMatch(test *testing.T) {
+	albumId, artistId := "testImageIfMatchAlbum", "testImageIfMatchArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	data, err := testPng(20, 20)
+	if err != nil {
+		test.Fatalf("Unable to encode image: %s", err)
+	}
+
+	album, err := getAlbum(albumId)
+	if err != nil {
+		test.Fatalf("Unable to get album: %s", err)
+	}
+	stale := formatETag(album.Version)
+	if status, err := uploadImage("uploadAlbumImage", albumId, data, stale, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to upload album image with a current If-Match: %d, %v", status, err)
+	}
+
+	// The version the first upload was based on is now stale.
+	if status, err := uploadImage("uploadAlbumImage", albumId, data, stale, nil); err != nil || status != http.StatusPreconditionFailed {
+		test.Errorf("Expected 412 for a stale If-Match, got %d, %v", status, err)
+	}
+
+	updated, err := getAlbum(albumId)
+	if err != nil {
+		test.Fatalf("Unable to get album: %s", err)
+	}
+	if updated.Version != album.Version+1 {
+		test.Errorf("Expected version %d after one upload, got %d", album.Version+1, updated.Version)
+	}
+
+	artist, err := getArtist(artistId)
+	if err != nil {
+		test.Fatalf("Unable to get artist: %s", err)
+	}
+	stale = formatETag(artist.Version)
+	if status, err := uploadImage("uploadArtistImage", artistId, data, stale, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to upload artist image with a current If-Match: %d, %v", status, err)
+	}
+	if status, err := uploadImage("uploadArtistImage", artistId, data, stale, nil); err != nil || status != http.StatusPreconditionFailed {
+		test.Errorf("Expected 412 for a stale If-Match, got %d, %v", status, err)
+	}
+
+	updatedArtist, err := getArtist(artistId)
+	if err != nil {
+		test.Fatalf("Unable to get artist: %s", err)
+	}
+	if updatedArtist.Version != artist.Version+1 {
+		test.Errorf("Expected version %d after one upload, got %d", artist.Version+1, updatedArtist.Version)
+	}
+}
+
+func getImage(url string) (int, []byte, error) {
+	resp, err := http.Get(TEST_SERVER_END_POINT + url)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+func TestImageThumbnails(test *testing.T) {
+	artistId := "testThumbnailsArtist"
+	if err := ensureArtist(artistId); err != nil {
+		test.Fatalf("Unable to add artist %s: %s", artistId, err)
+	}
+
+	data, err := testPng(300, 200)
+	if err != nil {
+		test.Fatalf("Unable to encode image: %s", err)
+	}
+
+	var photo Image
+	if status, err := uploadImage("uploadArtistImage", artistId, data, "", &photo); err != nil || status != 200 {
+		test.Fatalf("Unable to upload artist image: %d, %v", status, err)
+	}
+
+	status, thumbnail, err := getImage("images/" + photo.Id + "?size=128")
+	if err != nil || status != 200 {
+		test.Fatalf("Unable to get thumbnail: %d, %v", status, err)
+	}
+
+	thumbnailConfig, err := png.DecodeConfig(bytes.NewReader(thumbnail))
+	if err != nil {
+		test.Fatalf("Expected a png thumbnail: %s", err)
+	}
+	if thumbnailConfig.Width != 128 || thumbnailConfig.Height != 85 {
+		test.Errorf("Expected a 128x85 thumbnail, got %dx%d", thumbnailConfig.Width, thumbnailConfig.Height)
+	}
+
+	path := filepath.Join(GetConfig().GetMediaDir(), "thumbnails", "128", photo.Id[:2], photo.Id)
+	if cached, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(cached, thumbnail) {
+		test.Errorf("Expected the thumbnail to be kept at %s: %v", path, err)
+	}
+
+	// An image that already fits is served as it is.
+	if status, served, err := getImage("images/" + photo.Id + "?size=512"); err != nil || status != 200 || !bytes.Equal(served, data) {
+		test.Errorf("Expected the image itself for a larger size, got %d, %v", status, err)
+	}
+
+	if status, _, _ := getImage("images/" + photo.Id + "?size=100"); status != 404 {
+		test.Errorf("Expected 404 for a size that is not configured, got %d", status)
+	}
+}
+
+func TestMediaDisabled(test *testing.T) {
+	data, err := testPng(10, 10)
+	if err != nil {
+		test.Fatalf("Unable to encode image: %s", err)
+	}
+
+	// Without a directory nothing is written, not even to the working directory.
+	if _, err := NewImages("").Put(data); err != MediaDisabledError {
+		test.Errorf("Expected images to be disabled, got %v", err)
+	}
+	if _, err := NewAudioFiles("").Put(bytes.NewReader([]byte("ID3")), 1<<10); err != MediaDisabledError {
+		test.Errorf("Expected audio to be disabled, got %v", err)
+	}
+}
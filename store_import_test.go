@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func importSong(data []byte, report *ImportReport) (int, error) {
+	resp, err := http.Post(TEST_SERVER_END_POINT+"importSong", "audio/mpeg", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && report != nil {
+		err = json.NewDecoder(resp.Body).Decode(report)
+	}
+
+	return resp.StatusCode, err
+}
+
+/*
+Whether the file is stored as audio, looked up by the hash of its content.
+*/
+func audioStored(data []byte) bool {
+	hash := sha256.Sum256(data)
+	id := hex.EncodeToString(hash[:])
+
+	_, err := os.Stat(filepath.Join(GetConfig().GetMediaDir(), "audio", id[:2], id))
+	return err == nil
+}
+
+func importStatuses(report *ImportReport) map[string]string {
+	statuses := make(map[string]string)
+	for _, record := range report.Records {
+		statuses[record.Kind] = record.Status
+	}
+
+	return statuses
+}
+
+func TestImportSong(test *testing.T) {
+	first := bytes.Join([][]byte{
+		id3v2Tag(3,
+			latin1Frame(3, "TIT2", "testImportFirst"),
+			latin1Frame(3, "TPE1", "testImportArtist"),
+			latin1Frame(3, "TALB", "testImportAlbum"),
+			latin1Frame(3, "TCON", "(17)"),
+			latin1Frame(3, "TRCK", "1/2"),
+		),
+		mpegFrames(3),
+	}, nil)
+
+	var report ImportReport
+	if status, err := importSong(first, &report); err != nil || status != 200 {
+		test.Fatalf("Unable to import song: %d, %v", status, err)
+	}
+	statuses := importStatuses(&report)
+	if report.Status != IMPORT_CREATED || statuses["artist"] != IMPORT_CREATED || statuses["album"] != IMPORT_CREATED || statuses["song"] != IMPORT_CREATED {
+		test.Fatalf("Expected the artist, album and song created, got %#v", report)
+	}
+
+	songId := report.Records[2].Id
+	song, err := getSong(songId)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	if song.Name != "testImportFirst" || song.Track != 1 || song.Disc != 1 || song.Time.Seconds != 3 || song.AudioId != report.AudioId {
+		test.Errorf("Expected the song as tagged, got %#v", song)
+	}
+	if song.ArtistId != report.Records[0].Id || song.AlbumId != report.Records[1].Id {
+		test.Errorf("Expected the song under the imported artist and album, got %#v", song)
+	}
+
+	// The same file again matches everything.
+	report = ImportReport{}
+	if status, err := importSong(first, &report); err != nil || status != 200 {
+		test.Fatalf("Unable to import song again: %d, %v", status, err)
+	}
+	statuses = importStatuses(&report)
+	if report.Status != IMPORT_MATCHED || statuses["artist"] != IMPORT_MATCHED || statuses["album"] != IMPORT_MATCHED || statuses["song"] != IMPORT_MATCHED {
+		test.Errorf("Expected the artist, album and song matched, got %#v", report)
+	}
+	if !audioStored(first) {
+		test.Errorf("Expected the audio of the matched song kept")
+	}
+
+	// Names match ignoring case, the second song comes from an ID3v1 tag.
+	second := append(mpegFrames(2), id3v1Tag("testImportSecond", "TESTIMPORTARTIST", "testimportalbum", 2, 17)...)
+	report = ImportReport{}
+	if status, err := importSong(second, &report); err != nil || status != 200 {
+		test.Fatalf("Unable to import second song: %d, %v", status, err)
+	}
+	statuses = importStatuses(&report)
+	if report.Status != IMPORT_CREATED || statuses["artist"] != IMPORT_MATCHED || statuses["album"] != IMPORT_MATCHED {
+		test.Errorf("Expected the second song created on the matched album, got %#v", report)
+	}
+
+	// A song whose track is taken is skipped without creating anything.
+	taken := append(mpegFrames(1), id3v1Tag("testImportThird", "testImportArtist", "testImportAlbum", 2, 17)...)
+	report = ImportReport{}
+	if status, err := importSong(taken, &report); err != nil || status != 200 {
+		test.Fatalf("Unable to import third song: %d, %v", status, err)
+	}
+	if report.Status != IMPORT_SKIPPED || report.Reason == "" || len(report.Records) != 0 {
+		test.Errorf("Expected the song with a taken track skipped, got %#v", report)
+	}
+	if audioStored(taken) {
+		test.Errorf("Expected the audio of the skipped song removed")
+	}
+
+	untitled := append(mpegFrames(1), id3v1Tag("", "testImportArtist", "testImportAlbum", 3, 17)...)
+	report = ImportReport{}
+	if status, err := importSong(untitled, &report); err != nil || status != 200 {
+		test.Fatalf("Unable to import untitled song: %d, %v", status, err)
+	}
+	if report.Status != IMPORT_SKIPPED || report.Reason == "" {
+		test.Errorf("Expected the untitled song skipped, got %#v", report)
+	}
+	if audioStored(untitled) {
+		test.Errorf("Expected the audio of the untitled song removed")
+	}
+
+	if status, _ := importSong([]byte("not audio at all"), nil); status != 422 {
+		test.Errorf("Expected 422 importing a text file, got %d", status)
+	}
+
+	flac := []byte("fLaCtestImportNotMp3")
+	if status, _ := importSong(flac, nil); status != 422 {
+		test.Errorf("Expected 422 importing a FLAC file, got %d", status)
+	}
+	if audioStored(flac) {
+		test.Errorf("Expected the audio of the FLAC file removed")
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Uploads go to a directory of their own, not the working directory.
+	mediaDir, err := ioutil.TempDir("", "media")
+	if err != nil {
+		panic(err)
+	}
+	config.state.MediaDir = mediaDir
+
+	NewStore(nil)
+	code := m.Run()
+
+	os.RemoveAll(mediaDir)
+	os.Exit(code)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlaylists(test *testing.T) {
+	albumId, artistId := "testPlaylistsAlbum", "testPlaylistsArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	songIds := []string{"testPlaylistSong1", "testPlaylistSong2", "testPlaylistSong3"}
+	for _, id := range songIds {
+		if err := addSong(&Song{Id: id, Name: id, AlbumId: albumId, ArtistId: artistId}); err != nil {
+			test.Fatalf("Unable to add song %s: %s", id, err)
+		}
+	}
+
+	playlist := Playlist{Id: "testPlaylist", Name: "Test Playlist", SongIds: songIds[:1]}
+	if status, err := postAs("carol", "addPlaylist", playlist, &playlist); err != nil || status != 200 {
+		test.Fatalf("Unable to add playlist: %d, %v", status, err)
+	}
+	if playlist.Owner != "carol" {
+		test.Errorf("Expected the playlist owned by its creator, got '%s'", playlist.Owner)
+	}
+
+	check := func(expected ...string) {
+		var stored Playlist
+		if status, err := postAs("test", "getPlaylist", playlist.Id, &stored); err != nil || status != 200 {
+			test.Fatalf("Unable to get playlist: %d, %v", status, err)
+		}
+		if len(stored.SongIds) != len(expected) {
+			test.Fatalf("Expected songs %v, got %v", expected, stored.SongIds)
+		}
+		for i := range expected {
+			if stored.SongIds[i] != expected[i] {
+				test.Fatalf("Expected songs %v, got %v", expected, stored.SongIds)
+			}
+		}
+	}
+
+	edits := []struct {
+		endPoint string
+		request  interface{}
+		expected []string
+	}{
+		{"appendToPlaylist", PlaylistSongsRequest{PlaylistId: playlist.Id, SongIds: songIds[1:]}, songIds},
+		{"insertIntoPlaylist", map[string]interface{}{"playlistId": playlist.Id, "songIds": songIds[2:], "position": 0},
+			[]string{songIds[2], songIds[0], songIds[1], songIds[2]}},
+		{"movePlaylistSong", PlaylistMoveRequest{PlaylistId: playlist.Id, From: 0, To: 2},
+			[]string{songIds[0], songIds[1], songIds[2], songIds[2]}},
+		{"removeFromPlaylist", PlaylistRemoveRequest{PlaylistId: playlist.Id, Position: 3}, songIds},
+	}
+	for _, edit := range edits {
+		if status, err := postAs("test", edit.endPoint, edit.request, nil); err != nil || status != 200 {
+			test.Fatalf("Unable to %s: %d, %v", edit.endPoint, status, err)
+		}
+		check(edit.expected...)
+	}
+
+	invalid := []struct {
+		endPoint string
+		request  interface{}
+	}{
+		{"appendToPlaylist", PlaylistSongsRequest{PlaylistId: playlist.Id, SongIds: []string{"testPlaylistNoSong"}}},
+		{"insertIntoPlaylist", PlaylistSongsRequest{PlaylistId: playlist.Id, SongIds: songIds[:1]}},
+		{"movePlaylistSong", PlaylistMoveRequest{PlaylistId: playlist.Id, From: 0, To: 3}},
+		{"removeFromPlaylist", PlaylistRemoveRequest{PlaylistId: playlist.Id, Position: -1}},
+		{"renamePlaylist", PlaylistRenameRequest{PlaylistId: playlist.Id, Name: " "}},
+	}
+	for _, edit := range invalid {
+		if status, _ := postAs("test", edit.endPoint, edit.request, nil); status != 422 {
+			test.Errorf("Expected 422 for %s %#v, got %d", edit.endPoint, edit.request, status)
+		}
+	}
+	check(songIds...)
+
+	description := "renamed"
+	rename := PlaylistRenameRequest{PlaylistId: playlist.Id, Name: "Renamed", Description: &description, Version: 1}
+	if status, _ := postAs("test", "renamePlaylist", rename, nil); status != 409 {
+		test.Errorf("Expected 409 renaming a stale version, got %d", status)
+	}
+	rename.Version = 0
+	if status, err := postAs("test", "renamePlaylist", rename, nil); err != nil || status != 200 {
+		test.Errorf("Unable to rename playlist: %d, %v", status, err)
+	}
+
+	// Deleting a song takes it out of the playlist.
+	if err := deleteSong(songIds[1]); err != nil {
+		test.Fatalf("Unable to delete song: %s", err)
+	}
+	check(songIds[0], songIds[2])
+
+	if status, err := postAs("test", "deletePlaylist", playlist.Id, nil); err != nil || status != 200 {
+		test.Errorf("Unable to delete playlist: %d, %v", status, err)
+	}
+	if status, _ := postAs("test", "getPlaylist", playlist.Id, nil); status == 200 {
+		test.Errorf("Expected the deleted playlist to be gone")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestArtistRelationships(test *testing.T) {
+	bandId, singerId, drummerId := "testRelationshipsBand", "testRelationshipsSinger", "testRelationshipsDrummer"
+	for _, id := range []string{bandId, singerId, drummerId} {
+		if err := ensureArtist(id); err != nil {
+			test.Fatalf("Unable to add artist %s: %s", id, err)
+		}
+	}
+
+	singer := Relationship{Kind: RELATIONSHIP_MEMBER_OF, ArtistId: singerId, RelatedId: bandId, From: PartialDate{Year: 1990}}
+	if status, err := postAs("test", "addRelationship", singer, &singer); err != nil || status != 200 {
+		test.Fatalf("Unable to add relationship: %d, %v", status, err)
+	}
+
+	drummer := Relationship{
+		Kind:      RELATIONSHIP_MEMBER_OF,
+		ArtistId:  drummerId,
+		RelatedId: bandId,
+		From:      PartialDate{Year: 1990, Month: 3},
+		To:        PartialDate{Year: 1995},
+	}
+	if status, err := postAs("test", "addRelationship", drummer, &drummer); err != nil || status != 200 {
+		test.Fatalf("Unable to add relationship: %d, %v", status, err)
+	}
+
+	// The drummer came back later, which does not overlap the first stint.
+	comeback := Relationship{Kind: RELATIONSHIP_MEMBER_OF, ArtistId: drummerId, RelatedId: bandId, From: PartialDate{Year: 2001}}
+	if status, err := postAs("test", "addRelationship", comeback, &comeback); err != nil || status != 200 {
+		test.Fatalf("Unable to add relationship: %d, %v", status, err)
+	}
+
+	overlapping := Relationship{Kind: RELATIONSHIP_MEMBER_OF, ArtistId: drummerId, RelatedId: bandId, From: PartialDate{Year: 1994}}
+	if status, _ := postAs("test", "addRelationship", overlapping, nil); status != 409 {
+		test.Errorf("Expected 409 adding an overlapping membership, got %d", status)
+	}
+
+	dated := Relationship{Kind: RELATIONSHIP_ALIAS_OF, ArtistId: singerId, RelatedId: bandId, From: PartialDate{Year: 1990}}
+	if status, _ := postAs("test", "addRelationship", dated, nil); status != 422 {
+		test.Errorf("Expected 422 adding an alias with dates, got %d", status)
+	}
+
+	itself := Relationship{Kind: RELATIONSHIP_SIDE_PROJECT_OF, ArtistId: bandId, RelatedId: bandId}
+	if status, _ := postAs("test", "addRelationship", itself, nil); status != 422 {
+		test.Errorf("Expected 422 relating an artist to itself, got %d", status)
+	}
+
+	lineups := []struct {
+		at      PartialDate
+		members []string
+	}{
+		// Within 1990 the drummer may already have joined.
+		{PartialDate{Year: 1990}, []string{singer.Id, drummer.Id}},
+		{PartialDate{Year: 1990, Month: 1}, []string{singer.Id}},
+		{PartialDate{Year: 1998, Month: 6, Day: 1}, []string{singer.Id}},
+		{PartialDate{}, []string{singer.Id, comeback.Id}},
+	}
+
+	for _, lineup := range lineups {
+		var members []Relationship
+		request := LineupRequest{ArtistId: bandId, At: lineup.at}
+		if status, err := postAs("test", "getLineup", request, &members); err != nil || status != 200 {
+			test.Fatalf("Unable to get lineup at %s: %d, %v", lineup.at, status, err)
+		}
+
+		ids := make(map[string]bool)
+		for _, member := range members {
+			ids[member.Id] = true
+		}
+		if len(members) != len(lineup.members) {
+			test.Errorf("Expected %d members at %s, got %v", len(lineup.members), lineup.at, members)
+			continue
+		}
+		for _, id := range lineup.members {
+			if !ids[id] {
+				test.Errorf("Expected relationship %s in the lineup at %s, got %v", id, lineup.at, members)
+			}
+		}
+	}
+
+	// The singer leaves.
+	singer.To = PartialDate{Year: 2010, Month: 5}
+	if status, err := postAs("test", "updateRelationship", singer, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to update relationship: %d, %v", status, err)
+	}
+
+	var members []Relationship
+	if status, err := postAs("test", "getLineup", LineupRequest{ArtistId: bandId}, &members); err != nil || status != 200 {
+		test.Fatalf("Unable to get lineup: %d, %v", status, err)
+	}
+	if len(members) != 1 || members[0].Id != comeback.Id {
+		test.Errorf("Expected only the drummer in the current lineup, got %v", members)
+	}
+
+	if err := deleteArtist(drummerId); err != nil {
+		test.Fatalf("Unable to delete artist: %s", err)
+	}
+
+	var relationships []Relationship
+	if status, err := postAs("test", "getArtistRelationships", bandId, &relationships); err != nil || status != 200 {
+		test.Fatalf("Unable to get artist relationships: %d, %v", status, err)
+	}
+	if len(relationships) != 1 || relationships[0].Id != singer.Id {
+		test.Errorf("Expected the deleted artist's relationships to be gone, got %v", relationships)
+	}
+	if status, _ := postAs("test", "getRelationship", drummer.Id, nil); status == 200 {
+		test.Errorf("Expected the deleted artist's relationship to be gone")
+	}
+}
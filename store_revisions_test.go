@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+Posts to an end point as the given actor, decoding a 200 OK response into result when given.
+*/
+func postAs(actor, endPoint string, request interface{}, result interface{}) (int, error) {
+	buffer, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest("POST", TEST_SERVER_END_POINT+endPoint, bytes.NewReader(buffer))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Actor", actor)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 || result == nil {
+		return resp.StatusCode, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.StatusCode, json.Unmarshal(body, result)
+}
+
+func TestRevisions(test *testing.T) {
+	artist := Artist{Id: "testRevisionArtist", Name: "before", Birthdate: PartialDate{Year: 1970}}
+
+	if status, err := postAs("alice", "addArtist", artist, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to add artist: %d, %v", status, err)
+	}
+
+	// Revision times are taken when the change is applied.
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	artist.Name = "after"
+	if status, err := postAs("bob", "updateArtist", artist, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to update artist: %d, %v", status, err)
+	}
+
+	var revisions []*Revision
+	request := RevisionRequest{Kind: REVISION_ARTIST, Id: artist.Id}
+	if status, err := postAs("carol", "getRevisions", request, &revisions); err != nil || status != 200 {
+		test.Fatalf("Unable to get revisions: %d, %v", status, err)
+	}
+
+	if len(revisions) != 2 {
+		test.Fatalf("Expected 2 revisions, got %d", len(revisions))
+	}
+	if revisions[0].Op != REVISION_ADD || revisions[0].Actor != "alice" {
+		test.Errorf("Unexpected first revision %+v", revisions[0])
+	}
+	if revisions[1].Op != REVISION_UPDATE || revisions[1].Actor != "bob" || revisions[1].Number != 2 {
+		test.Errorf("Unexpected second revision %+v", revisions[1])
+	}
+
+	var changes []FieldChange
+	request.From, request.To = 1, 2
+	if status, err := postAs("carol", "diffRevisions", request, &changes); err != nil || status != 200 {
+		test.Fatalf("Unable to diff revisions: %d, %v", status, err)
+	}
+
+	fields := make(map[string]FieldChange)
+	for _, change := range changes {
+		fields[change.Field] = change
+	}
+	if name, ok := fields["name"]; !ok || string(name.From) != `"before"` || string(name.To) != `"after"` {
+		test.Errorf("Expected the name change in %v", changes)
+	}
+	if _, ok := fields["version"]; !ok {
+		test.Errorf("Expected the version change in %v", changes)
+	}
+	if _, ok := fields["birthdate"]; ok {
+		test.Errorf("Unchanged birthdate in %v", changes)
+	}
+
+	var revision Revision
+	request.At = &between
+	if status, err := postAs("carol", "getRevisionAt", request, &revision); err != nil || status != 200 {
+		test.Fatalf("Unable to get revision at %s: %d, %v", between, status, err)
+	}
+
+	var old Artist
+	if err := json.Unmarshal(revision.Data, &old); err != nil || old.Name != "before" {
+		test.Errorf("Expected the artist before the update, got %s", revision.Data)
+	}
+
+	before := between.Add(-time.Hour)
+	request.At = &before
+	if status, _ := postAs("carol", "getRevisionAt", request, nil); status != 404 {
+		test.Errorf("Expected 404 before the artist was added, got %d", status)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"sort"
@@ -222,14 +223,20 @@ func TestAddSong(test *testing.T) {
 		Id:       "testAddId",
 		Name:     "testAdd",
 		Genre:    "testAddGenre",
-		Time:     "testAddSongTime",
-		Price:    "testAddSongPrice",
+		Time:     Duration{Seconds: 181},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testAddSongAlbumId",
 		ArtistId: "testAddSongArtistId",
 	}
 
 	test.Log("Adding song")
-	err := addSong(&song)
+	err := ensureAlbum(song.AlbumId, song.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add album %s: %s", song.AlbumId, err)
+		test.FailNow()
+	}
+
+	err = addSong(&song)
 	if err != nil {
 		test.Errorf("Unable to add song %#v: %s", song, err)
 		test.FailNow()
@@ -242,13 +249,19 @@ func TestDeleteSong(test *testing.T) {
 		Id:       "testDeleteId",
 		Name:     "testDelete",
 		Genre:    "testDeleteGenre",
-		Time:     "testDeleteSongTime",
-		Price:    "testDeleteSongPrice",
+		Time:     Duration{Seconds: 182},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testDeleteSongAlbumId",
 		ArtistId: "testDeleteSongArtistId",
 	}
 
-	err := addSong(&song)
+	err := ensureAlbum(song.AlbumId, song.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add album %s: %s", song.AlbumId, err)
+		test.FailNow()
+	}
+
+	err = addSong(&song)
 	if err != nil {
 		test.Errorf("Unable to add song %#v: %s", song, err)
 		test.FailNow()
@@ -274,13 +287,19 @@ func TestGetSong(test *testing.T) {
 		Id:       "testGetId",
 		Name:     "testGet",
 		Genre:    "testGetGenre",
-		Time:     "testGetSongTime",
-		Price:    "testGetSongPrice",
+		Time:     Duration{Seconds: 183},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testGetSongAlbumId",
 		ArtistId: "testGetSongArtistId",
 	}
 
-	err := addSong(&songI)
+	err := ensureAlbum(songI.AlbumId, songI.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add album %s: %s", songI.AlbumId, err)
+		test.FailNow()
+	}
+
+	err = addSong(&songI)
 	if err != nil {
 		test.Errorf("Unable to add song %#v: %s", songI, err)
 		test.FailNow()
@@ -321,13 +340,19 @@ func TestGetAllSongs(test *testing.T) {
 		Id:       "testGetAllSongsId",
 		Name:     "testGetAllSongs",
 		Genre:    "testGetAllSongsGenre",
-		Time:     "testGetAllSongsTime",
-		Price:    "testGetAllSongsPrice",
+		Time:     Duration{Seconds: 184},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testGetAllSongsAlbumId",
 		ArtistId: "testGetAllSongsArtistId",
 	}
 
-	err := addSong(&songI)
+	err := ensureAlbum(songI.AlbumId, songI.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add album %s: %s", songI.AlbumId, err)
+		test.FailNow()
+	}
+
+	err = addSong(&songI)
 	if err != nil {
 		test.Errorf("Unable to add song %#v: %s", songI, err)
 		test.FailNow()
@@ -350,8 +375,8 @@ func TestGetAlbumSongs(test *testing.T) {
 		Id:       "testGetAlbumSongsId0",
 		Name:     "testGetAlbumSongs0",
 		Genre:    "testGetAlbumSongsGenre0",
-		Time:     "testGetAlbumSongsTime0",
-		Price:    "testGetAlbumSongsPrice0",
+		Time:     Duration{Seconds: 185},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testGetAlbumSongsAlbumId",
 		ArtistId: "testGetAlbumSongsArtistId",
 	}
@@ -359,14 +384,20 @@ func TestGetAlbumSongs(test *testing.T) {
 		Id:       "testGetAlbumSongsId1",
 		Name:     "testGetAlbumSongs1",
 		Genre:    "testGetAlbumSongsGenre1",
-		Time:     "testGetAlbumSongsTime1",
-		Price:    "testGetAlbumSongsPrice1",
+		Time:     Duration{Seconds: 186},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testGetAlbumSongsAlbumId",
 		ArtistId: "testGetAlbumSongsArtistId",
 	}
 
+	err := ensureAlbum(song0.AlbumId, song0.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add album %s: %s", song0.AlbumId, err)
+		test.FailNow()
+	}
+
 	// Add the songs first.
-	err := addSong(&song0)
+	err = addSong(&song0)
 	if err != nil {
 		test.Errorf("Unable to add song %#v: %s", song0, err)
 		test.FailNow()
@@ -408,8 +439,8 @@ func TestGetArtistSongs(test *testing.T) {
 		Id:       "testGetArtistSongsId0",
 		Name:     "testGetArtistSongs0",
 		Genre:    "testGetArtistSongsGenre0",
-		Time:     "testGetArtistSongsTime0",
-		Price:    "testGetArtistSongsPrice0",
+		Time:     Duration{Seconds: 187},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testGetArtistSongsAlbumId",
 		ArtistId: "testGetArtistSongsArtistId",
 	}
@@ -417,14 +448,20 @@ func TestGetArtistSongs(test *testing.T) {
 		Id:       "testGetArtistSongsId1",
 		Name:     "testGetArtistSongs1",
 		Genre:    "testGetArtistSongsGenre1",
-		Time:     "testGetArtistSongsTime1",
-		Price:    "testGetArtistSongsPrice1",
+		Time:     Duration{Seconds: 188},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testGetArtistSongsAlbumId",
 		ArtistId: "testGetArtistSongsArtistId",
 	}
 
+	err := ensureAlbum(song0.AlbumId, song0.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add album %s: %s", song0.AlbumId, err)
+		test.FailNow()
+	}
+
 	// Add the songs first.
-	err := addSong(&song0)
+	err = addSong(&song0)
 	if err != nil {
 		test.Errorf("Unable to add song %#v: %s", song0, err)
 		test.FailNow()
@@ -466,14 +503,20 @@ func TestUpdateSong(test *testing.T) {
 		Id:       "testUpdateId",
 		Name:     "testUpdate",
 		Genre:    "testUpdateGenre",
-		Time:     "testUpdateSongTime",
-		Price:    "testUpdateSongPrice",
+		Time:     Duration{Seconds: 189},
+		Price:    Price{Currency: "USD", Amount: 99},
 		AlbumId:  "testUpdateSongAlbumId",
 		ArtistId: "testUpdateSongArtistId",
 	}
 
+	err := ensureAlbum(song.AlbumId, song.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add album %s: %s", song.AlbumId, err)
+		test.FailNow()
+	}
+
 	// First, add the song.
-	err := addSong(&song)
+	err = addSong(&song)
 	if err != nil {
 		test.Errorf("Unable to add song %#v: %s", song, err)
 		test.FailNow()
@@ -499,3 +542,206 @@ func TestUpdateSong(test *testing.T) {
 		test.FailNow()
 	}
 }
+
+func TestAddSongMissingAlbum(test *testing.T) {
+	song := Song{
+		Id:       "testAddSongMissingAlbumId",
+		Name:     "testAddSongMissingAlbum",
+		Genre:    "testAddSongMissingAlbumGenre",
+		Time:     Duration{Seconds: 190},
+		Price:    Price{Currency: "USD", Amount: 99},
+		AlbumId:  "testAddSongMissingAlbumAlbumId",
+		ArtistId: "testAddSongMissingAlbumArtistId",
+	}
+
+	err := ensureArtist(song.ArtistId)
+	if err != nil {
+		test.Errorf("Unable to add artist %s: %s", song.ArtistId, err)
+		test.FailNow()
+	}
+
+	err = addSong(&song)
+	if err == nil {
+		test.Errorf("Song %#v was added without its album", song)
+		test.FailNow()
+	}
+}
+
+func TestAlbumTrackOrder(test *testing.T) {
+	albumId, artistId := "testTrackOrderAlbum", "testTrackOrderArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	// Added out of order, the last one without a track goes at the end.
+	songs := []Song{
+		{Id: "testTrackOrderC", Name: "C", Disc: 1, Track: 3, AlbumId: albumId, ArtistId: artistId},
+		{Id: "testTrackOrderA", Name: "A", Disc: 1, Track: 1, AlbumId: albumId, ArtistId: artistId},
+		{Id: "testTrackOrderB", Name: "B", Track: 2, AlbumId: albumId, ArtistId: artistId},
+		{Id: "testTrackOrderD", Name: "D", AlbumId: albumId, ArtistId: artistId},
+	}
+	for i := range songs {
+		if err := addSong(&songs[i]); err != nil {
+			test.Fatalf("Unable to add song %s: %s", songs[i].Id, err)
+		}
+	}
+
+	expectOrder := func(expected ...string) {
+		ids, err := getAlbumSongs(albumId)
+		if err != nil {
+			test.Fatalf("Unable to get album songs: %s", err)
+		}
+		if len(ids) != len(expected) {
+			test.Fatalf("Expected %v, got %v", expected, ids)
+		}
+		for i := range ids {
+			if ids[i] != expected[i] {
+				test.Fatalf("Expected %v, got %v", expected, ids)
+			}
+		}
+	}
+
+	expectOrder("testTrackOrderA", "testTrackOrderB", "testTrackOrderC", "testTrackOrderD")
+
+	song, err := getSong("testTrackOrderD")
+	if err != nil || song.Disc != 1 || song.Track != 4 {
+		test.Errorf("Expected the song without a track at disc 1 track 4, got %+v, %v", song, err)
+	}
+
+	taken := Song{Id: "testTrackOrderTaken", Name: "taken", Disc: 1, Track: 2, AlbumId: albumId, ArtistId: artistId}
+	if status, _ := postAs("test", "addSong", taken, nil); status != 409 {
+		test.Errorf("Expected 409 adding a taken track, got %d", status)
+	}
+
+	// Deleting keeps the rest in order.
+	if err := deleteSong("testTrackOrderA"); err != nil {
+		test.Fatalf("Unable to delete song: %s", err)
+	}
+	expectOrder("testTrackOrderB", "testTrackOrderC", "testTrackOrderD")
+
+	reorder := ReorderRequest{albumId, [][]string{{"testTrackOrderD", "testTrackOrderB"}, {"testTrackOrderC"}}}
+	if status, err := postAs("test", "reorderAlbumSongs", reorder, nil); err != nil || status != 200 {
+		test.Fatalf("Unable to reorder album songs: %d, %v", status, err)
+	}
+	expectOrder("testTrackOrderD", "testTrackOrderB", "testTrackOrderC")
+
+	song, err = getSong("testTrackOrderC")
+	if err != nil || song.Disc != 2 || song.Track != 1 {
+		test.Errorf("Expected the song at disc 2 track 1, got %+v, %v", song, err)
+	}
+
+	// Every song must be listed.
+	reorder.Discs = [][]string{{"testTrackOrderD", "testTrackOrderB"}}
+	if status, _ := postAs("test", "reorderAlbumSongs", reorder, nil); status != 422 {
+		test.Errorf("Expected 422 for a partial listing, got %d", status)
+	}
+	expectOrder("testTrackOrderD", "testTrackOrderB", "testTrackOrderC")
+}
+
+func TestSongCredits(test *testing.T) {
+	albumId, artistId, guestId := "testCreditsAlbum", "testCreditsArtist", "testCreditsGuest"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+	if err := ensureArtist(guestId); err != nil {
+		test.Fatalf("Unable to add artist %s: %s", guestId, err)
+	}
+
+	song := Song{
+		Id:       "testCreditsSong",
+		Name:     "testCreditsSong",
+		AlbumId:  albumId,
+		ArtistId: artistId,
+		Credits:  []Credit{{guestId, CREDIT_FEATURED}, {guestId, CREDIT_PRODUCER}},
+	}
+	if err := addSong(&song); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	var ids []string
+	for _, role := range []string{"", CREDIT_FEATURED, CREDIT_PRODUCER} {
+		request := ArtistSongsRequest{ArtistId: guestId, Role: role}
+		if status, err := postAs("test", "getArtistSongs", request, &ids); err != nil || status != 200 {
+			test.Fatalf("Unable to get artist songs as %s: %d, %v", role, status, err)
+		}
+		if len(ids) != 1 || ids[0] != song.Id {
+			test.Errorf("Expected the song credited as '%s', got %v", role, ids)
+		}
+	}
+
+	request := ArtistSongsRequest{ArtistId: guestId, Role: CREDIT_REMIXER}
+	if status, err := postAs("test", "getArtistSongs", request, &ids); err != nil || status != 200 || len(ids) != 0 {
+		test.Errorf("Expected no remixer credits, got %d, %v, %v", status, ids, err)
+	}
+
+	// Dropping the credits takes the song off the guest's list.
+	stored, err := getSong(song.Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	stored.Credits = nil
+	if err := updateSong(stored); err != nil {
+		test.Fatalf("Unable to update song: %s", err)
+	}
+	if ids, err := getArtistSongs(guestId); err == nil {
+		test.Errorf("Expected no songs for the guest after the update, got %v", ids)
+	}
+	if ids, err := getArtistSongs(artistId); err != nil || len(ids) != 1 {
+		test.Errorf("Expected the song under its primary artist, got %v, %v", ids, err)
+	}
+
+	invalid := []Song{
+		{Name: "testCreditsBadRole", AlbumId: albumId, ArtistId: artistId, Credits: []Credit{{guestId, "drummer"}}},
+		{Name: "testCreditsMissing", AlbumId: albumId, ArtistId: artistId, Credits: []Credit{{"testCreditsNobody", CREDIT_COMPOSER}}},
+	}
+	for _, song := range invalid {
+		if status, _ := postAs("test", "addSong", song, nil); status != 422 {
+			test.Errorf("Expected 422 adding %s, got %d", song.Name, status)
+		}
+	}
+}
+
+func TestSongManyCredits(test *testing.T) {
+	albumId, artistId := "testManyCreditsAlbum", "testManyCreditsArtist"
+	if err := ensureAlbum(albumId, artistId); err != nil {
+		test.Fatalf("Unable to add album %s: %s", albumId, err)
+	}
+
+	song := Song{Id: "testManyCreditsSong", Name: "testManyCreditsSong", AlbumId: albumId, ArtistId: artistId}
+	for i := 0; i < 24; i++ {
+		guestId := fmt.Sprintf("testManyCreditsGuest%02d", i)
+		if err := ensureArtist(guestId); err != nil {
+			test.Fatalf("Unable to add artist %s: %s", guestId, err)
+		}
+		song.Credits = append(song.Credits, Credit{guestId, CREDIT_FEATURED})
+	}
+
+	// Well over the 1 KB the end points once read.
+	if buffer, _ := json.Marshal(song); len(buffer) <= 1<<10 {
+		test.Fatalf("Expected a body over 1 KB, got %d bytes", len(buffer))
+	}
+	if err := addSong(&song); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	stored, err := getSong(song.Id)
+	if err != nil {
+		test.Fatalf("Unable to get song: %s", err)
+	}
+	if len(stored.Credits) != len(song.Credits) {
+		test.Errorf("Expected %d credits, got %d", len(song.Credits), len(stored.Credits))
+	}
+
+	resp, err := http.Post(
+		TEST_SERVER_END_POINT+"updateSong",
+		"application/x-www-form-urlencoded",
+		bytes.NewReader(bytes.Repeat([]byte(" "), MAX_BODY_SIZE+1)),
+	)
+	if err != nil {
+		test.Fatalf("Unable to post: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		test.Errorf("Expected 413 for a body over the limit, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func transaction(request *TxRequest) (*TxResult, error) {
+	buffer, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.Post(
+		TEST_SERVER_END_POINT+"transaction",
+		"application/x-www-form-urlencoded",
+		bytes.NewReader(buffer),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 422 {
+		return nil, errors.New("Expected 200 OK or 422 but got " + resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(TxResult)
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func txOperation(op string, data interface{}) TxOperation {
+	buffer, _ := json.Marshal(data)
+	return TxOperation{Op: op, Data: buffer}
+}
+
+func TestTransactionCommit(test *testing.T) {
+	artist := Artist{Id: "testTxCommitArtist", Name: "testTxCommitArtist"}
+	album := Album{Id: "testTxCommitAlbum", Name: "testTxCommitAlbum", Price: Price{Currency: "USD", Amount: 100}, ArtistId: artist.Id}
+	song := Song{Id: "testTxCommitSong", Name: "testTxCommitSong", AlbumId: album.Id, ArtistId: artist.Id}
+
+	result, err := transaction(&TxRequest{
+		Operations: []TxOperation{
+			txOperation("addArtist", artist),
+			txOperation("addAlbum", album),
+			txOperation("addSong", song),
+		},
+	})
+	if err != nil {
+		test.Errorf("Unable to run transaction: %s", err)
+		test.FailNow()
+	}
+
+	if !result.Committed {
+		test.Errorf("Transaction was not committed: %#v", result.Results)
+		test.FailNow()
+	}
+
+	_, err = getSong(song.Id)
+	if err != nil {
+		test.Errorf("Song %s was not added: %s", song.Id, err)
+	}
+}
+
+func TestTransactionRollback(test *testing.T) {
+	artist := Artist{Id: "testTxRollbackArtist", Name: "testTxRollbackArtist"}
+	album := Album{Id: "testTxRollbackAlbum", Name: "testTxRollbackAlbum", Price: Price{Currency: "USD", Amount: 100}, ArtistId: artist.Id}
+	song := Song{Id: "testTxRollbackSong", Name: "testTxRollbackSong", AlbumId: "testTxRollbackMissing", ArtistId: artist.Id}
+
+	result, err := transaction(&TxRequest{
+		Operations: []TxOperation{
+			txOperation("addArtist", artist),
+			txOperation("addAlbum", album),
+			txOperation("addSong", song),
+			txOperation("deleteArtist", artist.Id),
+		},
+	})
+	if err != nil {
+		test.Errorf("Unable to run transaction: %s", err)
+		test.FailNow()
+	}
+
+	if result.Committed {
+		test.Errorf("Transaction with a missing album was committed")
+		test.FailNow()
+	}
+
+	expected := []string{TX_ROLLED_BACK, TX_ROLLED_BACK, TX_FAILED, TX_SKIPPED}
+	for i, status := range expected {
+		if result.Results[i].Status != status {
+			test.Errorf("Operation %d: expected %s, got %#v", i, status, result.Results[i])
+		}
+	}
+
+	_, err = getArtist(artist.Id)
+	if err == nil {
+		test.Errorf("Artist %s was not rolled back", artist.Id)
+	}
+	_, err = getAlbum(album.Id)
+	if err == nil {
+		test.Errorf("Album %s was not rolled back", album.Id)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+Posts a request to a trash end point, decoding the response into result when given.
+*/
+func postTrash(endPoint string, request interface{}, result interface{}) (int, error) {
+	buffer, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := http.Post(
+		TEST_SERVER_END_POINT+endPoint,
+		"application/x-www-form-urlencoded",
+		bytes.NewReader(buffer),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 || result == nil {
+		return resp.StatusCode, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.StatusCode, json.Unmarshal(body, result)
+}
+
+func getTrash() (*Trash, error) {
+	trash := new(Trash)
+
+	status, err := postTrash("getTrash", nil, trash)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, errors.New("Expected 200 OK from getTrash")
+	}
+
+	return trash, nil
+}
+
+func trashHasSong(trash *Trash, id string) bool {
+	for _, song := range trash.Songs {
+		if song.Id == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestTrashRestoreAndPurge(test *testing.T) {
+	artist := Artist{Id: "testTrashArtist", Name: "testTrashArtist"}
+	album := Album{Id: "testTrashAlbum", Name: "testTrashAlbum", Price: Price{Currency: "USD", Amount: 100}, ArtistId: artist.Id}
+	song := Song{Id: "testTrashSong", Name: "testTrashSong", AlbumId: album.Id, ArtistId: artist.Id}
+
+	if err := AddArtist(&artist); err != nil {
+		test.Fatalf("Unable to add artist: %s", err)
+	}
+	if err := addAlbum(&album); err != nil {
+		test.Fatalf("Unable to add album: %s", err)
+	}
+	if err := addSong(&song); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	if _, err := deleteArtistWithPolicy(artist.Id, DELETE_CASCADE); err != nil {
+		test.Fatalf("Unable to delete artist: %s", err)
+	}
+
+	if _, err := getSong(song.Id); err == nil {
+		test.Errorf("Deleted song is still returned")
+	}
+
+	trash, err := getTrash()
+	if err != nil {
+		test.Fatalf("Unable to get trash: %s", err)
+	}
+	if !trashHasSong(trash, song.Id) {
+		test.Errorf("Deleted song is not in the trash")
+	}
+
+	if err := AddArtist(&artist); err == nil {
+		test.Errorf("Added an artist whose id is in the trash")
+	}
+
+	// The song cannot come back before its album and artist.
+	status, err := postTrash("restoreFromTrash", RestoreRequest{TRASH_SONG, song.Id}, nil)
+	if err != nil || status != 422 {
+		test.Errorf("Expected 422 restoring a song without its album, got %d, %v", status, err)
+	}
+
+	for _, request := range []RestoreRequest{
+		{TRASH_ARTIST, artist.Id},
+		{TRASH_ALBUM, album.Id},
+		{TRASH_SONG, song.Id},
+	} {
+		status, err := postTrash("restoreFromTrash", request, nil)
+		if err != nil || status != 200 {
+			test.Fatalf("Unable to restore %s: %d, %v", request.Kind, status, err)
+		}
+	}
+
+	songIds, err := getAlbumSongs(album.Id)
+	if err != nil || len(songIds) != 1 || songIds[0] != song.Id {
+		test.Errorf("Restored song is not indexed under its album: %v, %v", songIds, err)
+	}
+
+	if err := deleteSong(song.Id); err != nil {
+		test.Fatalf("Unable to delete song: %s", err)
+	}
+
+	// Nothing is older than the default retention.
+	result := new(DeleteResult)
+	if _, err := postTrash("purgeTrash", nil, result); err != nil {
+		test.Fatalf("Unable to purge trash: %s", err)
+	}
+	for _, id := range result.Songs {
+		if id == song.Id {
+			test.Errorf("Purged a song deleted within the retention")
+		}
+	}
+
+	before := time.Now().Add(time.Hour)
+	if _, err := postTrash("purgeTrash", PurgeRequest{&before}, result); err != nil {
+		test.Fatalf("Unable to purge trash: %s", err)
+	}
+
+	trash, err = getTrash()
+	if err != nil {
+		test.Fatalf("Unable to get trash: %s", err)
+	}
+	if trashHasSong(trash, song.Id) {
+		test.Errorf("Purged song is still in the trash")
+	}
+
+	if err := addSong(&song); err != nil {
+		test.Errorf("Unable to add a song whose id was purged: %s", err)
+	}
+}
+
+func TestPurgeRollback(test *testing.T) {
+	albums := NewAlbums()
+	artists := NewArtists()
+	songs := NewSongs()
+
+	state, err := NewStateWith(albums, artists, songs)
+	if err != nil {
+		test.Fatalf("Unable to create state: %s", err)
+	}
+
+	artist := Artist{Name: "purgeRollbackArtist"}
+	if err := state.addArtist("test", &artist); err != nil {
+		test.Fatalf("Unable to add artist: %s", err)
+	}
+	if _, err := state.deleteArtist("test", artist.Id, DELETE_ORPHAN); err != nil {
+		test.Fatalf("Unable to delete artist: %s", err)
+	}
+	before, _ := artists.GetTrash()
+
+	// A failure after the purge, in the same transaction, puts the artist back.
+	failure := errors.New("Failing on purpose")
+	err = state.transact("test", func(tx *catalogTx) error {
+		err := tx.purgeArtist(artist.Id)
+		if err != nil {
+			return err
+		}
+
+		return failure
+	})
+	if err != failure {
+		test.Fatalf("Expected the transaction to fail, got %v", err)
+	}
+
+	after, _ := artists.GetTrash()
+	if len(after) != 1 || len(before) != 1 || *after[0] != *before[0] {
+		test.Errorf("Expected the artist back in the trash as it was, got %#v", after)
+	}
+	if revisions, _ := state.revisions.Get(REVISION_ARTIST, artist.Id); len(revisions) != 2 {
+		test.Errorf("Expected the purge revision to be rolled back, got %d revisions", len(revisions))
+	}
+
+	result, err := state.purgeTrash("test", time.Now().Add(time.Hour))
+	if err != nil || len(result.Artists) != 1 {
+		test.Fatalf("Unable to purge artist: %v, %v", result, err)
+	}
+	if trash, _ := artists.GetTrash(); len(trash) != 0 {
+		test.Errorf("Expected the trash to be empty, got %#v", trash)
+	}
+}
+
+/*
+Purging an artist or album that albums or songs still refer to is refused, on any storage.
+*/
+func checkPurgeReferenced(test *testing.T, state *State) {
+	artist := Artist{Name: "purgeReferencedArtist"}
+	featured := Artist{Name: "purgeReferencedFeatured"}
+	for _, a := range []*Artist{&artist, &featured} {
+		if err := state.addArtist("test", a); err != nil {
+			test.Fatalf("Unable to add artist: %s", err)
+		}
+	}
+
+	album := Album{Name: "purgeReferencedAlbum", ArtistId: artist.Id}
+	if err := state.addAlbum("test", &album); err != nil {
+		test.Fatalf("Unable to add album: %s", err)
+	}
+
+	song := Song{
+		Name:     "purgeReferencedSong",
+		AlbumId:  album.Id,
+		ArtistId: artist.Id,
+		Credits:  []Credit{{ArtistId: featured.Id, Role: CREDIT_FEATURED}},
+	}
+	if err := state.addSong("test", &song); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	// The album and song are left in place, referring to the trashed artists and album.
+	for _, id := range []string{artist.Id, featured.Id} {
+		if _, err := state.deleteArtist("test", id, DELETE_ORPHAN); err != nil {
+			test.Fatalf("Unable to delete artist: %s", err)
+		}
+	}
+	if _, err := state.deleteAlbum("test", album.Id, DELETE_ORPHAN); err != nil {
+		test.Fatalf("Unable to delete album: %s", err)
+	}
+
+	result, err := state.purgeTrash("test", time.Now().Add(time.Hour))
+	if err != nil {
+		test.Fatalf("Unable to purge trash: %s", err)
+	}
+	if len(result.Artists)+len(result.Albums)+len(result.Songs) != 0 {
+		test.Errorf("Expected nothing purged while the song refers to it, got %#v", result)
+	}
+
+	err = state.transact("test", func(tx *catalogTx) error {
+		return tx.purgeArtist(featured.Id)
+	})
+	if _, ok := err.(*DeleteRestrictedError); !ok {
+		test.Errorf("Expected the purge of a credited artist restricted, got %v", err)
+	}
+
+	// With the song gone too, the song goes first and then what it referred to.
+	if err := state.deleteSong("test", song.Id); err != nil {
+		test.Fatalf("Unable to delete song: %s", err)
+	}
+
+	result, err = state.purgeTrash("test", time.Now().Add(time.Hour))
+	if err != nil {
+		test.Fatalf("Unable to purge trash: %s", err)
+	}
+	if len(result.Artists) != 2 || len(result.Albums) != 1 || len(result.Songs) != 1 {
+		test.Errorf("Expected everything purged, got %#v", result)
+	}
+}
+
+func TestPurgeReferenced(test *testing.T) {
+	state, err := NewStateWith(NewAlbums(), NewArtists(), NewSongs())
+	if err != nil {
+		test.Fatalf("Unable to create state: %s", err)
+	}
+
+	checkPurgeReferenced(test, state)
+}
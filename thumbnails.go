@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+/*
+Thumbnails are kept beside the images, in a directory per size.
+*/
+func (images *Images) thumbnailPath(id string, size int) string {
+	return filepath.Join(images.dir, "thumbnails", strconv.Itoa(size), id[:2], id)
+}
+
+/*
+Opens the image scaled down to fit a size by size square, keeping its aspect ratio.
+The thumbnail is generated on the first request for it and kept on disk.
+An image that already fits is opened as it is.
+*/
+func (images *Images) OpenThumbnail(id string, size int) (*os.File, error) {
+	original, err := images.Open(id)
+	if err != nil {
+		return nil, err
+	}
+
+	path := images.thumbnailPath(id, size)
+	if file, err := os.Open(path); err == nil {
+		original.Close()
+		return file, nil
+	}
+
+	images.thumbnailLock.Lock()
+	defer images.thumbnailLock.Unlock()
+
+	// Generated while waiting for the lock.
+	if file, err := os.Open(path); err == nil {
+		original.Close()
+		return file, nil
+	}
+
+	data, err := ioutil.ReadAll(original)
+	original.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	picture, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := picture.Bounds().Dx(), picture.Bounds().Dy()
+	if width <= size && height <= size {
+		return images.Open(id)
+	}
+
+	if width >= height {
+		width, height = size, maxInt(1, height*size/width)
+	} else {
+		width, height = maxInt(1, width*size/height), size
+	}
+
+	var buffer bytes.Buffer
+	thumbnail := scaleImage(picture, width, height)
+	if format == "png" {
+		err = png.Encode(&buffer, thumbnail)
+	} else {
+		err = jpeg.Encode(&buffer, thumbnail, &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFileAtomic(path, buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+/*
+Scales the image down to width by height, averaging the source pixels each pixel covers.
+Only shrinks, the size must not be larger than the image.
+*/
+func scaleImage(src image.Image, width, height int) *image.NRGBA {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+
+			// Sums of the alpha-premultiplied 16 bit channels.
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			if a == 0 {
+				continue
+			}
+
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r * 0xffff / a >> 8),
+				G: uint8(g * 0xffff / a >> 8),
+				B: uint8(b * 0xffff / a >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+Returned when a song is given a disc and track another song of the album already has.
+*/
+type TrackTakenError struct {
+	AlbumId string
+	Disc    int
+	Track   int
+	SongId  string
+}
+
+func (err *TrackTakenError) Error() string {
+	return fmt.Sprintf("Disc %d track %d of album '%s' is taken by song '%s'", err.Disc, err.Track, err.AlbumId, err.SongId)
+}
+
+/*
+Body of /reorderAlbumSongs.
+Lists every song of the album once, disc by disc in play order.
+*/
+type ReorderRequest struct {
+	AlbumId string     `json:"albumId"`
+	Discs   [][]string `json:"discs"`
+}
+
+/*
+Lists the other songs on the song's album.
+*/
+func (state *State) albumSiblings(song *Song) ([]*Song, error) {
+	// The lookup fails when the album has no songs.
+	songIds, _ := state.songs.GetAlbumSongs(song.AlbumId)
+
+	siblings := make([]*Song, 0, len(songIds))
+	for _, id := range songIds {
+		if id == song.Id {
+			continue
+		}
+
+		sibling, err := state.songs.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		siblings = append(siblings, sibling)
+	}
+
+	return siblings, nil
+}
+
+/*
+Numbers a song that is added or updated.
+A song given without a track keeps its place when it stays on its album,
+and otherwise goes at the end of the given disc, or of the album's last disc.
+A track given without a disc is on the first disc.
+*/
+func (state *State) placeSong(song *Song, old *Song) error {
+	if song.Track == 0 && old != nil && old.Track != 0 && old.AlbumId == song.AlbumId {
+		if song.Disc == 0 || song.Disc == old.Disc {
+			song.Disc, song.Track = old.Disc, old.Track
+		}
+	}
+
+	siblings, err := state.albumSiblings(song)
+	if err != nil {
+		return err
+	}
+
+	if song.Track == 0 {
+		if song.Disc == 0 {
+			for _, sibling := range siblings {
+				if sibling.Track != 0 && sibling.Disc > song.Disc {
+					song.Disc = sibling.Disc
+				}
+			}
+		}
+		if song.Disc == 0 {
+			song.Disc = 1
+		}
+
+		for _, sibling := range siblings {
+			if sibling.Disc == song.Disc && sibling.Track > song.Track {
+				song.Track = sibling.Track
+			}
+		}
+		song.Track++
+
+		return nil
+	}
+
+	if song.Disc == 0 {
+		song.Disc = 1
+	}
+
+	return checkTrack(song, siblings)
+}
+
+func checkTrack(song *Song, siblings []*Song) error {
+	if song.Track == 0 {
+		return nil
+	}
+
+	for _, sibling := range siblings {
+		if sibling.Disc == song.Disc && sibling.Track == song.Track {
+			return &TrackTakenError{song.AlbumId, song.Disc, song.Track, sibling.Id}
+		}
+	}
+
+	return nil
+}
+
+func (state *State) reorderAlbumSongs(actor string, request *ReorderRequest) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		return tx.reorderAlbumSongs(request)
+	})
+}
+
+/*
+Renumbers the songs of an album from the listing in the request,
+counting discs and tracks from one.
+*/
+func (tx *catalogTx) reorderAlbumSongs(request *ReorderRequest) error {
+	err := tx.state.checkAlbum(request.AlbumId)
+	if err != nil {
+		return err
+	}
+
+	// The lookup fails when the album has no songs.
+	songIds, _ := tx.state.songs.GetAlbumSongs(request.AlbumId)
+
+	onAlbum := make(map[string]bool, len(songIds))
+	for _, id := range songIds {
+		onAlbum[id] = true
+	}
+
+	listed := make(map[string]bool, len(songIds))
+	for i, disc := range request.Discs {
+		if len(disc) == 0 {
+			return &ValidationError{"discs", fmt.Sprintf("disc %d is empty", i+1)}
+		}
+
+		for _, id := range disc {
+			if !onAlbum[id] {
+				return &ValidationError{"discs", fmt.Sprintf("song '%s' is not on the album", id)}
+			}
+			if listed[id] {
+				return &ValidationError{"discs", fmt.Sprintf("song '%s' is listed twice", id)}
+			}
+
+			listed[id] = true
+		}
+	}
+
+	if len(listed) != len(songIds) {
+		return &ValidationError{"discs", fmt.Sprintf("lists %d of the album's %d songs", len(listed), len(songIds))}
+	}
+
+	// Songs may share a place until all of them are moved, places are only checked on adds and updates.
+	for i, disc := range request.Discs {
+		for j, id := range disc {
+			err := tx.moveSong(id, i+1, j+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (tx *catalogTx) moveSong(id string, disc, track int) error {
+	old, err := tx.state.songs.Get(id)
+	if err != nil {
+		return err
+	}
+	if old.Disc == disc && old.Track == track {
+		return nil
+	}
+	old = old.clone()
+
+	song := old.clone()
+	song.Disc, song.Track = disc, track
+
+	err = tx.state.songs.Update(song)
+	if err != nil {
+		return err
+	}
+
+	tx.onRollback(func() error {
+		return tx.state.songs.Revert(old)
+	})
+
+	return tx.recordCurrent(REVISION_SONG, id, REVISION_UPDATE)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	TRASH_ARTIST = "artist"
+	TRASH_ALBUM  = "album"
+	TRASH_SONG   = "song"
+)
+
+/*
+Everything in the trash, oldest deletion first.
+*/
+type Trash struct {
+	Artists []*TrashedArtist `json:"artists"`
+	Albums  []*TrashedAlbum  `json:"albums"`
+	Songs   []*TrashedSong   `json:"songs"`
+}
+
+/*
+Names the artist, album or song to restore.
+*/
+type RestoreRequest struct {
+	Kind string `json:"kind"`
+	Id   string `json:"id"`
+}
+
+/*
+Purges what was deleted before the given time,
+or before the configured retention when not set.
+*/
+type PurgeRequest struct {
+	Before *time.Time `json:"before"`
+}
+
+func (state *State) getTrash() (*Trash, error) {
+	artists, err := state.artists.GetTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	albums, err := state.albums.GetTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	songs, err := state.songs.GetTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Trash{artists, albums, songs}, nil
+}
+
+/*
+Moves an artist, album or song out of the trash.
+Children deleted along with it by a cascade stay in the trash, restore them one by one.
+*/
+func (state *State) restore(actor string, request *RestoreRequest) error {
+	return state.transact(actor, func(tx *catalogTx) error {
+		switch request.Kind {
+		case TRASH_ARTIST:
+			return tx.restoreArtist(request.Id)
+		case TRASH_ALBUM:
+			return tx.restoreAlbum(request.Id)
+		case TRASH_SONG:
+			return tx.restoreSong(request.Id)
+		}
+
+		return fmt.Errorf("Unknown kind '%s'", request.Kind)
+	})
+}
+
+func (tx *catalogTx) restoreArtist(id string) error {
+	trash, err := tx.state.artists.GetTrash()
+	if err != nil {
+		return err
+	}
+
+	for _, trashed := range trash {
+		if trashed.Id != id {
+			continue
+		}
+
+		err := tx.state.artists.Restore(id)
+		if err != nil {
+			return err
+		}
+
+		tx.onRollback(func() error {
+			return tx.state.artists.Delete(id, trashed.DeletedAt)
+		})
+
+		return tx.recordCurrent(REVISION_ARTIST, id, REVISION_RESTORE)
+	}
+
+	return fmt.Errorf("Artist '%s' is not in the trash", id)
+}
+
+func (tx *catalogTx) restoreAlbum(id string) error {
+	trash, err := tx.state.albums.GetTrash()
+	if err != nil {
+		return err
+	}
+
+	for _, trashed := range trash {
+		if trashed.Id != id {
+			continue
+		}
+
+		err := tx.state.checkAlbumReferences(&trashed.Album)
+		if err != nil {
+			return err
+		}
+
+		err = tx.state.albums.Restore(id)
+		if err != nil {
+			return err
+		}
+
+		tx.onRollback(func() error {
+			return tx.state.albums.Delete(id, trashed.DeletedAt)
+		})
+
+		return tx.recordCurrent(REVISION_ALBUM, id, REVISION_RESTORE)
+	}
+
+	return fmt.Errorf("Album '%s' is not in the trash", id)
+}
+
+func (tx *catalogTx) restoreSong(id string) error {
+	trash, err := tx.state.songs.GetTrash()
+	if err != nil {
+		return err
+	}
+
+	for _, trashed := range trash {
+		if trashed.Id != id {
+			continue
+		}
+
+		// The genre may have been deleted while the song was in the trash,
+		// refreshSongGenre takes it off the song once restored.
+		song := trashed.Song
+		if song.GenreId != "" && tx.state.checkGenre(song.GenreId) != nil {
+			song.GenreId = ""
+		}
+
+		err := tx.state.checkSongReferences(&song)
+		if err != nil {
+			return err
+		}
+
+		// Another song may have taken its place on the album meanwhile.
+		siblings, err := tx.state.albumSiblings(&trashed.Song)
+		if err != nil {
+			return err
+		}
+
+		err = checkTrack(&trashed.Song, siblings)
+		if err != nil {
+			return err
+		}
+
+		err = tx.state.songs.Restore(id)
+		if err != nil {
+			return err
+		}
+
+		tx.onRollback(func() error {
+			return tx.state.songs.Delete(id, trashed.DeletedAt)
+		})
+
+		// The genre may also have been renamed meanwhile.
+		_, err = tx.refreshSongGenre(id)
+		if err != nil {
+			return err
+		}
+
+		return tx.recordCurrent(REVISION_SONG, id, REVISION_RESTORE)
+	}
+
+	return fmt.Errorf("Song '%s' is not in the trash", id)
+}
+
+/*
+Removes for good everything deleted before the given time.
+Songs go first, then albums, then artists. An item that fails to purge
+is logged and left in the trash, the rest are still purged.
+*/
+func (state *State) purgeTrash(actor string, before time.Time) (*DeleteResult, error) {
+	result := newDeleteResult()
+
+	trash, err := state.getTrash()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, song := range trash.Songs {
+		if !song.DeletedAt.Before(before) {
+			continue
+		}
+
+		if state.purge(actor, TRASH_SONG, song.Id) {
+			result.Songs = append(result.Songs, song.Id)
+		}
+	}
+
+	for _, album := range trash.Albums {
+		if !album.DeletedAt.Before(before) {
+			continue
+		}
+
+		if state.purge(actor, TRASH_ALBUM, album.Id) {
+			result.Albums = append(result.Albums, album.Id)
+		}
+	}
+
+	for _, artist := range trash.Artists {
+		if !artist.DeletedAt.Before(before) {
+			continue
+		}
+
+		if state.purge(actor, TRASH_ARTIST, artist.Id) {
+			result.Artists = append(result.Artists, artist.Id)
+		}
+	}
+
+	return result, nil
+}
+
+/*
+Purges a single item in a transaction of its own, so one failure leaves the rest to purge.
+*/
+func (state *State) purge(actor, kind, id string) bool {
+	err := state.transact(actor, func(tx *catalogTx) error {
+		switch kind {
+		case TRASH_ARTIST:
+			return tx.purgeArtist(id)
+		case TRASH_ALBUM:
+			return tx.purgeAlbum(id)
+		}
+
+		return tx.purgeSong(id)
+	})
+	if err != nil {
+		state.log.Warn("Unable to purge %s '%s' from the trash: %s", kind, id, err)
+		return false
+	}
+
+	return true
+}
+
+/*
+Removes an artist from the trash for good.
+Until the transaction commits a rollback puts it back in the trash as it was.
+*/
+func (tx *catalogTx) purgeArtist(id string) error {
+	trash, err := tx.state.artists.GetTrash()
+	if err != nil {
+		return err
+	}
+
+	for _, trashed := range trash {
+		if trashed.Id != id {
+			continue
+		}
+
+		referents, err := tx.state.artistReferents(id)
+		if err != nil {
+			return err
+		}
+		if referents > 0 {
+			return &DeleteRestrictedError{"artist", id, referents}
+		}
+
+		err = tx.state.artists.Purge(id)
+		if err != nil {
+			return err
+		}
+
+		tx.onRollback(func() error {
+			err := tx.state.artists.Revert(&trashed.Artist)
+			if err != nil {
+				return err
+			}
+
+			return tx.state.artists.Delete(id, trashed.DeletedAt)
+		})
+
+		return tx.recordRevision(REVISION_ARTIST, id, REVISION_PURGE, nil)
+	}
+
+	return fmt.Errorf("Artist '%s' is not in the trash", id)
+}
+
+func (tx *catalogTx) purgeAlbum(id string) error {
+	trash, err := tx.state.albums.GetTrash()
+	if err != nil {
+		return err
+	}
+
+	for _, trashed := range trash {
+		if trashed.Id != id {
+			continue
+		}
+
+		referents, err := tx.state.albumReferents(id)
+		if err != nil {
+			return err
+		}
+		if referents > 0 {
+			return &DeleteRestrictedError{"album", id, referents}
+		}
+
+		err = tx.state.albums.Purge(id)
+		if err != nil {
+			return err
+		}
+
+		tx.onRollback(func() error {
+			err := tx.state.albums.Revert(&trashed.Album)
+			if err != nil {
+				return err
+			}
+
+			return tx.state.albums.Delete(id, trashed.DeletedAt)
+		})
+
+		return tx.recordRevision(REVISION_ALBUM, id, REVISION_PURGE, nil)
+	}
+
+	return fmt.Errorf("Album '%s' is not in the trash", id)
+}
+
+func (tx *catalogTx) purgeSong(id string) error {
+	trash, err := tx.state.songs.GetTrash()
+	if err != nil {
+		return err
+	}
+
+	for _, trashed := range trash {
+		if trashed.Id != id {
+			continue
+		}
+
+		err := tx.state.songs.Purge(id)
+		if err != nil {
+			return err
+		}
+
+		tx.onRollback(func() error {
+			err := tx.state.songs.Revert(&trashed.Song)
+			if err != nil {
+				return err
+			}
+
+			return tx.state.songs.Delete(id, trashed.DeletedAt)
+		})
+
+		return tx.recordRevision(REVISION_SONG, id, REVISION_PURGE, nil)
+	}
+
+	return fmt.Errorf("Song '%s' is not in the trash", id)
+}
+
+/*
+Counts the albums and songs, live or in the trash, that still refer to the artist
+as their artist or in their credits. An artist with any cannot be purged,
+so the memory and sqlite storages never leave a reference to nothing.
+Albums are not indexed by their credits, so all of them are looked at.
+*/
+func (state *State) artistReferents(id string) (int, error) {
+	// Lookups fail when there is nothing under the artist.
+	songIds, _ := state.songs.GetArtistSongs(id)
+	referents := len(songIds)
+
+	albumIds, err := state.albums.GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, albumId := range albumIds {
+		album, err := state.albums.Get(albumId)
+		if err != nil {
+			return 0, err
+		}
+
+		if hasCredit(album.ArtistId, album.Credits, id, "") {
+			referents++
+		}
+	}
+
+	albumTrash, err := state.albums.GetTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, trashed := range albumTrash {
+		if hasCredit(trashed.ArtistId, trashed.Credits, id, "") {
+			referents++
+		}
+	}
+
+	songTrash, err := state.songs.GetTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, trashed := range songTrash {
+		if hasCredit(trashed.ArtistId, trashed.Credits, id, "") {
+			referents++
+		}
+	}
+
+	return referents, nil
+}
+
+/*
+Counts the songs, live or in the trash, still on the album, see artistReferents.
+*/
+func (state *State) albumReferents(id string) (int, error) {
+	// Lookups fail when there is nothing on the album.
+	songIds, _ := state.songs.GetAlbumSongs(id)
+	referents := len(songIds)
+
+	songTrash, err := state.songs.GetTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, trashed := range songTrash {
+		if trashed.AlbumId == id {
+			referents++
+		}
+	}
+
+	return referents, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+/*
+A catalog transaction.
+Every change made through it registers how to undo itself, so a failure
+part way leaves the stores as they were before the transaction began.
+*/
+type catalogTx struct {
+	state *State
+	undo  []func() error
+
+	// Everything deleted by the transaction is moved to the trash at this time,
+	// and every revision it records carries this time and actor.
+	now   time.Time
+	actor string
+}
+
+func (tx *catalogTx) onRollback(undo func() error) {
+	tx.undo = append(tx.undo, undo)
+}
+
+func (tx *catalogTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		err := tx.undo[i]()
+		if err != nil {
+			tx.state.log.Error("Error rolling back catalog transaction: %s", err)
+		}
+	}
+
+	tx.undo = nil
+}
+
+/*
+A storage backend that runs a catalog transaction as one transaction of its own.
+Begin returns a copy of the State whose stores work within that transaction.
+*/
+type txBackend interface {
+	Begin(state *State) (*State, backendTx, error)
+}
+
+type backendTx interface {
+	Commit() error
+	Rollback() error
+}
+
+/*
+Runs fn as one all or nothing change to the catalog.
+Locks are always taken in the order catalog, write-ahead log, then the
+artist, album and song stores, so concurrent transactions cannot deadlock.
+The write-ahead log batches the records of the transaction and writes them
+as one record on commit, so a crash never leaves half a transaction on disk.
+A backend with transactions of its own, such as sqlite, commits once at the end instead.
+*/
+func (state *State) transact(actor string, fn func(tx *catalogTx) error) error {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	tx := &catalogTx{state: state, now: time.Now(), actor: actor}
+
+	var backend backendTx
+	if db, ok := state.db.(txBackend); ok {
+		bound, begun, err := db.Begin(state)
+		if err != nil {
+			return err
+		}
+
+		tx.state, backend = bound, begun
+	}
+
+	if state.wal != nil {
+		state.wal.Begin()
+	}
+
+	err := fn(tx)
+	if err == nil && state.wal != nil {
+		err = state.wal.Commit()
+	}
+	if err == nil && backend != nil {
+		err = backend.Commit()
+	}
+	if err != nil {
+		if backend != nil {
+			// Rolling back the backend undoes every change at once.
+			backend.Rollback()
+		} else {
+			tx.rollback()
+		}
+
+		if state.wal != nil {
+			state.wal.Rollback()
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+/*
+Answers a read under the read side of the catalog lock, so it waits for a
+transaction in progress and never sees a change that may yet be rolled back.
+The body is read first, so a slow client does not hold up the writers.
+*/
+func (state *State) readCommitted(handle http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		body, ok := state.readBody(resp, req)
+		if !ok {
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		state.lock.RLock()
+		defer state.lock.RUnlock()
+
+		handle(resp, req)
+	}
+}
+
+const (
+	TX_APPLIED     = "applied"
+	TX_FAILED      = "failed"
+	TX_SKIPPED     = "skipped"
+	TX_ROLLED_BACK = "rolledBack"
+)
+
+/*
+One operation of a transaction.
+Op names the end point it stands for, such as "addSong", and Data is the body
+that end point takes.
+*/
+type TxOperation struct {
+	Op   string          `json:"op"`
+	Data json.RawMessage `json:"data"`
+}
+
+type TxRequest struct {
+	Operations []TxOperation `json:"operations"`
+}
+
+type TxOperationResult struct {
+	Op     string        `json:"op"`
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Result *DeleteResult `json:"result,omitempty"`
+	// The entity as stored by an applied add, with its id.
+	Created interface{} `json:"created,omitempty"`
+}
+
+type TxResult struct {
+	Committed bool                `json:"committed"`
+	Results   []TxOperationResult `json:"results"`
+}
+
+/*
+Applies the operations of a transaction in order, all or nothing.
+The result reports what happened to each operation either way.
+*/
+func (state *State) runTransaction(actor string, request *TxRequest) *TxResult {
+	result := &TxResult{
+		Results: make([]TxOperationResult, len(request.Operations)),
+	}
+	for i, operation := range request.Operations {
+		result.Results[i] = TxOperationResult{Op: operation.Op, Status: TX_SKIPPED}
+	}
+
+	applied := 0
+
+	err := state.transact(actor, func(tx *catalogTx) error {
+		for i, operation := range request.Operations {
+			deleted, created, err := tx.apply(&operation)
+			if err != nil {
+				result.Results[i].Status = TX_FAILED
+				result.Results[i].Error = err.Error()
+				return err
+			}
+
+			result.Results[i].Status = TX_APPLIED
+			result.Results[i].Result = deleted
+			result.Results[i].Created = created
+			applied = i + 1
+		}
+
+		return nil
+	})
+	if err != nil {
+		for i := 0; i < applied; i++ {
+			result.Results[i].Status = TX_ROLLED_BACK
+			result.Results[i].Result = nil
+			result.Results[i].Created = nil
+		}
+
+		return result
+	}
+
+	result.Committed = true
+
+	return result
+}
+
+/*
+Applies a single operation, returning what was removed for deletes,
+and the stored entity for adds.
+*/
+func (tx *catalogTx) apply(operation *TxOperation) (*DeleteResult, interface{}, error) {
+	switch operation.Op {
+	case "addArtist", "updateArtist":
+		var artist Artist
+		err := json.Unmarshal(operation.Data, &artist)
+		if err != nil {
+			return nil, nil, errors.New("Invalid JSON")
+		}
+
+		if operation.Op == "addArtist" {
+			err = tx.addArtist(&artist)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			created, err := tx.state.artists.Get(artist.Id)
+			return nil, created, err
+		}
+		err = requireVersion(artist.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, tx.updateArtist(&artist)
+
+	case "addAlbum", "updateAlbum":
+		var album Album
+		err := json.Unmarshal(operation.Data, &album)
+		if err != nil {
+			return nil, nil, errors.New("Invalid JSON")
+		}
+
+		if operation.Op == "addAlbum" {
+			err = tx.addAlbum(&album)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			created, err := tx.state.albums.Get(album.Id)
+			return nil, created, err
+		}
+		err = requireVersion(album.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, tx.updateAlbum(&album)
+
+	case "addSong", "updateSong":
+		var song Song
+		err := json.Unmarshal(operation.Data, &song)
+		if err != nil {
+			return nil, nil, errors.New("Invalid JSON")
+		}
+
+		if operation.Op == "addSong" {
+			err = tx.addSong(&song)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			created, err := tx.state.songs.Get(song.Id)
+			return nil, created, err
+		}
+		err = requireVersion(song.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, tx.updateSong(&song)
+
+	case "deleteArtist", "deleteAlbum", "deleteSong":
+		var request deleteRequest
+		err := json.Unmarshal(operation.Data, &request)
+		if err != nil {
+			return nil, nil, errors.New("Invalid JSON")
+		}
+
+		if request.Policy == "" {
+			request.Policy = GetConfig().GetDeletePolicy()
+		}
+		if !validDeletePolicy(request.Policy) {
+			return nil, nil, errors.New("Invalid delete policy")
+		}
+
+		switch operation.Op {
+		case "deleteArtist":
+			result, err := tx.deleteArtist(request.Id, request.Policy)
+			return result, nil, err
+		case "deleteAlbum":
+			result, err := tx.deleteAlbum(request.Id, request.Policy)
+			return result, nil, err
+		}
+
+		result := newDeleteResult()
+		err = tx.removeSong(request.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		result.Songs = append(result.Songs, request.Id)
+
+		return result, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("Unknown operation '%s'", operation.Op)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Returned when an update names a version other than the stored one.
+*/
+type VersionConflictError struct {
+	Kind    string
+	Id      string
+	Version int64
+	Current int64
+}
+
+func (err *VersionConflictError) Error() string {
+	return fmt.Sprintf(
+		"Version %d of %s '%s' is stale, the current version is %d",
+		err.Version,
+		err.Kind,
+		err.Id,
+		err.Current,
+	)
+}
+
+/*
+Checks the version an update was based on.
+Version 0 means the client did not say, and always matches, see requireVersion.
+*/
+func checkVersion(kind, id string, version, current int64) error {
+	if version != 0 && version != current {
+		return &VersionConflictError{kind, id, version, current}
+	}
+
+	return nil
+}
+
+/*
+Refuses an update that does not say which version it was based on,
+when the requireVersion setting is on.
+*/
+func requireVersion(version int64) error {
+	if version == 0 && GetConfig().GetRequireVersion() {
+		return &ValidationError{"version", "must be given, in the body or as If-Match"}
+	}
+
+	return nil
+}
+
+func formatETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+/*
+Parses an If-Match header into the version it names.
+Returns 0 for "*", which matches any version.
+*/
+func parseIfMatch(header string) (int64, error) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return 0, nil
+	}
+
+	header = strings.TrimPrefix(header, "W/")
+
+	value, err := strconv.Unquote(header)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid If-Match header %s", header)
+	}
+
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("Invalid If-Match header %s", header)
+	}
+
+	return version, nil
+}
@@ -0,0 +1,1612 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	WAL_ARTIST       = "artist"
+	WAL_ALBUM        = "album"
+	WAL_SONG         = "song"
+	WAL_GENRE        = "genre"
+	WAL_PLAYLIST     = "playlist"
+	WAL_LABEL        = "label"
+	WAL_RELATIONSHIP = "relationship"
+
+	WAL_REVISION = "revision"
+
+	WAL_ADD     = "add"
+	WAL_UPDATE  = "update"
+	WAL_DELETE  = "delete"
+	WAL_REBUILD = "rebuild"
+	WAL_REVERT  = "revert"
+	WAL_RESTORE = "restore"
+	WAL_REMOVE  = "remove"
+	WAL_PURGE   = "purge"
+	// Drops the last revision of an entity.
+	WAL_REMOVE_LAST = "removeLast"
+
+	// A committed transaction, its data holds the records of the transaction.
+	WAL_BATCH  = "batch"
+	WAL_COMMIT = "commit"
+)
+
+/*
+A single entry of the write-ahead log.
+Each entry is written as one line of "<crc32> <json>\n", so a torn write
+at the tail of the file can be detected and dropped on replay.
+*/
+type walRecord struct {
+	Seq    uint64          `json:"seq"`
+	Entity string          `json:"entity"`
+	Op     string          `json:"op"`
+	Data   json.RawMessage `json:"data"`
+}
+
+/*
+Data of a delete record, the entity is moved to the trash at the given time.
+Logs written before the trash existed hold a bare id instead.
+*/
+type walDelete struct {
+	Id string    `json:"id"`
+	At time.Time `json:"at"`
+}
+
+/*
+The trash operations shared by the artist, album and song stores.
+*/
+type trashStore interface {
+	Delete(id string, deletedAt time.Time) error
+	Restore(id string) error
+	Remove(id string) error
+	Purge(id string) error
+}
+
+/*
+Wal is an append only, fsynced log of every successful mutation.
+The log is split into segments named after the first sequence number they hold,
+so segments covered by a snapshot can be removed as a whole.
+The lock is held by the journaled stores for the duration of a mutation,
+so the order of the log always matches the order applied in memory.
+*/
+type Wal struct {
+	sync.Mutex
+	log   *Log
+	dir   string
+	file  walFile
+	start uint64
+	seq   uint64
+
+	// Records of the open transaction, nil outside of one.
+	batch []walRecord
+}
+
+/*
+The open segment of the log, an *os.File.
+*/
+type walFile interface {
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+func OpenWal(dir string) (*Wal, error) {
+	config := GetConfig()
+
+	wal := &Wal{
+		log: NewLogger("wal", config.GetLogLevel()),
+		dir: dir,
+	}
+
+	return wal, nil
+}
+
+func walSegmentName(start uint64) string {
+	return fmt.Sprintf("wal-%020d.log", start)
+}
+
+/*
+Lists the start sequence numbers of the segments on disk, oldest first.
+*/
+func (wal *Wal) segments() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(wal.dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	starts := make([]uint64, 0, len(names))
+	for _, name := range names {
+		var start uint64
+		_, err := fmt.Sscanf(filepath.Base(name), "wal-%d.log", &start)
+		if err != nil {
+			wal.log.Warn("Ignoring unknown file %s in %s", name, wal.dir)
+			continue
+		}
+
+		starts = append(starts, start)
+	}
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	return starts, nil
+}
+
+/*
+Reads every record after the given sequence number and hands it to apply.
+A corrupt or partial record at the end of the last segment is the result of a crash
+mid-write; it is truncated away so new records append after the last good one.
+Corruption anywhere else, or a gap in the sequence, is an error since data would be lost.
+*/
+func (wal *Wal) Replay(after uint64, apply func(record *walRecord) error) error {
+	wal.Lock()
+	defer wal.Unlock()
+
+	starts, err := wal.segments()
+	if err != nil {
+		return err
+	}
+
+	wal.seq = after
+	count := 0
+
+	for i, start := range starts {
+		last := i == len(starts)-1
+
+		// Skip segments that are fully covered by the snapshot.
+		if !last && starts[i+1] <= after+1 {
+			continue
+		}
+
+		path := filepath.Join(wal.dir, walSegmentName(start))
+
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+
+		offset, n, err := wal.replaySegment(file, path, last, apply)
+		count += n
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		if !last {
+			file.Close()
+			continue
+		}
+
+		// Continue appending to the last segment.
+		err = file.Truncate(offset)
+		if err == nil {
+			_, err = file.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		wal.file = file
+		wal.start = start
+	}
+
+	if wal.file == nil {
+		err = wal.openSegment(wal.seq + 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	wal.log.Info("Replayed %d records from %s after seq %d", count, wal.dir, after)
+
+	return nil
+}
+
+func (wal *Wal) replaySegment(
+	file *os.File,
+	path string,
+	last bool,
+	apply func(record *walRecord) error,
+) (int64, int, error) {
+	reader := bufio.NewReader(file)
+
+	var offset int64
+	count := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return offset, count, err
+		}
+
+		record, decodeErr := decodeWalRecord(line)
+		if decodeErr != nil {
+			// Only the tail of the log is allowed to be damaged.
+			rest, _ := reader.Peek(1)
+			if !last || len(rest) > 0 {
+				return offset, count, fmt.Errorf("Corrupt wal record at offset %d of %s: %s", offset, path, decodeErr)
+			}
+
+			wal.log.Warn("Dropping partial wal record at offset %d of %s: %s", offset, path, decodeErr)
+			break
+		}
+
+		offset += int64(len(line))
+
+		if record.Seq <= wal.seq {
+			continue
+		}
+		if record.Seq != wal.seq+1 {
+			return offset, count, fmt.Errorf("Missing wal records %d to %d in %s", wal.seq+1, record.Seq-1, wal.dir)
+		}
+
+		err = apply(record)
+		if err != nil {
+			return offset, count, fmt.Errorf("Unable to replay wal record %d: %s", record.Seq, err)
+		}
+
+		wal.seq = record.Seq
+		count++
+	}
+
+	return offset, count, nil
+}
+
+/*
+Starts a new segment holding records from the given sequence number.
+The caller must hold the lock.
+*/
+func (wal *Wal) openSegment(start uint64) error {
+	path := filepath.Join(wal.dir, walSegmentName(start))
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	wal.file = file
+	wal.start = start
+
+	return syncDir(wal.dir)
+}
+
+/*
+Closes the current segment and starts a new one after the last record.
+The caller must hold the lock.
+*/
+func (wal *Wal) rotate() error {
+	if wal.start == wal.seq+1 {
+		// The current segment is still empty.
+		return nil
+	}
+
+	err := wal.file.Close()
+	if err != nil {
+		return err
+	}
+
+	return wal.openSegment(wal.seq + 1)
+}
+
+/*
+Removes the segments that only hold records up to and including seq.
+*/
+func (wal *Wal) Truncate(seq uint64) error {
+	wal.Lock()
+	defer wal.Unlock()
+
+	starts, err := wal.segments()
+	if err != nil {
+		return err
+	}
+
+	for i, start := range starts {
+		if i == len(starts)-1 || start == wal.start || starts[i+1] > seq+1 {
+			break
+		}
+
+		path := filepath.Join(wal.dir, walSegmentName(start))
+		err := os.Remove(path)
+		if err != nil {
+			return err
+		}
+
+		wal.log.Debug("Removed wal segment %s", path)
+	}
+
+	return nil
+}
+
+func decodeWalRecord(line []byte) (*walRecord, error) {
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		return nil, errors.New("Record is not terminated")
+	}
+
+	line = line[:len(line)-1]
+
+	sep := bytes.IndexByte(line, ' ')
+	if sep == -1 {
+		return nil, errors.New("Record has no checksum")
+	}
+
+	sum, err := strconv.ParseUint(string(line[:sep]), 16, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	data := line[sep+1:]
+	if crc32.ChecksumIEEE(data) != uint32(sum) {
+		return nil, errors.New("Record checksum mismatch")
+	}
+
+	record := new(walRecord)
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+/*
+Starts a transaction.
+Records appended until Commit or Rollback are held back in memory.
+*/
+func (wal *Wal) Begin() {
+	wal.Lock()
+	defer wal.Unlock()
+
+	wal.batch = make([]walRecord, 0)
+}
+
+/*
+Writes the records of the transaction as a single record.
+When the write fails the transaction stays open, so the records of undoing
+its changes are held back too, and dropped along with it by Rollback.
+*/
+func (wal *Wal) Commit() error {
+	wal.Lock()
+	defer wal.Unlock()
+
+	var err error
+	switch len(wal.batch) {
+	case 0:
+	case 1:
+		err = wal.write(wal.batch[0].Entity, wal.batch[0].Op, wal.batch[0].Data)
+	default:
+		var data []byte
+		data, err = json.Marshal(wal.batch)
+		if err == nil {
+			err = wal.write(WAL_BATCH, WAL_COMMIT, data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	wal.batch = nil
+
+	return nil
+}
+
+/*
+Drops the records of the transaction.
+*/
+func (wal *Wal) Rollback() {
+	wal.Lock()
+	defer wal.Unlock()
+
+	wal.batch = nil
+}
+
+/*
+Appends a record and fsyncs it to disk, or holds it back during a transaction.
+The caller must hold the lock.
+*/
+func (wal *Wal) append(entity, op string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	if wal.batch != nil {
+		wal.batch = append(wal.batch, walRecord{Entity: entity, Op: op, Data: data})
+		return nil
+	}
+
+	return wal.write(entity, op, data)
+}
+
+/*
+Appends the record of a change the journaled store already applied in memory.
+When the record cannot be written the change is undone, so memory never holds
+a change the log lost. The caller must hold the lock.
+*/
+func (wal *Wal) journal(entity, op string, value interface{}, undo func() error) error {
+	err := wal.append(entity, op, value)
+	if err == nil {
+		return nil
+	}
+
+	undoErr := undo()
+	if undoErr != nil {
+		wal.log.Error("Error undoing %s %s that could not be logged: %s", entity, op, undoErr)
+	}
+
+	return err
+}
+
+/*
+The caller must hold the lock.
+*/
+func (wal *Wal) write(entity, op string, data json.RawMessage) error {
+	record := walRecord{
+		Seq:    wal.seq + 1,
+		Entity: entity,
+		Op:     op,
+		Data:   data,
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "%08x ", crc32.ChecksumIEEE(line))
+	buffer.Write(line)
+	buffer.WriteByte('\n')
+
+	end, err := wal.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	_, err = wal.file.Write(buffer.Bytes())
+	if err != nil {
+		wal.log.Error("Error writing wal record %d: %s", record.Seq, err)
+		wal.discard(end)
+		return err
+	}
+
+	err = wal.file.Sync()
+	if err != nil {
+		wal.log.Error("Error syncing wal record %d: %s", record.Seq, err)
+		wal.discard(end)
+		return err
+	}
+
+	wal.seq = record.Seq
+
+	return nil
+}
+
+/*
+Cuts the segment back to where a failed write started, so what it left behind
+is neither replayed nor followed by the records after it.
+The caller must hold the lock.
+*/
+func (wal *Wal) discard(end int64) {
+	err := wal.file.Truncate(end)
+	if err == nil {
+		_, err = wal.file.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		wal.log.Error("Error discarding failed wal write at offset %d: %s", end, err)
+	}
+}
+
+func (wal *Wal) Close() error {
+	wal.Lock()
+	defer wal.Unlock()
+
+	if wal.file == nil {
+		return nil
+	}
+
+	return wal.file.Close()
+}
+
+/*
+Fsyncs a directory so newly created and renamed files survive a crash.
+*/
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+/*
+Applies a replayed record directly to the in memory stores.
+*/
+func replayWalRecord(
+	albums AlbumStore,
+	artists ArtistStore,
+	songs SongStore,
+	revisions RevisionStore,
+	genres GenreStore,
+	playlists PlaylistStore,
+	labels LabelStore,
+	relationships RelationshipStore,
+	record *walRecord,
+) error {
+	switch record.Entity + "." + record.Op {
+	case WAL_BATCH + "." + WAL_COMMIT:
+		var batch []walRecord
+		err := json.Unmarshal(record.Data, &batch)
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			err := replayWalRecord(albums, artists, songs, revisions, genres, playlists, labels, relationships, &batch[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	case WAL_ARTIST + "." + WAL_ADD, WAL_ARTIST + "." + WAL_UPDATE, WAL_ARTIST + "." + WAL_REVERT:
+		var artist Artist
+		err := json.Unmarshal(record.Data, &artist)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case WAL_ADD:
+			return artists.Add(&artist)
+		case WAL_REVERT:
+			return artists.Revert(&artist)
+		}
+		return artists.Update(&artist)
+
+	case WAL_ALBUM + "." + WAL_ADD, WAL_ALBUM + "." + WAL_UPDATE, WAL_ALBUM + "." + WAL_REVERT:
+		var album Album
+		err := json.Unmarshal(record.Data, &album)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case WAL_ADD:
+			return albums.Add(&album)
+		case WAL_REVERT:
+			return albums.Revert(&album)
+		}
+		return albums.Update(&album)
+
+	case WAL_SONG + "." + WAL_ADD, WAL_SONG + "." + WAL_UPDATE, WAL_SONG + "." + WAL_REVERT:
+		var song Song
+		err := json.Unmarshal(record.Data, &song)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case WAL_ADD:
+			return songs.Add(&song)
+		case WAL_REVERT:
+			return songs.Revert(&song)
+		}
+		return songs.Update(&song)
+
+	case WAL_GENRE + "." + WAL_ADD, WAL_GENRE + "." + WAL_UPDATE, WAL_GENRE + "." + WAL_REVERT:
+		var genre Genre
+		err := json.Unmarshal(record.Data, &genre)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case WAL_ADD:
+			return genres.Add(&genre)
+		case WAL_REVERT:
+			return genres.Revert(&genre)
+		}
+		return genres.Update(&genre)
+
+	case WAL_GENRE + "." + WAL_REMOVE:
+		var id string
+		err := json.Unmarshal(record.Data, &id)
+		if err != nil {
+			return err
+		}
+		return genres.Remove(id)
+
+	case WAL_PLAYLIST + "." + WAL_ADD, WAL_PLAYLIST + "." + WAL_UPDATE, WAL_PLAYLIST + "." + WAL_REVERT:
+		var playlist Playlist
+		err := json.Unmarshal(record.Data, &playlist)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case WAL_ADD:
+			return playlists.Add(&playlist)
+		case WAL_REVERT:
+			return playlists.Revert(&playlist)
+		}
+		return playlists.Update(&playlist)
+
+	case WAL_PLAYLIST + "." + WAL_REMOVE:
+		var id string
+		err := json.Unmarshal(record.Data, &id)
+		if err != nil {
+			return err
+		}
+		return playlists.Remove(id)
+
+	case WAL_LABEL + "." + WAL_ADD, WAL_LABEL + "." + WAL_UPDATE, WAL_LABEL + "." + WAL_REVERT:
+		var label Label
+		err := json.Unmarshal(record.Data, &label)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case WAL_ADD:
+			return labels.Add(&label)
+		case WAL_REVERT:
+			return labels.Revert(&label)
+		}
+		return labels.Update(&label)
+
+	case WAL_LABEL + "." + WAL_REMOVE:
+		var id string
+		err := json.Unmarshal(record.Data, &id)
+		if err != nil {
+			return err
+		}
+		return labels.Remove(id)
+
+	case WAL_RELATIONSHIP + "." + WAL_ADD, WAL_RELATIONSHIP + "." + WAL_UPDATE, WAL_RELATIONSHIP + "." + WAL_REVERT:
+		var relationship Relationship
+		err := json.Unmarshal(record.Data, &relationship)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case WAL_ADD:
+			return relationships.Add(&relationship)
+		case WAL_REVERT:
+			return relationships.Revert(&relationship)
+		}
+		return relationships.Update(&relationship)
+
+	case WAL_RELATIONSHIP + "." + WAL_REMOVE:
+		var id string
+		err := json.Unmarshal(record.Data, &id)
+		if err != nil {
+			return err
+		}
+		return relationships.Remove(id)
+
+	case WAL_REVISION + "." + WAL_ADD:
+		var revision Revision
+		err := json.Unmarshal(record.Data, &revision)
+		if err != nil {
+			return err
+		}
+		return revisions.Add(&revision)
+
+	case WAL_REVISION + "." + WAL_REMOVE_LAST:
+		var revision Revision
+		err := json.Unmarshal(record.Data, &revision)
+		if err != nil {
+			return err
+		}
+		return revisions.RemoveLast(revision.Kind, revision.Id)
+
+	case WAL_ALBUM + "." + WAL_REBUILD:
+		return albums.(indexedStore).rebuildIndexes()
+
+	case WAL_SONG + "." + WAL_REBUILD:
+		return songs.(indexedStore).rebuildIndexes()
+
+	case WAL_ARTIST + "." + WAL_DELETE, WAL_ALBUM + "." + WAL_DELETE, WAL_SONG + "." + WAL_DELETE:
+		store := replayTrashStore(albums, artists, songs, record.Entity)
+
+		var id string
+		if json.Unmarshal(record.Data, &id) == nil {
+			// Deletes were permanent before the trash existed.
+			return store.Remove(id)
+		}
+
+		var trash walDelete
+		err := json.Unmarshal(record.Data, &trash)
+		if err != nil {
+			return err
+		}
+		return store.Delete(trash.Id, trash.At)
+
+	case WAL_ARTIST + "." + WAL_RESTORE, WAL_ALBUM + "." + WAL_RESTORE, WAL_SONG + "." + WAL_RESTORE,
+		WAL_ARTIST + "." + WAL_REMOVE, WAL_ALBUM + "." + WAL_REMOVE, WAL_SONG + "." + WAL_REMOVE,
+		WAL_ARTIST + "." + WAL_PURGE, WAL_ALBUM + "." + WAL_PURGE, WAL_SONG + "." + WAL_PURGE:
+		store := replayTrashStore(albums, artists, songs, record.Entity)
+
+		var id string
+		err := json.Unmarshal(record.Data, &id)
+		if err != nil {
+			return err
+		}
+		switch record.Op {
+		case WAL_RESTORE:
+			return store.Restore(id)
+		case WAL_REMOVE:
+			return store.Remove(id)
+		}
+		return store.Purge(id)
+	}
+
+	return fmt.Errorf("Unknown wal record %s.%s", record.Entity, record.Op)
+}
+
+func replayTrashStore(albums AlbumStore, artists ArtistStore, songs SongStore, entity string) trashStore {
+	switch entity {
+	case WAL_ARTIST:
+		return artists
+	case WAL_ALBUM:
+		return albums
+	}
+	return songs
+}
+
+/*
+walArtists journals every successful mutation of the wrapped store.
+*/
+type walArtists struct {
+	ArtistStore
+	wal *Wal
+}
+
+func (store *walArtists) Add(artist *Artist) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.ArtistStore.Add(artist)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ARTIST, WAL_ADD, artist, func() error {
+		return store.ArtistStore.Remove(artist.Id)
+	})
+}
+
+func (store *walArtists) Delete(id string, deletedAt time.Time) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.ArtistStore.Delete(id, deletedAt)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ARTIST, WAL_DELETE, walDelete{id, deletedAt}, func() error {
+		return store.ArtistStore.Restore(id)
+	})
+}
+
+func (store *walArtists) Restore(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	trashed := store.trashed(id)
+
+	err := store.ArtistStore.Restore(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ARTIST, WAL_RESTORE, id, func() error {
+		return store.ArtistStore.Delete(id, trashed.DeletedAt)
+	})
+}
+
+func (store *walArtists) Remove(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.ArtistStore.Get(id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = store.ArtistStore.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ARTIST, WAL_REMOVE, id, func() error {
+		return store.ArtistStore.Revert(old)
+	})
+}
+
+func (store *walArtists) Purge(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	trashed := store.trashed(id)
+
+	err := store.ArtistStore.Purge(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ARTIST, WAL_PURGE, id, func() error {
+		err := store.ArtistStore.Revert(&trashed.Artist)
+		if err != nil {
+			return err
+		}
+
+		return store.ArtistStore.Delete(id, trashed.DeletedAt)
+	})
+}
+
+func (store *walArtists) Update(artist *Artist) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.ArtistStore.Get(artist.Id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = store.ArtistStore.Update(artist)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ARTIST, WAL_UPDATE, artist, func() error {
+		return store.ArtistStore.Revert(old)
+	})
+}
+
+func (store *walArtists) Revert(artist *Artist) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, getErr := store.ArtistStore.Get(artist.Id)
+	if getErr == nil {
+		old = old.clone()
+	}
+
+	err := store.ArtistStore.Revert(artist)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ARTIST, WAL_REVERT, artist, func() error {
+		if getErr != nil {
+			return store.ArtistStore.Remove(artist.Id)
+		}
+		return store.ArtistStore.Revert(old)
+	})
+}
+
+/*
+The artist in the trash under the id, an empty one when it is not there.
+*/
+func (store *walArtists) trashed(id string) *TrashedArtist {
+	trash, _ := store.ArtistStore.GetTrash()
+	for _, trashed := range trash {
+		if trashed.Id == id {
+			return trashed
+		}
+	}
+
+	return new(TrashedArtist)
+}
+
+/*
+walAlbums journals every successful mutation of the wrapped store.
+*/
+type walAlbums struct {
+	AlbumStore
+	wal *Wal
+}
+
+func (store *walAlbums) Add(album *Album) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.AlbumStore.Add(album)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ALBUM, WAL_ADD, album, func() error {
+		return store.AlbumStore.Remove(album.Id)
+	})
+}
+
+func (store *walAlbums) Delete(id string, deletedAt time.Time) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.AlbumStore.Delete(id, deletedAt)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ALBUM, WAL_DELETE, walDelete{id, deletedAt}, func() error {
+		return store.AlbumStore.Restore(id)
+	})
+}
+
+func (store *walAlbums) Restore(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	trashed := store.trashed(id)
+
+	err := store.AlbumStore.Restore(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ALBUM, WAL_RESTORE, id, func() error {
+		return store.AlbumStore.Delete(id, trashed.DeletedAt)
+	})
+}
+
+func (store *walAlbums) Remove(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.AlbumStore.Get(id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = store.AlbumStore.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ALBUM, WAL_REMOVE, id, func() error {
+		return store.AlbumStore.Revert(old)
+	})
+}
+
+func (store *walAlbums) Purge(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	trashed := store.trashed(id)
+
+	err := store.AlbumStore.Purge(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ALBUM, WAL_PURGE, id, func() error {
+		err := store.AlbumStore.Revert(&trashed.Album)
+		if err != nil {
+			return err
+		}
+
+		return store.AlbumStore.Delete(id, trashed.DeletedAt)
+	})
+}
+
+func (store *walAlbums) Update(album *Album) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.AlbumStore.Get(album.Id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = store.AlbumStore.Update(album)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ALBUM, WAL_UPDATE, album, func() error {
+		return store.AlbumStore.Revert(old)
+	})
+}
+
+func (store *walAlbums) Revert(album *Album) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, getErr := store.AlbumStore.Get(album.Id)
+	if getErr == nil {
+		old = old.clone()
+	}
+
+	err := store.AlbumStore.Revert(album)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_ALBUM, WAL_REVERT, album, func() error {
+		if getErr != nil {
+			return store.AlbumStore.Remove(album.Id)
+		}
+		return store.AlbumStore.Revert(old)
+	})
+}
+
+/*
+The album in the trash under the id, an empty one when it is not there.
+*/
+func (store *walAlbums) trashed(id string) *TrashedAlbum {
+	trash, _ := store.AlbumStore.GetTrash()
+	for _, trashed := range trash {
+		if trashed.Id == id {
+			return trashed
+		}
+	}
+
+	return new(TrashedAlbum)
+}
+
+func (store *walAlbums) checkIndexes() []CatalogIssue {
+	return store.AlbumStore.(indexedStore).checkIndexes()
+}
+
+/*
+Rebuilt indexes follow from the primary maps, so there is nothing to undo when the record cannot be written.
+*/
+func (store *walAlbums) rebuildIndexes() error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.AlbumStore.(indexedStore).rebuildIndexes()
+	if err != nil {
+		return err
+	}
+
+	return store.wal.append(WAL_ALBUM, WAL_REBUILD, nil)
+}
+
+/*
+walSongs journals every successful mutation of the wrapped store.
+*/
+type walSongs struct {
+	SongStore
+	wal *Wal
+}
+
+func (store *walSongs) Add(song *Song) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.SongStore.Add(song)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_SONG, WAL_ADD, song, func() error {
+		return store.SongStore.Remove(song.Id)
+	})
+}
+
+func (store *walSongs) Delete(id string, deletedAt time.Time) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.SongStore.Delete(id, deletedAt)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_SONG, WAL_DELETE, walDelete{id, deletedAt}, func() error {
+		return store.SongStore.Restore(id)
+	})
+}
+
+func (store *walSongs) Restore(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	trashed := store.trashed(id)
+
+	err := store.SongStore.Restore(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_SONG, WAL_RESTORE, id, func() error {
+		return store.SongStore.Delete(id, trashed.DeletedAt)
+	})
+}
+
+func (store *walSongs) Remove(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.SongStore.Get(id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = store.SongStore.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_SONG, WAL_REMOVE, id, func() error {
+		return store.SongStore.Revert(old)
+	})
+}
+
+func (store *walSongs) Purge(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	trashed := store.trashed(id)
+
+	err := store.SongStore.Purge(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_SONG, WAL_PURGE, id, func() error {
+		err := store.SongStore.Revert(&trashed.Song)
+		if err != nil {
+			return err
+		}
+
+		return store.SongStore.Delete(id, trashed.DeletedAt)
+	})
+}
+
+func (store *walSongs) Update(song *Song) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.SongStore.Get(song.Id)
+	if err != nil {
+		return err
+	}
+	old = old.clone()
+
+	err = store.SongStore.Update(song)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_SONG, WAL_UPDATE, song, func() error {
+		return store.SongStore.Revert(old)
+	})
+}
+
+func (store *walSongs) Revert(song *Song) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, getErr := store.SongStore.Get(song.Id)
+	if getErr == nil {
+		old = old.clone()
+	}
+
+	err := store.SongStore.Revert(song)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_SONG, WAL_REVERT, song, func() error {
+		if getErr != nil {
+			return store.SongStore.Remove(song.Id)
+		}
+		return store.SongStore.Revert(old)
+	})
+}
+
+/*
+The song in the trash under the id, an empty one when it is not there.
+*/
+func (store *walSongs) trashed(id string) *TrashedSong {
+	trash, _ := store.SongStore.GetTrash()
+	for _, trashed := range trash {
+		if trashed.Id == id {
+			return trashed
+		}
+	}
+
+	return new(TrashedSong)
+}
+
+func (store *walSongs) checkIndexes() []CatalogIssue {
+	return store.SongStore.(indexedStore).checkIndexes()
+}
+
+/*
+Rebuilt indexes follow from the primary maps, so there is nothing to undo when the record cannot be written.
+*/
+func (store *walSongs) rebuildIndexes() error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.SongStore.(indexedStore).rebuildIndexes()
+	if err != nil {
+		return err
+	}
+
+	return store.wal.append(WAL_SONG, WAL_REBUILD, nil)
+}
+
+/*
+walRevisions journals every successful mutation of the wrapped store.
+*/
+type walRevisions struct {
+	RevisionStore
+	wal *Wal
+}
+
+func (store *walRevisions) Add(revision *Revision) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.RevisionStore.Add(revision)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_REVISION, WAL_ADD, revision, func() error {
+		return store.RevisionStore.RemoveLast(revision.Kind, revision.Id)
+	})
+}
+
+func (store *walRevisions) RemoveLast(kind, id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	revisions, err := store.RevisionStore.Get(kind, id)
+	if err != nil {
+		return err
+	}
+	last := revisions[len(revisions)-1]
+
+	err = store.RevisionStore.RemoveLast(kind, id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_REVISION, WAL_REMOVE_LAST, Revision{Kind: kind, Id: id}, func() error {
+		return store.RevisionStore.Add(last)
+	})
+}
+
+/*
+walGenres journals every successful mutation of the wrapped store.
+*/
+type walGenres struct {
+	GenreStore
+	wal *Wal
+}
+
+func (store *walGenres) Add(genre *Genre) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.GenreStore.Add(genre)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_GENRE, WAL_ADD, genre, func() error {
+		return store.GenreStore.Remove(genre.Id)
+	})
+}
+
+func (store *walGenres) Update(genre *Genre) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.GenreStore.Get(genre.Id)
+	if err != nil {
+		return err
+	}
+
+	err = store.GenreStore.Update(genre)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_GENRE, WAL_UPDATE, genre, func() error {
+		return store.GenreStore.Revert(old)
+	})
+}
+
+func (store *walGenres) Revert(genre *Genre) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, getErr := store.GenreStore.Get(genre.Id)
+
+	err := store.GenreStore.Revert(genre)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_GENRE, WAL_REVERT, genre, func() error {
+		if getErr != nil {
+			return store.GenreStore.Remove(genre.Id)
+		}
+		return store.GenreStore.Revert(old)
+	})
+}
+
+func (store *walGenres) Remove(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.GenreStore.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = store.GenreStore.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_GENRE, WAL_REMOVE, id, func() error {
+		return store.GenreStore.Revert(old)
+	})
+}
+
+/*
+walPlaylists journals every successful mutation of the wrapped store.
+*/
+type walPlaylists struct {
+	PlaylistStore
+	wal *Wal
+}
+
+func (store *walPlaylists) Add(playlist *Playlist) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.PlaylistStore.Add(playlist)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_PLAYLIST, WAL_ADD, playlist, func() error {
+		return store.PlaylistStore.Remove(playlist.Id)
+	})
+}
+
+func (store *walPlaylists) Update(playlist *Playlist) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.PlaylistStore.Get(playlist.Id)
+	if err != nil {
+		return err
+	}
+
+	err = store.PlaylistStore.Update(playlist)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_PLAYLIST, WAL_UPDATE, playlist, func() error {
+		return store.PlaylistStore.Revert(old)
+	})
+}
+
+func (store *walPlaylists) Revert(playlist *Playlist) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, getErr := store.PlaylistStore.Get(playlist.Id)
+
+	err := store.PlaylistStore.Revert(playlist)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_PLAYLIST, WAL_REVERT, playlist, func() error {
+		if getErr != nil {
+			return store.PlaylistStore.Remove(playlist.Id)
+		}
+		return store.PlaylistStore.Revert(old)
+	})
+}
+
+func (store *walPlaylists) Remove(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.PlaylistStore.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = store.PlaylistStore.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_PLAYLIST, WAL_REMOVE, id, func() error {
+		return store.PlaylistStore.Revert(old)
+	})
+}
+
+/*
+walLabels journals every successful mutation of the wrapped store.
+*/
+type walLabels struct {
+	LabelStore
+	wal *Wal
+}
+
+func (store *walLabels) Add(label *Label) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.LabelStore.Add(label)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_LABEL, WAL_ADD, label, func() error {
+		return store.LabelStore.Remove(label.Id)
+	})
+}
+
+func (store *walLabels) Update(label *Label) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.LabelStore.Get(label.Id)
+	if err != nil {
+		return err
+	}
+
+	err = store.LabelStore.Update(label)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_LABEL, WAL_UPDATE, label, func() error {
+		return store.LabelStore.Revert(old)
+	})
+}
+
+func (store *walLabels) Revert(label *Label) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, getErr := store.LabelStore.Get(label.Id)
+
+	err := store.LabelStore.Revert(label)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_LABEL, WAL_REVERT, label, func() error {
+		if getErr != nil {
+			return store.LabelStore.Remove(label.Id)
+		}
+		return store.LabelStore.Revert(old)
+	})
+}
+
+func (store *walLabels) Remove(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.LabelStore.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = store.LabelStore.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_LABEL, WAL_REMOVE, id, func() error {
+		return store.LabelStore.Revert(old)
+	})
+}
+
+/*
+walRelationships journals every successful mutation of the wrapped store.
+*/
+type walRelationships struct {
+	RelationshipStore
+	wal *Wal
+}
+
+func (store *walRelationships) Add(relationship *Relationship) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	err := store.RelationshipStore.Add(relationship)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_RELATIONSHIP, WAL_ADD, relationship, func() error {
+		return store.RelationshipStore.Remove(relationship.Id)
+	})
+}
+
+func (store *walRelationships) Update(relationship *Relationship) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.RelationshipStore.Get(relationship.Id)
+	if err != nil {
+		return err
+	}
+
+	err = store.RelationshipStore.Update(relationship)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_RELATIONSHIP, WAL_UPDATE, relationship, func() error {
+		return store.RelationshipStore.Revert(old)
+	})
+}
+
+func (store *walRelationships) Revert(relationship *Relationship) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, getErr := store.RelationshipStore.Get(relationship.Id)
+
+	err := store.RelationshipStore.Revert(relationship)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_RELATIONSHIP, WAL_REVERT, relationship, func() error {
+		if getErr != nil {
+			return store.RelationshipStore.Remove(relationship.Id)
+		}
+		return store.RelationshipStore.Revert(old)
+	})
+}
+
+func (store *walRelationships) Remove(id string) error {
+	store.wal.Lock()
+	defer store.wal.Unlock()
+
+	old, err := store.RelationshipStore.Get(id)
+	if err != nil {
+		return err
+	}
+
+	err = store.RelationshipStore.Remove(id)
+	if err != nil {
+		return err
+	}
+
+	return store.wal.journal(WAL_RELATIONSHIP, WAL_REMOVE, id, func() error {
+		return store.RelationshipStore.Revert(old)
+	})
+}
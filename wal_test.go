@@ -0,0 +1,418 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func replayWalInto(dir string) (*Wal, *Albums, *Artists, *Songs, error) {
+	albums := NewAlbums()
+	artists := NewArtists()
+	songs := NewSongs()
+	revisions := NewRevisions()
+	genres := NewGenres()
+	playlists := NewPlaylists()
+	labels := NewLabels()
+	relationships := NewRelationships()
+
+	wal, err := OpenWal(dir)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	seq, err := NewSnapshots(dir, wal, albums, artists, songs, revisions, genres, playlists, labels, relationships).Load()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	err = wal.Replay(seq, func(record *walRecord) error {
+		return replayWalRecord(albums, artists, songs, revisions, genres, playlists, labels, relationships, record)
+	})
+	if err != nil {
+		wal.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	return wal, albums, artists, songs, nil
+}
+
+func TestWalReplay(test *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		test.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, albums, artists, songs, err := replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to open wal: %s", err)
+	}
+
+	artistStore := &walArtists{artists, wal}
+	albumStore := &walAlbums{albums, wal}
+	songStore := &walSongs{songs, wal}
+
+	artist := Artist{Id: "walArtist", Name: "walArtist", Birthdate: PartialDate{Year: 1234}}
+	album := Album{Id: "walAlbum", Name: "walAlbum", Price: Price{Currency: "USD", Amount: 100}, ArtistId: artist.Id}
+	song := Song{Id: "walSong", Name: "walSong", AlbumId: album.Id, ArtistId: artist.Id}
+
+	if err := artistStore.Add(&artist); err != nil {
+		test.Fatalf("Unable to add artist: %s", err)
+	}
+	if err := albumStore.Add(&album); err != nil {
+		test.Fatalf("Unable to add album: %s", err)
+	}
+	if err := songStore.Add(&song); err != nil {
+		test.Fatalf("Unable to add song: %s", err)
+	}
+
+	artist.Name = "walArtist_updated"
+	if err := artistStore.Update(&artist); err != nil {
+		test.Fatalf("Unable to update artist: %s", err)
+	}
+	if err := songStore.Delete(song.Id, time.Now()); err != nil {
+		test.Fatalf("Unable to delete song: %s", err)
+	}
+
+	wal.Close()
+
+	// Simulate a crash in the middle of writing a record.
+	file, err := os.OpenFile(filepath.Join(dir, walSegmentName(1)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		test.Fatalf("Unable to open wal: %s", err)
+	}
+	file.WriteString("0badc0de {\"seq\":6,\"entity\":\"art")
+	file.Close()
+
+	wal, albums, artists, songs, err = replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to replay wal: %s", err)
+	}
+	defer wal.Close()
+
+	artistF, err := artists.Get(artist.Id)
+	if err != nil {
+		test.Fatalf("Artist was not replayed: %s", err)
+	}
+	if artistF.Name != artist.Name {
+		test.Errorf("Artist update was not replayed: %s != %s", artistF.Name, artist.Name)
+	}
+
+	if _, err := albums.Get(album.Id); err != nil {
+		test.Errorf("Album was not replayed: %s", err)
+	}
+
+	if _, err := songs.Get(song.Id); err == nil {
+		test.Errorf("Song delete was not replayed")
+	}
+	if trash, _ := songs.GetTrash(); len(trash) != 1 || trash[0].Id != song.Id {
+		test.Errorf("Deleted song was not replayed into the trash: %v", trash)
+	}
+
+	// The torn record must be gone, new records append after the last good one.
+	if err := (&walArtists{artists, wal}).Add(&Artist{Id: "walArtist2"}); err != nil {
+		test.Fatalf("Unable to add artist after replay: %s", err)
+	}
+	if wal.seq != 6 {
+		test.Errorf("Expected seq 6 after replay and append, got %d", wal.seq)
+	}
+}
+
+func TestSnapshotCompaction(test *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		test.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, albums, artists, songs, err := replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to open wal: %s", err)
+	}
+
+	artistStore := &walArtists{artists, wal}
+	snapshots := NewSnapshots(dir, wal, albums, artists, songs, NewRevisions(), NewGenres(), NewPlaylists(), NewLabels(), NewRelationships())
+
+	// Three snapshots, each after a new artist.
+	for _, id := range []string{"snapArtist0", "snapArtist1", "snapArtist2"} {
+		if err := artistStore.Add(&Artist{Id: id}); err != nil {
+			test.Fatalf("Unable to add artist %s: %s", id, err)
+		}
+		if err := snapshots.Take(); err != nil {
+			test.Fatalf("Unable to take snapshot: %s", err)
+		}
+	}
+
+	// The tail after the last snapshot.
+	if err := artistStore.Add(&Artist{Id: "snapArtist3"}); err != nil {
+		test.Fatalf("Unable to add artist: %s", err)
+	}
+	wal.Close()
+
+	names, _ := filepath.Glob(filepath.Join(dir, "snapshot-*.json"))
+	if len(names) != SNAPSHOT_RETAIN {
+		test.Errorf("Expected %d snapshots to be kept, found %d", SNAPSHOT_RETAIN, len(names))
+	}
+
+	// The segment before the oldest retained snapshot must be gone.
+	if _, err := os.Stat(filepath.Join(dir, walSegmentName(1))); !os.IsNotExist(err) {
+		test.Errorf("Expected the first wal segment to be removed")
+	}
+
+	// Damage the newest snapshot, startup must fall back to the older one.
+	err = ioutil.WriteFile(filepath.Join(dir, snapshotName(3)), []byte("{\"seq\":3,"), 0644)
+	if err != nil {
+		test.Fatalf("Unable to damage snapshot: %s", err)
+	}
+
+	wal, _, artists, _, err = replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to recover: %s", err)
+	}
+	defer wal.Close()
+
+	ids, _ := artists.GetAll()
+	if len(ids) != 4 {
+		test.Errorf("Expected 4 artists after recovery, got %#v", ids)
+	}
+}
+
+func TestWalBatch(test *testing.T) {
+	dir, err := ioutil.TempDir("", "walbatch")
+	if err != nil {
+		test.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, _, artists, _, err := replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to open wal: %s", err)
+	}
+
+	artistStore := &walArtists{artists, wal}
+
+	wal.Begin()
+	artistStore.Add(&Artist{Id: "batchArtist0"})
+	artistStore.Add(&Artist{Id: "batchArtist1"})
+	if err := wal.Commit(); err != nil {
+		test.Fatalf("Unable to commit: %s", err)
+	}
+
+	wal.Begin()
+	artistStore.Add(&Artist{Id: "batchArtist2"})
+	wal.Rollback()
+
+	if wal.seq != 1 {
+		test.Errorf("Expected the committed batch to be a single record, seq is %d", wal.seq)
+	}
+	wal.Close()
+
+	wal, _, artists, _, err = replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to replay wal: %s", err)
+	}
+	defer wal.Close()
+
+	ids, _ := artists.GetAll()
+	if len(ids) != 2 {
+		test.Errorf("Expected only the committed artists after replay, got %#v", ids)
+	}
+}
+
+func TestWalWriteFailure(test *testing.T) {
+	dir, err := ioutil.TempDir("", "walfail")
+	if err != nil {
+		test.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, _, artists, _, err := replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to open wal: %s", err)
+	}
+
+	artistStore := &walArtists{artists, wal}
+	artist := Artist{Id: "failArtist", Name: "failArtist"}
+	if err := artistStore.Add(&artist); err != nil {
+		test.Fatalf("Unable to add artist: %s", err)
+	}
+
+	// Every write fails once the segment is closed.
+	wal.file.Close()
+
+	if err := artistStore.Add(&Artist{Id: "failArtist2"}); err == nil {
+		test.Errorf("Expected the add to fail when the wal cannot be written")
+	}
+	if _, err := artists.Get("failArtist2"); err == nil {
+		test.Errorf("Expected the unlogged add to be undone")
+	}
+
+	updated := artist
+	updated.Name = "failArtist_updated"
+	updated.Version = 1
+	if err := artistStore.Update(&updated); err == nil {
+		test.Errorf("Expected the update to fail when the wal cannot be written")
+	}
+	if stored, _ := artists.Get(artist.Id); stored.Name != artist.Name || stored.Version != 1 {
+		test.Errorf("Expected the unlogged update to be undone, got %#v", stored)
+	}
+
+	if err := artistStore.Delete(artist.Id, time.Now()); err == nil {
+		test.Errorf("Expected the delete to fail when the wal cannot be written")
+	}
+	if _, err := artists.Get(artist.Id); err != nil {
+		test.Errorf("Expected the unlogged delete to be undone: %s", err)
+	}
+}
+
+/*
+A wal segment whose fsync fails the given number of times, after the record was written.
+*/
+type failingSyncFile struct {
+	*os.File
+	failures int
+}
+
+func (file *failingSyncFile) Sync() error {
+	if file.failures > 0 {
+		file.failures--
+		return errors.New("Injected sync failure")
+	}
+
+	return file.File.Sync()
+}
+
+func TestWalCommitFailure(test *testing.T) {
+	dir, err := ioutil.TempDir("", "walcommit")
+	if err != nil {
+		test.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, albums, artists, songs, err := replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to open wal: %s", err)
+	}
+
+	state, err := NewStateWith(&walAlbums{albums, wal}, &walArtists{artists, wal}, &walSongs{songs, wal})
+	if err != nil {
+		test.Fatalf("Unable to create state: %s", err)
+	}
+	state.wal = wal
+
+	if err := state.addArtist("test", &Artist{Id: "commitArtist0"}); err != nil {
+		test.Fatalf("Unable to add artist: %s", err)
+	}
+
+	wal.file = &failingSyncFile{File: wal.file.(*os.File), failures: 1}
+
+	err = state.addArtist("test", &Artist{Id: "commitArtist1"})
+	if err == nil {
+		test.Fatalf("Expected the add to fail when the wal cannot be synced")
+	}
+	if _, err := artists.Get("commitArtist1"); err == nil {
+		test.Errorf("Expected the failed add to be rolled back")
+	}
+	if wal.seq != 1 || wal.batch != nil {
+		test.Errorf("Expected neither the add nor its undo to be logged, seq is %d", wal.seq)
+	}
+
+	if err := state.addArtist("test", &Artist{Id: "commitArtist2"}); err != nil {
+		test.Fatalf("Unable to add artist after the failure: %s", err)
+	}
+	wal.Close()
+
+	wal, _, artists, _, err = replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to replay wal: %s", err)
+	}
+	defer wal.Close()
+
+	ids, _ := artists.GetAll()
+	if len(ids) != 2 {
+		test.Errorf("Expected only the committed artists after replay, got %#v", ids)
+	}
+	if _, err := artists.Get("commitArtist1"); err == nil {
+		test.Errorf("Expected the failed add not to be replayed")
+	}
+}
+
+/*
+Holds a sync until released, then fails it.
+*/
+type blockingSyncFile struct {
+	*os.File
+	syncing chan struct{}
+	release chan struct{}
+}
+
+func (file *blockingSyncFile) Sync() error {
+	close(file.syncing)
+	<-file.release
+
+	return errors.New("Injected sync failure")
+}
+
+func TestWalCommitFailureUnseen(test *testing.T) {
+	dir, err := ioutil.TempDir("", "walunseen")
+	if err != nil {
+		test.Fatalf("Unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, albums, artists, songs, err := replayWalInto(dir)
+	if err != nil {
+		test.Fatalf("Unable to open wal: %s", err)
+	}
+	defer wal.Close()
+
+	state, err := NewStateWith(&walAlbums{albums, wal}, &walArtists{artists, wal}, &walSongs{songs, wal})
+	if err != nil {
+		test.Fatalf("Unable to create state: %s", err)
+	}
+	state.wal = wal
+
+	file := &blockingSyncFile{File: wal.file.(*os.File), syncing: make(chan struct{}), release: make(chan struct{})}
+	wal.file = file
+
+	added := make(chan error)
+	go func() {
+		added <- state.addArtist("test", &Artist{Id: "unseenArtist"})
+	}()
+
+	// The artist is in the store, its commit is not yet written.
+	<-file.syncing
+
+	got := make(chan int)
+	go func() {
+		req := httptest.NewRequest("POST", "/getArtist", strings.NewReader(`"unseenArtist"`))
+		resp := httptest.NewRecorder()
+		state.newServeMux().ServeHTTP(resp, req)
+		got <- resp.Code
+	}()
+
+	status := 0
+	select {
+	case status = <-got:
+		test.Errorf("Expected the get to wait for the commit, got %d", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(file.release)
+	if err := <-added; err == nil {
+		test.Errorf("Expected the add to fail when the wal cannot be synced")
+	}
+	if status == 0 {
+		status = <-got
+	}
+	if status == http.StatusOK {
+		test.Errorf("Expected the rolled back artist not to be found")
+	}
+}